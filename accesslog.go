@@ -0,0 +1,68 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// accessLogEntry is one line written to ServerConfig.AccessLog
+type accessLogEntry struct {
+	Timestamp  string  `json:"timestamp"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Query      string  `json:"query"`
+	StatusCode int     `json:"status_code"`
+	DurationMs float64 `json:"duration_ms"`
+	UserAgent  string  `json:"user_agent"`
+	RemoteAddr string  `json:"remote_addr"`
+	RequestID  string  `json:"request_id"`
+}
+
+// accessLog writes a JSON line for every request to ServerConfig.AccessLog once the response is sent
+func (h *MetadataServer) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.ServerConfig.AccessLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		line, err := json.Marshal(&accessLogEntry{
+			Timestamp:  start.UTC().Format(time.RFC3339Nano),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      r.URL.RawQuery,
+			StatusCode: sw.code,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			UserAgent:  r.UserAgent(),
+			RemoteAddr: r.RemoteAddr,
+			RequestID:  RequestIDFromContext(r.Context()),
+		})
+		if err != nil {
+			h.requestLog(r).Error("Unable to marshal access log entry", "error", err)
+			return
+		}
+		h.accessLogMutex.Lock()
+		defer h.accessLogMutex.Unlock()
+		if _, err := h.ServerConfig.AccessLog.Write(append(line, '\n')); err != nil {
+			h.requestLog(r).Error("Unable to write access log entry", "error", err)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package mds
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{AccessLog: &buf}, &google.Credentials{}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for _, flavor := range []string{"Google", ""} {
+		req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/project/project-id?alt=text", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flavor != "" {
+			req.Header.Set("Metadata-Flavor", flavor)
+		}
+		req.Header.Set("User-Agent", "access-log-test")
+		req.Header.Set("X-Request-ID", "request-"+flavor)
+		req.RemoteAddr = "10.0.0.1:1234"
+		h.handler().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		e := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("access log line is not JSON: %s", scanner.Text())
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected number of access log lines: got %d want %d", len(entries), 2)
+	}
+
+	for i, wantStatus := range []float64{http.StatusOK, http.StatusForbidden} {
+		e := entries[i]
+		for _, k := range []string{"timestamp", "method", "path", "query", "status_code", "duration_ms", "user_agent", "remote_addr"} {
+			if _, ok := e[k]; !ok {
+				t.Errorf("access log line is missing %s: %v", k, e)
+			}
+		}
+		if _, err := time.Parse(time.RFC3339Nano, e["timestamp"].(string)); err != nil {
+			t.Errorf("unexpected timestamp: %v", e["timestamp"])
+		}
+		if e["method"] != http.MethodGet || e["path"] != "/computeMetadata/v1/project/project-id" || e["query"] != "alt=text" {
+			t.Errorf("unexpected request fields: %v", e)
+		}
+		if e["user_agent"] != "access-log-test" || e["remote_addr"] != "10.0.0.1:1234" {
+			t.Errorf("unexpected client fields: %v", e)
+		}
+		if e["status_code"] != wantStatus {
+			t.Errorf("unexpected status_code: got %v want %v", e["status_code"], wantStatus)
+		}
+	}
+	if entries[0]["request_id"] != "request-Google" {
+		t.Errorf("unexpected request_id: got %v want %v", entries[0]["request_id"], "request-Google")
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	defaultAdminInterface = "127.0.0.1"
+)
+
+var errTokenInvalidationUnsupported = errors.New("the credential source does not support invalidating cached tokens")
+
+var errServiceAccountNotFound = errors.New("no such service account")
+
+// tokenInvalidator is implemented by credential sources which cache tokens and can be forced to fetch a new one
+type tokenInvalidator interface {
+	Invalidate()
+}
+
+// requestStats counts the requests served by a MetadataServer for `GET /admin/stats`
+type requestStats struct {
+	mu             sync.Mutex
+	requests       int64
+	statusCodes    map[int]int64
+	paths          map[string]int64
+	tokenRefreshes map[string]int64
+}
+
+type requestStatsResponse struct {
+	Requests       int64            `json:"requests"`
+	StatusCodes    map[string]int64 `json:"statusCodes"`
+	Paths          map[string]int64 `json:"paths"`
+	TokenRefreshes map[string]int64 `json:"tokenRefreshes"`
+}
+
+func (s *requestStats) requestServed(path string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.statusCodes == nil {
+		s.statusCodes = map[int]int64{}
+		s.paths = map[string]int64{}
+	}
+	s.requests++
+	s.statusCodes[code]++
+	s.paths[path]++
+}
+
+func (s *requestStats) tokenRefreshed(tokenType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokenRefreshes == nil {
+		s.tokenRefreshes = map[string]int64{}
+	}
+	s.tokenRefreshes[tokenType]++
+}
+
+func (s *requestStats) snapshot() *requestStatsResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := &requestStatsResponse{
+		Requests:       s.requests,
+		StatusCodes:    make(map[string]int64, len(s.statusCodes)),
+		Paths:          make(map[string]int64, len(s.paths)),
+		TokenRefreshes: make(map[string]int64, len(s.tokenRefreshes)),
+	}
+	for k, v := range s.statusCodes {
+		ret.StatusCodes[strconv.Itoa(k)] = v
+	}
+	for k, v := range s.paths {
+		ret.Paths[k] = v
+	}
+	for k, v := range s.tokenRefreshes {
+		ret.TokenRefreshes[k] = v
+	}
+	return ret
+}
+
+func (s *requestStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = 0
+	s.statusCodes = nil
+	s.paths = nil
+	s.tokenRefreshes = nil
+}
+
+// ServerStats is a snapshot of the requests served by a MetadataServer, eg to assert in tests that the
+// server was actually called.
+type ServerStats struct {
+	RequestsTotal     int64            // requests served, including errors
+	RequestsByPath    map[string]int64 // requests served per URL path
+	TokenRefreshCount int64            // access_token and id_token requests to the upstream credential source
+	ErrorCount        map[int]int64    // responses with a 4xx or 5xx status per status code
+}
+
+// Stats returns a consistent snapshot of the request counters.  The maps are never nil.
+func (h *MetadataServer) Stats() ServerStats {
+	h.stats.mu.Lock()
+	defer h.stats.mu.Unlock()
+	ret := ServerStats{
+		RequestsTotal:  h.stats.requests,
+		RequestsByPath: make(map[string]int64, len(h.stats.paths)),
+		ErrorCount:     map[int]int64{},
+	}
+	for k, v := range h.stats.paths {
+		ret.RequestsByPath[k] = v
+	}
+	for k, v := range h.stats.statusCodes {
+		if k >= http.StatusBadRequest {
+			ret.ErrorCount[k] = v
+		}
+	}
+	for _, v := range h.stats.tokenRefreshes {
+		ret.TokenRefreshCount += v
+	}
+	return ret
+}
+
+// ResetStats zeroes all request counters, including the ones served by `GET /admin/stats`
+func (h *MetadataServer) ResetStats() {
+	h.stats.reset()
+}
+
+// countRequests records the path and status code of every request for the admin stats
+func (h *MetadataServer) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		h.stats.requestServed(r.URL.Path, sw.code)
+	})
+}
+
+// tokenRefreshed records a token request to the upstream credential source
+func (h *MetadataServer) tokenRefreshed(tokenType string) {
+	h.metrics.tokenRefreshed(tokenType)
+	h.stats.tokenRefreshed(tokenType)
+}
+
+// InvalidateToken drops cached tokens so the next request fetches a new token from the credential source.
+//
+// The access_tokens cached by the metadata server and the sessions of ServerConfig.TPMHandles are always dropped.
+// Credentials created from a service account JSON key are recreated; other credential sources must implement
+// `Invalidate()`, otherwise an error is returned.
+func (h *MetadataServer) InvalidateToken() error {
+	h.stateMutex.Lock()
+	defer h.stateMutex.Unlock()
+	h.tokenCache.invalidate()
+	if err := h.tpmSessions.close(); err != nil {
+		h.log().Error("Unable to close TPM sessions", "error", err)
+	}
+
+	return h.invalidateCredentials(defaultServiceAccount)
+}
+
+// InvalidateServiceAccountToken drops the cached access_tokens of the service account addressed by its alias or
+// email so the next request fetches a new token from its credential source, like InvalidateToken() does for all
+// accounts.  It returns the number of requests which were waiting for a token of the account being fetched; they
+// get the result of that call.
+func (h *MetadataServer) InvalidateServiceAccountToken(acct string) (int, error) {
+	h.stateMutex.RLock()
+	account, ok := h.serviceAccount(acct)
+	h.stateMutex.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", errServiceAccountNotFound, acct)
+	}
+	// waiting requests hold the state lock, so they are counted before it is taken
+	pending := h.tokenCache.invalidateAccount(account)
+
+	h.stateMutex.Lock()
+	defer h.stateMutex.Unlock()
+	if handle, ok := h.ServerConfig.TPMHandles[account]; ok {
+		if err := h.tpmSessions.closeHandle(uint32(handle)); err != nil {
+			h.log().Error("Unable to close TPM session", "account", account, "error", err)
+		}
+		return pending, nil
+	}
+	return pending, h.invalidateCredentials(account)
+}
+
+// invalidateCredentials makes the credentials of account fetch a new token.  Credentials created from a service
+// account JSON key are recreated; other credential sources must implement `Invalidate()`.  Callers hold stateMutex.
+func (h *MetadataServer) invalidateCredentials(account string) error {
+	creds := h.credentials(account)
+	if creds == nil {
+		return errTokenInvalidationUnsupported
+	}
+	if ti, ok := creds.TokenSource.(tokenInvalidator); ok {
+		ti.Invalidate()
+		return nil
+	}
+	if len(creds.JSON) > 0 {
+		recreated, err := google.CredentialsFromJSON(context.Background(), creds.JSON, h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[account].Scopes...)
+		if err != nil {
+			return fmt.Errorf("unable to recreate credentials: %v", err)
+		}
+		if account == defaultServiceAccount {
+			h.Creds = recreated
+		} else {
+			h.namedCredentials[account] = recreated
+		}
+		return nil
+	}
+	return errTokenInvalidationUnsupported
+}
+
+// AdminServer serves the runtime management API of a MetadataServer:
+//
+//	GET  /admin/claims            current claims as JSON
+//	PUT  /admin/claims            replace the claims (JSON, or YAML with Content-Type: application/yaml)
+//	PUT  /admin/faults            replace the fault injection rules (JSON FaultConfig)
+//	GET  /admin/stats             request and token refresh counters
+//	POST /admin/invalidate-token  force the next token request to fetch a new token
+//	POST /admin/service-accounts/{alias}/invalidate-token
+//	                              force the next token request for one service account to fetch a new token
+//
+// It is started on ServerConfig.AdminPort by `Start()`; use NewAdminServer to mount it elsewhere.
+type AdminServer struct {
+	h      *MetadataServer
+	token  string
+	router *mux.Router
+}
+
+// NewAdminServer returns the admin API for h.  If token is set, requests must carry it as `Authorization: Bearer <token>`.
+func NewAdminServer(h *MetadataServer, token string) *AdminServer {
+	a := &AdminServer{h: h, token: token}
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/claims", a.getClaimsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/admin/claims", a.putClaimsHandler).Methods(http.MethodPut)
+	r.HandleFunc("/admin/faults", a.putFaultsHandler).Methods(http.MethodPut)
+	r.HandleFunc("/admin/stats", a.statsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/admin/invalidate-token", a.invalidateTokenHandler).Methods(http.MethodPost)
+	r.HandleFunc("/admin/service-accounts/{acct}/invalidate-token", a.invalidateServiceAccountTokenHandler).Methods(http.MethodPost)
+	a.router = r
+	return a
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized, "text/plain; charset=utf-8")
+			return
+		}
+	}
+	if limitBody(w, r, a.h.adminMaxRequestBodySize(), "text/plain; charset=utf-8") {
+		stripPathPrefix(a.h.ServerConfig.PathPrefix, http.NotFound, a.router).ServeHTTP(w, r)
+	}
+}
+
+func (a *AdminServer) getClaimsHandler(w http.ResponseWriter, r *http.Request) {
+	a.h.stateMutex.RLock()
+	js, err := json.Marshal(a.h.Claims)
+	a.h.stateMutex.RUnlock()
+	if err != nil {
+		a.h.requestLog(r).Error("Unable to marshal claims", "error", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/plain; charset=utf-8")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (a *AdminServer) putClaimsHandler(w http.ResponseWriter, r *http.Request) {
+	format := ConfigFormatJSON
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+		switch mt {
+		case "application/yaml", "application/x-yaml":
+			format = ConfigFormatYAML
+		case "application/toml":
+			format = ConfigFormatTOML
+		}
+	}
+	claims, err := ClaimsFromReader(r.Body, format)
+	if bodyTooLarge(err) {
+		httpError(w, err.Error(), http.StatusRequestEntityTooLarge, "text/plain; charset=utf-8")
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest, "text/plain; charset=utf-8")
+		return
+	}
+	if err := a.h.UpdateClaims(claims); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest, "text/plain; charset=utf-8")
+		return
+	}
+	a.h.requestLog(r).Info("Claims replaced through admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) putFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	fc := FaultConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&fc); err != nil {
+		if bodyTooLarge(err) {
+			httpError(w, fmt.Sprintf("error parsing fault config: %v", err), http.StatusRequestEntityTooLarge, "text/plain; charset=utf-8")
+			return
+		}
+		httpError(w, fmt.Sprintf("error parsing fault config: %v", err), http.StatusBadRequest, "text/plain; charset=utf-8")
+		return
+	}
+	if err := a.h.UpdateFaultConfig(fc); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest, "text/plain; charset=utf-8")
+		return
+	}
+	a.h.requestLog(r).Info("Fault config replaced through admin API", "rules", len(fc.Rules))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	js, err := json.Marshal(a.h.stats.snapshot())
+	if err != nil {
+		a.h.requestLog(r).Error("Unable to marshal stats", "error", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/plain; charset=utf-8")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (a *AdminServer) invalidateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := a.h.InvalidateToken()
+	if errors.Is(err, errTokenInvalidationUnsupported) {
+		httpError(w, err.Error(), http.StatusNotImplemented, "text/plain; charset=utf-8")
+		return
+	}
+	if err != nil {
+		a.h.requestLog(r).Error("Unable to invalidate token", "error", err)
+		httpError(w, err.Error(), http.StatusInternalServerError, "text/plain; charset=utf-8")
+		return
+	}
+	a.h.requestLog(r).Info("Cached tokens invalidated through admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// invalidateTokenResponse is returned by `POST /admin/service-accounts/{alias}/invalidate-token`
+type invalidateTokenResponse struct {
+	PendingRequests int `json:"pendingRequests"` // requests which were waiting for a token being fetched
+}
+
+func (a *AdminServer) invalidateServiceAccountTokenHandler(w http.ResponseWriter, r *http.Request) {
+	acct := mux.Vars(r)["acct"]
+	pending, err := a.h.InvalidateServiceAccountToken(acct)
+	if errors.Is(err, errServiceAccountNotFound) {
+		httpError(w, err.Error(), http.StatusNotFound, "text/plain; charset=utf-8")
+		return
+	}
+	if errors.Is(err, errTokenInvalidationUnsupported) {
+		httpError(w, err.Error(), http.StatusNotImplemented, "text/plain; charset=utf-8")
+		return
+	}
+	if err != nil {
+		a.h.requestLog(r).Error("Unable to invalidate token", "account", acct, "error", err)
+		httpError(w, err.Error(), http.StatusInternalServerError, "text/plain; charset=utf-8")
+		return
+	}
+	a.h.requestLog(r).Info("Cached tokens of service account invalidated through admin API", "account", acct, "pendingRequests", pending)
+	js, err := json.Marshal(invalidateTokenResponse{PendingRequests: pending})
+	if err != nil {
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/plain; charset=utf-8")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// AdminAddr returns the address the admin API is listening on, or an empty string if it is not running
+func (h *MetadataServer) AdminAddr() string {
+	if h.adminListener == nil {
+		return ""
+	}
+	return h.adminListener.Addr().String()
+}
@@ -0,0 +1,458 @@
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+func adminRequest(t *testing.T, method, url, token, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error calling %s %v", url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func metadataRequest(t *testing.T, url string) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error calling %s %v", url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestAdminServer(t *testing.T) {
+	p, err := getFreePort()
+	if err != nil {
+		t.Fatalf("error getting emulator port %v", err)
+	}
+	cmd, countFile := countingCommand(t, `{"access_token":"foo","token_type":"Bearer","expires_in":3600}`)
+	sc := &ServerConfig{
+		BindInterface:     "127.0.0.1",
+		Port:              fmt.Sprintf(":%d", p),
+		AdminPort:         "0",
+		AdminToken:        "secret",
+		CredentialCommand: cmd,
+	}
+	h, err := NewMetadataServer(context.Background(), sc, nil, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	if h.AdminAddr() != "" {
+		t.Errorf("admin address set before the server was started: %s", h.AdminAddr())
+	}
+	if err := h.Start(); err != nil {
+		t.Fatalf("error starting emulator %v", err)
+	}
+	defer h.Shutdown()
+
+	admin := "http://" + h.AdminAddr()
+	metadata := fmt.Sprintf("http://127.0.0.1:%d", p)
+
+	for _, token := range []string{"", "wrong"} {
+		if code, _ := adminRequest(t, http.MethodGet, admin+"/admin/claims", token, ""); code != http.StatusUnauthorized {
+			t.Errorf("admin API returned wrong status code for token %q: got %v want %v", token, code, http.StatusUnauthorized)
+		}
+	}
+
+	code, body := adminRequest(t, http.MethodGet, admin+"/admin/claims", "secret", "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /admin/claims returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal([]byte(body), claims); err != nil {
+		t.Fatalf("error parsing claims %v", err)
+	}
+	if claims.ComputeMetadata.V1.Project.ProjectID != "some-project" {
+		t.Errorf("unexpected project id: got %v want %v", claims.ComputeMetadata.V1.Project.ProjectID, "some-project")
+	}
+
+	// claims
+	js, err := json.Marshal(projectClaims("other-project"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := adminRequest(t, http.MethodPut, admin+"/admin/claims", "secret", string(js)); code != http.StatusNoContent {
+		t.Errorf("PUT /admin/claims returned wrong status code: got %v want %v: %s", code, http.StatusNoContent, body)
+	}
+	if _, body := metadataRequest(t, metadata+"/computeMetadata/v1/project/project-id"); body != "other-project" {
+		t.Errorf("claims were not replaced: got project id %v want %v", body, "other-project")
+	}
+	if code, _ := adminRequest(t, http.MethodPut, admin+"/admin/claims", "secret", `{"computeMetadata":{}}`); code != http.StatusBadRequest {
+		t.Errorf("PUT /admin/claims accepted invalid claims: got %v want %v", code, http.StatusBadRequest)
+	}
+
+	// faults
+	if code, body := adminRequest(t, http.MethodPut, admin+"/admin/faults", "secret", `{"rules":[{"path":"/computeMetadata/v1/project/project-id","httpStatus":503,"rate":1}]}`); code != http.StatusNoContent {
+		t.Errorf("PUT /admin/faults returned wrong status code: got %v want %v: %s", code, http.StatusNoContent, body)
+	}
+	if code, _ := metadataRequest(t, metadata+"/computeMetadata/v1/project/project-id"); code != http.StatusServiceUnavailable {
+		t.Errorf("fault was not injected: got %v want %v", code, http.StatusServiceUnavailable)
+	}
+	if code, _ := adminRequest(t, http.MethodPut, admin+"/admin/faults", "secret", `{"rules":[{"path":"/","httpStatus":200,"rate":1}]}`); code != http.StatusBadRequest {
+		t.Errorf("PUT /admin/faults accepted an invalid rule: got %v want %v", code, http.StatusBadRequest)
+	}
+
+	// tokens
+	tokenPath := "/computeMetadata/v1/instance/service-accounts/default/token"
+	for i := 0; i < 2; i++ {
+		if code, _ := metadataRequest(t, metadata+tokenPath); code != http.StatusOK {
+			t.Fatalf("token request returned wrong status code: got %v want %v", code, http.StatusOK)
+		}
+	}
+	if n := invocations(t, countFile); n != 1 {
+		t.Errorf("unexpected number of command invocations: got %d want %d", n, 1)
+	}
+	if code, _ := adminRequest(t, http.MethodGet, admin+"/admin/invalidate-token", "secret", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/invalidate-token returned wrong status code: got %v want %v", code, http.StatusMethodNotAllowed)
+	}
+	if code, body := adminRequest(t, http.MethodPost, admin+"/admin/invalidate-token", "secret", ""); code != http.StatusNoContent {
+		t.Errorf("POST /admin/invalidate-token returned wrong status code: got %v want %v: %s", code, http.StatusNoContent, body)
+	}
+	if code, _ := metadataRequest(t, metadata+tokenPath); code != http.StatusOK {
+		t.Fatalf("token request returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+	if n := invocations(t, countFile); n != 2 {
+		t.Errorf("token was not refreshed after invalidation: got %d command invocations want %d", n, 2)
+	}
+
+	// stats
+	code, body = adminRequest(t, http.MethodGet, admin+"/admin/stats", "secret", "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /admin/stats returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+	stats := &requestStatsResponse{}
+	if err := json.Unmarshal([]byte(body), stats); err != nil {
+		t.Fatalf("error parsing stats %v", err)
+	}
+	if stats.Requests != 5 {
+		t.Errorf("unexpected number of requests: got %d want %d", stats.Requests, 5)
+	}
+	if stats.Paths[tokenPath] != 3 || stats.StatusCodes["503"] != 1 || stats.TokenRefreshes[accessTokenType] != 2 {
+		t.Errorf("unexpected stats: %s", body)
+	}
+}
+
+func TestAdminInvalidateTokenUnsupported(t *testing.T) {
+	creds := &google.Credentials{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "foo"})}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, creds, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "/admin/invalidate-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	NewAdminServer(h, "").ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotImplemented {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotImplemented)
+	}
+}
+
+func TestAdminMaxRequestBodySize(t *testing.T) {
+	sc := &ServerConfig{MaxRequestBodySize: 16, AdminMaxRequestBodySize: 1024}
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	admin := NewAdminServer(h, "")
+
+	for _, tc := range []struct {
+		path string
+		body io.Reader
+		want int
+	}{
+		// the admin API is not bound by MaxRequestBodySize
+		{"/admin/faults", strings.NewReader(`{"rules":[]}` + strings.Repeat(" ", 100)), http.StatusNoContent},
+		{"/admin/faults", strings.NewReader(`{"rules":[]}` + strings.Repeat(" ", 1024)), http.StatusRequestEntityTooLarge},
+		{"/admin/claims", io.MultiReader(strings.NewReader(`{"computeMetadata":"` + strings.Repeat("a", 1024) + `"}`)), http.StatusRequestEntityTooLarge},
+	} {
+		req, err := http.NewRequest(http.MethodPut, tc.path, tc.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, req)
+		if rr.Code != tc.want {
+			t.Errorf("PUT %s returned wrong status code: got %v want %v: %s", tc.path, rr.Code, tc.want, rr.Body.String())
+		}
+	}
+}
+
+func TestAdminPutClaimsTOML(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	body := `
+[computeMetadata.v1.project]
+projectId = "other-project"
+
+[computeMetadata.v1.instance.serviceAccounts.default]
+email = "metadata-sa@other-project.iam.gserviceaccount.com"
+`
+	req, err := http.NewRequest(http.MethodPut, "/admin/claims", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/toml")
+	rr := httptest.NewRecorder()
+	NewAdminServer(h, "").ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("PUT /admin/claims returned wrong status code: got %v want %v: %s", rr.Code, http.StatusNoContent, rr.Body.String())
+	}
+	if got := h.Claims.ComputeMetadata.V1.Project.ProjectID; got != "other-project" {
+		t.Errorf("unexpected project id after PUT: got %v want %v", got, "other-project")
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	creds := &google.Credentials{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "foo"})}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, creds, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	if s := h.Stats(); s.RequestsTotal != 0 || len(s.RequestsByPath) != 0 || len(s.ErrorCount) != 0 || s.TokenRefreshCount != 0 {
+		t.Errorf("unexpected stats before any request: %+v", s)
+	}
+
+	handler := h.handler()
+	for _, tc := range []struct {
+		path   string
+		flavor string
+	}{
+		{"/computeMetadata/v1/project/project-id", "Google"},
+		{"/computeMetadata/v1/project/project-id", "Google"},
+		{"/computeMetadata/v1/instance/service-accounts/default/token", "Google"},
+		{"/computeMetadata/v1/instance/missing", "Google"},
+		{"/computeMetadata/v1/project/project-id", ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.flavor != "" {
+			req.Header.Set("Metadata-Flavor", tc.flavor)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	want := ServerStats{
+		RequestsTotal: 5,
+		RequestsByPath: map[string]int64{
+			"/computeMetadata/v1/project/project-id":                      3,
+			"/computeMetadata/v1/instance/service-accounts/default/token": 1,
+			"/computeMetadata/v1/instance/missing":                        1,
+		},
+		TokenRefreshCount: 1,
+		ErrorCount: map[int]int64{
+			http.StatusNotFound:  1,
+			http.StatusForbidden: 1,
+		},
+	}
+	s := h.Stats()
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("unexpected stats: got %+v want %+v", s, want)
+	}
+
+	// the snapshot is not changed by later requests
+	s.RequestsByPath["/computeMetadata/v1/project/project-id"] = 0
+	if h.Stats().RequestsByPath["/computeMetadata/v1/project/project-id"] != 3 {
+		t.Errorf("modifying a snapshot changed the server's stats")
+	}
+
+	h.ResetStats()
+	if s := h.Stats(); s.RequestsTotal != 0 || len(s.RequestsByPath) != 0 || len(s.ErrorCount) != 0 || s.TokenRefreshCount != 0 {
+		t.Errorf("unexpected stats after ResetStats: %+v", s)
+	}
+}
+
+// invalidatingTokenSource is a countingTokenSource which can be told to fetch a new token
+type invalidatingTokenSource struct {
+	countingTokenSource
+	invalidations int
+}
+
+func (s *invalidatingTokenSource) Invalidate() {
+	s.invalidations++
+}
+
+func invalidateServiceAccountToken(t *testing.T, h *MetadataServer, acct string) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, "/admin/service-accounts/"+acct+"/invalidate-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	NewAdminServer(h, "").ServeHTTP(rr, req)
+	return rr.Code, rr.Body.String()
+}
+
+func TestAdminInvalidateServiceAccountToken(t *testing.T) {
+	ts := &invalidatingTokenSource{countingTokenSource: countingTokenSource{expiresIn: time.Hour}}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{TokenSource: ts}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := serveToken(h, "default"); rr.Code != http.StatusOK {
+			t.Fatalf("token request returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+	}
+	if n := ts.calls.Load(); n != 1 {
+		t.Fatalf("unexpected number of upstream token calls: got %d want %d", n, 1)
+	}
+
+	code, body := invalidateServiceAccountToken(t, h, "metadata-sa@some-project.iam.gserviceaccount.com")
+	if code != http.StatusOK || body != `{"pendingRequests":0}` {
+		t.Errorf("unexpected response: got %v %s", code, body)
+	}
+	if ts.invalidations != 1 {
+		t.Errorf("credential source was not invalidated")
+	}
+	for i := 0; i < 2; i++ {
+		if rr := serveToken(h, "default"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "token-2") {
+			t.Fatalf("unexpected token after invalidation: got %v %s", rr.Code, rr.Body.String())
+		}
+	}
+	if n := ts.calls.Load(); n != 2 {
+		t.Errorf("unexpected number of upstream token calls after invalidation: got %d want %d", n, 2)
+	}
+
+	if code, _ := invalidateServiceAccountToken(t, h, "unknown"); code != http.StatusNotFound {
+		t.Errorf("unexpected status code for an unknown service account: got %v want %v", code, http.StatusNotFound)
+	}
+	h, err = NewMetadataServer(context.Background(), &ServerConfig{}, staticCredentials("foo"), projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	if code, _ := invalidateServiceAccountToken(t, h, "default"); code != http.StatusNotImplemented {
+		t.Errorf("unexpected status code for a token source which cannot be invalidated: got %v want %v", code, http.StatusNotImplemented)
+	}
+}
+
+func TestAdminInvalidateNamedCredentials(t *testing.T) {
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["app"] = serviceAccountDetails{Email: "app@some-project.iam.gserviceaccount.com", Scopes: []string{cloudPlatformScope}}
+	app := serviceAccountFileCredentials(t)
+	named := map[string]*google.Credentials{"default": staticCredentials("foo"), "app": app}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{NamedCredentials: named}, nil, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	if code, body := invalidateServiceAccountToken(t, h, "app"); code != http.StatusOK {
+		t.Fatalf("unexpected response: got %v %s", code, body)
+	}
+	// the credentials are recreated from the key without changing the map passed in
+	if named["app"] != app {
+		t.Errorf("NamedCredentials of the caller were modified")
+	}
+	if h.credentials("app") == app {
+		t.Errorf("credentials were not recreated")
+	}
+	if rr := serveToken(h, "app"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "file-token") {
+		t.Errorf("unexpected token after invalidation: got %v %s", rr.Code, rr.Body.String())
+	}
+}
+
+// blockingTokenSource returns a token once release is closed
+type blockingTokenSource struct {
+	release chan struct{}
+}
+
+func (s blockingTokenSource) Token() (*oauth2.Token, error) {
+	<-s.release
+	return &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func (s blockingTokenSource) Invalidate() {}
+
+func TestAdminInvalidateServiceAccountTokenPending(t *testing.T) {
+	ts := blockingTokenSource{release: make(chan struct{})}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{TokenSource: ts}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	done := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() { done <- serveToken(h, "default").Code }()
+	}
+	waiting := func() int {
+		h.tokenCache.mu.Lock()
+		defer h.tokenCache.mu.Unlock()
+		n := 0
+		for _, v := range h.tokenCache.waiting {
+			n += v
+		}
+		return n
+	}
+	for deadline := time.Now().Add(5 * time.Second); waiting() != 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("token requests are not waiting: got %d", waiting())
+		}
+	}
+
+	gen := func() int {
+		h.tokenCache.mu.Lock()
+		defer h.tokenCache.mu.Unlock()
+		return h.tokenCache.gen
+	}
+	before := gen()
+	result := make(chan string, 1)
+	go func() {
+		_, body := invalidateServiceAccountToken(t, h, "default")
+		result <- body
+	}()
+	// the cache is invalidated right away, the credentials once the waiting requests are served
+	for deadline := time.Now().Add(5 * time.Second); gen() == before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("cached tokens were not invalidated")
+		}
+	}
+	close(ts.release)
+	for i := 0; i < 3; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("waiting request returned wrong status code: got %v want %v", code, http.StatusOK)
+		}
+	}
+	if body := <-result; body != `{"pendingRequests":3}` {
+		t.Errorf("unexpected response: got %s", body)
+	}
+}
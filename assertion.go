@@ -0,0 +1,150 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultTokenURL = "https://oauth2.googleapis.com/token"
+)
+
+// idTokenIssuer is implemented by credential sources which sign their own assertions and can therefore
+// exchange them for id_tokens directly
+type idTokenIssuer interface {
+	IDToken(audience string) (string, error)
+}
+
+// assertionSigner returns the RS256 (PKCS#1 v1.5 with SHA-256) signature over a JWT signing input
+type assertionSigner func(signingInput []byte) ([]byte, error)
+
+// jwtAssertion is a service account JWT bearer assertion exchanged at a token endpoint
+type jwtAssertion struct {
+	Email    string
+	KeyID    string
+	TokenURL string
+	Client   *http.Client
+}
+
+// sign builds the assertion for the service account with the extra claims and signs it
+func (a *jwtAssertion) sign(signer assertionSigner, extra map[string]interface{}) (string, error) {
+	iat := time.Now()
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if a.KeyID != "" {
+		header["kid"] = a.KeyID
+	}
+	claims := map[string]interface{}{
+		"iss": a.Email,
+		"aud": a.TokenURL,
+		"iat": iat.Unix(),
+		"exp": iat.Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	sig, err := signer([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// accessToken exchanges a signed assertion for an access_token with the scopes
+func (a *jwtAssertion) accessToken(signer assertionSigner, scopes []string) (*oauth2.Token, error) {
+	assertion, err := a.sign(signer, map[string]interface{}{
+		"scope": strings.Join(scopes, " "),
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := &struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err := a.exchange(assertion, resp); err != nil {
+		return nil, err
+	}
+	tokenType := resp.TokenType
+	if tokenType == "" {
+		tokenType = "Bearer"
+	}
+	return &oauth2.Token{
+		AccessToken: resp.AccessToken,
+		TokenType:   tokenType,
+		Expiry:      time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// idToken exchanges a signed assertion for an id_token with the audience
+func (a *jwtAssertion) idToken(signer assertionSigner, audience string) (string, error) {
+	assertion, err := a.sign(signer, map[string]interface{}{
+		"target_audience": audience,
+	})
+	if err != nil {
+		return "", err
+	}
+	resp := &struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := a.exchange(assertion, resp); err != nil {
+		return "", err
+	}
+	return resp.IDToken, nil
+}
+
+func (a *jwtAssertion) exchange(assertion string, ret interface{}) error {
+	data := url.Values{}
+	data.Add("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	data.Add("assertion", assertion)
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.PostForm(a.TokenURL, data)
+	if err != nil {
+		return fmt.Errorf("unable to POST token request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error response from token endpoint %d: %s", resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, ret)
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// validateBearerTokenExemptPaths checks the ServerConfig.BearerTokenExemptPaths patterns
+func validateBearerTokenExemptPaths(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, "/"); err != nil || !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("BearerTokenExemptPaths must be absolute path patterns, got %q", p)
+		}
+	}
+	return nil
+}
+
+// bearerTokenExempt reports if requests for p do not need ServerConfig.RequiredBearerToken
+func (h *MetadataServer) bearerTokenExempt(p string) bool {
+	for _, pattern := range h.ServerConfig.BearerTokenExemptPaths {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// requireBearerToken rejects requests without `Authorization: Bearer <ServerConfig.RequiredBearerToken>` with a 401.
+// The header is removed from accepted requests so it is not forwarded to ProxyTo.
+func (h *MetadataServer) requireBearerToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := h.ServerConfig.RequiredBearerToken
+		if token == "" || h.bearerTokenExempt(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			h.requestLog(r).Info("Rejected request without a valid bearer token", "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized, "text/html; charset=UTF-8")
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Header.Del("Authorization")
+		next.ServeHTTP(w, r)
+	})
+}
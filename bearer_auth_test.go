@@ -0,0 +1,61 @@
+package mds
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+func TestRequiredBearerToken(t *testing.T) {
+	sc := &ServerConfig{
+		RequiredBearerToken:    "secret",
+		BearerTokenExemptPaths: []string{"/healthz", "/computeMetadata/v1/instance/service-accounts/*/email"},
+	}
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	for _, tc := range []struct {
+		path, auth string
+		want       int
+	}{
+		{"/computeMetadata/v1/project/project-id", "", http.StatusUnauthorized},
+		{"/computeMetadata/v1/project/project-id", "Bearer wrong", http.StatusUnauthorized},
+		{"/computeMetadata/v1/project/project-id", "secret", http.StatusUnauthorized},
+		{"/computeMetadata/v1/project/project-id", "Bearer secret", http.StatusOK},
+		{"/computeMetadata/v1/instance/service-accounts/default/email", "", http.StatusOK},
+		{"/computeMetadata/v1/instance/service-accounts/default/aliases", "", http.StatusUnauthorized},
+		{"/healthz", "", http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodGet, tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tc.want {
+			t.Errorf("%s with %q: returned wrong status code: got %v want %v", tc.path, tc.auth, rr.Code, tc.want)
+		}
+		if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: missing WWW-Authenticate header", tc.path)
+		}
+	}
+}
+
+func TestBearerTokenExemptPathsValidation(t *testing.T) {
+	for _, paths := range [][]string{{"healthz"}, {"/computeMetadata/["}} {
+		sc := &ServerConfig{RequiredBearerToken: "secret", BearerTokenExemptPaths: paths}
+		if _, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("some-project")); err == nil {
+			t.Errorf("expected error for BearerTokenExemptPaths %v", paths)
+		}
+	}
+}
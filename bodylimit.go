@@ -0,0 +1,67 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"errors"
+	"net/http"
+)
+
+const (
+	defaultMaxRequestBodySize      = 64 << 10
+	defaultAdminMaxRequestBodySize = 1 << 20
+)
+
+func (h *MetadataServer) maxRequestBodySize() int64 {
+	if h.ServerConfig.MaxRequestBodySize == 0 {
+		return defaultMaxRequestBodySize
+	}
+	return h.ServerConfig.MaxRequestBodySize
+}
+
+func (h *MetadataServer) adminMaxRequestBodySize() int64 {
+	if h.ServerConfig.AdminMaxRequestBodySize == 0 {
+		return defaultAdminMaxRequestBodySize
+	}
+	return h.ServerConfig.AdminMaxRequestBodySize
+}
+
+// limitRequestBody caps the request bodies of the metadata listeners at ServerConfig.MaxRequestBodySize
+func (h *MetadataServer) limitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limitBody(w, r, h.maxRequestBodySize(), "text/html; charset=UTF-8") {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// limitBody rejects a request with a Content-Length above limit with a 413 and returns false.  Otherwise the body is
+// wrapped so reading past limit fails, see bodyTooLarge().
+func limitBody(w http.ResponseWriter, r *http.Request, limit int64, contentType string) bool {
+	if r.ContentLength > limit {
+		httpError(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge, contentType)
+		return false
+	}
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	return true
+}
+
+// bodyTooLarge reports if err is caused by reading a body past the limit of limitBody()
+func bodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
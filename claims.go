@@ -0,0 +1,269 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ConfigFormatJSON = "json" // claims encoded as JSON (default)
+	ConfigFormatYAML = "yaml" // claims encoded as YAML using the same field names as the JSON format
+	ConfigFormatTOML = "toml" // claims encoded as TOML using the same field names as the JSON format
+	ConfigFormatAuto = "auto" // TOML if the document starts with a [computeMetadata] table, otherwise JSON
+)
+
+// ConfigFormatForFile returns the config format to use for a file based on its extension.
+//
+// Files ending in `.json` are JSON, `.yaml` or `.yml` YAML and `.toml` TOML; the format of other files is detected
+// from their content with ConfigFormatAuto
+func ConfigFormatForFile(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ConfigFormatJSON
+	case ".yaml", ".yml":
+		return ConfigFormatYAML
+	case ".toml":
+		return ConfigFormatTOML
+	default:
+		return ConfigFormatAuto
+	}
+}
+
+// ClaimsFromReader parses Claims from r in the given format (`json`, `yaml`, `toml` or `auto`).
+//
+// YAML and TOML documents use the same keys as the JSON config file (eg `computeMetadata.v1.project.projectId`)
+func ClaimsFromReader(r io.Reader, format string) (*Claims, error) {
+	return parseClaims(r, format, false)
+}
+
+// ClaimsFromFile parses Claims from the config file at path in the format given by ConfigFormatForFile().
+//
+// If expandEnv is set, `${VAR}` and `$VAR` in string values are replaced with the environment variable, eg
+// `"projectId": "${PROJECT_ID}"`; unset variables become empty and `$$` is a literal `$`.  Keys are not expanded.
+func ClaimsFromFile(path string, expandEnv bool) (*Claims, error) {
+	return ClaimsFromFileFormat(path, "", expandEnv)
+}
+
+// ClaimsFromFileFormat is ClaimsFromFile() in the given format, eg to read TOML from a file without a `.toml`
+// extension.  An empty format uses ConfigFormatForFile().
+func ClaimsFromFileFormat(path, format string, expandEnv bool) (*Claims, error) {
+	if format == "" {
+		format = ConfigFormatForFile(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	defer f.Close()
+	return parseClaims(f, format, expandEnv)
+}
+
+func parseClaims(r io.Reader, format string, expandEnv bool) (*Claims, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading claims: %w", err)
+	}
+
+	format = strings.ToLower(format)
+	if format == ConfigFormatAuto {
+		format = sniffConfigFormat(data)
+	}
+	switch format {
+	case ConfigFormatJSON, "":
+	case ConfigFormatYAML, "yml":
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing yaml: %v", err)
+		}
+	case ConfigFormatTOML:
+		data, err = tomlToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing toml: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format %q", format)
+	}
+
+	if expandEnv {
+		data, err = expandJSONEnv(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing json: %v", err)
+		}
+	}
+
+	claims := &Claims{}
+	err = json.Unmarshal(data, claims)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing json: %v", err)
+	}
+	return claims, nil
+}
+
+// sniffConfigFormat returns ConfigFormatTOML if the first line which is not blank or a comment opens the
+// computeMetadata table, otherwise ConfigFormatJSON
+func sniffConfigFormat(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[computeMetadata") {
+			return ConfigFormatTOML
+		}
+		break
+	}
+	return ConfigFormatJSON
+}
+
+// tomlToJSON converts a TOML document to JSON; parse errors include the line number
+func tomlToJSON(data []byte) ([]byte, error) {
+	var v map[string]interface{}
+	if _, err := toml.Decode(string(data), &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// expandJSONEnv expands environment variables in the string values of a JSON document
+func expandJSONEnv(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(expandValueEnv(v))
+}
+
+func expandValueEnv(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return os.Expand(v, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			return os.Getenv(name)
+		})
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = expandValueEnv(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = expandValueEnv(e)
+		}
+	}
+	return v
+}
+
+// validateClaims checks the fields every metadata server is expected to provide
+func validateClaims(c *Claims) error {
+	sa, ok := c.ComputeMetadata.V1.Instance.ServiceAccounts["default"]
+	if !ok {
+		return errors.New("claims must include a default service account")
+	}
+	if sa.Email == "" {
+		return errors.New("default service account email cannot be empty")
+	}
+	if err := validateInstance(&c.ComputeMetadata.V1.Instance); err != nil {
+		return err
+	}
+	scheduling := c.ComputeMetadata.V1.Instance.Scheduling
+	if v := scheduling.Preemptible; v != "" && v != "TRUE" && v != "FALSE" {
+		return fmt.Errorf("scheduling preemptible must be TRUE or FALSE, got %q", v)
+	}
+	if v := scheduling.OnHostMaintenance; v != "" && v != "MIGRATE" && v != "TERMINATE" {
+		return fmt.Errorf("scheduling onHostMaintenance must be MIGRATE or TERMINATE, got %q", v)
+	}
+	if v := strings.ToLower(scheduling.AutomaticRestart); v != "" && v != "true" && v != "false" {
+		return fmt.Errorf("scheduling automaticRestart must be true or false, got %q", scheduling.AutomaticRestart)
+	}
+	return nil
+}
+
+// validateProjectID checks id follows the GCP project id naming rules
+func validateProjectID(id string) error {
+	if !projectIDRegex.MatchString(id) {
+		return fmt.Errorf("project ID '%s' is invalid: must match %s", id, projectIDRegex)
+	}
+	return nil
+}
+
+// validateInstance checks the instance values GCE returns as resource paths are well formed.  Unlike
+// validateClaims, it is also applied to claims loaded from a config file.
+func validateInstance(instance *Instance) error {
+	if instance.Zone != "" && !instanceZoneRegex.MatchString(instance.Zone) {
+		return fmt.Errorf("zone must be of the form projects/<numericProjectId>/zones/<zone>, got %q", instance.Zone)
+	}
+	if instance.Region != "" {
+		if !instanceRegionRegex.MatchString(instance.Region) {
+			return fmt.Errorf("region must be of the form projects/<numericProjectId>/regions/<region>, got %q", instance.Region)
+		}
+		if instance.Zone != "" && regionFromZone(instance.Zone) != instance.Region {
+			return fmt.Errorf("region %q does not contain zone %q", instance.Region, instance.Zone)
+		}
+	}
+	if v := instance.Image; v != "" && !imageRegex.MatchString(v) {
+		return fmt.Errorf("image must be of the form projects/<project>/global/images/<image>, got %q", v)
+	}
+	if v := instance.MachineType; v != "" && !machineTypeRegex.MatchString(v) {
+		return fmt.Errorf("machineType must be of the form projects/<numericProjectId>/machineTypes/<type>, got %q", v)
+	}
+	for alias, sa := range instance.ServiceAccounts {
+		if sa.X509Cert == "" {
+			continue
+		}
+		if _, err := x509DER(sa.X509Cert); err != nil {
+			return fmt.Errorf("x509Cert of service account %s: %v", alias, err)
+		}
+	}
+	if v := instance.ConfidentialComputing.AttestationReport; v != "" {
+		if _, err := base64.StdEncoding.DecodeString(v); err != nil {
+			return fmt.Errorf("confidentialComputing.attestationReport must be base64 encoded: %v", err)
+		}
+	}
+	if v := instance.MaintenanceEvent; v != "" {
+		return validateMaintenanceEvent(v)
+	}
+	return nil
+}
+
+func validateMaintenanceEvent(event string) error {
+	switch event {
+	case maintenanceEventNone, maintenanceEventMigrateOnHost, maintenanceEventTerminateOnHost:
+		return nil
+	}
+	return fmt.Errorf("maintenanceEvent must be %s, %s or %s, got %q", maintenanceEventNone, maintenanceEventMigrateOnHost, maintenanceEventTerminateOnHost, event)
+}
+
+// ClaimsToYAML encodes the claims as a YAML document readable by `ClaimsFromReader()`
+func ClaimsToYAML(c *Claims) ([]byte, error) {
+	if c == nil {
+		return nil, fmt.Errorf("claims cannot be nil")
+	}
+	return yaml.Marshal(c)
+}
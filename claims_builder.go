@@ -0,0 +1,243 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+const (
+	defaultBuilderScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+var (
+	projectIDRegex      = regexp.MustCompile(`^[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+	zoneNameRegex       = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+-[a-z]$`)
+	zonePathRegex       = regexp.MustCompile(`^projects/[^/]+/zones/([^/]+)$`)
+	machineTypeRegex    = regexp.MustCompile(`^projects/[0-9]+/machineTypes/[a-z0-9][a-z0-9-]*$`)
+	instanceZoneRegex   = regexp.MustCompile(`^projects/([0-9]+)/zones/([a-z]+-[a-z]+[0-9]+)-[a-z]$`)
+	instanceRegionRegex = regexp.MustCompile(`^projects/[0-9]+/regions/[a-z]+-[a-z]+[0-9]+$`)
+	imageRegex          = regexp.MustCompile(`^projects/[a-z0-9.:-]+/global/images/[a-z]([a-z0-9-]*[a-z0-9])?$`)
+	labelKeyRegex       = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValueRegex     = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+)
+
+// ClaimsBuilder constructs Claims programmatically, eg
+//
+//	claims, err := mds.NewClaimsBuilder().
+//		ProjectID("some-project").
+//		NumericProjectID(123456).
+//		Zone("us-central1-a").
+//		DefaultServiceAccount("metadata-sa@some-project.iam.gserviceaccount.com").
+//		Build()
+//
+// Unlike a config file, `Build()` checks the claims are usable: the project id and zone must be well formed
+// and the project number and a default service account are required.
+type ClaimsBuilder struct {
+	claims Claims
+	zone   string
+	errs   []error
+
+	allowArbitraryProjectID bool
+}
+
+// NewClaimsBuilder returns an empty ClaimsBuilder
+func NewClaimsBuilder() *ClaimsBuilder {
+	return &ClaimsBuilder{}
+}
+
+// ProjectID sets the project id
+func (b *ClaimsBuilder) ProjectID(projectID string) *ClaimsBuilder {
+	b.claims.ComputeMetadata.V1.Project.ProjectID = projectID
+	return b
+}
+
+// AllowArbitraryProjectID skips the project id naming rules in `Build()`, eg to use fake ids in tests.
+// NewMetadataServer() still rejects such claims unless ServerConfig.AllowArbitraryProjectID is set.
+func (b *ClaimsBuilder) AllowArbitraryProjectID() *ClaimsBuilder {
+	b.allowArbitraryProjectID = true
+	return b
+}
+
+// NumericProjectID sets the project number.  It is required whenever a project id is set.
+func (b *ClaimsBuilder) NumericProjectID(n int64) *ClaimsBuilder {
+	b.claims.ComputeMetadata.V1.Project.NumericProjectID = n
+	return b
+}
+
+// Zone sets the instance zone either as a zone name (`us-central1-a`) or as the full
+// `projects/<numericProjectId>/zones/<zone>` value returned by the metadata server
+func (b *ClaimsBuilder) Zone(zone string) *ClaimsBuilder {
+	b.zone = zone
+	return b
+}
+
+// MachineType sets the instance machine type as `projects/<numericProjectId>/machineTypes/<mtype>`, eg `n1-standard-4`
+func (b *ClaimsBuilder) MachineType(numericProjectID int64, mtype string) *ClaimsBuilder {
+	b.claims.ComputeMetadata.V1.Instance.MachineType = fmt.Sprintf("projects/%d/machineTypes/%s", numericProjectID, mtype)
+	return b
+}
+
+// Image sets the instance boot image as `projects/<project>/global/images/<image>`, eg
+// `projects/debian-cloud/global/images/debian-11-bullseye-v20231004`
+func (b *ClaimsBuilder) Image(image string) *ClaimsBuilder {
+	b.claims.ComputeMetadata.V1.Instance.Image = image
+	return b
+}
+
+// InstanceName sets the instance name
+func (b *ClaimsBuilder) InstanceName(name string) *ClaimsBuilder {
+	b.claims.ComputeMetadata.V1.Instance.Name = name
+	return b
+}
+
+// Hostname sets the instance hostname
+func (b *ClaimsBuilder) Hostname(hostname string) *ClaimsBuilder {
+	b.claims.ComputeMetadata.V1.Instance.Hostname = hostname
+	return b
+}
+
+// InstanceID sets the instance id.  If it is not set, the metadata server serves a random id for its lifetime.
+func (b *ClaimsBuilder) InstanceID(id uint64) *ClaimsBuilder {
+	b.claims.ComputeMetadata.V1.Instance.ID = id
+	return b
+}
+
+// DefaultServiceAccount sets the default service account.  The account is served both as `default` and
+// under its email.  If no scopes are provided, `https://www.googleapis.com/auth/cloud-platform` is used.
+func (b *ClaimsBuilder) DefaultServiceAccount(email string, scopes ...string) *ClaimsBuilder {
+	if email == "" {
+		b.errs = append(b.errs, errors.New("default service account email cannot be empty"))
+		return b
+	}
+	if len(scopes) == 0 {
+		scopes = []string{defaultBuilderScope}
+	}
+	sa := serviceAccountDetails{
+		Aliases: []string{"default"},
+		Email:   email,
+		Scopes:  scopes,
+	}
+	if b.claims.ComputeMetadata.V1.Instance.ServiceAccounts == nil {
+		b.claims.ComputeMetadata.V1.Instance.ServiceAccounts = map[string]serviceAccountDetails{}
+	}
+	b.claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = sa
+	b.claims.ComputeMetadata.V1.Instance.ServiceAccounts[email] = sa
+	return b
+}
+
+// AddLabel adds an instance label.  Keys and values must follow the GCE label restrictions.
+func (b *ClaimsBuilder) AddLabel(k, v string) *ClaimsBuilder {
+	if !labelKeyRegex.MatchString(k) {
+		b.errs = append(b.errs, fmt.Errorf("invalid label key %q", k))
+		return b
+	}
+	if !labelValueRegex.MatchString(v) {
+		b.errs = append(b.errs, fmt.Errorf("invalid value %q for label %q", v, k))
+		return b
+	}
+	if b.claims.ComputeMetadata.V1.Instance.Labels == nil {
+		b.claims.ComputeMetadata.V1.Instance.Labels = map[string]string{}
+	}
+	b.claims.ComputeMetadata.V1.Instance.Labels[k] = v
+	return b
+}
+
+// AddInstanceAttribute adds a custom instance attribute served at `/computeMetadata/v1/instance/attributes/<k>`
+func (b *ClaimsBuilder) AddInstanceAttribute(k, v string) *ClaimsBuilder {
+	if k == "" {
+		b.errs = append(b.errs, errors.New("instance attribute key cannot be empty"))
+		return b
+	}
+	if b.claims.ComputeMetadata.V1.Instance.Attributes == nil {
+		b.claims.ComputeMetadata.V1.Instance.Attributes = map[string]string{}
+	}
+	b.claims.ComputeMetadata.V1.Instance.Attributes[k] = v
+	return b
+}
+
+// AddProjectAttribute adds a custom project attribute served at `/computeMetadata/v1/project/attributes/<k>`
+func (b *ClaimsBuilder) AddProjectAttribute(k, v string) *ClaimsBuilder {
+	if k == "" {
+		b.errs = append(b.errs, errors.New("project attribute key cannot be empty"))
+		return b
+	}
+	if b.claims.ComputeMetadata.V1.Project.Attributes == nil {
+		b.claims.ComputeMetadata.V1.Project.Attributes = map[string]string{}
+	}
+	b.claims.ComputeMetadata.V1.Project.Attributes[k] = v
+	return b
+}
+
+// Build validates and returns the claims.  All problems found are returned as one error.
+func (b *ClaimsBuilder) Build() (*Claims, error) {
+	errs := append([]error{}, b.errs...)
+
+	project := b.claims.ComputeMetadata.V1.Project
+	if project.ProjectID == "" {
+		errs = append(errs, errors.New("project id cannot be empty"))
+	} else if err := validateProjectID(project.ProjectID); err != nil && !b.allowArbitraryProjectID {
+		errs = append(errs, err)
+	} else if project.NumericProjectID <= 0 {
+		errs = append(errs, fmt.Errorf("numeric project id must be set for project %q", project.ProjectID))
+	}
+
+	// copy the maps so later calls on the builder do not modify the returned claims
+	c := b.claims
+	c.ComputeMetadata.V1.Instance.Attributes = copyStringMap(c.ComputeMetadata.V1.Instance.Attributes)
+	c.ComputeMetadata.V1.Instance.Labels = copyStringMap(c.ComputeMetadata.V1.Instance.Labels)
+	c.ComputeMetadata.V1.Project.Attributes = copyStringMap(c.ComputeMetadata.V1.Project.Attributes)
+	if sas := c.ComputeMetadata.V1.Instance.ServiceAccounts; sas != nil {
+		c.ComputeMetadata.V1.Instance.ServiceAccounts = make(map[string]serviceAccountDetails, len(sas))
+		for k, v := range sas {
+			c.ComputeMetadata.V1.Instance.ServiceAccounts[k] = v
+		}
+	}
+
+	if b.zone != "" {
+		name := b.zone
+		if m := zonePathRegex.FindStringSubmatch(b.zone); m != nil {
+			name = m[1]
+		}
+		if !zoneNameRegex.MatchString(name) {
+			errs = append(errs, fmt.Errorf("invalid zone %q", b.zone))
+		} else if name == b.zone {
+			c.ComputeMetadata.V1.Instance.Zone = fmt.Sprintf("projects/%d/zones/%s", project.NumericProjectID, name)
+		} else {
+			c.ComputeMetadata.V1.Instance.Zone = b.zone
+		}
+	}
+
+	if err := validateClaims(&c); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid claims: %w", errors.Join(errs...))
+	}
+	return &c, nil
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	ret := make(map[string]string, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
@@ -0,0 +1,183 @@
+package mds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+func TestClaimsBuilder(t *testing.T) {
+	email := "metadata-sa@some-project.iam.gserviceaccount.com"
+	b := NewClaimsBuilder().
+		ProjectID("some-project").
+		NumericProjectID(123456).
+		Zone("us-central1-a").
+		InstanceName("instance-1").
+		Hostname("instance-1.c.some-project.internal").
+		InstanceID(42).
+		MachineType(123456, "n1-standard-4").
+		Image("projects/debian-cloud/global/images/debian-11-bullseye-v20231004").
+		DefaultServiceAccount(email, "https://www.googleapis.com/auth/userinfo.email").
+		AddLabel("env", "test").
+		AddInstanceAttribute("foo", "bar").
+		AddProjectAttribute("ssh-keys", "user:ssh-rsa AAAA")
+
+	c, err := b.Build()
+	if err != nil {
+		t.Fatalf("error building claims %v", err)
+	}
+
+	v1 := c.ComputeMetadata.V1
+	if v1.Project.ProjectID != "some-project" || v1.Project.NumericProjectID != 123456 {
+		t.Errorf("unexpected project: got %+v", v1.Project)
+	}
+	if v1.Instance.Zone != "projects/123456/zones/us-central1-a" {
+		t.Errorf("unexpected zone: got %s", v1.Instance.Zone)
+	}
+	if v1.Instance.Name != "instance-1" || v1.Instance.Hostname != "instance-1.c.some-project.internal" || v1.Instance.ID != 42 {
+		t.Errorf("unexpected instance: got %+v", v1.Instance)
+	}
+	if v1.Instance.MachineType != "projects/123456/machineTypes/n1-standard-4" {
+		t.Errorf("unexpected machine type: got %s", v1.Instance.MachineType)
+	}
+	if v1.Instance.Image != "projects/debian-cloud/global/images/debian-11-bullseye-v20231004" {
+		t.Errorf("unexpected image: got %s", v1.Instance.Image)
+	}
+	for _, k := range []string{"default", email} {
+		sa, ok := v1.Instance.ServiceAccounts[k]
+		if !ok || sa.Email != email || len(sa.Scopes) != 1 || sa.Scopes[0] != "https://www.googleapis.com/auth/userinfo.email" {
+			t.Errorf("unexpected service account %s: got %+v", k, sa)
+		}
+	}
+	if v1.Instance.Labels["env"] != "test" {
+		t.Errorf("unexpected labels: got %v", v1.Instance.Labels)
+	}
+	if v1.Instance.Attributes["foo"] != "bar" {
+		t.Errorf("unexpected instance attributes: got %v", v1.Instance.Attributes)
+	}
+	if v1.Project.Attributes["ssh-keys"] != "user:ssh-rsa AAAA" {
+		t.Errorf("unexpected project attributes: got %v", v1.Project.Attributes)
+	}
+
+	// the built claims are independent of the builder
+	b.AddInstanceAttribute("later", "value")
+	if _, ok := c.ComputeMetadata.V1.Instance.Attributes["later"]; ok {
+		t.Errorf("builder modified previously built claims")
+	}
+
+	// the built claims can be served directly
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{Port: fmt.Sprintf(":%d", p), SkipPrefetch: true}, &google.Credentials{}, c)
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err != nil {
+		t.Errorf("error starting emulator %v", err)
+	}
+	defer h.Shutdown()
+	_, body, err := getMetadata(fmt.Sprintf("http://127.0.0.1:%d/computeMetadata/v1/instance/attributes/foo", p))
+	if err != nil {
+		t.Fatalf("error getting attribute %v", err)
+	}
+	if body != "bar" {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, "bar")
+	}
+}
+
+func TestClaimsBuilderDefaults(t *testing.T) {
+	c, err := NewClaimsBuilder().
+		ProjectID("some-project").
+		NumericProjectID(123456).
+		Zone("projects/123456/zones/europe-west1-b").
+		DefaultServiceAccount("metadata-sa@some-project.iam.gserviceaccount.com").
+		Build()
+	if err != nil {
+		t.Fatalf("error building claims %v", err)
+	}
+	if c.ComputeMetadata.V1.Instance.Zone != "projects/123456/zones/europe-west1-b" {
+		t.Errorf("unexpected zone: got %s", c.ComputeMetadata.V1.Instance.Zone)
+	}
+	scopes := c.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Scopes
+	if len(scopes) != 1 || scopes[0] != defaultBuilderScope {
+		t.Errorf("unexpected default scopes: got %v", scopes)
+	}
+}
+
+func TestClaimsBuilderProjectID(t *testing.T) {
+	build := func(id string) *ClaimsBuilder {
+		return NewClaimsBuilder().ProjectID(id).NumericProjectID(123456).DefaultServiceAccount("metadata-sa@p.iam.gserviceaccount.com")
+	}
+	for _, id := range []string{"some-project", "a12345", "a" + strings.Repeat("0", 29)} {
+		if _, err := build(id).Build(); err != nil {
+			t.Errorf("unexpected error for project id %q: %v", id, err)
+		}
+	}
+	for _, id := range []string{"MY_PROJECT", "abcde", "1project", "project-", "a" + strings.Repeat("0", 30)} {
+		_, err := build(id).Build()
+		if err == nil {
+			t.Errorf("expected error for project id %q", id)
+			continue
+		}
+		if want := fmt.Sprintf("project ID '%s' is invalid: must match ^[a-z][a-z0-9-]{4,28}[a-z0-9]$", id); !strings.Contains(err.Error(), want) {
+			t.Errorf("unexpected error: got %v want %s", err, want)
+		}
+		if _, err := build(id).AllowArbitraryProjectID().Build(); err != nil {
+			t.Errorf("unexpected error for project id %q with AllowArbitraryProjectID: %v", id, err)
+		}
+	}
+}
+
+func TestClaimsBuilderErrors(t *testing.T) {
+	valid := func() *ClaimsBuilder {
+		return NewClaimsBuilder().
+			ProjectID("some-project").
+			NumericProjectID(123456).
+			DefaultServiceAccount("metadata-sa@some-project.iam.gserviceaccount.com")
+	}
+
+	for name, tc := range map[string]struct {
+		builder *ClaimsBuilder
+		want    string
+	}{
+		"missing project":         {NewClaimsBuilder().DefaultServiceAccount("sa@p.iam.gserviceaccount.com"), "project id cannot be empty"},
+		"missing project number":  {valid().NumericProjectID(0), "numeric project id must be set"},
+		"invalid project":         {valid().ProjectID("Invalid_Project"), "project ID 'Invalid_Project' is invalid"},
+		"missing service account": {NewClaimsBuilder().ProjectID("some-project").NumericProjectID(123456), "default service account"},
+		"empty service account":   {valid().DefaultServiceAccount(""), "email cannot be empty"},
+		"invalid zone":            {valid().Zone("uscentral1"), "invalid zone"},
+		"invalid zone path":       {valid().Zone("projects/1/zones/nowhere"), "invalid zone"},
+		"invalid machine type":    {valid().MachineType(123456, "N1 Standard"), "machineType must be of the form"},
+		"invalid image":           {valid().Image("debian-11"), "image must be of the form"},
+		"invalid label key":       {valid().AddLabel("Env", "test"), "invalid label key"},
+		"invalid label value":     {valid().AddLabel("env", "Test Value"), "invalid value"},
+		"empty attribute key":     {valid().AddInstanceAttribute("", "v"), "instance attribute key cannot be empty"},
+		"empty project attribute": {valid().AddProjectAttribute("", "v"), "project attribute key cannot be empty"},
+	} {
+		_, err := tc.builder.Build()
+		if err == nil {
+			t.Errorf("%s: expected error building claims", name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: unexpected error: got %v want %s", name, err, tc.want)
+		}
+	}
+
+	// every problem is reported at once
+	_, err := NewClaimsBuilder().Zone("bad").AddLabel("Bad", "").Build()
+	if err == nil {
+		t.Fatalf("expected error building claims")
+	}
+	for _, want := range []string{"project id cannot be empty", "invalid zone", "invalid label key", "default service account"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %q: got %v", want, err)
+		}
+	}
+}
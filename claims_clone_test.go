@@ -0,0 +1,95 @@
+package mds
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// sharedReferences returns the paths of the maps, slices and pointers which a and b have in common
+func sharedReferences(a, b reflect.Value, path string) []string {
+	var shared []string
+	switch a.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice:
+		if a.IsNil() {
+			return nil
+		}
+		if a.Pointer() == b.Pointer() {
+			shared = append(shared, path)
+		}
+	}
+	switch a.Kind() {
+	case reflect.Pointer:
+		shared = append(shared, sharedReferences(a.Elem(), b.Elem(), path)...)
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if a.Type().Field(i).IsExported() {
+				shared = append(shared, sharedReferences(a.Field(i), b.Field(i), path+"."+a.Type().Field(i).Name)...)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < a.Len(); i++ {
+			shared = append(shared, sharedReferences(a.Index(i), b.Index(i), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Map:
+		iter := a.MapRange()
+		for iter.Next() {
+			shared = append(shared, sharedReferences(iter.Value(), b.MapIndex(iter.Key()), fmt.Sprintf("%s[%v]", path, iter.Key()))...)
+		}
+	}
+	return shared
+}
+
+func TestClaimsClone(t *testing.T) {
+	c := &Claims{}
+	populate(reflect.ValueOf(c).Elem(), "clone")
+	clone := c.Clone()
+	if !reflect.DeepEqual(c, clone) {
+		t.Fatalf("clone differs from the claims")
+	}
+	if shared := sharedReferences(reflect.ValueOf(c), reflect.ValueOf(clone), "Claims"); len(shared) != 0 {
+		t.Errorf("clone shares references with the claims: %v", shared)
+	}
+
+	// nil maps and slices stay nil
+	empty := (&Claims{}).Clone()
+	if empty.ComputeMetadata.V1.Instance.ServiceAccounts != nil || empty.ComputeMetadata.V1.Instance.Tags != nil {
+		t.Errorf("empty claims were not cloned as is: got %+v", empty)
+	}
+	if (*Claims)(nil).Clone() != nil {
+		t.Errorf("expected nil clone of nil claims")
+	}
+}
+
+func TestUpdateClaimsServesCopy(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Project.Attributes = map[string]string{"key": "before"}
+	if err := s.UpdateClaims(claims); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+
+	// the caller keeps modifying the claims while they are served
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; !stop.Load(); i++ {
+			claims.ComputeMetadata.V1.Project.Attributes["key"] = fmt.Sprintf("after-%d", i)
+			claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = serviceAccountDetails{Email: "other@some-project.iam.gserviceaccount.com"}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, body, err := getMetadata(s.URL() + "/computeMetadata/v1/project/attributes/key"); err != nil || body != "before" {
+			t.Errorf("attribute changed after UpdateClaims: got %q %v", body, err)
+		}
+		if _, body, err := getMetadata(s.URL() + "/computeMetadata/v1/instance/service-accounts/default/email"); err != nil || body != "metadata-sa@some-project.iam.gserviceaccount.com" {
+			t.Errorf("service account changed after UpdateClaims: got %q %v", body, err)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// ClaimsDiff is a value which differs between two claims
+type ClaimsDiff struct {
+	Path     string      `json:"path"`     // JSON path of the value, eg $.computeMetadata.v1.project.projectId or $.computeMetadata.v1.instance.tags[0]
+	OldValue interface{} `json:"oldValue"` // nil if the value is added; numbers are json.Number
+	NewValue interface{} `json:"newValue"` // nil if the value is removed; numbers are json.Number
+}
+
+var jsonPathIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// DiffClaims returns the values UpdateClaims(newClaims) would change, one entry per scalar value in the order of
+// their paths.  Objects and lists are compared element by element; a missing value and null are the same.  The
+// generated instance id and guest attributes written at runtime are not part of the claims and are not compared.
+func (h *MetadataServer) DiffClaims(newClaims *Claims) []ClaimsDiff {
+	h.stateMutex.RLock()
+	old := h.Claims
+	h.stateMutex.RUnlock()
+	if newClaims == nil {
+		newClaims = &Claims{}
+	}
+	var diffs []ClaimsDiff
+	diffJSON("$", claimsJSON(&old), claimsJSON(newClaims), &diffs)
+	return diffs
+}
+
+// claimsJSON returns c decoded into maps, lists and json.Number values
+func claimsJSON(c *Claims) interface{} {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil
+	}
+	return v
+}
+
+func diffJSON(path string, a, b interface{}, diffs *[]ClaimsDiff) {
+	am, aIsMap := a.(map[string]interface{})
+	bm, bIsMap := b.(map[string]interface{})
+	if (aIsMap || a == nil) && (bIsMap || b == nil) && (aIsMap || bIsMap) {
+		keys := make([]string, 0, len(am)+len(bm))
+		for k := range am {
+			keys = append(keys, k)
+		}
+		for k := range bm {
+			if _, ok := am[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diffJSON(jsonPathKey(path, k), am[k], bm[k], diffs)
+		}
+		return
+	}
+	al, aIsList := a.([]interface{})
+	bl, bIsList := b.([]interface{})
+	if (aIsList || a == nil) && (bIsList || b == nil) && (aIsList || bIsList) {
+		for i := 0; i < len(al) || i < len(bl); i++ {
+			var av, bv interface{}
+			if i < len(al) {
+				av = al[i]
+			}
+			if i < len(bl) {
+				bv = bl[i]
+			}
+			diffJSON(path+"["+strconv.Itoa(i)+"]", av, bv, diffs)
+		}
+		return
+	}
+	if a != b {
+		// scalars are strings, bools, json.Number or nil and compare by value; an object replaced by a scalar is
+		// reported as one change
+		*diffs = append(*diffs, ClaimsDiff{Path: path, OldValue: a, NewValue: b})
+	}
+}
+
+// jsonPathKey appends the object key k to path in dot notation, or bracket notation if k is not an identifier
+func jsonPathKey(path, k string) string {
+	if jsonPathIdentifier.MatchString(k) {
+		return path + "." + k
+	}
+	return path + "[" + strconv.Quote(k) + "]"
+}
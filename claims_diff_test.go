@@ -0,0 +1,44 @@
+package mds
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffClaims(t *testing.T) {
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.Tags = []string{"web", "prod"}
+	claims.ComputeMetadata.V1.Instance.Attributes = map[string]string{"enable-oslogin": "TRUE"}
+	s := NewTestMetadataServer(t, claims, WithLogger(&recordingLogger{}))
+
+	if diffs := s.DiffClaims(claims); len(diffs) != 0 {
+		t.Errorf("unexpected diff for the same claims: %+v", diffs)
+	}
+
+	updated := projectClaims("other-project")
+	updated.ComputeMetadata.V1.Instance.Tags = []string{"web"}
+	updated.ComputeMetadata.V1.Instance.Attributes = map[string]string{"enable-oslogin": "TRUE", "startup-script": "echo"}
+	updated.ComputeMetadata.V1.Instance.ID = 42
+	want := []ClaimsDiff{
+		{Path: `$.computeMetadata.v1.instance.attributes["startup-script"]`, OldValue: nil, NewValue: "echo"},
+		{Path: "$.computeMetadata.v1.instance.id", OldValue: json.Number("0"), NewValue: json.Number("42")},
+		{Path: "$.computeMetadata.v1.instance.serviceAccounts.default.email", OldValue: "metadata-sa@some-project.iam.gserviceaccount.com", NewValue: "metadata-sa@other-project.iam.gserviceaccount.com"},
+		{Path: "$.computeMetadata.v1.instance.tags[1]", OldValue: "prod", NewValue: nil},
+		{Path: "$.computeMetadata.v1.project.projectId", OldValue: "some-project", NewValue: "other-project"},
+	}
+	got := s.DiffClaims(updated)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected diff: got %+v want %+v", got, want)
+	}
+
+	// the diff is not applied
+	if _, body, err := getMetadata(s.URL() + "/computeMetadata/v1/project/project-id"); err != nil || body != "some-project" {
+		t.Errorf("claims were changed by DiffClaims: got %v %q", err, body)
+	}
+
+	js, err := json.Marshal(got[1])
+	if err != nil || string(js) != `{"path":"$.computeMetadata.v1.instance.id","oldValue":0,"newValue":42}` {
+		t.Errorf("unexpected JSON: got %s %v", js, err)
+	}
+}
@@ -0,0 +1,64 @@
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+func FuzzClaimsUnmarshal(f *testing.F) {
+	configData, err := os.ReadFile("config.json")
+	if err != nil {
+		f.Fatalf("error reading config.json %v", err)
+	}
+	f.Add(configData)
+	minimal, err := json.Marshal(projectClaims("some-project"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(minimal)
+	for _, seed := range []string{
+		`{}`,
+		`{"computeMetadata":{"v1":{"instance":{"serviceAccounts":{"default":{}}}}}}`,
+		`{"computeMetadata":{"v1":{"instance":{"disks":[{"index":"0"}]}}}}`,
+		`{"computeMetadata":{"v1":{"project":{"attributes":{"a":null}}}}}`,
+		`[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		claims := &Claims{}
+		if err := json.Unmarshal(data, claims); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
+				t.Fatalf("unexpected error parsing %q: %v", data, err)
+			}
+			return
+		}
+		if _, err := json.Marshal(claims); err != nil {
+			t.Fatalf("error encoding parsed claims %v", err)
+		}
+		if validateClaims(claims) != nil {
+			return
+		}
+
+		// claims accepted by the server are served without panics
+		h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims, WithLogger(discardLogger{}))
+		if err != nil {
+			return
+		}
+		for _, path := range []string{"/computeMetadata/v1/?recursive=true", "/computeMetadata/v1/instance/", "/computeMetadata/v1/project/attributes/"} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Metadata-Flavor", "Google")
+			h.handler().ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+}
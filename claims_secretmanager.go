@@ -0,0 +1,157 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+var (
+	// overridden in tests
+	secretManagerEndpoint     = "https://secretmanager.googleapis.com"
+	secretManagerPollInterval = 30 * time.Second
+	secretManagerCredentials  = func(ctx context.Context) (*google.Credentials, error) {
+		return google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	}
+
+	secretNameRegex = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+(/versions/[^/]+)?$`)
+)
+
+// secretVersion is the response of the Secret Manager `versions.access` method
+type secretVersion struct {
+	Name    string `json:"name"`
+	Payload struct {
+		Data       string `json:"data"`
+		DataCrc32c string `json:"dataCrc32c"`
+	} `json:"payload"`
+}
+
+// ClaimsFromSecretManager reads the claims JSON stored in a Secret Manager secret.
+//
+// secretName is either `projects/<project>/secrets/<secret>`, which reads the latest version, or a specific
+// `projects/<project>/secrets/<secret>/versions/<version>`.  creds need `secretmanager.versions.access` on the secret.
+func ClaimsFromSecretManager(ctx context.Context, secretName string, creds *google.Credentials) (*Claims, error) {
+	if creds == nil {
+		return nil, errors.New("credentials cannot be nil")
+	}
+	claims, _, err := accessSecretClaims(ctx, oauth2.NewClient(ctx, creds.TokenSource), secretName)
+	return claims, err
+}
+
+// WatchSecretManager polls the latest version of a Secret Manager secret and calls onChange with the new claims
+// each time a new version is added, eg
+//
+//	go mds.WatchSecretManager(ctx, "projects/my-project/secrets/mds-claims", func(c *mds.Claims) {
+//		if err := f.UpdateClaims(c); err != nil {
+//			log.Printf("ignoring invalid claims: %v", err)
+//		}
+//	})
+//
+// The secret is accessed with application default credentials.  WatchSecretManager returns an error if the
+// secret cannot be read initially; afterwards it blocks until ctx is done.  Versions which cannot be read or
+// parsed are retried at the next poll.
+func WatchSecretManager(ctx context.Context, secretName string, onChange func(*Claims)) error {
+	if onChange == nil {
+		return errors.New("onChange cannot be nil")
+	}
+	creds, err := secretManagerCredentials(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to find default credentials: %w", err)
+	}
+	client := oauth2.NewClient(ctx, creds.TokenSource)
+	_, version, err := accessSecretClaims(ctx, client, secretName)
+	if err != nil {
+		return err
+	}
+
+	t := time.NewTicker(secretManagerPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			claims, v, err := accessSecretClaims(ctx, client, secretName)
+			if err != nil || v == version {
+				continue
+			}
+			version = v
+			onChange(claims)
+		}
+	}
+}
+
+// accessSecretClaims returns the claims stored in the secret and the resource name of the version read
+func accessSecretClaims(ctx context.Context, client *http.Client, secretName string) (*Claims, string, error) {
+	m := secretNameRegex.FindStringSubmatch(secretName)
+	if m == nil {
+		return nil, "", fmt.Errorf("secret name must be projects/<project>/secrets/<secret>[/versions/<version>], got %q", secretName)
+	}
+	name := secretName
+	if m[1] == "" {
+		name = secretName + "/versions/latest"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1/%s:access", secretManagerEndpoint, name), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to access secret %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("error response from secret manager %d: %s", resp.StatusCode, body)
+	}
+
+	v := &secretVersion{}
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, "", fmt.Errorf("error parsing secret manager response: %w", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(v.Payload.Data)
+	if err != nil {
+		return nil, "", fmt.Errorf("error decoding secret payload: %w", err)
+	}
+	if v.Payload.DataCrc32c != "" {
+		want, err := strconv.ParseUint(v.Payload.DataCrc32c, 10, 32)
+		if err != nil || crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)) != uint32(want) {
+			return nil, "", fmt.Errorf("secret %s payload failed its crc32c check", v.Name)
+		}
+	}
+	claims, err := ClaimsFromReader(bytes.NewReader(data), ConfigFormatJSON)
+	if err != nil {
+		return nil, "", fmt.Errorf("error parsing claims in secret %s: %w", v.Name, err)
+	}
+	return claims, v.Name, nil
+}
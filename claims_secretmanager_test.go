@@ -0,0 +1,151 @@
+package mds
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const secretManagerToken = "secretmanager-access-token"
+
+// secretManagerStub serves versions.access for one secret; add() stores a new latest version
+type secretManagerStub struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	versions [][]byte
+}
+
+func newSecretManagerStub(t *testing.T) *secretManagerStub {
+	s := &secretManagerStub{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+secretManagerToken {
+			http.Error(w, `{"error":{"code":401}}`, http.StatusUnauthorized)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var n int
+		switch r.URL.Path {
+		case "/v1/projects/some-project/secrets/claims/versions/latest:access":
+			n = len(s.versions)
+		case "/v1/projects/some-project/secrets/claims/versions/1:access":
+			n = 1
+		}
+		if n == 0 || n > len(s.versions) {
+			http.Error(w, `{"error":{"code":404}}`, http.StatusNotFound)
+			return
+		}
+		data := s.versions[n-1]
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name": "projects/123456/secrets/claims/versions/" + strconv.Itoa(n),
+			"payload": map[string]string{
+				"data":       base64.StdEncoding.EncodeToString(data),
+				"dataCrc32c": strconv.FormatUint(uint64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))), 10),
+			},
+		})
+	}))
+	t.Cleanup(s.Close)
+
+	endpoint, interval, creds := secretManagerEndpoint, secretManagerPollInterval, secretManagerCredentials
+	secretManagerEndpoint = s.URL
+	secretManagerPollInterval = 10 * time.Millisecond
+	secretManagerCredentials = func(ctx context.Context) (*google.Credentials, error) {
+		return secretManagerCredentialsForTest(), nil
+	}
+	t.Cleanup(func() {
+		secretManagerEndpoint, secretManagerPollInterval, secretManagerCredentials = endpoint, interval, creds
+	})
+	return s
+}
+
+func (s *secretManagerStub) add(t *testing.T, c *Claims) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versions = append(s.versions, data)
+}
+
+func secretManagerCredentialsForTest() *google.Credentials {
+	return &google.Credentials{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: secretManagerToken, Expiry: time.Now().Add(time.Hour)})}
+}
+
+func TestClaimsFromSecretManager(t *testing.T) {
+	s := newSecretManagerStub(t)
+	s.add(t, projectClaims("first-project"))
+	s.add(t, projectClaims("second-project"))
+
+	for name, want := range map[string]string{
+		"projects/some-project/secrets/claims":            "second-project",
+		"projects/some-project/secrets/claims/versions/1": "first-project",
+	} {
+		c, err := ClaimsFromSecretManager(context.Background(), name, secretManagerCredentialsForTest())
+		if err != nil {
+			t.Fatalf("%s: error reading claims %v", name, err)
+		}
+		if c.ComputeMetadata.V1.Project.ProjectID != want {
+			t.Errorf("%s: unexpected project id: got %v want %v", name, c.ComputeMetadata.V1.Project.ProjectID, want)
+		}
+	}
+
+	for _, name := range []string{"claims", "projects/some-project/secrets/missing", "projects/some-project/secrets/claims/versions/3"} {
+		if _, err := ClaimsFromSecretManager(context.Background(), name, secretManagerCredentialsForTest()); err == nil {
+			t.Errorf("expected error reading claims from %q", name)
+		}
+	}
+	if _, err := ClaimsFromSecretManager(context.Background(), "projects/some-project/secrets/claims", nil); err == nil {
+		t.Errorf("expected error for nil credentials")
+	}
+}
+
+func TestWatchSecretManager(t *testing.T) {
+	s := newSecretManagerStub(t)
+	s.add(t, projectClaims("first-project"))
+
+	changes := make(chan *Claims, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- WatchSecretManager(ctx, "projects/some-project/secrets/claims", func(c *Claims) {
+			changes <- c
+		})
+	}()
+
+	select {
+	case c := <-changes:
+		t.Fatalf("unexpected change before a new version was added: %v", c.ComputeMetadata.V1.Project.ProjectID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.add(t, projectClaims("second-project"))
+	select {
+	case c := <-changes:
+		if c.ComputeMetadata.V1.Project.ProjectID != "second-project" {
+			t.Errorf("unexpected project id: got %v want %v", c.ComputeMetadata.V1.Project.ProjectID, "second-project")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("new secret version was not noticed")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("unexpected error from WatchSecretManager: got %v want %v", err, context.Canceled)
+	}
+
+	if err := WatchSecretManager(context.Background(), "projects/some-project/secrets/missing", func(*Claims) {}); err == nil {
+		t.Errorf("expected error watching a missing secret")
+	}
+}
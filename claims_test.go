@@ -0,0 +1,237 @@
+package mds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// populate sets every field reachable from v to a non-zero value so that round trip
+// tests cover all fields in Claims, including ones added later
+func populate(v reflect.Value, seed string) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				populate(v.Field(i), fmt.Sprintf("%s-%d", seed, i))
+			}
+		}
+	case reflect.String:
+		v.SetString("value" + seed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(len(seed)) + 1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(len(seed)) + 1)
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), 2, 2)
+		for i := 0; i < s.Len(); i++ {
+			populate(s.Index(i), fmt.Sprintf("%s-%d", seed, i))
+		}
+		v.Set(s)
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for i := 0; i < 2; i++ {
+			k := reflect.New(v.Type().Key()).Elem()
+			populate(k, fmt.Sprintf("%s-key%d", seed, i))
+			e := reflect.New(v.Type().Elem()).Elem()
+			populate(e, fmt.Sprintf("%s-%d", seed, i))
+			m.SetMapIndex(k, e)
+		}
+		v.Set(m)
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		populate(p.Elem(), seed)
+		v.Set(p)
+	}
+}
+
+func TestClaimsYAMLRoundTrip(t *testing.T) {
+	expected := &Claims{}
+	populate(reflect.ValueOf(expected).Elem(), "")
+
+	y, err := ClaimsToYAML(expected)
+	if err != nil {
+		t.Fatalf("error encoding claims as yaml %v", err)
+	}
+
+	got, err := ClaimsFromReader(bytes.NewReader(y), ConfigFormatYAML)
+	if err != nil {
+		t.Fatalf("error decoding yaml claims %v", err)
+	}
+
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("yaml round trip returned unexpected claims: got %+v want %+v", got, expected)
+	}
+}
+
+func TestClaimsFromReaderFormats(t *testing.T) {
+	configData, err := os.ReadFile("config.json")
+	if err != nil {
+		t.Fatalf("error reading config.json %v", err)
+	}
+
+	fromJSON, err := ClaimsFromReader(bytes.NewReader(configData), ConfigFormatJSON)
+	if err != nil {
+		t.Fatalf("error parsing json claims %v", err)
+	}
+
+	y, err := ClaimsToYAML(fromJSON)
+	if err != nil {
+		t.Fatalf("error encoding claims as yaml %v", err)
+	}
+	fromYAML, err := ClaimsFromReader(bytes.NewReader(y), ConfigFormatYAML)
+	if err != nil {
+		t.Fatalf("error parsing yaml claims %v", err)
+	}
+
+	if !reflect.DeepEqual(fromJSON, fromYAML) {
+		t.Errorf("yaml claims do not match json claims: got %+v want %+v", fromYAML, fromJSON)
+	}
+
+	yamlConfig := `
+computeMetadata:
+  v1:
+    project:
+      projectId: some-project-id
+      numericProjectId: 123456
+`
+	c, err := ClaimsFromReader(strings.NewReader(yamlConfig), ConfigFormatYAML)
+	if err != nil {
+		t.Fatalf("error parsing yaml claims %v", err)
+	}
+	if c.ComputeMetadata.V1.Project.ProjectID != "some-project-id" || c.ComputeMetadata.V1.Project.NumericProjectID != 123456 {
+		t.Errorf("unexpected project values from yaml: got %+v", c.ComputeMetadata.V1.Project)
+	}
+
+	// TOML documents are converted with the same field names
+	var m map[string]interface{}
+	if err := json.Unmarshal(configData, &m); err != nil {
+		t.Fatal(err)
+	}
+	var tomlConfig bytes.Buffer
+	if err := toml.NewEncoder(&tomlConfig).Encode(m); err != nil {
+		t.Fatalf("error encoding claims as toml %v", err)
+	}
+	fromTOML, err := ClaimsFromReader(bytes.NewReader(tomlConfig.Bytes()), ConfigFormatTOML)
+	if err != nil {
+		t.Fatalf("error parsing toml claims %v", err)
+	}
+	if !reflect.DeepEqual(fromJSON, fromTOML) {
+		t.Errorf("toml claims do not match json claims: got %+v want %+v", fromTOML, fromJSON)
+	}
+
+	_, err = ClaimsFromReader(strings.NewReader("{}"), "xml")
+	if err == nil {
+		t.Errorf("expected error for unsupported config format")
+	}
+}
+
+func TestClaimsFromReaderTOML(t *testing.T) {
+	tomlConfig := `
+[computeMetadata.v1.project]
+projectId = "some-project-id"
+numericProjectId = 123456
+
+[computeMetadata.v1.project.attributes]
+ssh-keys = "user:ssh-ed25519 AAAA"
+
+[computeMetadata.v1.instance]
+tags = ["http-server"]
+
+[[computeMetadata.v1.instance.disks]]
+deviceName = "persistent-disk-0"
+index = 0
+`
+	jsonConfig := `{"computeMetadata":{"v1":{
+		"project":{"projectId":"some-project-id","numericProjectId":123456,"attributes":{"ssh-keys":"user:ssh-ed25519 AAAA"}},
+		"instance":{"tags":["http-server"],"disks":[{"deviceName":"persistent-disk-0","index":0}]}}}}`
+	want, err := ClaimsFromReader(strings.NewReader(jsonConfig), ConfigFormatJSON)
+	if err != nil {
+		t.Fatalf("error parsing json claims %v", err)
+	}
+
+	// the format of documents without an extension is detected from their content
+	for name, tc := range map[string]struct{ data, format string }{
+		"toml":             {tomlConfig, ConfigFormatTOML},
+		"detected toml":    {"# claims for the test VM\n" + tomlConfig, ConfigFormatAuto},
+		"detected json":    {jsonConfig, ConfigFormatAuto},
+		"detected default": {jsonConfig, ""},
+	} {
+		got, err := ClaimsFromReader(strings.NewReader(tc.data), tc.format)
+		if err != nil {
+			t.Fatalf("%s: error parsing claims %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: claims do not match json claims: got %+v want %+v", name, got, want)
+		}
+	}
+
+	_, err = ClaimsFromReader(strings.NewReader("[computeMetadata.v1.project]\nprojectId = \"some-project-id\"\nnumericProjectId = twelve\n"), ConfigFormatAuto)
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("expected toml error with the line number: got %v", err)
+	}
+}
+
+func TestConfigFormatForFile(t *testing.T) {
+	for path, want := range map[string]string{
+		"config.json":          ConfigFormatJSON,
+		"/etc/mds/config.yaml": ConfigFormatYAML,
+		"config.YML":           ConfigFormatYAML,
+		"config.toml":          ConfigFormatTOML,
+		"config":               ConfigFormatAuto,
+	} {
+		if got := ConfigFormatForFile(path); got != want {
+			t.Errorf("unexpected format for %s: got %s want %s", path, got, want)
+		}
+	}
+}
+
+func TestClaimsFromFileExpandEnv(t *testing.T) {
+	t.Setenv("PROJECT_ID", "env-project")
+	t.Setenv("ATTR_NAME", "should-not-expand")
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.json": `{"computeMetadata":{"v1":{"project":{"projectId":"${PROJECT_ID}","attributes":{"${ATTR_NAME}":"cost $$5 $${PROJECT_ID}"}}}}}`,
+		"config.yaml": "computeMetadata:\n  v1:\n    project:\n      projectId: ${PROJECT_ID}\n      attributes:\n        ${ATTR_NAME}: cost $$5 $${PROJECT_ID}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := ClaimsFromFile(path, true)
+		if err != nil {
+			t.Fatalf("%s: error parsing claims %v", name, err)
+		}
+		project := c.ComputeMetadata.V1.Project
+		if project.ProjectID != "env-project" {
+			t.Errorf("%s: projectId was not expanded: got %q", name, project.ProjectID)
+		}
+		// keys are kept and $$ is a literal $ which is not expanded again
+		if got := project.Attributes["${ATTR_NAME}"]; got != "cost $5 ${PROJECT_ID}" {
+			t.Errorf("%s: unexpected attribute: got %q", name, got)
+		}
+
+		c, err = ClaimsFromFile(path, false)
+		if err != nil {
+			t.Fatalf("%s: error parsing claims %v", name, err)
+		}
+		if got := c.ComputeMetadata.V1.Project.ProjectID; got != "${PROJECT_ID}" {
+			t.Errorf("%s: projectId was expanded without expandEnv: got %q", name, got)
+		}
+	}
+
+	if _, err := ClaimsFromFile(filepath.Join(dir, "missing.json"), true); err == nil {
+		t.Errorf("expected error for a missing config file")
+	}
+}
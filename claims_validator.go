@@ -0,0 +1,119 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	emailRegex         = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	validatorZoneRegex = regexp.MustCompile(`^[a-z]+-[a-z0-9]+-[a-z]$`)
+)
+
+// ValidationError is one problem a ClaimsValidator found with the claims
+type ValidationError struct {
+	Field   string `json:"path"` // JSON path of the offending value, eg `computeMetadata.v1.project.projectId`
+	Message string `json:"message"`
+	Value   string `json:"value"` // the offending value, empty if it is missing
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ClaimsValidator checks claims before they are served by NewMetadataServer() or UpdateClaims()
+type ClaimsValidator interface {
+	Validate(*Claims) []ValidationError
+}
+
+// WithClaimsValidator rejects claims for which v returns any ValidationError.  All errors are returned
+// together by NewMetadataServer() and UpdateClaims(), eg
+//
+//	f, err := mds.NewMetadataServer(ctx, serverConfig, creds, claims, mds.WithClaimsValidator(mds.DefaultClaimsValidator{}))
+func WithClaimsValidator(v ClaimsValidator) Option {
+	return func(h *MetadataServer) {
+		h.claimsValidator = v
+	}
+}
+
+// DefaultClaimsValidator requires a project id and a default service account with a well formed email
+// and at least one scope.  Service account scopes must be URLs and the zone, if set, must name a GCE zone.
+type DefaultClaimsValidator struct{}
+
+// Validate returns every problem found with the claims
+func (DefaultClaimsValidator) Validate(c *Claims) []ValidationError {
+	var errs []ValidationError
+	add := func(field, value, format string, a ...interface{}) {
+		errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf(format, a...), Value: value})
+	}
+
+	if c.ComputeMetadata.V1.Project.ProjectID == "" {
+		add("computeMetadata.v1.project.projectId", "", "cannot be empty")
+	}
+
+	instance := c.ComputeMetadata.V1.Instance
+	if zone := instance.Zone; zone != "" && !validatorZoneRegex.MatchString(zone[strings.LastIndex(zone, "/")+1:]) {
+		add("computeMetadata.v1.instance.zone", zone, "%q is not a zone like us-central1-a", zone)
+	}
+
+	if _, ok := instance.ServiceAccounts[defaultServiceAccount]; !ok {
+		add("computeMetadata.v1.instance.serviceAccounts.default", "", "the default service account is required")
+	}
+	aliases := make([]string, 0, len(instance.ServiceAccounts))
+	for alias := range instance.ServiceAccounts {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		sa := instance.ServiceAccounts[alias]
+		field := "computeMetadata.v1.instance.serviceAccounts." + alias
+		if sa.Email == "" {
+			add(field+".email", "", "cannot be empty")
+		} else if !emailRegex.MatchString(sa.Email) {
+			add(field+".email", sa.Email, "%q is not an email address", sa.Email)
+		}
+		if len(sa.Scopes) == 0 {
+			add(field+".scopes", "", "at least one scope is required")
+		}
+		for _, s := range sa.Scopes {
+			if u, err := url.Parse(s); err != nil || u.Scheme != "https" || u.Host == "" {
+				add(field+".scopes", s, "%q is not a scope URL", s)
+			}
+		}
+	}
+	return errs
+}
+
+// validateWith runs v on the claims and joins what it finds into one error
+func validateWith(v ClaimsValidator, c *Claims) error {
+	if v == nil {
+		return nil
+	}
+	verrs := v.Validate(c)
+	if len(verrs) == 0 {
+		return nil
+	}
+	errs := make([]error, len(verrs))
+	for i, e := range verrs {
+		errs[i] = e
+	}
+	return fmt.Errorf("invalid claims: %w", errors.Join(errs...))
+}
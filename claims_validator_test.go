@@ -0,0 +1,118 @@
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+func validatedClaims() *Claims {
+	c := projectClaims("some-project")
+	c.ComputeMetadata.V1.Instance.Zone = "projects/123456/zones/us-central1-a"
+	c.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = serviceAccountDetails{
+		Email:  "metadata-sa@some-project.iam.gserviceaccount.com",
+		Scopes: []string{cloudPlatformScope},
+	}
+	return c
+}
+
+func TestDefaultClaimsValidator(t *testing.T) {
+	if errs := (DefaultClaimsValidator{}).Validate(validatedClaims()); len(errs) != 0 {
+		t.Errorf("unexpected errors for valid claims: %v", errs)
+	}
+
+	for name, tc := range map[string]struct {
+		modify func(*Claims)
+		field  string
+	}{
+		"empty project id":   {func(c *Claims) { c.ComputeMetadata.V1.Project.ProjectID = "" }, "computeMetadata.v1.project.projectId"},
+		"invalid zone":       {func(c *Claims) { c.ComputeMetadata.V1.Instance.Zone = "projects/123456/zones/uscentral1" }, "computeMetadata.v1.instance.zone"},
+		"missing default sa": {func(c *Claims) { c.ComputeMetadata.V1.Instance.ServiceAccounts = nil }, "computeMetadata.v1.instance.serviceAccounts.default"},
+		"empty email": {func(c *Claims) {
+			c.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = serviceAccountDetails{Scopes: []string{cloudPlatformScope}}
+		}, "computeMetadata.v1.instance.serviceAccounts.default.email"},
+		"invalid email": {func(c *Claims) {
+			c.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = serviceAccountDetails{Email: "metadata-sa", Scopes: []string{cloudPlatformScope}}
+		}, "computeMetadata.v1.instance.serviceAccounts.default.email"},
+		"empty scopes": {func(c *Claims) {
+			c.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = serviceAccountDetails{Email: "metadata-sa@p.iam.gserviceaccount.com"}
+		}, "computeMetadata.v1.instance.serviceAccounts.default.scopes"},
+		"invalid scope": {func(c *Claims) {
+			c.ComputeMetadata.V1.Instance.ServiceAccounts["app"] = serviceAccountDetails{Email: "app@p.iam.gserviceaccount.com", Scopes: []string{"cloud-platform"}}
+		}, "computeMetadata.v1.instance.serviceAccounts.app.scopes"},
+	} {
+		c := validatedClaims()
+		tc.modify(c)
+		errs := (DefaultClaimsValidator{}).Validate(c)
+		if len(errs) != 1 || errs[0].Field != tc.field {
+			t.Errorf("%s: unexpected errors: got %v want one error for %s", name, errs, tc.field)
+		}
+	}
+}
+
+func TestValidationErrorJSON(t *testing.T) {
+	c := validatedClaims()
+	c.ComputeMetadata.V1.Instance.Zone = "projects/123456/zones/uscentral1"
+	errs := (DefaultClaimsValidator{}).Validate(c)
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors: got %v", errs)
+	}
+	js, err := json.Marshal(errs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"path":"computeMetadata.v1.instance.zone","message":"\"projects/123456/zones/uscentral1\" is not a zone like us-central1-a","value":"projects/123456/zones/uscentral1"}`
+	if string(js) != want {
+		t.Errorf("unexpected JSON: got %s want %s", js, want)
+	}
+}
+
+type fieldValidator []ValidationError
+
+func (v fieldValidator) Validate(*Claims) []ValidationError {
+	return v
+}
+
+func TestWithClaimsValidator(t *testing.T) {
+	// without a validator claims are not deep validated
+	if _, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, &Claims{}); err != nil {
+		t.Errorf("unexpected error without a validator %v", err)
+	}
+
+	_, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, &Claims{}, WithClaimsValidator(DefaultClaimsValidator{}))
+	if err == nil {
+		t.Fatalf("expected error for empty claims")
+	}
+	for _, want := range []string{"computeMetadata.v1.project.projectId: cannot be empty", "computeMetadata.v1.instance.serviceAccounts.default: the default service account is required"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %q: got %v", want, err)
+		}
+	}
+
+	custom := fieldValidator{{Field: "a", Message: "first"}, {Field: "b", Message: "second"}}
+	_, err = NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, validatedClaims(), WithClaimsValidator(custom))
+	if err == nil {
+		t.Fatalf("expected error from the custom validator")
+	}
+	if !strings.Contains(err.Error(), "a: first\nb: second") {
+		t.Errorf("expected every validation error to be returned: got %v", err)
+	}
+	var verr ValidationError
+	if !errors.As(err, &verr) || verr != custom[0] {
+		t.Errorf("expected error to wrap a ValidationError: got %v", err)
+	}
+
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, validatedClaims(), WithClaimsValidator(DefaultClaimsValidator{}), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	invalid := validatedClaims()
+	invalid.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = serviceAccountDetails{Email: "metadata-sa@some-project.iam.gserviceaccount.com"}
+	if err := h.UpdateClaims(invalid); err == nil {
+		t.Errorf("expected error updating claims without scopes")
+	}
+}
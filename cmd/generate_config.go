@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	mds "github.com/salrashid123/gce_metadata_server"
+)
+
+const (
+	generateConfigCommand = "generate-config"
+	defaultGenerateZone   = "us-central1-a"
+	defaultGenerateScope  = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// generateConfig implements `gce_metadata_server generate-config`, which writes a minimal config file.
+//
+// Values not provided as flags are prompted for on stdin, an empty answer keeps the default.  With -nonInteractive
+// the defaults are used instead and only -projectId and -numericProjectId are required.
+func generateConfig(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet(generateConfigCommand, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	projectID := fs.String("projectId", "", "project id")
+	numericProjectID := fs.Int64("numericProjectId", 0, "project number")
+	zone := fs.String("zone", "", "instance zone (default: "+defaultGenerateZone+")")
+	email := fs.String("serviceAccountEmail", "", "default service account email (default: metadata-sa@<projectId>.iam.gserviceaccount.com)")
+	scopes := fs.String("scopes", "", "comma separated scopes of the default service account (default: "+defaultGenerateScope+")")
+	output := fs.String("output", "", "write the config to this file instead of stdout")
+	nonInteractive := fs.Bool("nonInteractive", false, "do not prompt for values which are not set as flags")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	p := &prompter{in: bufio.NewReader(stdin), out: stderr}
+	ask := func(name, label, def string, dst *string) error {
+		if set[name] || *nonInteractive {
+			if *dst == "" {
+				*dst = def
+			}
+			return nil
+		}
+		v, err := p.ask(label, def)
+		*dst = v
+		return err
+	}
+
+	if err := ask("projectId", "Project ID", "", projectID); err != nil {
+		return err
+	}
+	number := ""
+	if *numericProjectID != 0 {
+		number = strconv.FormatInt(*numericProjectID, 10)
+	}
+	if err := ask("numericProjectId", "Project number", number, &number); err != nil {
+		return err
+	}
+	if number != "" {
+		n, err := strconv.ParseInt(number, 10, 64)
+		if err != nil {
+			return fmt.Errorf("project number must be an integer, got %q", number)
+		}
+		*numericProjectID = n
+	}
+	if err := ask("zone", "Zone", defaultGenerateZone, zone); err != nil {
+		return err
+	}
+	defaultEmail := ""
+	if *projectID != "" {
+		defaultEmail = fmt.Sprintf("metadata-sa@%s.iam.gserviceaccount.com", *projectID)
+	}
+	if err := ask("serviceAccountEmail", "Service account email", defaultEmail, email); err != nil {
+		return err
+	}
+	if err := ask("scopes", "Scopes (comma separated)", defaultGenerateScope, scopes); err != nil {
+		return err
+	}
+
+	var scopeList []string
+	for _, s := range strings.Split(*scopes, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scopeList = append(scopeList, s)
+		}
+	}
+	claims, err := mds.NewClaimsBuilder().
+		ProjectID(*projectID).
+		NumericProjectID(*numericProjectID).
+		Zone(*zone).
+		DefaultServiceAccount(*email, scopeList...).
+		Build()
+	if err != nil {
+		return err
+	}
+	if verrs := (mds.DefaultClaimsValidator{}).Validate(claims); len(verrs) > 0 {
+		errs := make([]error, 0, len(verrs))
+		for _, e := range verrs {
+			errs = append(errs, e)
+		}
+		return fmt.Errorf("invalid claims: %w", errors.Join(errs...))
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(pruneZeroValues(doc), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if *output == "" {
+		_, err = stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "Wrote %s\n", *output)
+	return nil
+}
+
+// pruneZeroValues drops the empty values of a decoded JSON document so only the values that were set are written
+func pruneZeroValues(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if e = pruneZeroValues(e); e == nil {
+				delete(t, k)
+			} else {
+				t[k] = e
+			}
+		}
+		if len(t) == 0 {
+			return nil
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			return nil
+		}
+	case string:
+		if t == "" {
+			return nil
+		}
+	case float64:
+		if t == 0 {
+			return nil
+		}
+	case bool:
+		if !t {
+			return nil
+		}
+	}
+	return v
+}
+
+// prompter asks for one value per line, falling back to a default for empty answers
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p *prompter) ask(label, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", label, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", label)
+	}
+	// the remaining questions take their defaults once stdin is closed
+	line, err := p.in.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("error reading %s: %w", strings.ToLower(label), err)
+	}
+	if v := strings.TrimSpace(line); v != "" {
+		return v, nil
+	}
+	return def, nil
+}
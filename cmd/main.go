@@ -2,17 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/golang/glog"
 	"github.com/google/go-tpm/legacy/tpm2"
 	"github.com/google/go-tpm/tpmutil"
@@ -27,41 +31,113 @@ var (
 	bindInterface      = flag.String("interface", "127.0.0.1", "interface address to bind to")
 	port               = flag.String("port", ":8080", "port...")
 	useDomainSocket    = flag.String("domainsocket", "", "listen only on unix socket")
+	tlsCert            = flag.String("tlsCert", "", "PEM certificate to serve the metadata listener with TLS")
+	tlsKey             = flag.String("tlsKey", "", "PEM private key for --tlsCert")
 	serviceAccountFile = flag.String("serviceAccountFile", "", "serviceAccountFile...")
-	configFile         = flag.String("configFile", "config.json", "config file")
+	configFile         = flag.String("configFile", "config.json", "config file (.json, .yaml or .yml)")
+	configFormat       = flag.String("config-format", "", "format of --configFile: json, yaml, toml or auto (default: from the file extension, else detected from its content)")
+	expandConfigEnv    = flag.Bool("expandConfigEnv", false, "expand ${VAR} environment variables in the string values of --configFile; $$ is a literal $")
+	watchConfig        = flag.Bool("watchConfig", true, "reload --configFile whenever it is written; --watchConfig=false only reloads it on SIGHUP")
 	useImpersonate     = flag.Bool("impersonate", false, "Impersonate a service Account instead of using the keyfile")
 	useFederate        = flag.Bool("federate", false, "Use Workload Identity Federation ADC")
 	allowDynamicScopes = flag.Bool("allowDynamicScopes", false, "Allow dynamic scopes for access_token")
 	useTPM             = flag.Bool("tpm", false, "Use TPM to get access and id_token")
+	credentialCommand  = flag.String("credentialCommand", "", "Run this command to get an access_token (printed as oauth2.Token JSON to stdout); a JSON array of arguments, eg '[\"helper\", \"--arg\", \"a b\"]', or arguments separated by spaces without quoting")
+	tokenTTL           = flag.Duration("tokenTTL", 0, "report access_tokens to expire after at most this duration")
 	tpmPath            = flag.String("tpm-path", "/dev/tpm0", "Path to the TPM device (character device or a Unix socket).")
 	persistentHandle   = flag.Int("persistentHandle", 0x81008000, "Handle value")
 
+	domainSocketMode = flag.String("domainsocketMode", "0660", "Octal permissions of the --domainsocket file")
+
+	enforceMetadataFlavor   = flag.Bool("enforceMetadataFlavor", true, "Reject requests without the Metadata-Flavor: Google header")
+	allowArbitraryProjectID = flag.Bool("allowArbitraryProjectID", false, "Accept project ids which do not follow the GCP naming rules")
+
+	readHeaderTimeout = flag.Duration("readHeaderTimeout", 0, "Time to read request headers; negative disables the timeout (default 5s)")
+	readTimeout       = flag.Duration("readTimeout", 0, "Time to read a whole request; negative disables the timeout (default 10s)")
+	writeTimeout      = flag.Duration("writeTimeout", 0, "Time to write a response; negative disables the timeout (default 30s)")
+
+	skipPrefetch         = flag.Bool("skipPrefetch", false, "Do not fetch a token to check the credentials at startup")
+	impersonateDelegates = flag.String("impersonate-delegates", "", "Comma separated list of service accounts in the delegation chain used with --impersonate")
+
+	pkcs11LibPath  = flag.String("pkcs11LibPath", "", "Path to a PKCS#11 module holding the service account key (eg /usr/lib/softhsm/libsofthsm2.so)")
+	pkcs11SlotID   = flag.Uint("pkcs11SlotID", 0, "PKCS#11 slot of the token holding the key")
+	pkcs11PIN      = flag.String("pkcs11PIN", "", "PKCS#11 user PIN")
+	pkcs11KeyLabel = flag.String("pkcs11KeyLabel", "", "CKA_LABEL of the service account private key on the PKCS#11 token")
+
+	kubernetesSATokenFile   = flag.String("kubernetesSATokenFile", "", "Projected Kubernetes service account token to exchange for federated access_tokens (eg /var/run/secrets/tokens/gcp-ksa-token)")
+	kubernetesTokenAudience = flag.String("kubernetesTokenAudience", "", "STS audience of the workload identity provider to exchange the Kubernetes token with")
+
+	tokenFilePath = flag.String("tokenFilePath", "", "Serve the JWT in this file as the access_token, eg /var/run/secrets/kubernetes.io/serviceaccount/token")
+
 	metricsEnabled   = flag.Bool("metricsEnabled", false, "Enable prometheus metrics endpoint")
 	metricsInterface = flag.String("metricsInterface", "127.0.0.1", "metrics interface address to bind to")
 	metricsPort      = flag.String("metricsPort", "9000", "metrics port to bind to")
 	metricsPath      = flag.String("metricsPath", "/metrics", "metrics path to use")
 
+	pathPrefix = flag.String("pathPrefix", "", "serve the metadata paths and the admin API below this path, eg /gce-metadata")
+
+	adminInterface = flag.String("adminInterface", "127.0.0.1", "admin API interface address to bind to")
+	adminPort      = flag.String("adminPort", "", "serve the admin API on this port (disabled if empty)")
+	adminToken     = flag.String("adminToken", "", "bearer token required for admin API requests")
+
+	grpcPort = flag.String("grpcPort", "", "also serve the gRPC metadata API on this port of --interface (disabled if empty)")
+
+	requiredBearerToken    = flag.String("requiredBearerToken", "", "bearer token required for metadata requests (disabled if empty)")
+	bearerTokenExemptPaths = flag.String("bearerTokenExemptPaths", "", "comma separated path patterns served without --requiredBearerToken (eg /healthz,/computeMetadata/v1/instance/service-accounts/*/identity)")
+
 	pcrs = flag.String("pcrs", "", "PCR Bound value (increasing order, comma separated)")
+
+	recordDir = flag.String("recordDir", "", "proxy requests to the real metadata server and save responses to this directory")
+	replayDir = flag.String("replayDir", "", "serve responses previously saved with --recordDir from this directory")
+
+	proxyTo = flag.String("proxyTo", "", "forward all requests unmodified to this metadata server (eg http://metadata.google.internal)")
+
+	idTokenSigningKey = flag.String("idTokenSigningKey", "", "PEM encoded RSA or EC private key to sign id_tokens locally with")
+	idTokenKMSKey     = flag.String("idTokenKMSKey", "", "Cloud KMS key version to sign id_tokens with (projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*)")
+
+	accessLog = flag.String("accessLog", "", "append JSON access log lines to this file (- for stdout)")
+
+	shutdownTimeout = flag.Duration("shutdownTimeout", 10*time.Second, "time to drain in-flight requests on shutdown")
+
+	printSchema  = flag.Bool("print-schema", false, "print the JSON schema of the config file and exit")
+	validateOnly = flag.Bool("validate-only", false, "validate --configFile, print each error as a JSON line to stderr and exit with 1 if it is invalid")
 )
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == generateConfigCommand {
+		err := generateConfig(os.Args[2:], os.Stdin, os.Stdout, os.Stderr)
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "Error generating config: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flag.Parse()
+	if *printSchema {
+		os.Stdout.Write(mds.ClaimsJSONSchema())
+		return
+	}
+	if *validateOnly {
+		if !validateConfig(*configFile, *configFormat, *expandConfigEnv, os.Stderr) {
+			os.Exit(1)
+		}
+		return
+	}
+	envConfig, err := applyEnvConfig()
+	if err != nil {
+		glog.Errorf("Error reading environment: %v\n", err)
+		os.Exit(1)
+	}
 
 	ctx := context.Background()
 
 	glog.Infof("Starting GCP metadataserver")
 
-	configData, err := os.ReadFile(*configFile)
+	claims, err := mds.ClaimsFromFileFormat(*configFile, *configFormat, *expandConfigEnv)
 	if err != nil {
-		glog.Errorf("Error reading config data file: %v\n", err)
-		os.Exit(-1)
-	}
-
-	claims := &mds.Claims{}
-	err = json.Unmarshal(configData, claims)
-	if err != nil {
-		glog.Errorf("Error parsing json: %v\n", err)
+		glog.Errorf("Error parsing config file: %v\n", err)
 		os.Exit(-1)
 	}
 
@@ -87,12 +163,43 @@ func main() {
 		os.Exit(-1)
 	}
 
+	var delegates []string
+	if *impersonateDelegates != "" {
+		if !*useImpersonate {
+			glog.Errorf("--impersonate-delegates requires --impersonate")
+			os.Exit(1)
+		}
+		for _, d := range strings.Split(*impersonateDelegates, ",") {
+			delegates = append(delegates, strings.TrimSpace(d))
+		}
+	}
+
+	var exemptPaths []string
+	if *bearerTokenExemptPaths != "" {
+		for _, p := range strings.Split(*bearerTokenExemptPaths, ",") {
+			exemptPaths = append(exemptPaths, strings.TrimSpace(p))
+		}
+	}
+
+	commandArgs, err := mds.ParseCredentialCommand(*credentialCommand)
+	if err != nil {
+		glog.Errorf("--credentialCommand: %v", err)
+		os.Exit(1)
+	}
+
+	socketMode, err := strconv.ParseUint(*domainSocketMode, 8, 32)
+	if err != nil {
+		glog.Errorf("--domainsocketMode must be an octal file mode: %v", err)
+		os.Exit(1)
+	}
+
 	if *useImpersonate {
 		glog.Infoln("Using Service Account Impersonation")
 
 		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
 			TargetPrincipal: claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Email,
 			Scopes:          claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Scopes,
+			Delegates:       delegates,
 		})
 		if err != nil {
 			glog.Errorf("Unable to create Impersonated TokenSource %v ", err)
@@ -152,6 +259,14 @@ func main() {
 			ProjectID:   claims.ComputeMetadata.V1.Project.ProjectID,
 			TokenSource: ts,
 		}
+	} else if *pkcs11LibPath != "" {
+		glog.Infof("Using PKCS#11 module %s", *pkcs11LibPath)
+	} else if *kubernetesSATokenFile != "" {
+		glog.Infof("Using Kubernetes service account token %s", *kubernetesSATokenFile)
+	} else if *tokenFilePath != "" {
+		glog.Infof("Using token file %s", *tokenFilePath)
+	} else if *credentialCommand != "" {
+		glog.Infof("Using credential command %s", *credentialCommand)
 	} else {
 
 		glog.Infoln("Using serviceAccountFile for credentials")
@@ -187,6 +302,47 @@ func main() {
 
 	}
 
+	var signingKey crypto.Signer
+	if *idTokenSigningKey != "" {
+		signingKey, err = readSigningKey(*idTokenSigningKey)
+		if err != nil {
+			glog.Errorf("Unable to read idTokenSigningKey %v", err)
+			os.Exit(1)
+		}
+	}
+	if *idTokenKMSKey != "" {
+		if signingKey != nil {
+			glog.Error("idTokenSigningKey and idTokenKMSKey cannot both be set")
+			os.Exit(1)
+		}
+		kmsCreds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+		if err != nil {
+			glog.Errorf("Unable to find credentials for Cloud KMS %v", err)
+			os.Exit(1)
+		}
+		signingKey, err = mds.NewKMSTokenSigner(ctx, mds.KMSConfig{
+			KeyVersion:  *idTokenKMSKey,
+			Credentials: kmsCreds,
+		})
+		if err != nil {
+			glog.Errorf("Unable to initialize Cloud KMS signer %v", err)
+			os.Exit(1)
+		}
+	}
+
+	var accessLogWriter io.Writer
+	if *accessLog == "-" {
+		accessLogWriter = os.Stdout
+	} else if *accessLog != "" {
+		f, err := os.OpenFile(*accessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			glog.Errorf("Unable to open accessLog %v", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		accessLogWriter = f
+	}
+
 	serverConfig := &mds.ServerConfig{
 		BindInterface:      *bindInterface,
 		Port:               *port,
@@ -194,83 +350,275 @@ func main() {
 		Federate:           *useFederate,
 		AllowDynamicScopes: *allowDynamicScopes,
 		DomainSocket:       *useDomainSocket,
+		TLSCertFile:        *tlsCert,
+		TLSKeyFile:         *tlsKey,
 		UseTPM:             *useTPM,
 		TPMPath:            *tpmPath,
 		PersistentHandle:   *persistentHandle,
 		PCRs:               pcrList,
 
+		ImpersonateDelegates: delegates,
+
+		PKCS11LibPath:  *pkcs11LibPath,
+		PKCS11SlotID:   *pkcs11SlotID,
+		PKCS11PIN:      *pkcs11PIN,
+		PKCS11KeyLabel: *pkcs11KeyLabel,
+
+		KubernetesSATokenFile:   *kubernetesSATokenFile,
+		KubernetesTokenAudience: *kubernetesTokenAudience,
+
+		TokenFilePath: *tokenFilePath,
+
 		MetricsEnabled:   *metricsEnabled,
 		MetricsInterface: *metricsInterface,
 		MetricsPort:      *metricsPort,
 		MetricsPath:      *metricsPath,
-	}
 
-	f, err := mds.NewMetadataServer(ctx, serverConfig, creds, claims)
-	if err != nil {
-		glog.Errorf("Error creating metadata server %v\n", err)
-		os.Exit(1)
+		PathPrefix: *pathPrefix,
+
+		AdminInterface: *adminInterface,
+		AdminPort:      *adminPort,
+		AdminToken:     *adminToken,
+
+		GRPCPort: *grpcPort,
+
+		RequiredBearerToken:    *requiredBearerToken,
+		BearerTokenExemptPaths: exemptPaths,
+
+		CredentialCommand:            commandArgs,
+		CredentialCommandExpiryDelta: envConfig.CredentialCommandExpiryDelta,
+		TokenTTL:                     *tokenTTL,
+
+		SkipPrefetch: *skipPrefetch,
+
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+
+		DomainSocketMode: os.FileMode(socketMode),
+
+		EnforceMetadataFlavor:   enforceMetadataFlavor,
+		AllowArbitraryProjectID: *allowArbitraryProjectID,
+		ExpandConfigEnv:         *expandConfigEnv,
+		ConfigFormat:            *configFormat,
+
+		RecordDir:      *recordDir,
+		RecordUpstream: envConfig.RecordUpstream,
+		ReplayDir:      *replayDir,
+
+		ProxyTo: *proxyTo,
+
+		IDTokenSigningKey: signingKey,
+
+		AccessLog: accessLogWriter,
 	}
 
-	watcher, err := fsnotify.NewWatcher()
+	var f metadataServer
+	if *grpcPort != "" {
+		f, err = mds.NewGRPCMetadataServer(ctx, serverConfig, creds, claims)
+	} else {
+		f, err = mds.NewMetadataServer(ctx, serverConfig, creds, claims)
+	}
 	if err != nil {
-		glog.Errorf("Error creating file watcher: %v\n", err)
+		glog.Errorf("Error creating metadata server %v\n", err)
 		os.Exit(1)
 	}
-	defer watcher.Close()
 
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-
-				if event.Has(fsnotify.Write) {
-					if event.Name == *configFile {
-						time.Sleep(8 * time.Millisecond) // https://github.com/fsnotify/fsnotify/issues/372
-						configData, err := os.ReadFile(*configFile)
-						if err != nil {
-							glog.Errorf("Error reading configFile: %v\n", err)
-							return
-						}
-
-						claims := &mds.Claims{}
-						err = json.Unmarshal(configData, claims)
-						if err != nil {
-							glog.Errorf("Error parsing json: %v\n", err)
-							return
-						}
-						f.Claims = *claims
-					}
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				glog.Errorf("Error on filewatcher %v\n", err)
-			}
+	if *watchConfig {
+		if err := f.AttachConfigWatcher(*configFile); err != nil {
+			glog.Errorf("Error watching configFile: %v\n", err)
+			os.Exit(1)
 		}
-	}()
-
-	err = watcher.Add(filepath.Dir(*configFile))
-	if err != nil {
-		glog.Errorf("Error watching configFile: %v\n", err)
-		os.Exit(1)
 	}
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			// errors are logged by the server and the previous claims stay active
+			f.ReloadConfigFile(*configFile)
+		}
+	}()
+
 	err = f.Start()
 	if err != nil {
 		glog.Errorf("Error starting %v\n", err)
 		os.Exit(1)
 	}
 	<-done
-	err = f.Shutdown()
+	shutdownCtx, cancel := context.WithTimeout(ctx, *shutdownTimeout)
+	defer cancel()
+	err = f.ShutdownContext(shutdownCtx)
 	if err != nil {
 		glog.Errorf("Error stopping %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// metadataServer is implemented by *mds.MetadataServer and *mds.GRPCMetadataServer
+type metadataServer interface {
+	AttachConfigWatcher(path string) error
+	ReloadConfigFile(path string) error
+	Start() error
+	ShutdownContext(ctx context.Context) error
+}
+
+// readSigningKey parses a PKCS#1, PKCS#8 or SEC 1 EC private key from a PEM file
+func readSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", k)
+	}
+	return signer, nil
+}
+
+// validateConfig implements --validate-only.  Parse errors and problems found by mds.DefaultClaimsValidator are
+// written to w as one JSON object per line with the path, message and value of the error; it returns false if any were found.
+func validateConfig(path, format string, expandEnv bool, w io.Writer) bool {
+	var verrs []mds.ValidationError
+	claims, err := mds.ClaimsFromFileFormat(path, format, expandEnv)
+	if err != nil {
+		verrs = append(verrs, mds.ValidationError{Message: err.Error()})
+	} else {
+		verrs = mds.DefaultClaimsValidator{}.Validate(claims)
+	}
+
+	enc := json.NewEncoder(w)
+	for _, e := range verrs {
+		enc.Encode(e)
+	}
+	return len(verrs) == 0
+}
+
+// applyEnvConfig sets each flag which was not passed on the command line to its GCE_MDS_* environment variable, if set.
+// The returned config also holds the fields which have no flag.
+func applyEnvConfig() (*mds.ServerConfig, error) {
+	env, err := mds.ServerConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	fromEnv := func(name, envName string) bool {
+		_, ok := os.LookupEnv(envName)
+		return ok && !explicit[name]
+	}
+
+	for _, f := range []struct {
+		name, env string
+		dst, val  *string
+	}{
+		{"interface", mds.EnvBindInterface, bindInterface, &env.BindInterface},
+		{"port", mds.EnvPort, port, &env.Port},
+		{"domainsocket", mds.EnvDomainSocket, useDomainSocket, &env.DomainSocket},
+		{"tlsCert", mds.EnvTLSCertFile, tlsCert, &env.TLSCertFile},
+		{"tlsKey", mds.EnvTLSKeyFile, tlsKey, &env.TLSKeyFile},
+		{"tpm-path", mds.EnvTPMPath, tpmPath, &env.TPMPath},
+		{"pkcs11LibPath", mds.EnvPKCS11LibPath, pkcs11LibPath, &env.PKCS11LibPath},
+		{"pkcs11PIN", mds.EnvPKCS11PIN, pkcs11PIN, &env.PKCS11PIN},
+		{"pkcs11KeyLabel", mds.EnvPKCS11KeyLabel, pkcs11KeyLabel, &env.PKCS11KeyLabel},
+		{"kubernetesSATokenFile", mds.EnvKubernetesSATokenFile, kubernetesSATokenFile, &env.KubernetesSATokenFile},
+		{"kubernetesTokenAudience", mds.EnvKubernetesTokenAudience, kubernetesTokenAudience, &env.KubernetesTokenAudience},
+		{"tokenFilePath", mds.EnvTokenFilePath, tokenFilePath, &env.TokenFilePath},
+		{"metricsInterface", mds.EnvMetricsInterface, metricsInterface, &env.MetricsInterface},
+		{"metricsPort", mds.EnvMetricsPort, metricsPort, &env.MetricsPort},
+		{"metricsPath", mds.EnvMetricsPath, metricsPath, &env.MetricsPath},
+		{"pathPrefix", mds.EnvPathPrefix, pathPrefix, &env.PathPrefix},
+		{"adminInterface", mds.EnvAdminInterface, adminInterface, &env.AdminInterface},
+		{"adminPort", mds.EnvAdminPort, adminPort, &env.AdminPort},
+		{"adminToken", mds.EnvAdminToken, adminToken, &env.AdminToken},
+		{"grpcPort", mds.EnvGRPCPort, grpcPort, &env.GRPCPort},
+		{"requiredBearerToken", mds.EnvRequiredBearerToken, requiredBearerToken, &env.RequiredBearerToken},
+		{"recordDir", mds.EnvRecordDir, recordDir, &env.RecordDir},
+		{"replayDir", mds.EnvReplayDir, replayDir, &env.ReplayDir},
+		{"proxyTo", mds.EnvProxyTo, proxyTo, &env.ProxyTo},
+	} {
+		if fromEnv(f.name, f.env) {
+			*f.dst = *f.val
+		}
+	}
+	for _, f := range []struct {
+		name, env string
+		dst, val  *bool
+	}{
+		{"impersonate", mds.EnvImpersonate, useImpersonate, &env.Impersonate},
+		{"federate", mds.EnvFederate, useFederate, &env.Federate},
+		{"allowDynamicScopes", mds.EnvAllowDynamicScopes, allowDynamicScopes, &env.AllowDynamicScopes},
+		{"tpm", mds.EnvUseTPM, useTPM, &env.UseTPM},
+		{"skipPrefetch", mds.EnvSkipPrefetch, skipPrefetch, &env.SkipPrefetch},
+		{"allowArbitraryProjectID", mds.EnvAllowArbitraryProjectID, allowArbitraryProjectID, &env.AllowArbitraryProjectID},
+		{"expandConfigEnv", mds.EnvExpandConfigEnv, expandConfigEnv, &env.ExpandConfigEnv},
+		{"metricsEnabled", mds.EnvMetricsEnabled, metricsEnabled, &env.MetricsEnabled},
+	} {
+		if fromEnv(f.name, f.env) {
+			*f.dst = *f.val
+		}
+	}
+
+	if fromEnv("enforceMetadataFlavor", mds.EnvEnforceMetadataFlavor) && env.EnforceMetadataFlavor != nil {
+		*enforceMetadataFlavor = *env.EnforceMetadataFlavor
+	}
+	if fromEnv("domainsocketMode", mds.EnvDomainSocketMode) {
+		*domainSocketMode = strconv.FormatUint(uint64(env.DomainSocketMode), 8)
+	}
+	if fromEnv("impersonate-delegates", mds.EnvImpersonateDelegates) {
+		*impersonateDelegates = strings.Join(env.ImpersonateDelegates, ",")
+	}
+	if fromEnv("bearerTokenExemptPaths", mds.EnvBearerTokenExemptPaths) {
+		*bearerTokenExemptPaths = strings.Join(env.BearerTokenExemptPaths, ",")
+	}
+	if fromEnv("pcrs", mds.EnvPCRs) {
+		pcrList := make([]string, len(env.PCRs))
+		for i, p := range env.PCRs {
+			pcrList[i] = strconv.Itoa(p)
+		}
+		*pcrs = strings.Join(pcrList, ",")
+	}
+	if fromEnv("persistentHandle", mds.EnvPersistentHandle) {
+		*persistentHandle = env.PersistentHandle
+	}
+	if fromEnv("pkcs11SlotID", mds.EnvPKCS11SlotID) {
+		*pkcs11SlotID = env.PKCS11SlotID
+	}
+	if fromEnv("credentialCommand", mds.EnvCredentialCommand) {
+		// as a JSON array so arguments with spaces are kept
+		args, _ := json.Marshal(env.CredentialCommand)
+		*credentialCommand = string(args)
+	}
+	if fromEnv("tokenTTL", mds.EnvTokenTTL) {
+		*tokenTTL = env.TokenTTL
+	}
+	if fromEnv("readHeaderTimeout", mds.EnvReadHeaderTimeout) {
+		*readHeaderTimeout = env.ReadHeaderTimeout
+	}
+	if fromEnv("readTimeout", mds.EnvReadTimeout) {
+		*readTimeout = env.ReadTimeout
+	}
+	if fromEnv("writeTimeout", mds.EnvWriteTimeout) {
+		*writeTimeout = env.WriteTimeout
+	}
+	return env, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configWatchDebounce is how long a config file must be left alone after a change before it is read again;
+// editors and `cp` often write a file in several steps
+var configWatchDebounce = 100 * time.Millisecond
+
+// WatchConfigFile calls onChange with the claims parsed from the config file, or the error reading it, every
+// time the file is written.  The format follows the file extension as with ConfigFormatForFile().
+//
+// The directory of the file is watched so that editors which replace the file are noticed too.  Events less
+// than 100ms apart are coalesced into one call.  The returned function stops watching.
+func WatchConfigFile(path string, onChange func(*Claims, error)) (func(), error) {
+	return watchConfigFile(path, "", false, onChange)
+}
+
+// watchConfigFile is WatchConfigFile() parsing the file in format, or the one of its extension if empty, and
+// expanding environment variables if expandEnv is set
+func watchConfigFile(path, format string, expandEnv bool, onChange func(*Claims, error)) (func(), error) {
+	if onChange == nil {
+		return nil, errors.New("onChange cannot be nil")
+	}
+	path = filepath.Clean(path)
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error creating file watcher: %w", err)
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("error watching %s: %w", path, err)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer w.Close()
+		var timer *time.Timer
+		var fire <-chan time.Time
+		for {
+			select {
+			case <-done:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path || !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.NewTimer(configWatchDebounce)
+				fire = timer.C
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				onChange(nil, fmt.Errorf("error watching %s: %w", path, err))
+			case <-fire:
+				fire = nil
+				onChange(ClaimsFromFileFormat(path, format, expandEnv))
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}, nil
+}
+
+// AttachConfigWatcher reloads the claims with UpdateClaims() every time the config file at path is written,
+// in ServerConfig.ConfigFormat and expanding environment variables if ServerConfig.ExpandConfigEnv is set.  Files which cannot be parsed and invalid claims are logged and the previous claims keep being served.
+// The watcher is stopped by Shutdown().
+func (h *MetadataServer) AttachConfigWatcher(path string) error {
+	stop, err := watchConfigFile(path, h.ServerConfig.ConfigFormat, h.ServerConfig.ExpandConfigEnv, func(c *Claims, err error) {
+		h.applyConfigFile(path, c, err)
+	})
+	if err != nil {
+		return err
+	}
+	h.watchMutex.Lock()
+	h.configWatchers = append(h.configWatchers, stop)
+	h.watchMutex.Unlock()
+	return nil
+}
+
+// ReloadConfigFile replaces the claims with the ones in the config file at path, eg when the emulator receives a
+// SIGHUP.  If the file cannot be parsed or UpdateClaims() rejects the claims, the error is logged and returned and
+// the previous claims keep being served.
+func (h *MetadataServer) ReloadConfigFile(path string) error {
+	c, err := ClaimsFromFileFormat(path, h.ServerConfig.ConfigFormat, h.ServerConfig.ExpandConfigEnv)
+	err = h.applyConfigFile(path, c, err)
+	h.metrics.configReloaded(err)
+	return err
+}
+
+// applyConfigFile serves the claims read from the config file at path
+func (h *MetadataServer) applyConfigFile(path string, c *Claims, err error) error {
+	if err == nil {
+		err = h.UpdateClaims(c)
+	}
+	if err != nil {
+		h.log().Error("Error reloading config file", "path", path, "error", err)
+		return err
+	}
+	h.log().Info("Reloaded config file", "path", path)
+	return nil
+}
+
+// stopConfigWatchers stops the watchers started by AttachConfigWatcher()
+func (h *MetadataServer) stopConfigWatchers() {
+	h.watchMutex.Lock()
+	defer h.watchMutex.Unlock()
+	for _, stop := range h.configWatchers {
+		stop()
+	}
+	h.configWatchers = nil
+}
@@ -0,0 +1,172 @@
+package mds
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func writeConfigFile(t *testing.T, path string, c *Claims) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfigFile(t, path, projectClaims("first-project"))
+
+	type change struct {
+		claims *Claims
+		err    error
+	}
+	changes := make(chan change, 10)
+	stop, err := WatchConfigFile(path, func(c *Claims, err error) {
+		changes <- change{c, err}
+	})
+	if err != nil {
+		t.Fatalf("error watching config file %v", err)
+	}
+	defer stop()
+
+	// several writes in quick succession are reloaded once
+	for _, id := range []string{"second-project", "third-project", "fourth-project"} {
+		writeConfigFile(t, path, projectClaims(id))
+	}
+	select {
+	case c := <-changes:
+		if c.err != nil || c.claims.ComputeMetadata.V1.Project.ProjectID != "fourth-project" {
+			t.Errorf("unexpected change: got %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("config file change was not noticed")
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected second change for one burst of writes: %+v", c)
+	case <-time.After(3 * configWatchDebounce):
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-changes:
+		if c.err == nil {
+			t.Errorf("expected error for an unparseable config file")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("config file change was not noticed")
+	}
+
+	stop()
+	writeConfigFile(t, path, projectClaims("fifth-project"))
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected change after stop: %+v", c)
+	case <-time.After(3 * configWatchDebounce):
+	}
+
+	if _, err := WatchConfigFile(filepath.Join(t.TempDir(), "missing", "config.json"), func(*Claims, error) {}); err == nil {
+		t.Errorf("expected error watching a file in a missing directory")
+	}
+}
+
+func TestAttachConfigWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfigFile(t, path, projectClaims("first-project"))
+
+	logger := &recordingLogger{}
+	s := NewTestMetadataServer(t, projectClaims("first-project"), WithLogger(logger))
+	if err := s.AttachConfigWatcher(path); err != nil {
+		t.Fatalf("error attaching config watcher %v", err)
+	}
+
+	projectID := func() string {
+		_, body, err := getMetadata(s.URL() + "/computeMetadata/v1/project/project-id")
+		if err != nil {
+			t.Fatalf("error getting project id %v", err)
+		}
+		return body
+	}
+	waitFor := func(want string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for projectID() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("server did not serve the reloaded project id %s", want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	writeConfigFile(t, path, projectClaims("second-project"))
+	waitFor("second-project")
+
+	// claims rejected by UpdateClaims are logged and the previous claims are kept
+	writeConfigFile(t, path, &Claims{})
+	logged := func() bool {
+		logger.mu.Lock()
+		defer logger.mu.Unlock()
+		for _, e := range logger.entries {
+			if e.level == "error" && e.msg == "Error reloading config file" {
+				return true
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !logged() {
+		if time.Now().After(deadline) {
+			t.Fatalf("invalid config file was not logged")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := projectID(); got != "second-project" {
+		t.Errorf("unexpected project id after an invalid config file: got %v want %v", got, "second-project")
+	}
+
+	if err := NewTestMetadataServer(t, nil).AttachConfigWatcher(filepath.Join(t.TempDir(), "missing", "config.json")); err == nil {
+		t.Errorf("expected error attaching a watcher to a missing directory")
+	}
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfigFile(t, path, projectClaims("second-project"))
+
+	reg := prometheus.NewRegistry()
+	s := NewTestMetadataServer(t, projectClaims("first-project"), WithLogger(&recordingLogger{}), EnableMetrics("", reg))
+	if err := s.ReloadConfigFile(path); err != nil {
+		t.Fatalf("error reloading config file %v", err)
+	}
+	if _, body, err := getMetadata(s.URL() + "/computeMetadata/v1/project/project-id"); err != nil || body != "second-project" {
+		t.Errorf("unexpected project id after reload: got %v %v", body, err)
+	}
+
+	// unparseable files, invalid claims and missing files keep the previous claims
+	writeConfigFile(t, path, &Claims{})
+	for _, p := range []string{path, filepath.Join(t.TempDir(), "missing.json")} {
+		if err := s.ReloadConfigFile(p); err == nil {
+			t.Errorf("%s: expected error reloading the config file", p)
+		}
+	}
+	if _, body, err := getMetadata(s.URL() + "/computeMetadata/v1/project/project-id"); err != nil || body != "second-project" {
+		t.Errorf("unexpected project id after a failed reload: got %v %v", body, err)
+	}
+
+	if got := testutil.ToFloat64(s.metrics.configReloads.WithLabelValues("success")); got != 1 {
+		t.Errorf("unexpected successful reloads: got %v want 1", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.configReloads.WithLabelValues("error")); got != 2 {
+		t.Errorf("unexpected failed reloads: got %v want 2", got)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultCredentialCommandExpiryDelta = 10 * time.Second
+)
+
+// ParseCredentialCommand returns the arguments of a credential command given as one string, eg in
+// GCE_MDS_CREDENTIAL_COMMAND or --credentialCommand.  A JSON array is used as is, eg `["helper", "--arg", "a b"]`;
+// anything else is split on white space, without quoting.
+func ParseCredentialCommand(v string) ([]string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(v), "[") {
+		return strings.Fields(v), nil
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(v), &args); err != nil {
+		return nil, fmt.Errorf("credential command must be a JSON array of strings: %w", err)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("credential command cannot be an empty array")
+	}
+	return args, nil
+}
+
+// ExternalCommandTokenSource is an oauth2.TokenSource which runs an external command to acquire tokens.
+//
+// The command must print an oauth2.Token as JSON to stdout, eg
+//
+//	{"access_token": "ya29...", "token_type": "Bearer", "expiry": "2024-01-01T00:00:00Z"}
+//
+// `expires_in` (seconds) is accepted in place of `expiry`.  The token is cached and the command
+// is only run again once the token is within ExpiryDelta of expiring.
+type ExternalCommandTokenSource struct {
+	Command     []string      // command and arguments to run
+	ExpiryDelta time.Duration // run the command again when the token expires within this duration (default: 10s)
+	Logger      Logger        // receives the command's stderr (default: glog)
+
+	mu  sync.Mutex
+	tok *oauth2.Token
+}
+
+type externalCommandToken struct {
+	oauth2.Token
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+// Token returns the cached token or runs the command if it is missing or about to expire
+func (s *ExternalCommandTokenSource) Token() (*oauth2.Token, error) {
+	return s.TokenContext(context.Background())
+}
+
+// TokenContext is Token() but kills the command if ctx is done before it exits
+func (s *ExternalCommandTokenSource) TokenContext(ctx context.Context) (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delta := s.ExpiryDelta
+	if delta == 0 {
+		delta = defaultCredentialCommandExpiryDelta
+	}
+	if s.tok != nil && (s.tok.Expiry.IsZero() || time.Until(s.tok.Expiry) > delta) {
+		return s.tok, nil
+	}
+
+	tok, err := s.run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.tok = tok
+	return tok, nil
+}
+
+// Invalidate drops the cached token so the next call to Token() fetches a new one
+func (s *ExternalCommandTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tok = nil
+}
+
+func (s *ExternalCommandTokenSource) run(ctx context.Context) (*oauth2.Token, error) {
+	if len(s.Command) == 0 {
+		return nil, errors.New("credential command cannot be empty")
+	}
+	logger := s.Logger
+	if logger == nil {
+		logger = glogLogger{}
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	scanner := bufio.NewScanner(&stderr)
+	for scanner.Scan() {
+		logger.Info("credential command stderr", "command", s.Command[0], "line", scanner.Text())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error running credential command %s: %v", s.Command[0], err)
+	}
+
+	ret := &externalCommandToken{}
+	err = json.Unmarshal(stdout.Bytes(), ret)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing credential command output: %v", err)
+	}
+	if ret.AccessToken == "" {
+		return nil, errors.New("credential command did not return an access_token")
+	}
+	if ret.TokenType == "" {
+		ret.TokenType = "Bearer"
+	}
+	if ret.Expiry.IsZero() && ret.ExpiresIn > 0 {
+		ret.Expiry = time.Now().Add(time.Duration(ret.ExpiresIn) * time.Second)
+	}
+	return &ret.Token, nil
+}
@@ -0,0 +1,155 @@
+package mds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingCommand returns a shell command which prints a token and appends a line to a file on every invocation
+func countingCommand(t *testing.T, output string) ([]string, string) {
+	countFile := filepath.Join(t.TempDir(), "count")
+	return []string{"sh", "-c", fmt.Sprintf("echo invoked >> %s; echo 'a warning' >&2; echo '%s'", countFile, output)}, countFile
+}
+
+func invocations(t *testing.T, countFile string) int {
+	data, err := os.ReadFile(countFile)
+	if err != nil {
+		t.Fatalf("error reading invocation count %v", err)
+	}
+	return strings.Count(string(data), "invoked")
+}
+
+func TestExternalCommandTokenSource(t *testing.T) {
+	cmd, countFile := countingCommand(t, `{"access_token":"foo","token_type":"Bearer","expires_in":30}`)
+
+	l := &recordingLogger{}
+	ts := &ExternalCommandTokenSource{
+		Command:     cmd,
+		ExpiryDelta: time.Second,
+		Logger:      l,
+	}
+
+	for i := 0; i < 3; i++ {
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatalf("error getting token %v", err)
+		}
+		if tok.AccessToken != "foo" {
+			t.Errorf("unexpected access_token: got %v want %v", tok.AccessToken, "foo")
+		}
+		if d := time.Until(tok.Expiry); d <= 0 || d > 30*time.Second {
+			t.Errorf("unexpected token expiry: got %v", d)
+		}
+	}
+	if n := invocations(t, countFile); n != 1 {
+		t.Errorf("unexpected number of command invocations: got %d want %d", n, 1)
+	}
+
+	var found bool
+	for _, e := range l.entries {
+		if e.msg == "credential command stderr" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("command stderr was not forwarded to the logger")
+	}
+
+	// the token expires within ExpiryDelta so every call runs the command again
+	ts.ExpiryDelta = time.Minute
+	for i := 0; i < 2; i++ {
+		_, err := ts.Token()
+		if err != nil {
+			t.Fatalf("error getting token %v", err)
+		}
+	}
+	if n := invocations(t, countFile); n != 3 {
+		t.Errorf("unexpected number of command invocations: got %d want %d", n, 3)
+	}
+}
+
+func TestParseCredentialCommand(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want []string
+	}{
+		{"gcloud auth print-access-token", []string{"gcloud", "auth", "print-access-token"}},
+		{`helper --arg "a b"`, []string{"helper", "--arg", `"a`, `b"`}},
+		{`["helper", "--arg", "a b"]`, []string{"helper", "--arg", "a b"}},
+		{` ["/opt/my tools/helper"]`, []string{"/opt/my tools/helper"}},
+	} {
+		got, err := ParseCredentialCommand(tc.v)
+		if err != nil {
+			t.Errorf("error parsing %q: %v", tc.v, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("unexpected arguments for %q: got %q want %q", tc.v, got, tc.want)
+		}
+	}
+	for _, v := range []string{`["helper", 1]`, `[]`, `["helper"`} {
+		if _, err := ParseCredentialCommand(v); err == nil {
+			t.Errorf("expected error parsing %q", v)
+		}
+	}
+}
+
+func TestExternalCommandTokenSourceErrors(t *testing.T) {
+	for _, cmd := range [][]string{
+		{},
+		{"sh", "-c", "exit 1"},
+		{"sh", "-c", "echo not-json"},
+		{"sh", "-c", `echo '{"token_type":"Bearer"}'`},
+	} {
+		ts := &ExternalCommandTokenSource{Command: cmd, Logger: &recordingLogger{}}
+		if _, err := ts.Token(); err == nil {
+			t.Errorf("expected error from command %v", cmd)
+		}
+	}
+}
+
+func TestExternalCommandTokenSourceContext(t *testing.T) {
+	ts := &ExternalCommandTokenSource{Command: []string{"sleep", "10"}, Logger: &recordingLogger{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := ts.TokenContext(ctx); err == nil {
+		t.Fatalf("expected error when the context is done")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("command was not killed when the context was done: took %v", d)
+	}
+}
+
+func TestCredentialCommandServerConfig(t *testing.T) {
+	cmd, _ := countingCommand(t, `{"access_token":"foo","token_type":"Bearer","expires_in":60}`)
+
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{CredentialCommand: cmd}, nil, &Claims{}, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	h.handler().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if !strings.HasPrefix(rr.Body.String(), `{"access_token":"foo"`) {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+}
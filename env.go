@@ -0,0 +1,237 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables read by ServerConfigFromEnv() and the ServerConfig field each one sets
+const (
+	EnvBindInterface = "GCE_MDS_INTERFACE"     // BindInterface
+	EnvPort          = "GCE_MDS_PORT"          // Port
+	EnvDomainSocket  = "GCE_MDS_DOMAIN_SOCKET" // DomainSocket
+
+	EnvDomainSocketMode = "GCE_MDS_DOMAIN_SOCKET_MODE" // DomainSocketMode, octal eg 0660
+
+	EnvMetricsEnabled   = "GCE_MDS_METRICS_ENABLED"   // MetricsEnabled
+	EnvMetricsInterface = "GCE_MDS_METRICS_INTERFACE" // MetricsInterface
+	EnvMetricsPort      = "GCE_MDS_METRICS_PORT"      // MetricsPort
+	EnvMetricsPath      = "GCE_MDS_METRICS_PATH"      // MetricsPath
+
+	EnvPathPrefix = "GCE_MDS_PATH_PREFIX" // PathPrefix
+
+	EnvAdminInterface = "GCE_MDS_ADMIN_INTERFACE" // AdminInterface
+	EnvAdminPort      = "GCE_MDS_ADMIN_PORT"      // AdminPort
+	EnvAdminToken     = "GCE_MDS_ADMIN_TOKEN"     // AdminToken
+
+	EnvGRPCPort = "GCE_MDS_GRPC_PORT" // GRPCPort
+
+	EnvRequiredBearerToken    = "GCE_MDS_REQUIRED_BEARER_TOKEN"     // RequiredBearerToken
+	EnvBearerTokenExemptPaths = "GCE_MDS_BEARER_TOKEN_EXEMPT_PATHS" // BearerTokenExemptPaths, comma separated
+
+	EnvImpersonate          = "GCE_MDS_IMPERSONATE"           // Impersonate
+	EnvImpersonateDelegates = "GCE_MDS_IMPERSONATE_DELEGATES" // ImpersonateDelegates, comma separated
+	EnvFederate             = "GCE_MDS_FEDERATE"              // Federate
+	EnvAllowDynamicScopes   = "GCE_MDS_ALLOW_DYNAMIC_SCOPES"  // AllowDynamicScopes
+
+	EnvEnforceMetadataFlavor   = "GCE_MDS_ENFORCE_METADATA_FLAVOR"    // EnforceMetadataFlavor
+	EnvAllowArbitraryProjectID = "GCE_MDS_ALLOW_ARBITRARY_PROJECT_ID" // AllowArbitraryProjectID
+	EnvExpandConfigEnv         = "GCE_MDS_EXPAND_CONFIG_ENV"          // ExpandConfigEnv
+
+	EnvUseTPM           = "GCE_MDS_TPM"               // UseTPM
+	EnvTPMPath          = "GCE_MDS_TPM_PATH"          // TPMPath
+	EnvPCRs             = "GCE_MDS_PCRS"              // PCRs, comma separated
+	EnvPersistentHandle = "GCE_MDS_PERSISTENT_HANDLE" // PersistentHandle, decimal or 0x prefixed hex
+
+	EnvPKCS11LibPath  = "GCE_MDS_PKCS11_LIB_PATH"  // PKCS11LibPath
+	EnvPKCS11SlotID   = "GCE_MDS_PKCS11_SLOT_ID"   // PKCS11SlotID
+	EnvPKCS11PIN      = "GCE_MDS_PKCS11_PIN"       // PKCS11PIN
+	EnvPKCS11KeyLabel = "GCE_MDS_PKCS11_KEY_LABEL" // PKCS11KeyLabel
+
+	EnvKubernetesSATokenFile   = "GCE_MDS_KUBERNETES_SA_TOKEN_FILE"  // KubernetesSATokenFile
+	EnvKubernetesTokenAudience = "GCE_MDS_KUBERNETES_TOKEN_AUDIENCE" // KubernetesTokenAudience
+
+	EnvTokenFilePath = "GCE_MDS_TOKEN_FILE_PATH" // TokenFilePath
+
+	EnvCredentialCommand            = "GCE_MDS_CREDENTIAL_COMMAND"              // CredentialCommand, a JSON array or split on white space, see ParseCredentialCommand()
+	EnvCredentialCommandExpiryDelta = "GCE_MDS_CREDENTIAL_COMMAND_EXPIRY_DELTA" // CredentialCommandExpiryDelta, eg 30s
+
+	EnvTokenTTL     = "GCE_MDS_TOKEN_TTL"     // TokenTTL, eg 5m
+	EnvSkipPrefetch = "GCE_MDS_SKIP_PREFETCH" // SkipPrefetch
+
+	EnvRecordDir      = "GCE_MDS_RECORD_DIR"      // RecordDir
+	EnvRecordUpstream = "GCE_MDS_RECORD_UPSTREAM" // RecordUpstream
+	EnvReplayDir      = "GCE_MDS_REPLAY_DIR"      // ReplayDir
+
+	EnvProxyTo = "GCE_MDS_PROXY_TO" // ProxyTo
+
+	EnvReadHeaderTimeout = "GCE_MDS_READ_HEADER_TIMEOUT" // ReadHeaderTimeout, eg 5s
+	EnvReadTimeout       = "GCE_MDS_READ_TIMEOUT"        // ReadTimeout, eg 10s
+	EnvWriteTimeout      = "GCE_MDS_WRITE_TIMEOUT"       // WriteTimeout, eg 30s
+
+	EnvTLSCertFile = "GCE_MDS_TLS_CERT_FILE" // TLSCertFile
+	EnvTLSKeyFile  = "GCE_MDS_TLS_KEY_FILE"  // TLSKeyFile
+)
+
+// ServerConfigFromEnv returns a ServerConfig populated from the GCE_MDS_* environment variables.
+//
+// Fields whose variable is not set keep their zero value.  Fields which cannot be expressed as a string,
+// eg Listeners, TLSConfig or NamedCredentials, are not read from the environment.  All malformed values
+// are returned as one error.
+func ServerConfigFromEnv() (*ServerConfig, error) {
+	c := &ServerConfig{}
+	var errs []error
+
+	str := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			for _, e := range strings.Split(v, ",") {
+				*dst = append(*dst, strings.TrimSpace(e))
+			}
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be true or false, got %q", name, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	duration := func(name string, dst *time.Duration) {
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be a duration, got %q", name, v))
+				return
+			}
+			*dst = d
+		}
+	}
+
+	str(EnvBindInterface, &c.BindInterface)
+	str(EnvPort, &c.Port)
+	str(EnvDomainSocket, &c.DomainSocket)
+	if v := os.Getenv(EnvDomainSocketMode); v != "" {
+		m, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be an octal file mode, got %q", EnvDomainSocketMode, v))
+		}
+		c.DomainSocketMode = os.FileMode(m)
+	}
+
+	boolean(EnvMetricsEnabled, &c.MetricsEnabled)
+	str(EnvMetricsInterface, &c.MetricsInterface)
+	str(EnvMetricsPort, &c.MetricsPort)
+	str(EnvMetricsPath, &c.MetricsPath)
+
+	str(EnvPathPrefix, &c.PathPrefix)
+
+	str(EnvAdminInterface, &c.AdminInterface)
+	str(EnvAdminPort, &c.AdminPort)
+	str(EnvAdminToken, &c.AdminToken)
+	str(EnvGRPCPort, &c.GRPCPort)
+	str(EnvRequiredBearerToken, &c.RequiredBearerToken)
+	list(EnvBearerTokenExemptPaths, &c.BearerTokenExemptPaths)
+
+	boolean(EnvImpersonate, &c.Impersonate)
+	list(EnvImpersonateDelegates, &c.ImpersonateDelegates)
+	boolean(EnvFederate, &c.Federate)
+	boolean(EnvAllowDynamicScopes, &c.AllowDynamicScopes)
+	if v := os.Getenv(EnvEnforceMetadataFlavor); v != "" {
+		enforce := true
+		boolean(EnvEnforceMetadataFlavor, &enforce)
+		c.EnforceMetadataFlavor = &enforce
+	}
+	boolean(EnvAllowArbitraryProjectID, &c.AllowArbitraryProjectID)
+	boolean(EnvExpandConfigEnv, &c.ExpandConfigEnv)
+
+	boolean(EnvUseTPM, &c.UseTPM)
+	str(EnvTPMPath, &c.TPMPath)
+	var pcrs []string
+	list(EnvPCRs, &pcrs)
+	for _, p := range pcrs {
+		i, err := strconv.Atoi(p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be a comma separated list of integers, got %q", EnvPCRs, os.Getenv(EnvPCRs)))
+			break
+		}
+		c.PCRs = append(c.PCRs, i)
+	}
+	if v := os.Getenv(EnvPersistentHandle); v != "" {
+		i, err := strconv.ParseInt(v, 0, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be an integer, got %q", EnvPersistentHandle, v))
+		}
+		c.PersistentHandle = int(i)
+	}
+
+	str(EnvPKCS11LibPath, &c.PKCS11LibPath)
+	if v := os.Getenv(EnvPKCS11SlotID); v != "" {
+		i, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be a positive integer, got %q", EnvPKCS11SlotID, v))
+		}
+		c.PKCS11SlotID = uint(i)
+	}
+	str(EnvPKCS11PIN, &c.PKCS11PIN)
+	str(EnvPKCS11KeyLabel, &c.PKCS11KeyLabel)
+
+	str(EnvKubernetesSATokenFile, &c.KubernetesSATokenFile)
+	str(EnvKubernetesTokenAudience, &c.KubernetesTokenAudience)
+
+	str(EnvTokenFilePath, &c.TokenFilePath)
+
+	if v := os.Getenv(EnvCredentialCommand); v != "" {
+		args, err := ParseCredentialCommand(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", EnvCredentialCommand, err))
+		}
+		c.CredentialCommand = args
+	}
+	duration(EnvCredentialCommandExpiryDelta, &c.CredentialCommandExpiryDelta)
+
+	duration(EnvTokenTTL, &c.TokenTTL)
+	boolean(EnvSkipPrefetch, &c.SkipPrefetch)
+
+	str(EnvRecordDir, &c.RecordDir)
+	str(EnvRecordUpstream, &c.RecordUpstream)
+	str(EnvReplayDir, &c.ReplayDir)
+	str(EnvProxyTo, &c.ProxyTo)
+
+	duration(EnvReadHeaderTimeout, &c.ReadHeaderTimeout)
+	duration(EnvReadTimeout, &c.ReadTimeout)
+	duration(EnvWriteTimeout, &c.WriteTimeout)
+
+	str(EnvTLSCertFile, &c.TLSCertFile)
+	str(EnvTLSKeyFile, &c.TLSKeyFile)
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid environment: %w", errors.Join(errs...))
+	}
+	return c, nil
+}
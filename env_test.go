@@ -0,0 +1,106 @@
+package mds
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerConfigFromEnv(t *testing.T) {
+	for k, v := range map[string]string{
+		EnvBindInterface:                "0.0.0.0",
+		EnvPort:                         ":9090",
+		EnvDomainSocketMode:             "0600",
+		EnvMetricsEnabled:               "true",
+		EnvAdminPort:                    "0",
+		EnvImpersonate:                  "1",
+		EnvImpersonateDelegates:         "a@p.iam.gserviceaccount.com, b@p.iam.gserviceaccount.com",
+		EnvPCRs:                         "0,7",
+		EnvPersistentHandle:             "0x81008001",
+		EnvPKCS11SlotID:                 "3",
+		EnvCredentialCommand:            "gcloud auth print-access-token",
+		EnvCredentialCommandExpiryDelta: "30s",
+		EnvTokenTTL:                     "5m",
+		EnvSkipPrefetch:                 "false",
+		EnvEnforceMetadataFlavor:        "false",
+		EnvAllowArbitraryProjectID:      "true",
+		EnvExpandConfigEnv:              "true",
+		EnvRecordUpstream:               "http://127.0.0.1:8081",
+		EnvProxyTo:                      "http://metadata.google.internal",
+		EnvGRPCPort:                     "9090",
+		EnvRequiredBearerToken:          "secret",
+		EnvBearerTokenExemptPaths:       "/healthz, /readyz",
+		EnvTLSCertFile:                  "/certs/tls.crt",
+		EnvReadHeaderTimeout:            "2s",
+		EnvWriteTimeout:                 "-1s",
+		EnvPathPrefix:                   "/gce-metadata",
+	} {
+		t.Setenv(k, v)
+	}
+
+	c, err := ServerConfigFromEnv()
+	if err != nil {
+		t.Fatalf("error reading environment %v", err)
+	}
+	enforce := false
+	want := &ServerConfig{
+		BindInterface:                "0.0.0.0",
+		Port:                         ":9090",
+		DomainSocketMode:             0600,
+		MetricsEnabled:               true,
+		AdminPort:                    "0",
+		Impersonate:                  true,
+		ImpersonateDelegates:         []string{"a@p.iam.gserviceaccount.com", "b@p.iam.gserviceaccount.com"},
+		PCRs:                         []int{0, 7},
+		PersistentHandle:             0x81008001,
+		PKCS11SlotID:                 3,
+		CredentialCommand:            []string{"gcloud", "auth", "print-access-token"},
+		CredentialCommandExpiryDelta: 30 * time.Second,
+		TokenTTL:                     5 * time.Minute,
+		EnforceMetadataFlavor:        &enforce,
+		AllowArbitraryProjectID:      true,
+		ExpandConfigEnv:              true,
+		RecordUpstream:               "http://127.0.0.1:8081",
+		ProxyTo:                      "http://metadata.google.internal",
+		GRPCPort:                     "9090",
+		RequiredBearerToken:          "secret",
+		BearerTokenExemptPaths:       []string{"/healthz", "/readyz"},
+		TLSCertFile:                  "/certs/tls.crt",
+		ReadHeaderTimeout:            2 * time.Second,
+		WriteTimeout:                 -time.Second,
+		PathPrefix:                   "/gce-metadata",
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("unexpected config: got %+v want %+v", c, want)
+	}
+}
+
+func TestServerConfigFromEnvDefaults(t *testing.T) {
+	c, err := ServerConfigFromEnv()
+	if err != nil {
+		t.Fatalf("error reading environment %v", err)
+	}
+	if !reflect.DeepEqual(c, &ServerConfig{}) {
+		t.Errorf("unexpected config without environment variables: got %+v", c)
+	}
+}
+
+func TestServerConfigFromEnvErrors(t *testing.T) {
+	t.Setenv(EnvMetricsEnabled, "maybe")
+	t.Setenv(EnvTokenTTL, "5")
+	t.Setenv(EnvPCRs, "0,x")
+	t.Setenv(EnvPKCS11SlotID, "-1")
+	t.Setenv(EnvDomainSocketMode, "rw-rw----")
+	t.Setenv(EnvCredentialCommand, `["helper"`)
+
+	_, err := ServerConfigFromEnv()
+	if err == nil {
+		t.Fatalf("expected error reading environment")
+	}
+	for _, want := range []string{EnvMetricsEnabled, EnvTokenTTL, EnvPCRs, EnvPKCS11SlotID, EnvDomainSocketMode, EnvCredentialCommand} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %q: got %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+)
+
+// FaultRule makes requests to Path fail with the given probability
+type FaultRule struct {
+	Path            string  // exact request path the rule applies to (eg /computeMetadata/v1/instance/service-accounts/default/token)
+	HTTPStatus      int     // status code returned when the fault triggers (eg 429, 500, 503)
+	ResetConnection bool    // close the connection without a response instead of returning HTTPStatus (default: false)
+	Rate            float64 // probability between 0.0 (never, default) and 1.0 (always) that a request fails
+}
+
+// FaultConfig configures simulated errors for chaos testing client retry behavior
+type FaultConfig struct {
+	Rules []FaultRule // the first rule matching a request path is applied
+}
+
+// Validate checks that every rule has a path, a rate between 0 and 1 and either an error status or ResetConnection
+func (fc FaultConfig) Validate() error {
+	for i, r := range fc.Rules {
+		if r.Path == "" {
+			return fmt.Errorf("fault rule %d: path cannot be empty", i)
+		}
+		if r.Rate < 0 || r.Rate > 1 {
+			return fmt.Errorf("fault rule %d: rate must be between 0.0 and 1.0, got %v", i, r.Rate)
+		}
+		if !r.ResetConnection && (r.HTTPStatus < 400 || r.HTTPStatus > 599) {
+			return fmt.Errorf("fault rule %d: httpStatus must be an error status code, got %d", i, r.HTTPStatus)
+		}
+	}
+	return nil
+}
+
+func (fc FaultConfig) match(path string) (FaultRule, bool) {
+	for _, r := range fc.Rules {
+		if r.Path == path {
+			return r, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+// UpdateFaultConfig replaces the fault rules of a running server.  Requests already in flight are not affected.
+func (h *MetadataServer) UpdateFaultConfig(fc FaultConfig) error {
+	if err := fc.Validate(); err != nil {
+		return err
+	}
+	rules := make([]FaultRule, len(fc.Rules))
+	copy(rules, fc.Rules)
+
+	h.faultMutex.Lock()
+	defer h.faultMutex.Unlock()
+	h.ServerConfig.FaultConfig = FaultConfig{Rules: rules}
+	return nil
+}
+
+// injectFaults fails requests matching a FaultRule with the configured probability
+func (h *MetadataServer) injectFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.faultMutex.RLock()
+		rule, ok := h.ServerConfig.FaultConfig.match(r.URL.Path)
+		h.faultMutex.RUnlock()
+
+		if !ok || rule.Rate <= 0 || rand.Float64() >= rule.Rate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if rule.ResetConnection {
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				h.requestLog(r).Info("injecting connection reset", "path", r.URL.Path)
+				conn.Close()
+				return
+			}
+			// http/2 connections cannot be hijacked; aborting the handler resets the stream instead
+			h.requestLog(r).Info("injecting stream reset", "path", r.URL.Path)
+			panic(http.ErrAbortHandler)
+		}
+
+		h.requestLog(r).Info("injecting fault", "path", r.URL.Path, "status", rule.HTTPStatus)
+		httpError(w, http.StatusText(rule.HTTPStatus), rule.HTTPStatus, "text/html; charset=UTF-8")
+	})
+}
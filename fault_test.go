@@ -0,0 +1,106 @@
+package mds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+func TestFaultConfig(t *testing.T) {
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	sc := &ServerConfig{
+		Port:         fmt.Sprintf(":%d", p),
+		SkipPrefetch: true,
+		FaultConfig: FaultConfig{
+			Rules: []FaultRule{
+				{Path: "/computeMetadata/v1/project/project-id", HTTPStatus: http.StatusServiceUnavailable, Rate: 1.0},
+				{Path: "/computeMetadata/v1/project/numeric-project-id", HTTPStatus: http.StatusTooManyRequests, Rate: 0.0},
+			},
+		},
+	}
+
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("some-project-id"))
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err != nil {
+		t.Errorf("error starting emulator %v", err)
+	}
+	defer h.Shutdown()
+
+	projectURL := fmt.Sprintf("http://127.0.0.1:%d/computeMetadata/v1/project/project-id", p)
+
+	resp, _, err := getMetadata(projectURL)
+	if err != nil {
+		t.Fatalf("error getting project-id %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	resp, _, err = getMetadata(fmt.Sprintf("http://127.0.0.1:%d/computeMetadata/v1/project/numeric-project-id", p))
+	if err != nil {
+		t.Fatalf("error getting numeric-project-id %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+
+	err = h.UpdateFaultConfig(FaultConfig{
+		Rules: []FaultRule{
+			{Path: "/computeMetadata/v1/project/project-id", ResetConnection: true, Rate: 1.0},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error updating fault config %v", err)
+	}
+	http.DefaultClient.CloseIdleConnections()
+	_, _, err = getMetadata(projectURL)
+	if err == nil {
+		t.Errorf("expected connection reset error")
+	}
+
+	err = h.UpdateFaultConfig(FaultConfig{})
+	if err != nil {
+		t.Fatalf("error updating fault config %v", err)
+	}
+	resp, body, err := getMetadata(projectURL)
+	if err != nil {
+		t.Fatalf("error getting project-id %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || body != "some-project-id" {
+		t.Errorf("handler returned unexpected response: got %v %v want %v %v", resp.StatusCode, body, http.StatusOK, "some-project-id")
+	}
+}
+
+func TestFaultConfigValidate(t *testing.T) {
+	for _, fc := range []FaultConfig{
+		{Rules: []FaultRule{{Path: "", HTTPStatus: http.StatusInternalServerError, Rate: 0.5}}},
+		{Rules: []FaultRule{{Path: "/", HTTPStatus: http.StatusInternalServerError, Rate: 1.5}}},
+		{Rules: []FaultRule{{Path: "/", HTTPStatus: http.StatusInternalServerError, Rate: -0.1}}},
+		{Rules: []FaultRule{{Path: "/", HTTPStatus: http.StatusOK, Rate: 0.5}}},
+	} {
+		if err := fc.Validate(); err == nil {
+			t.Errorf("expected error validating fault config %+v", fc)
+		}
+	}
+
+	h := &MetadataServer{}
+	if err := h.UpdateFaultConfig(FaultConfig{Rules: []FaultRule{{Path: "/", Rate: 2}}}); err == nil {
+		t.Errorf("expected error updating invalid fault config")
+	}
+
+	_, err := NewMetadataServer(context.Background(), &ServerConfig{
+		FaultConfig: FaultConfig{Rules: []FaultRule{{Path: "/", Rate: 2}}},
+	}, &google.Credentials{}, &Claims{})
+	if err == nil {
+		t.Errorf("expected error creating emulator with invalid fault config")
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	jwtSubjectTokenType      = "urn:ietf:params:oauth:token-type:jwt"
+	workloadIdentityAudience = "//iam.googleapis.com/projects/%d/locations/global/workloadIdentityPools/%s/providers/%s"
+)
+
+// FederationConfig configures a FederatedTokenSource which exchanges a subject token issued by an external
+// identity provider (eg an OIDC or SAML provider, or Azure) for a federated access_token, without a credentials file.
+//
+// Exactly one of SubjectTokenFile, SubjectTokenEnv or SubjectTokenURL must be set.
+type FederationConfig struct {
+	ProjectNumber int64  // project number of the workload identity pool
+	Pool          string // workload identity pool id
+	Provider      string // provider id within the pool
+
+	SubjectTokenType string // eg urn:ietf:params:oauth:token-type:saml2 (default: urn:ietf:params:oauth:token-type:jwt)
+
+	SubjectTokenFile       string            // read the subject token from this file, eg a token written by the provider's agent
+	SubjectTokenEnv        string            // read the subject token from this environment variable
+	SubjectTokenURL        string            // GET the subject token from this URL, eg the Azure instance metadata service
+	SubjectTokenURLHeaders map[string]string // headers sent with the SubjectTokenURL request
+	SubjectTokenJSONField  string            // if set, the subject token is this field of a JSON document rather than the whole text
+
+	Scopes []string // scopes to request for access_tokens
+
+	STSURL     string       // token exchange endpoint (default: https://sts.googleapis.com/v1/token)
+	HTTPClient *http.Client // client used for subject token and STS requests (default: http.DefaultClient)
+}
+
+// Audience returns the STS audience of the workload identity provider
+func (c FederationConfig) Audience() string {
+	return fmt.Sprintf(workloadIdentityAudience, c.ProjectNumber, c.Pool, c.Provider)
+}
+
+func (c FederationConfig) validate() error {
+	if c.ProjectNumber <= 0 || c.Pool == "" || c.Provider == "" {
+		return errors.New("federation requires the project number, pool and provider of the workload identity provider")
+	}
+	sources := 0
+	for _, s := range []string{c.SubjectTokenFile, c.SubjectTokenEnv, c.SubjectTokenURL} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("federation requires exactly one of SubjectTokenFile, SubjectTokenEnv or SubjectTokenURL")
+	}
+	return nil
+}
+
+// externalAccountFormat is the credential_source.format of an external_account credentials file
+type externalAccountFormat struct {
+	Type                  string `json:"type"`
+	SubjectTokenFieldName string `json:"subject_token_field_name,omitempty"`
+}
+
+// externalAccountSource is the credential_source of an external_account credentials file
+type externalAccountSource struct {
+	File    string                 `json:"file,omitempty"`
+	URL     string                 `json:"url,omitempty"`
+	Headers map[string]string      `json:"headers,omitempty"`
+	Format  *externalAccountFormat `json:"format,omitempty"`
+}
+
+// externalAccountJSON returns the external_account credentials file equivalent to a config which reads the
+// subject token from a file or URL
+func (c FederationConfig) externalAccountJSON() ([]byte, error) {
+	source := externalAccountSource{
+		File:    c.SubjectTokenFile,
+		URL:     c.SubjectTokenURL,
+		Headers: c.SubjectTokenURLHeaders,
+	}
+	if c.SubjectTokenJSONField != "" {
+		source.Format = &externalAccountFormat{Type: "json", SubjectTokenFieldName: c.SubjectTokenJSONField}
+	}
+	return json.Marshal(struct {
+		Type             string                `json:"type"`
+		Audience         string                `json:"audience"`
+		SubjectTokenType string                `json:"subject_token_type"`
+		TokenURL         string                `json:"token_url"`
+		CredentialSource externalAccountSource `json:"credential_source"`
+	}{
+		Type:             "external_account",
+		Audience:         c.Audience(),
+		SubjectTokenType: c.SubjectTokenType,
+		TokenURL:         c.STSURL,
+		CredentialSource: source,
+	})
+}
+
+// FederatedTokenSource is an oauth2.TokenSource which exchanges the subject token configured in a FederationConfig
+// for a federated GCP access_token at the Security Token Service.  The subject token is read again whenever the
+// access_token is about to expire.
+//
+// Subject tokens read from a file or URL are exchanged by the external_account credentials of
+// golang.org/x/oauth2/google; that package cannot read the subject token from an environment variable, so
+// SubjectTokenEnv is exchanged here.
+type FederatedTokenSource struct {
+	cfg FederationConfig
+
+	mu sync.Mutex
+	ts oauth2.TokenSource
+}
+
+// NewFederatedTokenSource validates the config and returns a FederatedTokenSource for it
+func NewFederatedTokenSource(cfg FederationConfig) (*FederatedTokenSource, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.SubjectTokenType == "" {
+		cfg.SubjectTokenType = jwtSubjectTokenType
+	}
+	if cfg.STSURL == "" {
+		cfg.STSURL = defaultSTSURL
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	s := &FederatedTokenSource{cfg: cfg}
+	ts, err := s.newTokenSource()
+	if err != nil {
+		return nil, err
+	}
+	s.ts = ts
+	return s, nil
+}
+
+// newTokenSource returns a caching token source which exchanges a freshly read subject token on each refresh
+func (s *FederatedTokenSource) newTokenSource() (oauth2.TokenSource, error) {
+	if s.cfg.SubjectTokenEnv != "" {
+		return oauth2.ReuseTokenSource(nil, envSubjectTokenSource{cfg: s.cfg}), nil
+	}
+	data, err := s.cfg.externalAccountJSON()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, s.cfg.HTTPClient)
+	creds, err := google.CredentialsFromJSON(ctx, data, s.cfg.Scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create external account credentials: %w", err)
+	}
+	return creds.TokenSource, nil
+}
+
+// Token returns a cached access_token or exchanges the current subject token once it is about to expire
+func (s *FederatedTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	ts := s.ts
+	s.mu.Unlock()
+
+	tok, err := ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok.AccessToken == "" {
+		return nil, errors.New("token exchange returned an empty access_token")
+	}
+	return tok, nil
+}
+
+// Invalidate drops the cached token so the next call to Token() exchanges the subject token again
+func (s *FederatedTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the config was already accepted by NewFederatedTokenSource
+	if ts, err := s.newTokenSource(); err == nil {
+		s.ts = ts
+	}
+}
+
+// envSubjectTokenSource exchanges the subject token held in the SubjectTokenEnv environment variable
+type envSubjectTokenSource struct {
+	cfg FederationConfig
+}
+
+func (s envSubjectTokenSource) Token() (*oauth2.Token, error) {
+	data := os.Getenv(s.cfg.SubjectTokenEnv)
+	token := strings.TrimSpace(data)
+	if f := s.cfg.SubjectTokenJSONField; f != "" {
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(data), &fields); err != nil {
+			return nil, fmt.Errorf("error parsing subject token json: %w", err)
+		}
+		v, ok := fields[f].(string)
+		if !ok {
+			return nil, fmt.Errorf("subject token json has no string field %q", f)
+		}
+		token = v
+	}
+	if token == "" {
+		return nil, errors.New("subject token is empty")
+	}
+	return stsExchange(s.cfg.HTTPClient, s.cfg.STSURL, s.cfg.Audience(), s.cfg.SubjectTokenType, token, s.cfg.Scopes)
+}
+
+// stsExchange trades a subject token for a federated access_token (RFC 8693)
+func stsExchange(client *http.Client, stsURL, audience, subjectTokenType, subjectToken string, scopes []string) (*oauth2.Token, error) {
+	data := url.Values{}
+	data.Add("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	data.Add("audience", audience)
+	data.Add("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	data.Add("subject_token_type", subjectTokenType)
+	data.Add("subject_token", subjectToken)
+	if len(scopes) > 0 {
+		data.Add("scope", strings.Join(scopes, " "))
+	}
+
+	resp, err := client.PostForm(stsURL, data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to POST token exchange request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error response from STS %d: %s", resp.StatusCode, body)
+	}
+
+	ret := &struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(body, ret); err != nil {
+		return nil, fmt.Errorf("error parsing STS response: %w", err)
+	}
+	if ret.AccessToken == "" {
+		return nil, errors.New("STS response has no access_token")
+	}
+	tokenType := ret.TokenType
+	if tokenType == "" {
+		tokenType = "Bearer"
+	}
+	return &oauth2.Token{
+		AccessToken: ret.AccessToken,
+		TokenType:   tokenType,
+		Expiry:      time.Now().Add(time.Duration(ret.ExpiresIn) * time.Second),
+	}, nil
+}
@@ -0,0 +1,231 @@
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+const federationAudience = "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/oidc"
+
+// oidcProviderStub serves the current subject token as a JSON document the way a cloud provider's metadata service does
+func oidcProviderStub(t *testing.T, token *atomic.Value) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			http.Error(w, "missing Metadata header", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"access_token": token.Load().(string)})
+	}))
+}
+
+func TestFederatedTokenSource(t *testing.T) {
+	var exchanges atomic.Int32
+	sts := stsStub(t, federationAudience, &exchanges)
+	defer sts.Close()
+
+	var urlToken atomic.Value
+	urlToken.Store("url-token-1")
+	provider := oidcProviderStub(t, &urlToken)
+	defer provider.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "oidc-token")
+	if err := os.WriteFile(tokenFile, []byte("file-token-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OIDC_TOKEN", "env-token-1")
+
+	base := FederationConfig{
+		ProjectNumber: 123,
+		Pool:          "pool",
+		Provider:      "oidc",
+		Scopes:        []string{cloudPlatformScope},
+		STSURL:        sts.URL,
+	}
+	for name, tc := range map[string]struct {
+		source func(*FederationConfig)
+		rotate func()
+		want   string
+	}{
+		"file": {
+			source: func(c *FederationConfig) { c.SubjectTokenFile = tokenFile },
+			rotate: func() { os.WriteFile(tokenFile, []byte("file-token-2"), 0600) },
+			want:   "file-token",
+		},
+		"env": {
+			source: func(c *FederationConfig) { c.SubjectTokenEnv = "OIDC_TOKEN" },
+			rotate: func() { os.Setenv("OIDC_TOKEN", "env-token-2") },
+			want:   "env-token",
+		},
+		"url": {
+			source: func(c *FederationConfig) {
+				c.SubjectTokenURL = provider.URL
+				c.SubjectTokenURLHeaders = map[string]string{"Metadata": "true"}
+				c.SubjectTokenJSONField = "access_token"
+			},
+			rotate: func() { urlToken.Store("url-token-2") },
+			want:   "url-token",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			exchanges.Store(0)
+			cfg := base
+			tc.source(&cfg)
+			ts, err := NewFederatedTokenSource(cfg)
+			if err != nil {
+				t.Fatalf("error creating token source %v", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				tok, err := ts.Token()
+				if err != nil {
+					t.Fatalf("error getting token %v", err)
+				}
+				if tok.AccessToken != "federated-"+tc.want+"-1" {
+					t.Errorf("unexpected access_token: got %v want %v", tok.AccessToken, "federated-"+tc.want+"-1")
+				}
+			}
+			if n := exchanges.Load(); n != 1 {
+				t.Errorf("unexpected number of token exchanges: got %d want %d", n, 1)
+			}
+
+			// a new subject token is read once the cached token is invalidated
+			tc.rotate()
+			ts.Invalidate()
+			tok, err := ts.Token()
+			if err != nil {
+				t.Fatalf("error getting token %v", err)
+			}
+			if tok.AccessToken != "federated-"+tc.want+"-2" {
+				t.Errorf("unexpected access_token: got %v want %v", tok.AccessToken, "federated-"+tc.want+"-2")
+			}
+		})
+	}
+}
+
+func TestFederatedTokenSourceErrors(t *testing.T) {
+	var exchanges atomic.Int32
+	sts := stsStub(t, federationAudience, &exchanges)
+	defer sts.Close()
+
+	if got := (FederationConfig{ProjectNumber: 123, Pool: "pool", Provider: "oidc"}).Audience(); got != federationAudience {
+		t.Errorf("unexpected audience: got %v want %v", got, federationAudience)
+	}
+
+	for _, cfg := range []FederationConfig{
+		{Pool: "pool", Provider: "oidc", SubjectTokenEnv: "OIDC_TOKEN"},
+		{ProjectNumber: 123, Provider: "oidc", SubjectTokenEnv: "OIDC_TOKEN"},
+		{ProjectNumber: 123, Pool: "pool", Provider: "oidc"},
+		{ProjectNumber: 123, Pool: "pool", Provider: "oidc", SubjectTokenEnv: "OIDC_TOKEN", SubjectTokenFile: "/tmp/token"},
+	} {
+		if _, err := NewFederatedTokenSource(cfg); err == nil {
+			t.Errorf("expected error for config %+v", cfg)
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		env, field string
+	}{
+		"empty":        {env: ""},
+		"rejected":     {env: "rejected"},
+		"not json":     {env: "token", field: "access_token"},
+		"missing json": {env: `{"id_token":"token"}`, field: "access_token"},
+	} {
+		t.Setenv("OIDC_TOKEN", tc.env)
+		ts, err := NewFederatedTokenSource(FederationConfig{
+			ProjectNumber:         123,
+			Pool:                  "pool",
+			Provider:              "oidc",
+			SubjectTokenEnv:       "OIDC_TOKEN",
+			SubjectTokenJSONField: tc.field,
+			Scopes:                []string{cloudPlatformScope},
+			STSURL:                sts.URL,
+		})
+		if err != nil {
+			t.Fatalf("%s: error creating token source %v", name, err)
+		}
+		if _, err := ts.Token(); err == nil {
+			t.Errorf("%s: expected error getting token", name)
+		}
+	}
+
+	// an STS response without an access_token is an error rather than an empty bearer token
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"token_type": "Bearer", "expires_in": 3600})
+	}))
+	defer empty.Close()
+	tokenFile := filepath.Join(t.TempDir(), "oidc-token")
+	if err := os.WriteFile(tokenFile, []byte("file-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OIDC_TOKEN", "env-token")
+	for name, source := range map[string]func(*FederationConfig){
+		"file": func(c *FederationConfig) { c.SubjectTokenFile = tokenFile },
+		"env":  func(c *FederationConfig) { c.SubjectTokenEnv = "OIDC_TOKEN" },
+	} {
+		cfg := FederationConfig{ProjectNumber: 123, Pool: "pool", Provider: "oidc", STSURL: empty.URL}
+		source(&cfg)
+		ts, err := NewFederatedTokenSource(cfg)
+		if err != nil {
+			t.Fatalf("%s: error creating token source %v", name, err)
+		}
+		if _, err := ts.Token(); err == nil {
+			t.Errorf("%s: expected error for an empty access_token", name)
+		}
+	}
+}
+
+func TestFederationConfig(t *testing.T) {
+	var exchanges atomic.Int32
+	sts := stsStub(t, federationAudience, &exchanges)
+	defer sts.Close()
+	t.Setenv("OIDC_TOKEN", "env-token")
+
+	claims := projectClaims("some-project")
+	sa := claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"]
+	sa.Scopes = []string{cloudPlatformScope}
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = sa
+
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{
+		FederationConfig: &FederationConfig{
+			ProjectNumber:   123,
+			Pool:            "pool",
+			Provider:        "oidc",
+			SubjectTokenEnv: "OIDC_TOKEN",
+			STSURL:          sts.URL,
+		},
+	}, nil, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	h.handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	tok := &struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), tok); err != nil {
+		t.Fatalf("error parsing token response %v", err)
+	}
+	if tok.AccessToken != "federated-env-token" {
+		t.Errorf("unexpected access_token: got %v want %v", tok.AccessToken, "federated-env-token")
+	}
+
+	if _, err := NewMetadataServer(context.Background(), &ServerConfig{FederationConfig: &FederationConfig{}}, nil, claims); err == nil {
+		t.Errorf("expected error for an invalid federation config")
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/salrashid123/gce_metadata_server/metadatapb"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const defaultGRPCInterface = "127.0.0.1"
+
+// GRPCMetadataServer serves the claims of a MetadataServer over the gRPC API defined in metadatapb/metadata.proto
+// in addition to HTTP.  Both APIs share the claims, guest attributes and cached tokens, so eg UpdateClaims() is seen
+// by gRPC Watch streams and HTTP wait_for_change requests alike.
+type GRPCMetadataServer struct {
+	*MetadataServer
+
+	grpcSrv      *grpc.Server
+	grpcListener net.Listener
+}
+
+// NewGRPCMetadataServer configures a metadata server which also serves gRPC on ServerConfig.GRPCPort.
+//
+// The arguments are the same as for `NewMetadataServer()`; `Start()` starts both the HTTP and the gRPC listeners.
+func NewGRPCMetadataServer(ctx context.Context, serverConfig *ServerConfig, creds *google.Credentials, claims *Claims, opts ...Option) (*GRPCMetadataServer, error) {
+	if serverConfig == nil || serverConfig.GRPCPort == "" {
+		return nil, errors.New("GRPCPort must be set to serve gRPC")
+	}
+	h, err := NewMetadataServer(ctx, serverConfig, creds, claims, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &GRPCMetadataServer{MetadataServer: h}, nil
+}
+
+// Start starts the HTTP listeners of the metadata server and then the gRPC listener
+func (g *GRPCMetadataServer) Start() error {
+	if err := g.MetadataServer.Start(); err != nil {
+		return err
+	}
+
+	// BindInterface may be unset when the HTTP API is configured with Listeners
+	iface := g.ServerConfig.BindInterface
+	if iface == "" {
+		iface = defaultGRPCInterface
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(iface, g.ServerConfig.GRPCPort))
+	if err != nil {
+		g.log().Error("Error listening for gRPC", "interface", iface, "port", g.ServerConfig.GRPCPort, "error", err)
+		g.MetadataServer.Shutdown()
+		return err
+	}
+	var sopts []grpc.ServerOption
+	if g.tlsConfig != nil {
+		sopts = append(sopts, grpc.Creds(credentials.NewTLS(g.tlsConfig.Clone())))
+	}
+	g.grpcSrv = grpc.NewServer(sopts...)
+	metadatapb.RegisterMetadataServer(g.grpcSrv, &grpcMetadataService{handler: g.handler(), pathPrefix: strings.TrimRight(g.ServerConfig.PathPrefix, "/")})
+	g.grpcListener = l
+
+	g.log().Info("gRPC listening", "address", l.Addr().String())
+	go func() {
+		if err := g.grpcSrv.Serve(l); err != nil {
+			g.log().Error("gRPC listener stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// GRPCAddr returns the address the gRPC API listens on, or "" if it is not started
+func (g *GRPCMetadataServer) GRPCAddr() string {
+	if g.grpcListener == nil {
+		return ""
+	}
+	return g.grpcListener.Addr().String()
+}
+
+// Shutdown stops the HTTP and gRPC listeners, see ShutdownContext()
+func (g *GRPCMetadataServer) Shutdown() error {
+	return g.ShutdownContext(context.Background())
+}
+
+// ShutdownContext stops the metadata server like `MetadataServer.ShutdownContext()`.  Watch streams are ended with
+// UNAVAILABLE and in-flight RPCs are drained until ctx is done.
+func (g *GRPCMetadataServer) ShutdownContext(ctx context.Context) error {
+	// signals the Watch streams before the gRPC server waits for them
+	err := g.MetadataServer.ShutdownContext(ctx)
+	if g.grpcSrv != nil {
+		stopped := make(chan struct{})
+		go func() {
+			g.grpcSrv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			g.grpcSrv.Stop()
+			if err == nil {
+				err = ctx.Err()
+			}
+		}
+	}
+	return err
+}
+
+// grpcMetadataService answers RPCs by serving the equivalent HTTP request, so both APIs return the same values,
+// faults and latency
+type grpcMetadataService struct {
+	metadatapb.UnimplementedMetadataServer
+
+	handler    http.Handler
+	pathPrefix string // ServerConfig.PathPrefix, which the handler strips from all paths
+}
+
+// maxGRPCRedirects limits the directory redirects followed for paths without a trailing slash
+const maxGRPCRedirects = 1
+
+// serve returns the response of the HTTP handler for the path below /computeMetadata/v1/
+func (s *grpcMetadataService) serve(ctx context.Context, path string, query url.Values) (*bufferedResponse, error) {
+	u := &url.URL{Path: s.pathPrefix + "/computeMetadata/v1/" + strings.TrimPrefix(path, "/"), RawQuery: query.Encode()}
+	for redirects := 0; ; redirects++ {
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		r.Header.Set("Metadata-Flavor", "Google")
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+			// for ServerConfig.RequiredBearerToken
+			r.Header.Set("Authorization", md.Get("authorization")[0])
+		}
+		if p, ok := peer.FromContext(ctx); ok {
+			r.RemoteAddr = p.Addr.String()
+		}
+		resp := newBufferedResponse()
+		s.handler.ServeHTTP(resp, r)
+		if err := ctx.Err(); err != nil {
+			return nil, status.FromContextError(err).Err()
+		}
+
+		switch {
+		case resp.code == http.StatusOK:
+			return resp, nil
+		case resp.code == http.StatusMovedPermanently && redirects < maxGRPCRedirects:
+			// directories are redirected to the path with a trailing slash
+			u.Path += "/"
+		default:
+			return nil, status.Error(grpcCode(resp.code), strings.TrimSpace(resp.body.String()))
+		}
+	}
+}
+
+// grpcCode returns the gRPC status code of an HTTP error status
+func grpcCode(code int) codes.Code {
+	switch code {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound, http.StatusMovedPermanently:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
+
+func getResponse(resp *bufferedResponse) *metadatapb.GetResponse {
+	return &metadatapb.GetResponse{
+		Value:       resp.body.String(),
+		Etag:        resp.etag(),
+		ContentType: resp.header.Get("Content-Type"),
+	}
+}
+
+func (s *grpcMetadataService) Get(ctx context.Context, req *metadatapb.GetRequest) (*metadatapb.GetResponse, error) {
+	query := url.Values{}
+	if req.GetRecursive() {
+		query.Set("recursive", "true")
+	}
+	resp, err := s.serve(ctx, req.GetPath(), query)
+	if err != nil {
+		return nil, err
+	}
+	return getResponse(resp), nil
+}
+
+func (s *grpcMetadataService) Watch(req *metadatapb.WatchRequest, stream metadatapb.Metadata_WatchServer) error {
+	etag := req.GetLastEtag()
+	for {
+		query := url.Values{}
+		if req.GetRecursive() {
+			query.Set("recursive", "true")
+		}
+		if etag != "" {
+			query.Set("wait_for_change", "true")
+			query.Set("last_etag", etag)
+		}
+		resp, err := s.serve(stream.Context(), req.GetPath(), query)
+		if err != nil {
+			return err
+		}
+		if resp.etag() == etag {
+			continue
+		}
+		etag = resp.etag()
+		if err := stream.Send(getResponse(resp)); err != nil {
+			return err
+		}
+	}
+}
+
+func serviceAccountPath(account, key string) string {
+	if account == "" {
+		account = defaultServiceAccount
+	}
+	return "instance/service-accounts/" + url.PathEscape(account) + "/" + key
+}
+
+func (s *grpcMetadataService) GetAccessToken(ctx context.Context, req *metadatapb.GetAccessTokenRequest) (*metadatapb.AccessToken, error) {
+	query := url.Values{}
+	if len(req.GetScopes()) > 0 {
+		query.Set("scopes", strings.Join(req.GetScopes(), ","))
+	}
+	resp, err := s.serve(ctx, serviceAccountPath(req.GetServiceAccount(), "token"), query)
+	if err != nil {
+		return nil, err
+	}
+	tok := &metadataToken{}
+	if err := json.Unmarshal(resp.body.Bytes(), tok); err != nil {
+		return nil, status.Errorf(codes.Internal, "could not parse token: %v", err)
+	}
+	return &metadatapb.AccessToken{
+		AccessToken: tok.AccessToken,
+		ExpiresIn:   int64(tok.ExpiresIn),
+		TokenType:   tok.TokenType,
+	}, nil
+}
+
+func (s *grpcMetadataService) GetIdentityToken(ctx context.Context, req *metadatapb.GetIdentityTokenRequest) (*metadatapb.IdentityToken, error) {
+	query := url.Values{"audience": {req.GetAudience()}}
+	if req.GetFormat() != "" {
+		query.Set("format", req.GetFormat())
+	}
+	resp, err := s.serve(ctx, serviceAccountPath(req.GetServiceAccount(), "identity"), query)
+	if err != nil {
+		return nil, err
+	}
+	return &metadatapb.IdentityToken{IdToken: resp.body.String()}, nil
+}
@@ -0,0 +1,189 @@
+package mds
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salrashid123/gce_metadata_server/metadatapb"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func startGRPCServer(t *testing.T, ts *countingTokenSource) (*GRPCMetadataServer, metadatapb.MetadataClient) {
+	return startGRPCServerConfig(t, &ServerConfig{}, ts)
+}
+
+// startGRPCServerConfig starts a gRPC metadata server with sc listening on ephemeral ports of the loopback interface
+func startGRPCServerConfig(t *testing.T, sc *ServerConfig, ts *countingTokenSource) (*GRPCMetadataServer, metadatapb.MetadataClient) {
+	sc.BindInterface, sc.Port, sc.GRPCPort, sc.SkipPrefetch = "127.0.0.1", ":0", "0", true
+	g, err := NewGRPCMetadataServer(context.Background(), sc, &google.Credentials{TokenSource: ts}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	if err := g.Start(); err != nil {
+		t.Fatalf("error starting emulator %v", err)
+	}
+	t.Cleanup(func() {
+		g.Shutdown()
+	})
+
+	conn, err := grpc.Dial(g.GRPCAddr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("error connecting to the gRPC API %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return g, metadatapb.NewMetadataClient(conn)
+}
+
+func TestGRPCGet(t *testing.T) {
+	_, c := startGRPCServer(t, &countingTokenSource{expiresIn: time.Hour})
+	ctx := context.Background()
+
+	resp, err := c.Get(ctx, &metadatapb.GetRequest{Path: "project/project-id"})
+	if err != nil {
+		t.Fatalf("error getting project-id %v", err)
+	}
+	if resp.Value != "some-project" || resp.Etag == "" {
+		t.Errorf("unexpected response: got %v", resp)
+	}
+
+	resp, err = c.Get(ctx, &metadatapb.GetRequest{Path: "project", Recursive: true})
+	if err != nil {
+		t.Fatalf("error getting project recursively %v", err)
+	}
+	if !strings.Contains(resp.Value, `"projectId":"some-project"`) || resp.ContentType != "application/json" {
+		t.Errorf("unexpected recursive response: got %v", resp)
+	}
+
+	_, err = c.Get(ctx, &metadatapb.GetRequest{Path: "instance/missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("unexpected error for a missing path: got %v want %v", err, codes.NotFound)
+	}
+}
+
+func TestGRPCPathPrefix(t *testing.T) {
+	_, c := startGRPCServerConfig(t, &ServerConfig{PathPrefix: "/gce-metadata/"}, &countingTokenSource{expiresIn: time.Hour})
+	ctx := context.Background()
+
+	resp, err := c.Get(ctx, &metadatapb.GetRequest{Path: "project/project-id"})
+	if err != nil {
+		t.Fatalf("error getting project-id %v", err)
+	}
+	if resp.Value != "some-project" {
+		t.Errorf("unexpected response: got %v", resp)
+	}
+	// directories are redirected below the prefix
+	resp, err = c.Get(ctx, &metadatapb.GetRequest{Path: "project"})
+	if err != nil || !strings.Contains(resp.Value, "project-id") {
+		t.Errorf("unexpected directory response: got %v %v", resp, err)
+	}
+	if _, err := c.GetAccessToken(ctx, &metadatapb.GetAccessTokenRequest{}); err != nil {
+		t.Errorf("error getting token %v", err)
+	}
+}
+
+func TestGRPCListenersOnly(t *testing.T) {
+	sc := &ServerConfig{
+		Listeners:    []ListenerSpec{{Network: "tcp", Address: "127.0.0.1:0"}},
+		GRPCPort:     "0",
+		SkipPrefetch: true,
+	}
+	g, err := NewGRPCMetadataServer(context.Background(), sc, &google.Credentials{TokenSource: &countingTokenSource{expiresIn: time.Hour}}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	if err := g.Start(); err != nil {
+		t.Fatalf("error starting emulator %v", err)
+	}
+	defer g.Shutdown()
+
+	// without BindInterface the gRPC API stays on the loopback interface rather than all interfaces
+	host, _, err := net.SplitHostPort(g.GRPCAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "127.0.0.1" {
+		t.Errorf("unexpected gRPC interface: got %v want %v", host, "127.0.0.1")
+	}
+}
+
+func TestGRPCAccessTokenSharesCache(t *testing.T) {
+	ts := &countingTokenSource{expiresIn: time.Hour}
+	g, c := startGRPCServer(t, ts)
+
+	_, body, err := getMetadata("http://" + g.listeners[0].Addr().String() + "/computeMetadata/v1/instance/service-accounts/default/token")
+	if err != nil {
+		t.Fatalf("error getting token over HTTP %v", err)
+	}
+	tok, err := c.GetAccessToken(context.Background(), &metadatapb.GetAccessTokenRequest{})
+	if err != nil {
+		t.Fatalf("error getting token over gRPC %v", err)
+	}
+	if tok.AccessToken != "token-1" || tok.TokenType != "Bearer" || tok.ExpiresIn <= 0 || !strings.Contains(body, tok.AccessToken) {
+		t.Errorf("unexpected token: got %v, HTTP response %s", tok, body)
+	}
+	if n := ts.calls.Load(); n != 1 {
+		t.Errorf("unexpected number of token refreshes: got %d want %d", n, 1)
+	}
+
+	_, err = c.GetAccessToken(context.Background(), &metadatapb.GetAccessTokenRequest{ServiceAccount: "missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("unexpected error for a missing service account: got %v want %v", err, codes.NotFound)
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	g, c := startGRPCServer(t, &countingTokenSource{expiresIn: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := c.Watch(ctx, &metadatapb.WatchRequest{Path: "project/project-id"})
+	if err != nil {
+		t.Fatalf("error watching project-id %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil || resp.Value != "some-project" {
+		t.Fatalf("unexpected first value: got %v %v", resp, err)
+	}
+
+	if err := g.UpdateClaims(projectClaims("other-project")); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	next, err := stream.Recv()
+	if err != nil || next.Value != "other-project" || next.Etag == resp.Etag {
+		t.Fatalf("unexpected value after the change: got %v %v", next, err)
+	}
+
+	g.Shutdown()
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("unexpected error after shutdown: got %v want %v", err, codes.Unavailable)
+	}
+}
+
+func TestGRPCRequiredBearerToken(t *testing.T) {
+	g, c := startGRPCServer(t, &countingTokenSource{expiresIn: time.Hour})
+	g.ServerConfig.RequiredBearerToken = "secret"
+
+	if _, err := c.Get(context.Background(), &metadatapb.GetRequest{Path: "project/project-id"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("unexpected error without a bearer token: got %v want %v", err, codes.Unauthenticated)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	if resp, err := c.Get(ctx, &metadatapb.GetRequest{Path: "project/project-id"}); err != nil || resp.Value != "some-project" {
+		t.Errorf("unexpected response with a bearer token: got %v %v", resp, err)
+	}
+}
+
+func TestNewGRPCMetadataServerRequiresPort(t *testing.T) {
+	if _, err := NewGRPCMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project")); err == nil {
+		t.Errorf("expected error without GRPCPort")
+	}
+}
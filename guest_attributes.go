@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+func copyGuestAttributes(in map[string]map[string]string) map[string]map[string]string {
+	ret := make(map[string]map[string]string, len(in))
+	for ns, attrs := range in {
+		ret[ns] = copyStringMap(attrs)
+	}
+	return ret
+}
+
+// resetGuestAttributes replaces all guest attributes with the ones from the claims
+func (h *MetadataServer) resetGuestAttributes(claims *Claims) {
+	h.guestMutex.Lock()
+	defer h.guestMutex.Unlock()
+	h.guestAttributes = copyGuestAttributes(claims.ComputeMetadata.V1.Instance.GuestAttributes)
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceGuestAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	h.guestMutex.RLock()
+	defer h.guestMutex.RUnlock()
+
+	all := h.guestAttributes
+	if all == nil {
+		all = map[string]map[string]string{}
+	}
+	if h.handleRecursion(w, r, all) {
+		return
+	}
+	namespaces := make([]string, 0, len(all))
+	for ns := range all {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for i := range namespaces {
+		namespaces[i] += "/"
+	}
+	h.writeDirectory(w, namespaces)
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceGuestAttributesNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	h.guestMutex.RLock()
+	defer h.guestMutex.RUnlock()
+
+	attrs, ok := h.guestAttributes[mux.Vars(r)["namespace"]]
+	if !ok {
+		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
+		return
+	}
+	if h.handleRecursion(w, r, attrs) {
+		return
+	}
+	h.writeDirectory(w, listKeys(attrs))
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceGuestAttributesKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ns, key := vars["namespace"], vars["key"]
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if bodyTooLarge(err) {
+			httpError(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge, "text/html; charset=UTF-8")
+			return
+		}
+		if err != nil {
+			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "text/html; charset=UTF-8")
+			return
+		}
+		h.guestMutex.Lock()
+		if h.guestAttributes == nil {
+			h.guestAttributes = map[string]map[string]string{}
+		}
+		if h.guestAttributes[ns] == nil {
+			h.guestAttributes[ns] = map[string]string{}
+		}
+		h.guestAttributes[ns][key] = string(body)
+		h.guestMutex.Unlock()
+
+		h.requestLog(r).Debug("guest attribute set", "namespace", ns, "key", key)
+		h.notifyChange()
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		h.guestMutex.Lock()
+		_, ok := h.guestAttributes[ns][key]
+		if ok {
+			delete(h.guestAttributes[ns], key)
+			if len(h.guestAttributes[ns]) == 0 {
+				delete(h.guestAttributes, ns)
+			}
+		}
+		h.guestMutex.Unlock()
+
+		if !ok {
+			httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
+			return
+		}
+		h.requestLog(r).Debug("guest attribute deleted", "namespace", ns, "key", key)
+		h.notifyChange()
+		w.WriteHeader(http.StatusOK)
+	default:
+		h.guestMutex.RLock()
+		val, ok := h.guestAttributes[ns][key]
+		h.guestMutex.RUnlock()
+
+		if !ok {
+			httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
+			return
+		}
+		h.writeScalar(w, val)
+	}
+}
@@ -0,0 +1,161 @@
+package mds
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+func guestAttributesRequest(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "/computeMetadata/v1/instance/guest-attributes/"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestGuestAttributes(t *testing.T) {
+	claims := projectClaims("some-project-id")
+	claims.ComputeMetadata.V1.Instance.GuestAttributes = map[string]map[string]string{
+		"hostkeys": {"ssh-rsa": "AAAA"},
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims)
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	rr := guestAttributesRequest(t, handler, http.MethodGet, "hostkeys/ssh-rsa", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != "AAAA" {
+		t.Errorf("unexpected initial value: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	rr = guestAttributesRequest(t, handler, http.MethodPut, "osconfig/state", "running")
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status code for PUT: got %v want %v", rr.Code, http.StatusOK)
+	}
+	// writing must not modify the claims the server was created with
+	if _, ok := claims.ComputeMetadata.V1.Instance.GuestAttributes["osconfig"]; ok {
+		t.Errorf("guest attribute write modified the initial claims")
+	}
+
+	for path, want := range map[string]string{
+		"":                         "hostkeys/\nosconfig/\n",
+		"osconfig/":                "state\n",
+		"osconfig/state":           "running",
+		"?recursive=true":          `{"hostkeys":{"ssh-rsa":"AAAA"},"osconfig":{"state":"running"}}`,
+		"hostkeys/?recursive=true": `{"ssh-rsa":"AAAA"}`,
+	} {
+		rr := guestAttributesRequest(t, handler, http.MethodGet, path, "")
+		if rr.Code != http.StatusOK || rr.Body.String() != want {
+			t.Errorf("unexpected response for %s: got %v %q want %q", path, rr.Code, rr.Body.String(), want)
+		}
+	}
+
+	rr = guestAttributesRequest(t, handler, http.MethodDelete, "osconfig/state", "")
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status code for DELETE: got %v want %v", rr.Code, http.StatusOK)
+	}
+	for _, path := range []string{"osconfig/state", "osconfig/"} {
+		rr := guestAttributesRequest(t, handler, http.MethodGet, path, "")
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code for %s after DELETE: got %v want %v", path, rr.Code, http.StatusNotFound)
+		}
+	}
+	rr = guestAttributesRequest(t, handler, http.MethodDelete, "osconfig/state", "")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unexpected status code deleting a missing key: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// writes are only allowed on individual keys
+	rr = guestAttributesRequest(t, handler, http.MethodPut, "osconfig/", "value")
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status code for PUT on a namespace: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+
+	// the Metadata-Flavor header is required for writes too
+	req, err := http.NewRequest(http.MethodPut, "/computeMetadata/v1/instance/guest-attributes/osconfig/state", strings.NewReader("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("unexpected status code for PUT without header: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestGuestAttributesConcurrentWrites(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project-id"))
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				key := fmt.Sprintf("ns%d/key%d", i%3, j)
+				guestAttributesRequest(t, handler, http.MethodPut, key, fmt.Sprintf("%d", i))
+				guestAttributesRequest(t, handler, http.MethodGet, key, "")
+				guestAttributesRequest(t, handler, http.MethodGet, "?recursive=true", "")
+				if j%2 == 0 {
+					guestAttributesRequest(t, handler, http.MethodDelete, key, "")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	rr := guestAttributesRequest(t, handler, http.MethodGet, "", "")
+	if rr.Body.String() != "ns0/\nns1/\nns2/\n" {
+		t.Errorf("unexpected namespaces: got %q", rr.Body.String())
+	}
+}
+
+func TestGuestAttributesMaxRequestBodySize(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{MaxRequestBodySize: 16}, &google.Credentials{}, projectClaims("some-project-id"))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	if rr := guestAttributesRequest(t, handler, http.MethodPut, "osconfig/state", strings.Repeat("a", 16)); rr.Code != http.StatusOK {
+		t.Errorf("unexpected status code for a body at the limit: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := guestAttributesRequest(t, handler, http.MethodPut, "osconfig/state", strings.Repeat("a", 17)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected status code for a body above the limit: got %v want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	// without a Content-Length the body is cut off while it is read
+	req, err := http.NewRequest(http.MethodPut, "/computeMetadata/v1/instance/guest-attributes/osconfig/state", io.MultiReader(strings.NewReader(strings.Repeat("b", 17))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected status code for a streamed body above the limit: got %v want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+	if rr := guestAttributesRequest(t, handler, http.MethodGet, "osconfig/state", ""); rr.Body.String() != strings.Repeat("a", 16) {
+		t.Errorf("rejected body was stored: got %q", rr.Body.String())
+	}
+
+	if _, err := NewMetadataServer(context.Background(), &ServerConfig{MaxRequestBodySize: -1}, &google.Credentials{}, projectClaims("some-project-id")); err == nil {
+		t.Errorf("expected error for a negative MaxRequestBodySize")
+	}
+}
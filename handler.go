@@ -0,0 +1,50 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/oauth2/google"
+)
+
+// NewMetadataHandler returns the http.Handler of a metadata server for claims without binding a listener, eg to pass
+// to httptest.NewServer() or to mount in an existing HTTP server.  Tokens are issued with creds.
+//
+// Like NewTestMetadataServer() it accepts any project id; use NewMetadataHandlerConfig() for other settings.
+func NewMetadataHandler(creds *google.Credentials, claims *Claims, opts ...Option) (http.Handler, error) {
+	return NewMetadataHandlerConfig(&ServerConfig{AllowArbitraryProjectID: true}, creds, claims, opts...)
+}
+
+// NewMetadataHandlerConfig returns the http.Handler of a metadata server configured with serverConfig without
+// binding a listener.  The settings of the listeners, the admin API and the metrics port are ignored.
+//
+// The handler serves the metadata paths, health checks and OIDC discovery like a started server and needs no Start()
+// or Shutdown().  The endpoints are not separate from MetadataServer: the handler is the one of a server which is
+// never started, so both behave the same.  Unless SkipPrefetch is set, a token is fetched from the credentials first
+// like in Start() so /readyz succeeds right away.
+func NewMetadataHandlerConfig(serverConfig *ServerConfig, creds *google.Credentials, claims *Claims, opts ...Option) (http.Handler, error) {
+	h, err := NewMetadataServer(context.Background(), serverConfig, creds, claims, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if !h.ServerConfig.SkipPrefetch {
+		if err := h.prefetchToken(); err != nil {
+			return nil, err
+		}
+	}
+	return h.handler(), nil
+}
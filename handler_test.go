@@ -0,0 +1,69 @@
+package mds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+func TestNewMetadataHandler(t *testing.T) {
+	handler, err := NewMetadataHandler(staticCredentials("some-token"), projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating handler %v", err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	// the token was fetched when the handler was created
+	code, body := metadataRequest(t, srv.URL+"/readyz")
+	if code != http.StatusOK {
+		t.Errorf("handler is not ready: got %d %q", code, body)
+	}
+	code, body = metadataRequest(t, srv.URL+"/computeMetadata/v1/project/project-id")
+	if code != http.StatusOK || body != "some-project" {
+		t.Errorf("unexpected response: got %d %q want %d %q", code, body, http.StatusOK, "some-project")
+	}
+	code, body = metadataRequest(t, srv.URL+"/computeMetadata/v1/instance/service-accounts/default/token")
+	tok := &metadataToken{}
+	if err := json.Unmarshal([]byte(body), tok); code != http.StatusOK || err != nil || tok.AccessToken != "some-token" {
+		t.Errorf("unexpected token response: got %d %q", code, body)
+	}
+
+	// requests are checked like on a started server
+	resp, err := http.Get(srv.URL + "/computeMetadata/v1/project/project-id")
+	if err != nil {
+		t.Fatalf("error getting project id %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("request without Metadata-Flavor returned wrong status code: got %v want %v", resp.StatusCode, http.StatusForbidden)
+	}
+
+	if _, err := NewMetadataHandler(staticCredentials("some-token"), nil); err == nil {
+		t.Errorf("expected error for nil claims")
+	}
+}
+
+func TestNewMetadataHandlerConfig(t *testing.T) {
+	handler, err := NewMetadataHandlerConfig(&ServerConfig{PathPrefix: "/gce-metadata"}, staticCredentials("some-token"), projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating handler %v", err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	code, body := metadataRequest(t, srv.URL+"/gce-metadata/computeMetadata/v1/project/project-id")
+	if code != http.StatusOK || body != "some-project" {
+		t.Errorf("unexpected response: got %d %q want %d %q", code, body, http.StatusOK, "some-project")
+	}
+
+	if _, err := NewMetadataHandlerConfig(&ServerConfig{}, &google.Credentials{TokenSource: errorTokenSource{}}, projectClaims("some-project")); err == nil {
+		t.Errorf("expected error for credentials which cannot issue a token")
+	}
+	if _, err := NewMetadataHandlerConfig(&ServerConfig{SkipPrefetch: true}, &google.Credentials{TokenSource: errorTokenSource{}}, projectClaims("some-project")); err != nil {
+		t.Errorf("error creating handler without prefetch %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	defaultKMSEndpoint = "https://cloudkms.googleapis.com"
+)
+
+// KMSConfig configures a KMSTokenSigner
+type KMSConfig struct {
+	KeyVersion  string              // projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>/cryptoKeyVersions/<version>
+	Credentials *google.Credentials // credentials to call Cloud KMS with; requires cloudkms.cryptoKeyVersions.useToSign and viewPublicKey
+
+	Endpoint string // Cloud KMS API endpoint (default: https://cloudkms.googleapis.com)
+}
+
+// KMSTokenSigner is a TokenSigner which signs id_tokens with an asymmetric Cloud KMS key version.
+//
+// The key must use RSA_SIGN_PKCS1_*_SHA256 or EC_SIGN_P256_SHA256; the private key never leaves Cloud KMS.
+type KMSTokenSigner struct {
+	cfg    KMSConfig
+	client *http.Client
+	pub    crypto.PublicKey
+}
+
+type kmsPublicKey struct {
+	Pem       string `json:"pem"`
+	Algorithm string `json:"algorithm"`
+}
+
+// NewKMSTokenSigner fetches the public key of the key version and checks it can sign id_tokens
+func NewKMSTokenSigner(ctx context.Context, cfg KMSConfig) (*KMSTokenSigner, error) {
+	if cfg.KeyVersion == "" || cfg.Credentials == nil {
+		return nil, errors.New("kms key version and credentials must be set")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = defaultKMSEndpoint
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	s := &KMSTokenSigner{
+		cfg:    cfg,
+		client: oauth2.NewClient(ctx, cfg.Credentials.TokenSource),
+	}
+
+	k := &kmsPublicKey{}
+	if err := s.call(http.MethodGet, "/publicKey", nil, k); err != nil {
+		return nil, fmt.Errorf("unable to get kms public key: %w", err)
+	}
+	rsaPKCS1 := strings.HasPrefix(k.Algorithm, "RSA_SIGN_PKCS1_") && strings.HasSuffix(k.Algorithm, "_SHA256")
+	if !rsaPKCS1 && k.Algorithm != "EC_SIGN_P256_SHA256" {
+		return nil, fmt.Errorf("unsupported kms key algorithm %s; use RSA_SIGN_PKCS1_*_SHA256 or EC_SIGN_P256_SHA256", k.Algorithm)
+	}
+	block, _ := pem.Decode([]byte(k.Pem))
+	if block == nil {
+		return nil, errors.New("unable to decode kms public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse kms public key: %v", err)
+	}
+	s.pub = pub
+	return s, nil
+}
+
+// Public returns the public key of the key version
+func (s *KMSTokenSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign sends the SHA-256 digest to Cloud KMS `asymmetricSign` and returns the signature
+func (s *KMSTokenSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("kms key only signs SHA-256 digests, got %v", opts.HashFunc())
+	}
+	req := map[string]interface{}{
+		"digest": map[string]string{
+			"sha256": base64.StdEncoding.EncodeToString(digest),
+		},
+	}
+	resp := &struct {
+		Signature string `json:"signature"`
+	}{}
+	if err := s.call(http.MethodPost, ":asymmetricSign", req, resp); err != nil {
+		return nil, fmt.Errorf("error signing with kms key %s: %w", s.cfg.KeyVersion, err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Signature)
+}
+
+// call sends a request for the key version resource and decodes the JSON response into ret
+func (s *KMSTokenSigner) call(method, suffix string, body, ret interface{}) error {
+	var r io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(js)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s%s", s.cfg.Endpoint, s.cfg.KeyVersion, suffix), r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error response from kms %d: %s", resp.StatusCode, data)
+	}
+	return json.Unmarshal(data, ret)
+}
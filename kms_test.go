@@ -0,0 +1,174 @@
+package mds
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	kmsKeyVersion = "projects/some-project/locations/global/keyRings/ring/cryptoKeys/idtoken/cryptoKeyVersions/1"
+	kmsToken      = "kms-access-token"
+)
+
+// kmsStub serves the publicKey and asymmetricSign methods of a Cloud KMS key version backed by key
+func kmsStub(t *testing.T, key crypto.Signer, algorithm string, signs *atomic.Int32) *httptest.Server {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+kmsToken {
+			http.Error(w, `{"error":{"code":401}}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/"+kmsKeyVersion+"/publicKey":
+			json.NewEncoder(w).Encode(map[string]string{
+				"pem":       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+				"algorithm": algorithm,
+			})
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/"+kmsKeyVersion+":asymmetricSign":
+			req := &struct {
+				Digest struct {
+					SHA256 string `json:"sha256"`
+				} `json:"digest"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil || r.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("unexpected asymmetricSign request: %v", err)
+				http.Error(w, `{"error":{"code":400}}`, http.StatusBadRequest)
+				return
+			}
+			digest, err := base64.StdEncoding.DecodeString(req.Digest.SHA256)
+			if err != nil || len(digest) != 32 {
+				t.Errorf("unexpected digest %q", req.Digest.SHA256)
+				http.Error(w, `{"error":{"code":400}}`, http.StatusBadRequest)
+				return
+			}
+			sig, err := key.Sign(rand.Reader, digest, crypto.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signs.Add(1)
+			json.NewEncoder(w).Encode(map[string]string{
+				"name":      kmsKeyVersion,
+				"signature": base64.StdEncoding.EncodeToString(sig),
+			})
+		default:
+			http.Error(w, `{"error":{"code":404}}`, http.StatusNotFound)
+		}
+	}))
+}
+
+func kmsCredentials() *google.Credentials {
+	return &google.Credentials{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: kmsToken, Expiry: time.Now().Add(time.Hour)})}
+}
+
+func TestKMSTokenSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		algorithm string
+		key       crypto.Signer
+		alg       string
+	}{
+		{"RSA_SIGN_PKCS1_2048_SHA256", rsaKey, "RS256"},
+		{"EC_SIGN_P256_SHA256", ecKey, "ES256"},
+	} {
+		t.Run(tc.alg, func(t *testing.T) {
+			var signs atomic.Int32
+			kms := kmsStub(t, tc.key, tc.algorithm, &signs)
+			defer kms.Close()
+
+			signer, err := NewKMSTokenSigner(context.Background(), KMSConfig{
+				KeyVersion:  kmsKeyVersion,
+				Credentials: kmsCredentials(),
+				Endpoint:    kms.URL,
+			})
+			if err != nil {
+				t.Fatalf("error creating kms signer %v", err)
+			}
+
+			h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project"), WithTokenSigner(signer), WithLogger(&recordingLogger{}))
+			if err != nil {
+				t.Fatalf("error creating emulator %v", err)
+			}
+			req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/identity?audience=https://foo.bar&format=full", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			rr := httptest.NewRecorder()
+			h.handler().ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			if n := signs.Load(); n != 1 {
+				t.Errorf("unexpected number of asymmetricSign calls: got %d want %d", n, 1)
+			}
+
+			kid, err := keyID(tc.key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims := &localIDTokenClaims{}
+			tok, err := jwt.ParseWithClaims(rr.Body.String(), claims, func(tok *jwt.Token) (interface{}, error) {
+				return tc.key.Public(), nil
+			}, jwt.WithValidMethods([]string{tc.alg}), jwt.WithAudience("https://foo.bar"), jwt.WithIssuer(h.localIssuer()))
+			if err != nil {
+				t.Fatalf("error verifying id_token %v", err)
+			}
+			if tok.Header["kid"] != kid {
+				t.Errorf("unexpected kid: got %v want %v", tok.Header["kid"], kid)
+			}
+			if claims.Email != "metadata-sa@some-project.iam.gserviceaccount.com" {
+				t.Errorf("unexpected email: got %v", claims.Email)
+			}
+		})
+	}
+}
+
+func TestKMSTokenSignerErrors(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signs atomic.Int32
+	kms := kmsStub(t, rsaKey, "RSA_SIGN_PSS_2048_SHA256", &signs)
+	defer kms.Close()
+
+	for _, cfg := range []KMSConfig{
+		{Credentials: kmsCredentials()},
+		{KeyVersion: kmsKeyVersion},
+		{KeyVersion: kmsKeyVersion, Credentials: kmsCredentials(), Endpoint: kms.URL},
+		{KeyVersion: kmsKeyVersion + "0", Credentials: kmsCredentials(), Endpoint: kms.URL},
+	} {
+		if _, err := NewKMSTokenSigner(context.Background(), cfg); err == nil {
+			t.Errorf("expected error for config %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultSTSURL                 = "https://sts.googleapis.com/v1/token"
+	defaultKubernetesTokenFile    = "/var/run/secrets/tokens/gcp-ksa-token"
+	defaultKubernetesPollInterval = 10 * time.Second
+	kubernetesTokenExpiryDelta    = 10 * time.Second
+)
+
+// KubernetesTokenConfig configures a KubernetesTokenFileTokenSource
+type KubernetesTokenConfig struct {
+	TokenFile string   // projected Kubernetes service account token (default: /var/run/secrets/tokens/gcp-ksa-token)
+	Audience  string   // STS audience, eg //iam.googleapis.com/projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>
+	Scopes    []string // scopes to request for access_tokens
+
+	STSURL       string        // token exchange endpoint (default: https://sts.googleapis.com/v1/token)
+	PollInterval time.Duration // interval to check TokenFile for changes if it cannot be watched (default: 10s)
+
+	HTTPClient *http.Client // client used for STS requests (default: http.DefaultClient)
+}
+
+// KubernetesTokenFileTokenSource is an oauth2.TokenSource which exchanges a projected Kubernetes service account
+// token for a federated GCP access_token at the Security Token Service.
+//
+// The token file is watched so a token rotated by the kubelet is exchanged on the next call to Token().  If the
+// file cannot be watched, it is polled every PollInterval instead.  Call Close() to stop watching.
+type KubernetesTokenFileTokenSource struct {
+	cfg KubernetesTokenConfig
+
+	mu  sync.Mutex
+	tok *oauth2.Token
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewKubernetesTokenFileTokenSource checks the token file exists and starts watching it
+func NewKubernetesTokenFileTokenSource(cfg KubernetesTokenConfig) (*KubernetesTokenFileTokenSource, error) {
+	if cfg.Audience == "" {
+		return nil, errors.New("kubernetes token exchange audience must be set")
+	}
+	if cfg.TokenFile == "" {
+		cfg.TokenFile = defaultKubernetesTokenFile
+	}
+	if cfg.STSURL == "" {
+		cfg.STSURL = defaultSTSURL
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultKubernetesPollInterval
+	}
+	if _, err := os.Stat(cfg.TokenFile); err != nil {
+		return nil, fmt.Errorf("unable to read kubernetes token file: %w", err)
+	}
+
+	s := &KubernetesTokenFileTokenSource{cfg: cfg, done: make(chan struct{})}
+	if err := s.watch(); err != nil {
+		go s.poll()
+	}
+	return s, nil
+}
+
+// Token returns a cached access_token or exchanges the current Kubernetes token once it is about to expire or the file changed
+func (s *KubernetesTokenFileTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tok != nil && time.Until(s.tok.Expiry) > kubernetesTokenExpiryDelta {
+		return s.tok, nil
+	}
+	data, err := os.ReadFile(s.cfg.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read kubernetes token file: %w", err)
+	}
+	subjectToken := strings.TrimSpace(string(data))
+	if subjectToken == "" {
+		return nil, fmt.Errorf("kubernetes token file %s is empty", s.cfg.TokenFile)
+	}
+	tok, err := s.exchange(subjectToken)
+	if err != nil {
+		return nil, err
+	}
+	s.tok = tok
+	return tok, nil
+}
+
+// Invalidate drops the cached token so the next call to Token() exchanges the Kubernetes token again
+func (s *KubernetesTokenFileTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tok = nil
+}
+
+// Close stops watching the token file
+func (s *KubernetesTokenFileTokenSource) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// watch invalidates the cached token whenever the directory of the token file changes.  Kubernetes updates
+// projected volumes by swapping a symlink, so the directory is watched rather than the file itself.
+func (s *KubernetesTokenFileTokenSource) watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(s.cfg.TokenFile)); err != nil {
+		w.Close()
+		return err
+	}
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-s.done:
+				return
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				s.Invalidate()
+			case _, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// poll invalidates the cached token whenever the modification time or size of the token file changes
+func (s *KubernetesTokenFileTokenSource) poll() {
+	var modTime time.Time
+	var size int64
+	if fi, err := os.Stat(s.cfg.TokenFile); err == nil {
+		modTime, size = fi.ModTime(), fi.Size()
+	}
+	t := time.NewTicker(s.cfg.PollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			fi, err := os.Stat(s.cfg.TokenFile)
+			if err != nil {
+				continue
+			}
+			if !fi.ModTime().Equal(modTime) || fi.Size() != size {
+				modTime, size = fi.ModTime(), fi.Size()
+				s.Invalidate()
+			}
+		}
+	}
+}
+
+// exchange trades the Kubernetes token for a federated access_token (RFC 8693)
+func (s *KubernetesTokenFileTokenSource) exchange(subjectToken string) (*oauth2.Token, error) {
+	client := s.cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return stsExchange(client, s.cfg.STSURL, s.cfg.Audience, jwtSubjectTokenType, subjectToken, s.cfg.Scopes)
+}
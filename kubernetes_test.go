@@ -0,0 +1,138 @@
+package mds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stsStub returns a federated access_token derived from the subject_token of every valid token exchange request
+func stsStub(t testing.TB, audience string, exchanges *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for k, want := range map[string]string{
+			"grant_type":           "urn:ietf:params:oauth:grant-type:token-exchange",
+			"audience":             audience,
+			"requested_token_type": "urn:ietf:params:oauth:token-type:access_token",
+			"subject_token_type":   "urn:ietf:params:oauth:token-type:jwt",
+			"scope":                cloudPlatformScope,
+		} {
+			if got := r.PostForm.Get(k); got != want {
+				t.Errorf("unexpected %s: got %q want %q", k, got, want)
+				http.Error(w, "invalid_request", http.StatusBadRequest)
+				return
+			}
+		}
+		if r.PostForm.Get("subject_token") == "rejected" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		exchanges.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":      "federated-" + r.PostForm.Get("subject_token"),
+			"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+			"token_type":        "Bearer",
+			"expires_in":        3600,
+		})
+	}))
+}
+
+func TestKubernetesTokenFileTokenSource(t *testing.T) {
+	audience := "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/gke"
+	var exchanges atomic.Int32
+	sts := stsStub(t, audience, &exchanges)
+	defer sts.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "gcp-ksa-token")
+	if err := os.WriteFile(tokenFile, []byte("ksa-token-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewKubernetesTokenFileTokenSource(KubernetesTokenConfig{
+		TokenFile:    tokenFile,
+		Audience:     audience,
+		Scopes:       []string{cloudPlatformScope},
+		STSURL:       sts.URL,
+		PollInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("error creating token source %v", err)
+	}
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatalf("error getting token %v", err)
+		}
+		if tok.AccessToken != "federated-ksa-token-1" {
+			t.Errorf("unexpected access_token: got %v want %v", tok.AccessToken, "federated-ksa-token-1")
+		}
+	}
+	if n := exchanges.Load(); n != 1 {
+		t.Errorf("unexpected number of token exchanges: got %d want %d", n, 1)
+	}
+
+	// a rotated token is exchanged once the change is noticed
+	if err := os.WriteFile(tokenFile, []byte("ksa-token-2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatalf("error getting token %v", err)
+		}
+		if tok.AccessToken == "federated-ksa-token-2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rotated kubernetes token was not exchanged: got %v", tok.AccessToken)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := os.WriteFile(tokenFile, []byte("rejected"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts.Invalidate()
+	if _, err := ts.Token(); err == nil {
+		t.Errorf("expected error for a token rejected by STS")
+	}
+}
+
+func TestKubernetesTokenFileTokenSourceErrors(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "gcp-ksa-token")
+	for _, cfg := range []KubernetesTokenConfig{
+		{TokenFile: tokenFile},
+		{TokenFile: tokenFile, Audience: "aud"},
+	} {
+		if _, err := NewKubernetesTokenFileTokenSource(cfg); err == nil {
+			t.Errorf("expected error for config %+v", cfg)
+		}
+	}
+
+	if err := os.WriteFile(tokenFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewKubernetesTokenFileTokenSource(KubernetesTokenConfig{TokenFile: tokenFile, Audience: "aud"})
+	if err != nil {
+		t.Fatalf("error creating token source %v", err)
+	}
+	defer ts.Close()
+	if _, err := ts.Token(); err == nil {
+		t.Errorf("expected error for an empty token file")
+	}
+}
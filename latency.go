@@ -0,0 +1,106 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Latency is the delay added before a response is written.  The delay is picked uniformly between Min and Max;
+// if Max is not greater than Min, the delay is always Min.
+type Latency struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// FixedLatency returns a Latency which always delays responses by d
+func FixedLatency(d time.Duration) Latency {
+	return Latency{Min: d, Max: d}
+}
+
+func (l Latency) duration() time.Duration {
+	if l.Max <= l.Min {
+		return l.Min
+	}
+	return l.Min + time.Duration(rand.Int63n(int64(l.Max-l.Min)))
+}
+
+// LatencyConfig maps request path prefixes to the latency simulated for them.  If several prefixes match a request, the longest one is used.
+type LatencyConfig map[string]Latency
+
+// Validate checks that every latency is non-negative
+func (lc LatencyConfig) Validate() error {
+	for prefix, l := range lc {
+		if l.Min < 0 || l.Max < 0 {
+			return fmt.Errorf("latency for %s cannot be negative", prefix)
+		}
+	}
+	return nil
+}
+
+func (lc LatencyConfig) match(path string) (Latency, bool) {
+	var ret Latency
+	longest := -1
+	for prefix, l := range lc {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			ret = l
+			longest = len(prefix)
+		}
+	}
+	return ret, longest >= 0
+}
+
+// SetLatencyConfig replaces the simulated latencies of a running server.  Requests already in flight are not affected.
+func (h *MetadataServer) SetLatencyConfig(lc LatencyConfig) error {
+	if err := lc.Validate(); err != nil {
+		return err
+	}
+	latencies := make(LatencyConfig, len(lc))
+	for k, v := range lc {
+		latencies[k] = v
+	}
+
+	h.latencyMutex.Lock()
+	defer h.latencyMutex.Unlock()
+	h.ServerConfig.LatencyConfig = latencies
+	return nil
+}
+
+// injectLatency holds requests matching the LatencyConfig before they are served
+func (h *MetadataServer) injectLatency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.latencyMutex.RLock()
+		l, ok := h.ServerConfig.LatencyConfig.match(r.URL.Path)
+		h.latencyMutex.RUnlock()
+
+		if ok {
+			if d := l.duration(); d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-t.C:
+				case <-r.Context().Done():
+					// the client gave up, there is nobody to respond to
+					t.Stop()
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
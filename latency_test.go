@@ -0,0 +1,94 @@
+package mds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+func TestLatencyConfig(t *testing.T) {
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	sc := &ServerConfig{
+		Port:         fmt.Sprintf(":%d", p),
+		SkipPrefetch: true,
+		LatencyConfig: LatencyConfig{
+			"/computeMetadata/v1/project/": FixedLatency(200 * time.Millisecond),
+		},
+	}
+
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("some-project-id"))
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err != nil {
+		t.Errorf("error starting emulator %v", err)
+	}
+	defer h.Shutdown()
+
+	projectURL := fmt.Sprintf("http://127.0.0.1:%d/computeMetadata/v1/project/project-id", p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, projectURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	_, err = http.DefaultClient.Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context deadline exceeded, got %v", err)
+	}
+
+	// more specific prefixes take precedence
+	err = h.SetLatencyConfig(LatencyConfig{
+		"/computeMetadata/v1/project/":           FixedLatency(200 * time.Millisecond),
+		"/computeMetadata/v1/project/project-id": {Min: 0, Max: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("error setting latency config %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, projectURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error getting project-id %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestLatencyConfigValidate(t *testing.T) {
+	h := &MetadataServer{}
+	err := h.SetLatencyConfig(LatencyConfig{"/": {Min: -time.Second}})
+	if err == nil {
+		t.Errorf("expected error setting negative latency")
+	}
+
+	for _, l := range []Latency{
+		FixedLatency(10 * time.Millisecond),
+		{Min: 10 * time.Millisecond, Max: 20 * time.Millisecond},
+	} {
+		for i := 0; i < 10; i++ {
+			if d := l.duration(); d < l.Min || (l.Max > l.Min && d >= l.Max) {
+				t.Errorf("latency %v outside of range %+v", d, l)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Logger receives all log output from the metadata server.
+//
+// Each call carries a message and an optional list of alternating key-value pairs,
+// which maps directly onto structured loggers like slog, zap or zerolog.  Lines logged
+// while serving a request carry the request id under the `requestID` key.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// Option configures optional behavior of a MetadataServer created with `NewMetadataServer()`
+type Option func(*MetadataServer)
+
+// WithLogger sends all server logging to the provided Logger instead of glog
+func WithLogger(l Logger) Option {
+	return func(h *MetadataServer) {
+		h.logger = l
+	}
+}
+
+// glogLogger is the default Logger and writes through glog.  Debug messages are emitted at verbosity 10
+type glogLogger struct{}
+
+func formatKeysAndValues(msg string, keysAndValues ...interface{}) string {
+	if len(keysAndValues) == 0 {
+		return msg
+	}
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 < len(keysAndValues) {
+			fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", keysAndValues[i])
+		}
+	}
+	return b.String()
+}
+
+func (glogLogger) Debug(msg string, keysAndValues ...interface{}) {
+	glog.V(10).Info(formatKeysAndValues(msg, keysAndValues...))
+}
+
+func (glogLogger) Info(msg string, keysAndValues ...interface{}) {
+	glog.InfoDepth(1, formatKeysAndValues(msg, keysAndValues...))
+}
+
+func (glogLogger) Warn(msg string, keysAndValues ...interface{}) {
+	glog.WarningDepth(1, formatKeysAndValues(msg, keysAndValues...))
+}
+
+func (glogLogger) Error(msg string, keysAndValues ...interface{}) {
+	glog.ErrorDepth(1, formatKeysAndValues(msg, keysAndValues...))
+}
+
+// log returns the configured Logger or falls back to glog
+func (h *MetadataServer) log() Logger {
+	if h.logger == nil {
+		return glogLogger{}
+	}
+	return h.logger
+}
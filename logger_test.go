@@ -0,0 +1,91 @@
+package mds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+type logEntry struct {
+	level         string
+	msg           string
+	keysAndValues []interface{}
+}
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) record(level, msg string, keysAndValues ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, keysAndValues})
+}
+
+func (l *recordingLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.record("debug", msg, keysAndValues...)
+}
+func (l *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.record("info", msg, keysAndValues...)
+}
+func (l *recordingLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.record("warn", msg, keysAndValues...)
+}
+func (l *recordingLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.record("error", msg, keysAndValues...)
+}
+
+func TestWithLogger(t *testing.T) {
+	l := &recordingLogger{}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, &Claims{}, WithLogger(l))
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/project/project-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Foo")
+	rr := httptest.NewRecorder()
+	h.handler().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	var found bool
+	for _, e := range l.entries {
+		if e.level == "error" && e.msg == "Incorrect metadata flavor provided" {
+			if len(e.keysAndValues) != 4 || e.keysAndValues[0] != RequestIDKey || e.keysAndValues[1] != rr.Header().Get(requestIDHeader) || e.keysAndValues[2] != "flavor" || e.keysAndValues[3] != "Foo" {
+				t.Errorf("logger received unexpected fields: got %v", e.keysAndValues)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("logger did not receive expected error entry: got %v", l.entries)
+	}
+}
+
+func TestFormatKeysAndValues(t *testing.T) {
+	for _, tc := range []struct {
+		keysAndValues []interface{}
+		want          string
+	}{
+		{nil, "msg"},
+		{[]interface{}{"path", "/"}, "msg path=/"},
+		{[]interface{}{"code", 404, "error", fmt.Errorf("foo")}, "msg code=404 error=foo"},
+		{[]interface{}{"dangling"}, "msg dangling"},
+	} {
+		if got := formatKeysAndValues("msg", tc.keysAndValues...); got != tc.want {
+			t.Errorf("unexpected formatted log line: got %q want %q", got, tc.want)
+		}
+	}
+}
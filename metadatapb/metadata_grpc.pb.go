@@ -0,0 +1,272 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.25.3
+// source: metadata.proto
+
+package metadatapb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Metadata_Get_FullMethodName              = "/google.compute.metadata.v1.Metadata/Get"
+	Metadata_Watch_FullMethodName            = "/google.compute.metadata.v1.Metadata/Watch"
+	Metadata_GetAccessToken_FullMethodName   = "/google.compute.metadata.v1.Metadata/GetAccessToken"
+	Metadata_GetIdentityToken_FullMethodName = "/google.compute.metadata.v1.Metadata/GetIdentityToken"
+)
+
+// MetadataClient is the client API for Metadata service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MetadataClient interface {
+	// Get returns the value at a path, eg "instance/hostname" or "project/attributes/"
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// Watch sends the current value at a path and then the new value each time it changes, like ?wait_for_change=true.
+	// The stream ends when the client cancels it or the server shuts down.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Metadata_WatchClient, error)
+	// GetAccessToken returns an access_token like instance/service-accounts/<service_account>/token
+	GetAccessToken(ctx context.Context, in *GetAccessTokenRequest, opts ...grpc.CallOption) (*AccessToken, error)
+	// GetIdentityToken returns an id_token like instance/service-accounts/<service_account>/identity
+	GetIdentityToken(ctx context.Context, in *GetIdentityTokenRequest, opts ...grpc.CallOption) (*IdentityToken, error)
+}
+
+type metadataClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMetadataClient(cc grpc.ClientConnInterface) MetadataClient {
+	return &metadataClient{cc}
+}
+
+func (c *metadataClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, Metadata_Get_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metadataClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Metadata_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Metadata_ServiceDesc.Streams[0], Metadata_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metadataWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Metadata_WatchClient interface {
+	Recv() (*GetResponse, error)
+	grpc.ClientStream
+}
+
+type metadataWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *metadataWatchClient) Recv() (*GetResponse, error) {
+	m := new(GetResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *metadataClient) GetAccessToken(ctx context.Context, in *GetAccessTokenRequest, opts ...grpc.CallOption) (*AccessToken, error) {
+	out := new(AccessToken)
+	err := c.cc.Invoke(ctx, Metadata_GetAccessToken_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metadataClient) GetIdentityToken(ctx context.Context, in *GetIdentityTokenRequest, opts ...grpc.CallOption) (*IdentityToken, error) {
+	out := new(IdentityToken)
+	err := c.cc.Invoke(ctx, Metadata_GetIdentityToken_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MetadataServer is the server API for Metadata service.
+// All implementations must embed UnimplementedMetadataServer
+// for forward compatibility
+type MetadataServer interface {
+	// Get returns the value at a path, eg "instance/hostname" or "project/attributes/"
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// Watch sends the current value at a path and then the new value each time it changes, like ?wait_for_change=true.
+	// The stream ends when the client cancels it or the server shuts down.
+	Watch(*WatchRequest, Metadata_WatchServer) error
+	// GetAccessToken returns an access_token like instance/service-accounts/<service_account>/token
+	GetAccessToken(context.Context, *GetAccessTokenRequest) (*AccessToken, error)
+	// GetIdentityToken returns an id_token like instance/service-accounts/<service_account>/identity
+	GetIdentityToken(context.Context, *GetIdentityTokenRequest) (*IdentityToken, error)
+	mustEmbedUnimplementedMetadataServer()
+}
+
+// UnimplementedMetadataServer must be embedded to have forward compatible implementations.
+type UnimplementedMetadataServer struct {
+}
+
+func (UnimplementedMetadataServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedMetadataServer) Watch(*WatchRequest, Metadata_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedMetadataServer) GetAccessToken(context.Context, *GetAccessTokenRequest) (*AccessToken, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAccessToken not implemented")
+}
+func (UnimplementedMetadataServer) GetIdentityToken(context.Context, *GetIdentityTokenRequest) (*IdentityToken, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetIdentityToken not implemented")
+}
+func (UnimplementedMetadataServer) mustEmbedUnimplementedMetadataServer() {}
+
+// UnsafeMetadataServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MetadataServer will
+// result in compilation errors.
+type UnsafeMetadataServer interface {
+	mustEmbedUnimplementedMetadataServer()
+}
+
+func RegisterMetadataServer(s grpc.ServiceRegistrar, srv MetadataServer) {
+	s.RegisterService(&Metadata_ServiceDesc, srv)
+}
+
+func _Metadata_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetadataServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Metadata_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetadataServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Metadata_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetadataServer).Watch(m, &metadataWatchServer{stream})
+}
+
+type Metadata_WatchServer interface {
+	Send(*GetResponse) error
+	grpc.ServerStream
+}
+
+type metadataWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *metadataWatchServer) Send(m *GetResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Metadata_GetAccessToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetAccessTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetadataServer).GetAccessToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Metadata_GetAccessToken_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetadataServer).GetAccessToken(ctx, req.(*GetAccessTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Metadata_GetIdentityToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetIdentityTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetadataServer).GetIdentityToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Metadata_GetIdentityToken_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetadataServer).GetIdentityToken(ctx, req.(*GetIdentityTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Metadata_ServiceDesc is the grpc.ServiceDesc for Metadata service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Metadata_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "google.compute.metadata.v1.Metadata",
+	HandlerType: (*MetadataServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _Metadata_Get_Handler,
+		},
+		{
+			MethodName: "GetAccessToken",
+			Handler:    _Metadata_GetAccessToken_Handler,
+		},
+		{
+			MethodName: "GetIdentityToken",
+			Handler:    _Metadata_GetIdentityToken_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Metadata_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "metadata.proto",
+}
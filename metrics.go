@@ -0,0 +1,165 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	accessTokenType = "access_token"
+	idTokenType     = "id_token"
+)
+
+// serverMetrics holds the prometheus collectors for a MetadataServer
+type serverMetrics struct {
+	path     string // path the metrics are served on through the metadata listener (empty if not served there)
+	registry prometheus.Registerer
+
+	httpDuration   *prometheus.HistogramVec
+	pathReqs       *prometheus.CounterVec
+	tokenRefreshes *prometheus.CounterVec
+	tokenExpiry    prometheus.Gauge
+	configReloads  *prometheus.CounterVec
+}
+
+// EnableMetrics registers the server's prometheus metrics with reg and serves them at path on the
+// metadata listener.  The metrics path does not require the Metadata-Flavor header.
+//
+// If reg is nil, prometheus.DefaultRegisterer is used.
+func EnableMetrics(path string, reg prometheus.Registerer) Option {
+	return func(h *MetadataServer) {
+		if path == "" {
+			path = defaultMetricsPath
+		}
+		h.metrics = newServerMetrics(reg)
+		h.metrics.path = path
+	}
+}
+
+// registerCollector registers c or returns the already registered collector with the same description
+// so multiple servers can share one registry
+func registerCollector[T prometheus.Collector](reg prometheus.Registerer, c T) T {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+	}
+	return c
+}
+
+func newServerMetrics(reg prometheus.Registerer) *serverMetrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return &serverMetrics{
+		registry: reg,
+		httpDuration: registerCollector(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "metadata_endpoint_latency_seconds",
+			Help: "Duration of HTTP requests.",
+		}, []string{"path"})),
+		pathReqs: registerCollector(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metadata_endpoint_path_requests",
+			Help: "backend status, partitioned by status code and route.",
+		}, []string{"code", "path"})),
+		tokenRefreshes: registerCollector(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metadata_upstream_token_refresh_total",
+			Help: "Number of tokens requested from the upstream credential source, partitioned by token type.",
+		}, []string{"type"})),
+		tokenExpiry: registerCollector(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "metadata_access_token_expiry_seconds",
+			Help: "Seconds until the most recently issued access_token expires.",
+		})),
+		configReloads: registerCollector(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metadata_config_reloads_total",
+			Help: "Number of config file reloads requested with ReloadConfigFile(), eg on SIGHUP, partitioned by result.",
+		}, []string{"result"})),
+	}
+}
+
+// handler returns the http.Handler serving the metrics registered with this server
+func (m *serverMetrics) handler() http.Handler {
+	if g, ok := m.registry.(prometheus.Gatherer); ok {
+		return promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	}
+	return promhttp.Handler()
+}
+
+func (m *serverMetrics) tokenRefreshed(tokenType string) {
+	if m == nil {
+		return
+	}
+	m.tokenRefreshes.WithLabelValues(tokenType).Inc()
+}
+
+func (m *serverMetrics) tokenExpiresIn(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.tokenExpiry.Set(d.Seconds())
+}
+
+func (m *serverMetrics) configReloaded(err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.configReloads.WithLabelValues(result).Inc()
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (h *MetadataServer) prometheusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.metrics == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := mux.CurrentRoute(r)
+		path, _ := route.GetPathTemplate()
+		timer := prometheus.NewTimer(h.metrics.httpDuration.WithLabelValues(path))
+		sw := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		timer.ObserveDuration()
+		// labelled by route like the latency so clients cannot create a series per path
+		h.metrics.pathReqs.WithLabelValues(strconv.Itoa(sw.code), path).Inc()
+	})
+}
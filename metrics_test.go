@@ -0,0 +1,148 @@
+package mds
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+func TestEnableMetrics(t *testing.T) {
+	creds := &google.Credentials{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{
+			AccessToken: "foo",
+			Expiry:      time.Now().Add(time.Second * 60),
+			TokenType:   "Bearer",
+		})}
+
+	reg := prometheus.NewRegistry()
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, creds, projectClaims("some-project-id"), EnableMetrics("/metrics", reg))
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	for _, path := range []string{
+		"/computeMetadata/v1/project/project-id",
+		"/computeMetadata/v1/project/project-id",
+		"/computeMetadata/v1/instance/service-accounts/default/token",
+	} {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+	}
+
+	if got := testutil.ToFloat64(h.metrics.pathReqs.WithLabelValues("200", "/computeMetadata/v1/project/project-id")); got != 2 {
+		t.Errorf("unexpected request count for project-id: got %v want %v", got, 2)
+	}
+	if got := testutil.ToFloat64(h.metrics.pathReqs.WithLabelValues("200", "/computeMetadata/v1/instance/service-accounts/{acct}/{key}")); got != 1 {
+		t.Errorf("unexpected request count for token: got %v want %v", got, 1)
+	}
+
+	// requests are counted by route, not by the path requested
+	for _, path := range []string{"/computeMetadata/v1/instance/attributes/missing-1", "/computeMetadata/v1/instance/attributes/missing-2"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if got := testutil.ToFloat64(h.metrics.pathReqs.WithLabelValues("404", "/computeMetadata/v1/instance/attributes/{key}")); got != 2 {
+		t.Errorf("unexpected request count for missing attributes: got %v want %v", got, 2)
+	}
+	if got := testutil.ToFloat64(h.metrics.tokenRefreshes.WithLabelValues(accessTokenType)); got != 1 {
+		t.Errorf("unexpected token refresh count: got %v want %v", got, 1)
+	}
+	if got := testutil.ToFloat64(h.metrics.tokenExpiry); got <= 0 || got > 60 {
+		t.Errorf("unexpected token expiry: got %v", got)
+	}
+	if got := testutil.CollectAndCount(h.metrics.httpDuration); got != 3 {
+		t.Errorf("unexpected number of latency series: got %v want %v", got, 3)
+	}
+
+	// the metrics endpoint must not require the Metadata-Flavor header
+	req, err := http.NewRequest(http.MethodGet, "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if !strings.Contains(rr.Body.String(), "metadata_upstream_token_refresh_total") {
+		t.Errorf("metrics endpoint did not return expected metric: got %v", rr.Body.String())
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project-id"))
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	h.handler().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestMetricsListenerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	sc := &ServerConfig{BindInterface: "127.0.0.1", Port: ":0", SkipPrefetch: true, MetricsEnabled: true, MetricsInterface: "127.0.0.1", MetricsPort: port}
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("some-project-id"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	url := "http://127.0.0.1:" + port + defaultMetricsPath
+	// the port is free again after Shutdown() so the server can be started again
+	for i := 0; i < 2; i++ {
+		if err := h.Start(); err != nil {
+			t.Fatalf("error starting emulator %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp, err := http.Get(url)
+			if err == nil {
+				resp.Body.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("metrics listener did not start: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := h.Shutdown(); err != nil {
+			t.Fatalf("error stopping emulator %v", err)
+		}
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+			t.Fatalf("metrics listener still serving after Shutdown()")
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+	jwksPath          = "/.well-known/jwks.json"
+
+	googleIssuer  = "https://accounts.google.com"
+	googleJWKSURI = "https://www.googleapis.com/oauth2/v3/certs"
+
+	localIssuerFormat = "http://metadata.google.internal/projects/%s"
+	idTokenLifetime   = time.Hour
+
+	// values of the identity endpoint's `format` and the token endpoint's `token_format` parameter
+	idTokenFormatStandard = "standard"
+	idTokenFormatFull     = "full"
+)
+
+// oidcDiscovery is the subset of the OpenID Provider Metadata needed to verify id_tokens
+type oidcDiscovery struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                  []string `json:"claims_supported"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type localIDTokenClaims struct {
+	jwt.RegisteredClaims
+	AuthorizedParty string `json:"azp,omitempty"`
+	Email           string `json:"email,omitempty"`
+	EmailVerified   bool   `json:"email_verified,omitempty"`
+
+	Google *googleIDTokenClaims `json:"google,omitempty"` // only with format=full
+}
+
+// googleIDTokenClaims is the `google` claim GCE adds to format=full id_tokens
+type googleIDTokenClaims struct {
+	ComputeEngine computeEngineIDTokenClaims `json:"compute_engine"`
+}
+
+type computeEngineIDTokenClaims struct {
+	ProjectID     string `json:"project_id"`
+	ProjectNumber int64  `json:"project_number"`
+	Zone          string `json:"zone"`
+	InstanceID    string `json:"instance_id"`
+	InstanceName  string `json:"instance_name"`
+}
+
+// TokenSigner signs the id_tokens issued by the metadata server, eg with a key held in Cloud KMS.
+//
+// Sign is called with the SHA-256 digest of the JWT signing input.  RSA keys must return a PKCS#1 v1.5
+// signature and P-256 EC keys an ASN.1 DER encoded signature, as *rsa.PrivateKey and *ecdsa.PrivateKey do.
+type TokenSigner interface {
+	crypto.Signer
+}
+
+// WithTokenSigner signs id_tokens with s instead of requesting them from Google; it replaces ServerConfig.IDTokenSigningKey
+func WithTokenSigner(s TokenSigner) Option {
+	return func(h *MetadataServer) {
+		h.ServerConfig.IDTokenSigningKey = s
+	}
+}
+
+// signingMethod returns the JWT algorithm used with key.  Only RSA and P-256 EC keys are supported.
+func signingMethod(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 EC keys are supported for id_token signing")
+		}
+		return jwt.SigningMethodES256, nil
+	default:
+		return nil, fmt.Errorf("unsupported id_token signing key type %T", pub)
+	}
+}
+
+// signerMethod signs JWTs with any crypto.Signer rather than only in-memory private keys
+type signerMethod struct {
+	jwt.SigningMethod
+}
+
+func (m *signerMethod) Sign(signingString string, key interface{}) ([]byte, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("id_token signing key %T is not a crypto.Signer", key)
+	}
+	digest := sha256.Sum256([]byte(signingString))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	if m.Alg() != jwt.SigningMethodES256.Alg() {
+		return sig, nil
+	}
+	// JWS uses the fixed size R || S encoding for EC signatures
+	var esig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(sig, &esig); err != nil {
+		return nil, fmt.Errorf("unable to parse EC signature: %v", err)
+	}
+	out := make([]byte, 64)
+	esig.R.FillBytes(out[:32])
+	esig.S.FillBytes(out[32:])
+	return out, nil
+}
+
+// keyID derives a stable key id from the public key
+func keyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:20]), nil
+}
+
+func toJWK(key crypto.Signer) (*jsonWebKey, error) {
+	method, err := signingMethod(key)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := keyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	jwk := &jsonWebKey{
+		Use: "sig",
+		Alg: method.Alg(),
+		Kid: kid,
+	}
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32)))
+	}
+	return jwk, nil
+}
+
+// localIssuer is the issuer of id_tokens signed with ServerConfig.IDTokenSigningKey
+func (h *MetadataServer) localIssuer() string {
+	return fmt.Sprintf(localIssuerFormat, h.Claims.ComputeMetadata.V1.Project.ProjectID)
+}
+
+// signIDToken signs an id_token for the account.  Like GCE, email and email_verified are only included with
+// format=full, together with the `google.compute_engine` instance claims.
+func (h *MetadataServer) signIDToken(account, targetAudience, format string) (string, error) {
+	key := h.ServerConfig.IDTokenSigningKey
+	method, err := signingMethod(key)
+	if err != nil {
+		return "", err
+	}
+	kid, err := keyID(key.Public())
+	if err != nil {
+		return "", err
+	}
+
+	email := h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[account].Email
+	if account == defaultServiceAccount && os.Getenv(googleServiceAccountEmail) != "" {
+		email = os.Getenv(googleServiceAccountEmail)
+	}
+	iat := time.Now()
+	claims := &localIDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    h.localIssuer(),
+			Subject:   email,
+			Audience:  []string{targetAudience},
+			IssuedAt:  jwt.NewNumericDate(iat),
+			ExpiresAt: jwt.NewNumericDate(iat.Add(idTokenLifetime)),
+		},
+		AuthorizedParty: email,
+	}
+	if format == idTokenFormatFull {
+		instance := h.recursiveInstance()
+		claims.Email = email
+		claims.EmailVerified = email != ""
+		claims.Google = &googleIDTokenClaims{
+			ComputeEngine: computeEngineIDTokenClaims{
+				ProjectID:     h.Claims.ComputeMetadata.V1.Project.ProjectID,
+				ProjectNumber: h.Claims.ComputeMetadata.V1.Project.NumericProjectID,
+				Zone:          path.Base(instance.Zone),
+				InstanceID:    strconv.FormatUint(instance.ID, 10),
+				InstanceName:  instance.Name,
+			},
+		}
+	}
+
+	token := jwt.NewWithClaims(&signerMethod{method}, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(key)
+}
+
+func (h *MetadataServer) oidcDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	h.stateMutex.RLock()
+	defer h.stateMutex.RUnlock()
+
+	// without a local key, id_tokens are issued by Google so point verifiers at its keys
+	d := &oidcDiscovery{
+		Issuer:                           googleIssuer,
+		JWKSURI:                          googleJWKSURI,
+		ResponseTypesSupported:           []string{"id_token"},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{"RS256"},
+		ClaimsSupported:                  []string{"aud", "azp", "email", "email_verified", "exp", "iat", "iss", "sub"},
+	}
+	if key := h.ServerConfig.IDTokenSigningKey; key != nil {
+		method, err := signingMethod(key)
+		if err != nil {
+			h.requestLog(r).Error("Unable to determine id_token signing algorithm", "error", err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/html; charset=UTF-8")
+			return
+		}
+		d.Issuer = h.localIssuer()
+		d.JWKSURI = fmt.Sprintf("http://%s%s", r.Host, jwksPath)
+		d.IDTokenSigningAlgValuesSupported = []string{method.Alg()}
+	}
+
+	js, err := json.Marshal(d)
+	if err != nil {
+		h.requestLog(r).Error("Unable to marshal discovery document", "error", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/html; charset=UTF-8")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (h *MetadataServer) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	key := h.ServerConfig.IDTokenSigningKey
+	if key == nil {
+		h.notFound(w, r)
+		return
+	}
+	jwk, err := toJWK(key)
+	if err != nil {
+		h.requestLog(r).Error("Unable to encode id_token signing key", "error", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/html; charset=UTF-8")
+		return
+	}
+	js, err := json.Marshal(&jsonWebKeySet{Keys: []jsonWebKey{*jwk}})
+	if err != nil {
+		h.requestLog(r).Error("Unable to marshal jwks", "error", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/html; charset=UTF-8")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
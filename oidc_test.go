@@ -0,0 +1,301 @@
+package mds
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2/google"
+)
+
+func publicKeyFromJWK(t *testing.T, k jsonWebKey) crypto.PublicKey {
+	decode := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("error decoding jwk value %v", err)
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	switch k.Kty {
+	case "RSA":
+		return &rsa.PublicKey{N: decode(k.N), E: int(decode(k.E).Int64())}
+	case "EC":
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: decode(k.X), Y: decode(k.Y)}
+	}
+	t.Fatalf("unexpected jwk type %s", k.Kty)
+	return nil
+}
+
+func TestLocalIDTokenSigning(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for alg, key := range map[string]crypto.Signer{
+		"RS256": rsaKey,
+		"ES256": ecKey,
+	} {
+		t.Run(alg, func(t *testing.T) {
+			p, err := getFreePort()
+			if err != nil {
+				t.Errorf("error getting emulator port %v", err)
+			}
+			sc := &ServerConfig{
+				Port:              fmt.Sprintf(":%d", p),
+				SkipPrefetch:      true,
+				IDTokenSigningKey: key,
+			}
+			claims := projectClaims("some-project-id")
+			claims.ComputeMetadata.V1.Instance.ServiceAccounts = map[string]serviceAccountDetails{
+				"default": {Email: "metadata-sa@some-project-id.iam.gserviceaccount.com"},
+			}
+
+			h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, claims)
+			if err != nil {
+				t.Errorf("error creating emulator %v", err)
+			}
+			err = h.Start()
+			if err != nil {
+				t.Errorf("error starting emulator %v", err)
+			}
+			defer h.Shutdown()
+
+			base := fmt.Sprintf("http://127.0.0.1:%d", p)
+
+			// discovery documents are fetched without the Metadata-Flavor header
+			resp, err := http.Get(base + oidcDiscoveryPath)
+			if err != nil {
+				t.Fatalf("error getting discovery document %v", err)
+			}
+			defer resp.Body.Close()
+			d := &oidcDiscovery{}
+			err = json.NewDecoder(resp.Body).Decode(d)
+			if err != nil {
+				t.Fatalf("error decoding discovery document %v", err)
+			}
+			if d.Issuer != "http://metadata.google.internal/projects/some-project-id" {
+				t.Errorf("unexpected issuer: got %s", d.Issuer)
+			}
+			if d.JWKSURI != base+jwksPath {
+				t.Errorf("unexpected jwks_uri: got %s want %s", d.JWKSURI, base+jwksPath)
+			}
+
+			resp, err = http.Get(d.JWKSURI)
+			if err != nil {
+				t.Fatalf("error getting jwks %v", err)
+			}
+			defer resp.Body.Close()
+			jwks := &jsonWebKeySet{}
+			err = json.NewDecoder(resp.Body).Decode(jwks)
+			if err != nil {
+				t.Fatalf("error decoding jwks %v", err)
+			}
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Alg != alg {
+				t.Fatalf("unexpected jwks: got %+v", jwks)
+			}
+
+			_, idToken, err := getMetadata(base + "/computeMetadata/v1/instance/service-accounts/default/identity?audience=https://foo.bar&format=full")
+			if err != nil {
+				t.Fatalf("error getting id_token %v", err)
+			}
+
+			parsed := &localIDTokenClaims{}
+			tok, err := jwt.ParseWithClaims(idToken, parsed, func(tok *jwt.Token) (interface{}, error) {
+				if tok.Header["kid"] != jwks.Keys[0].Kid {
+					return nil, fmt.Errorf("unexpected kid %v", tok.Header["kid"])
+				}
+				return publicKeyFromJWK(t, jwks.Keys[0]), nil
+			}, jwt.WithValidMethods([]string{alg}), jwt.WithIssuer(d.Issuer), jwt.WithAudience("https://foo.bar"))
+			if err != nil || !tok.Valid {
+				t.Fatalf("error verifying id_token %v", err)
+			}
+			if parsed.Email != "metadata-sa@some-project-id.iam.gserviceaccount.com" {
+				t.Errorf("unexpected email claim: got %s", parsed.Email)
+			}
+		})
+	}
+}
+
+func TestIdentityAudience(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{IDTokenSigningKey: key}, &google.Credentials{}, projectClaims("some-project-id"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		audience string
+	}{
+		{"audience=https://my-service.example.com", http.StatusOK, "https://my-service.example.com"},
+		{"audience=https%3A%2F%2Fmy-service.example.com%2Fpath%3Fa%3Db", http.StatusOK, "https://my-service.example.com/path?a=b"},
+		{"audience=https://first.example.com&audience=https://last.example.com", http.StatusOK, "https://last.example.com"},
+		{"", http.StatusBadRequest, ""},
+		{"audience=", http.StatusBadRequest, ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/identity?"+tc.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		h.handler().ServeHTTP(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", tc.query, rr.Code, tc.code)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			if !strings.Contains(rr.Body.String(), "non-empty audience parameter required") {
+				t.Errorf("%q: unexpected body: got %v", tc.query, rr.Body.String())
+			}
+			continue
+		}
+
+		parsed := &localIDTokenClaims{}
+		if _, err := jwt.ParseWithClaims(rr.Body.String(), parsed, func(tok *jwt.Token) (interface{}, error) {
+			return key.Public(), nil
+		}, jwt.WithValidMethods([]string{"ES256"})); err != nil {
+			t.Errorf("%q: error verifying id_token %v", tc.query, err)
+			continue
+		}
+		if len(parsed.Audience) != 1 || parsed.Audience[0] != tc.audience {
+			t.Errorf("%q: unexpected aud claim: got %v want %v", tc.query, parsed.Audience, tc.audience)
+		}
+	}
+}
+
+func TestIdentityFormat(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := projectClaims("some-project-id")
+	claims.ComputeMetadata.V1.Project.NumericProjectID = 123456
+	claims.ComputeMetadata.V1.Instance.ID = 123456
+	claims.ComputeMetadata.V1.Instance.Name = "some-instance"
+	claims.ComputeMetadata.V1.Instance.Zone = "projects/123456/zones/us-central1-a"
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{IDTokenSigningKey: key}, &google.Credentials{}, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	identity := func(format string) (int, jwt.MapClaims) {
+		req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/identity?audience=https://foo.bar"+format, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		h.handler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			return rr.Code, nil
+		}
+		parsed := jwt.MapClaims{}
+		if _, err := jwt.ParseWithClaims(rr.Body.String(), parsed, func(tok *jwt.Token) (interface{}, error) {
+			return key.Public(), nil
+		}, jwt.WithValidMethods([]string{"ES256"}), jwt.WithAudience("https://foo.bar")); err != nil {
+			t.Fatalf("%q: error verifying id_token %v", format, err)
+		}
+		return rr.Code, parsed
+	}
+
+	for _, format := range []string{"", "&format=standard"} {
+		_, c := identity(format)
+		for _, claim := range []string{"email", "email_verified", "google"} {
+			if _, ok := c[claim]; ok {
+				t.Errorf("%q: unexpected %s claim in standard id_token: %v", format, claim, c)
+			}
+		}
+		if c["sub"] != "metadata-sa@some-project-id.iam.gserviceaccount.com" {
+			t.Errorf("%q: unexpected sub claim: got %v", format, c["sub"])
+		}
+	}
+
+	_, c := identity("&format=full")
+	if c["email"] != "metadata-sa@some-project-id.iam.gserviceaccount.com" || c["email_verified"] != true {
+		t.Errorf("unexpected email claims in full id_token: %v", c)
+	}
+	want := map[string]interface{}{
+		"project_id":     "some-project-id",
+		"project_number": float64(123456),
+		"zone":           "us-central1-a",
+		"instance_id":    "123456",
+		"instance_name":  "some-instance",
+	}
+	if g, ok := c["google"].(map[string]interface{}); !ok || !reflect.DeepEqual(g["compute_engine"], want) {
+		t.Errorf("unexpected google claim in full id_token: got %v want %v", c["google"], want)
+	}
+
+	if code, _ := identity("&format=other"); code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code for an unknown format: got %v want %v", code, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCDiscoveryWithoutSigningKey(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, &Claims{})
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	req, err := http.NewRequest(http.MethodGet, oidcDiscoveryPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	d := &oidcDiscovery{}
+	err = json.Unmarshal(rr.Body.Bytes(), d)
+	if err != nil {
+		t.Fatalf("error decoding discovery document %v", err)
+	}
+	if d.Issuer != googleIssuer || d.JWKSURI != googleJWKSURI {
+		t.Errorf("unexpected discovery document: got %+v", d)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, jwksPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	_, err = NewMetadataServer(context.Background(), &ServerConfig{IDTokenSigningKey: unsupportedSigner{}}, &google.Credentials{}, &Claims{})
+	if err == nil {
+		t.Errorf("expected error creating emulator with an unsupported signing key")
+	}
+}
+
+type unsupportedSigner struct{}
+
+func (unsupportedSigner) Public() crypto.PublicKey { return nil }
+
+func (unsupportedSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
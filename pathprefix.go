@@ -0,0 +1,53 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// validatePathPrefix checks ServerConfig.PathPrefix
+func validatePathPrefix(prefix string) error {
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return errors.New("PathPrefix must start with /")
+	}
+	return nil
+}
+
+// stripPathPrefix serves requests below prefix with the prefix removed from their path and rejects all other
+// requests with a 404, so handlers and fault rules see the paths of the GCE metadata server.  Redirects are built
+// from the request URI and keep the prefix.  A trailing slash of prefix is ignored.
+func stripPathPrefix(prefix string, notFound http.HandlerFunc, next http.Handler) http.Handler {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, prefix)
+		if len(p) == len(r.URL.Path) || (p != "" && !strings.HasPrefix(p, "/")) {
+			notFound(w, r)
+			return
+		}
+		if p == "" {
+			p = "/"
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = p
+		r2.URL.RawPath = ""
+		next.ServeHTTP(w, r2)
+	})
+}
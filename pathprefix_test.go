@@ -0,0 +1,68 @@
+package mds
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+func TestPathPrefix(t *testing.T) {
+	for _, prefix := range []string{"/gce-metadata", "/gce-metadata/"} {
+		sc := &ServerConfig{PathPrefix: prefix, FaultConfig: FaultConfig{Rules: []FaultRule{{Path: "/computeMetadata/v1/project/attributes/", HTTPStatus: http.StatusServiceUnavailable, Rate: 1}}}}
+		h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+		if err != nil {
+			t.Fatalf("error creating emulator %v", err)
+		}
+		handler := h.handler()
+
+		for _, tc := range []struct {
+			path     string
+			wantCode int
+			wantBody string
+		}{
+			{"/gce-metadata/computeMetadata/v1/project/project-id", http.StatusOK, "some-project"},
+			{"/gce-metadata/computeMetadata/", http.StatusOK, "v1/\n"},
+			{"/gce-metadata/", http.StatusOK, "computeMetadata/\n"},
+			{"/gce-metadata", http.StatusOK, "computeMetadata/\n"},
+			{"/gce-metadata/computeMetadata/v1/project/attributes/", http.StatusServiceUnavailable, ""},
+			{"/computeMetadata/v1/project/project-id", http.StatusNotFound, ""},
+			{"/gce-metadataX/computeMetadata/v1/project/project-id", http.StatusNotFound, ""},
+			{"/gce-metadata/healthz", http.StatusNotFound, ""},
+			{"/healthz", http.StatusOK, "ok"},
+		} {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			req.Header.Set("Metadata-Flavor", "Google")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tc.wantCode || (tc.wantBody != "" && rr.Body.String() != tc.wantBody) {
+				t.Errorf("%s %s: unexpected response: got %v %q want %v %q", prefix, tc.path, rr.Code, rr.Body.String(), tc.wantCode, tc.wantBody)
+			}
+		}
+
+		// redirects keep the prefix
+		req := httptest.NewRequest(http.MethodGet, "/gce-metadata/computeMetadata/v1/project", nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusMovedPermanently || !strings.HasSuffix(rr.Header().Get("Location"), "/gce-metadata/computeMetadata/v1/project/") {
+			t.Errorf("%s: unexpected redirect: got %v %q", prefix, rr.Code, rr.Header().Get("Location"))
+		}
+
+		admin := NewAdminServer(h, "")
+		for path, want := range map[string]int{"/gce-metadata/admin/stats": http.StatusOK, "/admin/stats": http.StatusNotFound} {
+			rr := httptest.NewRecorder()
+			admin.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+			if rr.Code != want {
+				t.Errorf("%s %s: unexpected status code: got %v want %v", prefix, path, rr.Code, want)
+			}
+		}
+	}
+
+	if _, err := NewMetadataServer(context.Background(), &ServerConfig{PathPrefix: "gce-metadata"}, &google.Credentials{}, projectClaims("some-project")); err == nil {
+		t.Errorf("expected error for a prefix which does not start with /")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	pkcs11TokenExpiryDelta = 10 * time.Second
+)
+
+// PKCS11Config configures a PKCS11TokenSource.
+//
+// The service account's RSA private key must be present on the token in SlotID with the CKA_LABEL KeyLabel.
+type PKCS11Config struct {
+	LibPath  string // path to the PKCS#11 module, eg /usr/lib/softhsm/libsofthsm2.so
+	SlotID   uint   // slot of the token holding the key
+	PIN      string // user PIN of the token
+	KeyLabel string // CKA_LABEL of the service account private key
+	KeyID    string // service account private key id added as the JWT `kid` header (default: "")
+
+	Email    string   // service account email the assertion is issued for
+	Scopes   []string // scopes to request for access_tokens
+	TokenURL string   // token endpoint the assertion is exchanged at (default: https://oauth2.googleapis.com/token)
+
+	HTTPClient *http.Client // client used for token endpoint requests (default: http.DefaultClient)
+}
+
+// PKCS11TokenSource is an oauth2.TokenSource which signs service account assertions with a key held in a PKCS#11 token (HSM).
+//
+// A single session is opened and logged in for the lifetime of the source; all operations on it are serialized.
+// Call Close() to release the session and unload the module.  PKCS#11 support requires building with CGO_ENABLED=1.
+type PKCS11TokenSource struct {
+	cfg PKCS11Config
+
+	mu      sync.Mutex
+	session *pkcs11Session // nil once closed
+	tok     *oauth2.Token
+}
+
+// NewPKCS11TokenSource loads the PKCS#11 module, logs in to the token and finds the private key
+func NewPKCS11TokenSource(cfg PKCS11Config) (*PKCS11TokenSource, error) {
+	if cfg.LibPath == "" || cfg.KeyLabel == "" || cfg.Email == "" {
+		return nil, errors.New("pkcs11 library path, key label and service account email must be set")
+	}
+	if cfg.TokenURL == "" {
+		cfg.TokenURL = defaultTokenURL
+	}
+
+	session, err := openPKCS11Session(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &PKCS11TokenSource{cfg: cfg, session: session}, nil
+}
+
+// Token returns a cached access_token or signs a new assertion with the PKCS#11 key once it is about to expire
+func (s *PKCS11TokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tok != nil && time.Until(s.tok.Expiry) > pkcs11TokenExpiryDelta {
+		return s.tok, nil
+	}
+	tok, err := s.assertion().accessToken(s.sign, s.cfg.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	s.tok = tok
+	return tok, nil
+}
+
+// IDToken returns an id_token for the audience issued to the service account
+func (s *PKCS11TokenSource) IDToken(audience string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.assertion().idToken(s.sign, audience)
+}
+
+// Invalidate drops the cached token so the next call to Token() fetches a new one
+func (s *PKCS11TokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tok = nil
+}
+
+// Close logs out of the token and unloads the PKCS#11 module
+func (s *PKCS11TokenSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.session == nil {
+		return nil
+	}
+	err := s.session.close()
+	s.session = nil
+	return err
+}
+
+func (s *PKCS11TokenSource) assertion() *jwtAssertion {
+	return &jwtAssertion{
+		Email:    s.cfg.Email,
+		KeyID:    s.cfg.KeyID,
+		TokenURL: s.cfg.TokenURL,
+		Client:   s.cfg.HTTPClient,
+	}
+}
+
+// sign computes the RS256 signature over the input on the token; callers must hold s.mu
+func (s *PKCS11TokenSource) sign(input []byte) ([]byte, error) {
+	if s.session == nil {
+		return nil, errors.New("pkcs11 token source is closed")
+	}
+	sig, err := s.session.sign(input)
+	if err != nil {
+		return nil, fmt.Errorf("error signing with pkcs11 key %s: %w", s.cfg.KeyLabel, err)
+	}
+	return sig, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+
+package mds
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11Session is a logged in session on the token holding the service account key
+type pkcs11Session struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+}
+
+// openPKCS11Session loads the PKCS#11 module, logs in to the token and finds the private key
+func openPKCS11Session(cfg PKCS11Config) (*pkcs11Session, error) {
+	ctx := pkcs11.New(cfg.LibPath)
+	if ctx == nil {
+		return nil, fmt.Errorf("unable to load pkcs11 library %s", cfg.LibPath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("error initializing pkcs11 library %s: %w", cfg.LibPath, err)
+	}
+
+	session, err := ctx.OpenSession(cfg.SlotID, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, fmt.Errorf("error opening pkcs11 session on slot %d: %w", cfg.SlotID, err)
+	}
+	s := &pkcs11Session{ctx: ctx, session: session}
+	if err := ctx.Login(session, pkcs11.CKU_USER, cfg.PIN); err != nil {
+		ctx.CloseSession(session)
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, fmt.Errorf("error logging in to pkcs11 slot %d: %w", cfg.SlotID, err)
+	}
+	s.key, err = s.findKey(cfg)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *pkcs11Session) findKey(cfg PKCS11Config) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, cfg.KeyLabel),
+	}
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return 0, fmt.Errorf("error searching for pkcs11 key %s: %w", cfg.KeyLabel, err)
+	}
+	objs, _, err := s.ctx.FindObjects(s.session, 1)
+	if ferr := s.ctx.FindObjectsFinal(s.session); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error searching for pkcs11 key %s: %w", cfg.KeyLabel, err)
+	}
+	if len(objs) == 0 {
+		return 0, fmt.Errorf("pkcs11 RSA private key %s not found in slot %d", cfg.KeyLabel, cfg.SlotID)
+	}
+	return objs[0], nil
+}
+
+func (s *pkcs11Session) sign(input []byte) ([]byte, error) {
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_SHA256_RSA_PKCS, nil)}, s.key); err != nil {
+		return nil, err
+	}
+	return s.ctx.Sign(s.session, input)
+}
+
+// close logs out of the token and unloads the module
+func (s *pkcs11Session) close() error {
+	err := errors.Join(
+		s.ctx.Logout(s.session),
+		s.ctx.CloseSession(s.session),
+		s.ctx.Finalize(),
+	)
+	s.ctx.Destroy()
+	return err
+}
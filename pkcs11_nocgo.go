@@ -0,0 +1,36 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !cgo
+
+package mds
+
+import (
+	"errors"
+)
+
+// pkcs11Session is unavailable without cgo since PKCS#11 modules are loaded as shared libraries
+type pkcs11Session struct{}
+
+func openPKCS11Session(cfg PKCS11Config) (*pkcs11Session, error) {
+	return nil, errors.New("PKCS#11 support requires building with CGO_ENABLED=1")
+}
+
+func (s *pkcs11Session) sign(input []byte) ([]byte, error) {
+	return nil, errors.New("PKCS#11 support requires building with CGO_ENABLED=1")
+}
+
+func (s *pkcs11Session) close() error {
+	return nil
+}
@@ -0,0 +1,216 @@
+//go:build cgo
+
+package mds
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	softHSMUserPIN  = "1234"
+	softHSMKeyLabel = "sa-key"
+)
+
+// softHSMModule returns the SoftHSM2 module used for the PKCS#11 tests.  Set SOFTHSM2_MODULE if it is not installed in a default location.
+func softHSMModule(t *testing.T) string {
+	candidates := []string{
+		os.Getenv("SOFTHSM2_MODULE"),
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+	}
+	for _, c := range candidates {
+		if c == "" {
+			continue
+		}
+		if _, err := os.Stat(c); err == nil {
+			return c
+		}
+	}
+	t.Skip("SoftHSM2 is not installed; set SOFTHSM2_MODULE to run the PKCS#11 tests")
+	return ""
+}
+
+// initSoftHSM initializes a token in a temporary SoftHSM2 store, generates an RSA key on it and returns
+// the slot of the token and the public key
+func initSoftHSM(t *testing.T, module string) (uint, *rsa.PublicKey) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	err := os.Mkdir(filepath.Join(dir, "tokens"), 0700)
+	if err == nil {
+		err = os.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\nlog.level = ERROR\n", filepath.Join(dir, "tokens"))), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	p := pkcs11.New(module)
+	if p == nil {
+		t.Fatalf("unable to load %s", module)
+	}
+	defer p.Destroy()
+	if err := p.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Finalize()
+
+	slots, err := p.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("no free SoftHSM slot %v", err)
+	}
+	if err := p.InitToken(slots[0], "5678", "test"); err != nil {
+		t.Fatal(err)
+	}
+	// SoftHSM moves initialized tokens to a new slot
+	slots, err = p.GetSlotList(true)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("initialized token not found %v", err)
+	}
+	slot := slots[0]
+
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.CloseSession(session)
+	if err := p.Login(session, pkcs11.CKU_SO, "5678"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.InitPIN(session, softHSMUserPIN); err != nil {
+		t.Fatal(err)
+	}
+	p.Logout(session)
+	if err := p.Login(session, pkcs11.CKU_USER, softHSMUserPIN); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Logout(session)
+
+	pubHandle, _, err := p.GenerateKeyPair(session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, softHSMKeyLabel),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, softHSMKeyLabel),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := p.GetAttributeValue(session, pubHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return slot, &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attrs[0].Value),
+		E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+	}
+}
+
+func TestPKCS11TokenSource(t *testing.T) {
+	module := softHSMModule(t)
+	slot, pub := initSoftHSM(t, module)
+
+	var exchanges atomic.Int32
+	email := "pkcs11-sa@some-project.iam.gserviceaccount.com"
+	tokenServer := httptest.NewServer(tokenEndpointHandler(pub, email, &exchanges))
+	defer tokenServer.Close()
+
+	ts, err := NewPKCS11TokenSource(PKCS11Config{
+		LibPath:  module,
+		SlotID:   slot,
+		PIN:      softHSMUserPIN,
+		KeyLabel: softHSMKeyLabel,
+		Email:    email,
+		Scopes:   []string{cloudPlatformScope},
+		TokenURL: tokenServer.URL,
+	})
+	if err != nil {
+		t.Fatalf("error creating token source %v", err)
+	}
+	defer ts.Close()
+
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatalf("error getting token %v", err)
+	}
+	if want := "access-token-for-" + cloudPlatformScope; tok.AccessToken != want {
+		t.Errorf("unexpected access_token: got %v want %v", tok.AccessToken, want)
+	}
+
+	// signing operations on the shared session must be serialized
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			aud := fmt.Sprintf("https://foo.bar/%d", i)
+			idToken, err := ts.IDToken(aud)
+			if err == nil && idToken != "id-token-for-"+aud {
+				err = fmt.Errorf("unexpected id_token %s", idToken)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("error getting id_token %v", err)
+		}
+	}
+	if n := exchanges.Load(); n != 11 {
+		t.Errorf("unexpected number of token exchanges: got %d want %d", n, 11)
+	}
+
+	if err := ts.Close(); err != nil {
+		t.Errorf("error closing token source %v", err)
+	}
+	if _, err := ts.IDToken("https://foo.bar"); err == nil {
+		t.Errorf("expected error signing with a closed token source")
+	}
+}
+
+func TestPKCS11TokenSourceErrors(t *testing.T) {
+	for _, cfg := range []PKCS11Config{
+		{KeyLabel: softHSMKeyLabel, Email: "sa@some-project.iam.gserviceaccount.com"},
+		{LibPath: "/does/not/exist.so", Email: "sa@some-project.iam.gserviceaccount.com"},
+		{LibPath: "/does/not/exist.so", KeyLabel: softHSMKeyLabel},
+	} {
+		if _, err := NewPKCS11TokenSource(cfg); err == nil {
+			t.Errorf("expected error for config %+v", cfg)
+		}
+	}
+
+	_, err := NewPKCS11TokenSource(PKCS11Config{
+		LibPath:  filepath.Join(t.TempDir(), "libmissing.so"),
+		KeyLabel: softHSMKeyLabel,
+		Email:    "sa@some-project.iam.gserviceaccount.com",
+	})
+	if err == nil || !strings.Contains(err.Error(), "unable to load pkcs11 library") {
+		t.Errorf("expected error loading a missing module, got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxRateLimitedAudiences bounds the per audience limiters; idle ones are dropped once it is exceeded
+const maxRateLimitedAudiences = 1024
+
+// RateLimitConfig is a token bucket which allows BurstSize requests at once and RequestsPerSecond on average.
+// The zero value does not limit requests.
+type RateLimitConfig struct {
+	RequestsPerSecond float64
+	BurstSize         int // (default: 1)
+}
+
+// Validate checks that the rate and burst are not negative
+func (c RateLimitConfig) Validate() error {
+	if c.RequestsPerSecond < 0 {
+		return errors.New("RequestsPerSecond cannot be negative")
+	}
+	if c.BurstSize < 0 {
+		return errors.New("BurstSize cannot be negative")
+	}
+	return nil
+}
+
+func (c RateLimitConfig) enabled() bool {
+	return c.RequestsPerSecond > 0
+}
+
+func (c RateLimitConfig) limiter() *rate.Limiter {
+	burst := c.BurstSize
+	if burst == 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(c.RequestsPerSecond), burst)
+}
+
+// RateLimit is a token bucket for ServerConfig.PathRateLimits and GlobalRateLimit which allows Burst requests at
+// once and RPS on average.  The zero value does not limit requests.
+type RateLimit struct {
+	RPS   float64
+	Burst int // (default: 1)
+}
+
+// Validate checks that the rate and burst are not negative
+func (l RateLimit) Validate() error {
+	if l.RPS < 0 {
+		return errors.New("RPS cannot be negative")
+	}
+	if l.Burst < 0 {
+		return errors.New("Burst cannot be negative")
+	}
+	return nil
+}
+
+// Config returns the RateLimitConfig with the same rate and burst
+func (l RateLimit) Config() RateLimitConfig {
+	return RateLimitConfig{RequestsPerSecond: l.RPS, BurstSize: l.Burst}
+}
+
+// identityRateLimiter applies ServerConfig.IdentityRateLimit to each audience and
+// ServerConfig.GlobalIdentityRateLimit to all audiences combined
+type identityRateLimiter struct {
+	perAudience RateLimitConfig
+	global      *rate.Limiter // nil if not limited
+
+	mu        sync.Mutex
+	audiences map[string]*rate.Limiter
+}
+
+// newIdentityRateLimiter returns nil if neither limit is enabled
+func newIdentityRateLimiter(perAudience, global RateLimitConfig) *identityRateLimiter {
+	if !perAudience.enabled() && !global.enabled() {
+		return nil
+	}
+	l := &identityRateLimiter{perAudience: perAudience, audiences: map[string]*rate.Limiter{}}
+	if global.enabled() {
+		l.global = global.limiter()
+	}
+	return l
+}
+
+// allow reports if an id_token for audience may be issued now, otherwise how long the client should wait
+func (l *identityRateLimiter) allow(audience string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var limiters []*rate.Limiter
+	if l.perAudience.enabled() {
+		limiters = append(limiters, l.audienceLimiter(audience))
+	}
+	if l.global != nil {
+		limiters = append(limiters, l.global)
+	}
+	return reserveAll(limiters)
+}
+
+// reserveAll takes a token from each limiter if all of them allow a request now, otherwise it reports the longest wait
+func reserveAll(limiters []*rate.Limiter) (bool, time.Duration) {
+	now := time.Now()
+	var reservations []*rate.Reservation
+	for _, lim := range limiters {
+		reservations = append(reservations, lim.ReserveN(now, 1))
+	}
+
+	var wait time.Duration
+	for _, r := range reservations {
+		if d := r.DelayFrom(now); d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return true, 0
+	}
+	// a rejected request does not use up tokens of any limit
+	for _, r := range reservations {
+		r.CancelAt(now)
+	}
+	return false, wait
+}
+
+func (l *identityRateLimiter) audienceLimiter(audience string) *rate.Limiter {
+	if lim, ok := l.audiences[audience]; ok {
+		return lim
+	}
+	if len(l.audiences) >= maxRateLimitedAudiences {
+		now := time.Now()
+		for a, lim := range l.audiences {
+			// a full bucket behaves like a new limiter
+			if lim.TokensAt(now) >= float64(lim.Burst()) {
+				delete(l.audiences, a)
+			}
+		}
+	}
+	lim := l.perAudience.limiter()
+	l.audiences[audience] = lim
+	return lim
+}
+
+// pathRateLimiter applies ServerConfig.PathRateLimits to each listed path and ServerConfig.GlobalRateLimit to all
+// paths combined
+type pathRateLimiter struct {
+	paths  map[string]*rate.Limiter
+	global *rate.Limiter // nil if not limited
+
+	mu sync.Mutex
+}
+
+// validatePathRateLimits checks that each path is absolute and its limit is valid
+func validatePathRateLimits(limits map[string]RateLimit) error {
+	for path, c := range limits {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("PathRateLimits path %q must start with /", path)
+		}
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("invalid PathRateLimits for %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// newPathRateLimiter returns nil if no limit is enabled
+func newPathRateLimiter(paths map[string]RateLimit, global RateLimit) *pathRateLimiter {
+	l := &pathRateLimiter{paths: map[string]*rate.Limiter{}}
+	for path, c := range paths {
+		if c.Config().enabled() {
+			l.paths[path] = c.Config().limiter()
+		}
+	}
+	if global.Config().enabled() {
+		l.global = global.Config().limiter()
+	}
+	if len(l.paths) == 0 && l.global == nil {
+		return nil
+	}
+	return l
+}
+
+// allow reports if a request for path may be served now, otherwise how long the client should wait.  The limit of
+// the path is checked before the global limit.
+func (l *pathRateLimiter) allow(path string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var limiters []*rate.Limiter
+	if lim, ok := l.paths[path]; ok {
+		limiters = append(limiters, lim)
+	}
+	if l.global != nil {
+		limiters = append(limiters, l.global)
+	}
+	return reserveAll(limiters)
+}
+
+// limitRequestRate rejects requests above ServerConfig.PathRateLimits or GlobalRateLimit with a 429
+func (h *MetadataServer) limitRequestRate(next http.Handler) http.Handler {
+	if h.pathLimiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := h.pathLimiter.allow(r.URL.Path); !ok {
+			h.requestLog(r).Info("Request rate limited", "path", r.URL.Path, "retryAfter", wait)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			httpError(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests, "text/html")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,170 @@
+package mds
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+func rateLimitedServer(t *testing.T, sc *ServerConfig) http.Handler {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.IDTokenSigningKey = key
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	return h.handler()
+}
+
+func requestIdentity(t *testing.T, handler http.Handler, audience string) *httptest.ResponseRecorder {
+	return requestPath(t, handler, "/computeMetadata/v1/instance/service-accounts/default/identity?audience="+url.QueryEscape(audience))
+}
+
+func requestPath(t *testing.T, handler http.Handler, path string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIdentityRateLimit(t *testing.T) {
+	handler := rateLimitedServer(t, &ServerConfig{IdentityRateLimit: RateLimitConfig{RequestsPerSecond: 0.5, BurstSize: 2}})
+
+	for i := 0; i < 2; i++ {
+		if rr := requestIdentity(t, handler, "https://foo.bar"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst returned wrong status code: got %v want %v", i, rr.Code, http.StatusOK)
+		}
+	}
+	rr := requestIdentity(t, handler, "https://foo.bar")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("request above the burst returned wrong status code: got %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("unexpected Retry-After header: got %q want %q", got, "2")
+	}
+
+	// other audiences have their own limit
+	if rr := requestIdentity(t, handler, "https://other.bar"); rr.Code != http.StatusOK {
+		t.Errorf("request for another audience returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestGlobalIdentityRateLimit(t *testing.T) {
+	handler := rateLimitedServer(t, &ServerConfig{
+		IdentityRateLimit:       RateLimitConfig{RequestsPerSecond: 1, BurstSize: 5},
+		GlobalIdentityRateLimit: RateLimitConfig{RequestsPerSecond: 1, BurstSize: 2},
+	})
+
+	for _, audience := range []string{"https://a.bar", "https://b.bar"} {
+		if rr := requestIdentity(t, handler, audience); rr.Code != http.StatusOK {
+			t.Fatalf("%s: returned wrong status code: got %v want %v", audience, rr.Code, http.StatusOK)
+		}
+	}
+	rr := requestIdentity(t, handler, "https://c.bar")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("request above the global burst returned unexpected response: got %v Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestPathRateLimit(t *testing.T) {
+	tokenPath := "/computeMetadata/v1/instance/service-accounts/default/token"
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{
+		PathRateLimits: map[string]RateLimit{tokenPath: {RPS: 0.5, Burst: 3}},
+	}, staticCredentials("some-token"), projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	for i := 0; i < 4; i++ {
+		rr := requestPath(t, handler, tokenPath)
+		if i < 3 && rr.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst returned wrong status code: got %v want %v", i, rr.Code, http.StatusOK)
+		}
+		if i == 3 && (rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "2") {
+			t.Errorf("request above the burst returned unexpected response: got %v Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+		}
+	}
+
+	// other paths are not limited
+	for i := 0; i < 5; i++ {
+		rr := requestPath(t, handler, "/computeMetadata/v1/project/project-id")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d for another path returned wrong status code: got %v want %v", i, rr.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestGlobalRateLimit(t *testing.T) {
+	tokenPath := "/computeMetadata/v1/instance/service-accounts/default/token"
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{
+		PathRateLimits:  map[string]RateLimit{tokenPath: {RPS: 0.001, Burst: 1}},
+		GlobalRateLimit: RateLimit{RPS: 1, Burst: 2},
+	}, staticCredentials("some-token"), projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rr := requestPath(t, handler, tokenPath)
+		if rr.Code != want {
+			t.Fatalf("token request %d returned wrong status code: got %v want %v", i, rr.Code, want)
+		}
+	}
+	// the request rejected by the path limit did not use up the global limit
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rr := requestPath(t, handler, "/computeMetadata/v1/project/project-id")
+		if rr.Code != want {
+			t.Fatalf("project request %d returned wrong status code: got %v want %v", i, rr.Code, want)
+		}
+		if want == http.StatusTooManyRequests && rr.Header().Get("Retry-After") != "1" {
+			t.Errorf("unexpected Retry-After header: got %q want %q", rr.Header().Get("Retry-After"), "1")
+		}
+	}
+}
+
+func TestRateLimitConfigValidation(t *testing.T) {
+	for _, sc := range []*ServerConfig{
+		{IdentityRateLimit: RateLimitConfig{RequestsPerSecond: -1}},
+		{GlobalIdentityRateLimit: RateLimitConfig{RequestsPerSecond: 1, BurstSize: -1}},
+		{GlobalRateLimit: RateLimit{RPS: -1}},
+		{PathRateLimits: map[string]RateLimit{"/computeMetadata/v1/": {Burst: -1}}},
+		{PathRateLimits: map[string]RateLimit{"computeMetadata/v1/": {RPS: 1}}},
+	} {
+		if _, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("some-project")); err == nil {
+			t.Errorf("expected error for config %+v", sc)
+		}
+	}
+}
+
+func TestIdentityRateLimiterRejectedRequestsAreFree(t *testing.T) {
+	l := newIdentityRateLimiter(RateLimitConfig{RequestsPerSecond: 100, BurstSize: 1}, RateLimitConfig{RequestsPerSecond: 0.001, BurstSize: 1})
+	if ok, _ := l.allow("https://a.bar"); !ok {
+		t.Fatalf("first request was rejected")
+	}
+	if ok, _ := l.allow("https://b.bar"); ok {
+		t.Fatalf("request above the global limit was allowed")
+	}
+	// the rejected request did not take the token of its audience
+	if tokens := l.audiences["https://b.bar"].Tokens(); tokens < 1 {
+		t.Errorf("rejected request used up its audience limit: %v tokens left", tokens)
+	}
+	if newIdentityRateLimiter(RateLimitConfig{}, RateLimitConfig{}) != nil {
+		t.Errorf("expected no limiter without limits")
+	}
+}
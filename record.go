@@ -0,0 +1,152 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultRecordUpstream = "http://metadata.google.internal"
+)
+
+// recordedResponse is the fixture saved for every request while recording
+type recordedResponse struct {
+	Path       string      `json:"path"`
+	Query      string      `json:"query"`
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
+
+// fixturePath returns the file a request is recorded to or replayed from; fixtures are matched on path and query
+func fixturePath(dir string, r *http.Request) string {
+	key := r.URL.Path
+	if r.URL.RawQuery != "" {
+		key = key + "?" + r.URL.RawQuery
+	}
+	return filepath.Join(dir, url.QueryEscape(key)+".json")
+}
+
+// recordHandler proxies every request to the real metadata server and saves the response to ServerConfig.RecordDir
+func (h *MetadataServer) recordHandler(w http.ResponseWriter, r *http.Request) {
+	upstream := h.ServerConfig.RecordUpstream
+	if upstream == "" {
+		upstream = h.ServerConfig.ProxyTo
+	}
+	if upstream == "" {
+		upstream = defaultRecordUpstream
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, strings.TrimSuffix(upstream, "/")+r.URL.RequestURI(), nil)
+	if err != nil {
+		h.requestLog(r).Error("Unable to create upstream request", "error", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/html; charset=UTF-8")
+		return
+	}
+	req.Header.Set("Metadata-Flavor", r.Header.Get("Metadata-Flavor"))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.requestLog(r).Error("Unable to reach upstream metadata server", "upstream", upstream, "error", err)
+		httpError(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway, "text/html; charset=UTF-8")
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.requestLog(r).Error("Unable to read upstream response", "error", err)
+		httpError(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway, "text/html; charset=UTF-8")
+		return
+	}
+
+	rec := &recordedResponse{
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       string(body),
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err == nil {
+		err = os.WriteFile(fixturePath(h.ServerConfig.RecordDir, r), data, 0644)
+	}
+	if err != nil {
+		h.requestLog(r).Error("Unable to save recorded response", "path", r.URL.Path, "error", err)
+	}
+
+	writeRecordedResponse(w, rec)
+}
+
+// proxyHandler forwards every request to ServerConfig.ProxyTo without modifying the request or the response.
+// Requests are still counted and access logged.
+func (h *MetadataServer) proxyHandler() http.Handler {
+	// validated in NewMetadataServer()
+	target, _ := url.Parse(h.ServerConfig.ProxyTo)
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+		},
+		// stream long-polling wait_for_change responses as soon as they are available
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			h.requestLog(r).Error("Unable to reach upstream metadata server", "upstream", h.ServerConfig.ProxyTo, "error", err)
+			httpError(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway, "text/html; charset=UTF-8")
+		},
+	}
+}
+
+// replayHandler serves responses previously saved with ServerConfig.RecordDir
+func (h *MetadataServer) replayHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := os.ReadFile(fixturePath(h.ServerConfig.ReplayDir, r))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			h.requestLog(r).Error("Unable to read recorded response", "path", r.URL.Path, "error", err)
+		}
+		h.notFound(w, r)
+		return
+	}
+
+	rec := &recordedResponse{}
+	err = json.Unmarshal(data, rec)
+	if err != nil {
+		h.requestLog(r).Error("Unable to parse recorded response", "path", r.URL.Path, "error", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/html; charset=UTF-8")
+		return
+	}
+	writeRecordedResponse(w, rec)
+}
+
+func writeRecordedResponse(w http.ResponseWriter, rec *recordedResponse) {
+	for k, v := range rec.Header {
+		// the length is recomputed when writing the body
+		if k == "Content-Length" {
+			continue
+		}
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.StatusCode)
+	fmt.Fprint(w, rec.Body)
+}
@@ -0,0 +1,163 @@
+package mds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/computeMetadata/v1/project/project-id" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/text")
+		fmt.Fprint(w, "recorded-project")
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+
+	recorder, err := NewMetadataServer(context.Background(), &ServerConfig{RecordDir: dir, RecordUpstream: upstream.URL}, &google.Credentials{}, &Claims{})
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/project/project-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	recorder.handler().ServeHTTP(rr, req)
+	if rr.Body.String() != "recorded-project" {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), "recorded-project")
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("unexpected number of recorded responses: got %d want %d", len(files), 1)
+	}
+
+	upstream.Close()
+
+	replayer, err := NewMetadataServer(context.Background(), &ServerConfig{ReplayDir: dir}, &google.Credentials{}, &Claims{})
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	replayer.handler().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if rr.Body.String() != "recorded-project" {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), "recorded-project")
+	}
+	if rr.Header().Get("Content-Type") != "application/text" {
+		t.Errorf("handler returned unexpected content-type: got %v want %v", rr.Header().Get("Content-Type"), "application/text")
+	}
+
+	// fixtures are matched on path and query
+	req, err = http.NewRequest(http.MethodGet, "/computeMetadata/v1/project/project-id?alt=json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr = httptest.NewRecorder()
+	replayer.handler().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	_, err = NewMetadataServer(context.Background(), &ServerConfig{RecordDir: dir, ReplayDir: dir}, &google.Credentials{}, &Claims{})
+	if err == nil {
+		t.Errorf("expected error when both RecordDir and ReplayDir are set")
+	}
+}
+
+func TestProxyTo(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a real metadata server sees the request as the client sent it
+		if r.Header.Get("X-Forwarded-For") != "" {
+			t.Errorf("unexpected X-Forwarded-For header %q", r.Header.Get("X-Forwarded-For"))
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		w.Header()["ETag"] = []string{"upstream-etag"}
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, "upstream %s?%s", r.URL.Path, r.URL.RawQuery)
+	}))
+	defer upstream.Close()
+
+	var accessLog bytes.Buffer
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{ProxyTo: upstream.URL, AccessLog: &accessLog}, &google.Credentials{}, &Claims{})
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for _, tc := range []struct {
+		path, flavor, body string
+		code               int
+	}{
+		{"/computeMetadata/v1/project/project-id?alt=text", "Google", "upstream /computeMetadata/v1/project/project-id?alt=text", http.StatusOK},
+		{"/computeMetadata/v1/not/served/by/the/emulator", "Google", "upstream /computeMetadata/v1/not/served/by/the/emulator?", http.StatusOK},
+		{"/computeMetadata/v1/project/project-id", "", "", http.StatusForbidden},
+	} {
+		req, err := http.NewRequest(http.MethodGet, tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.flavor != "" {
+			req.Header.Set("Metadata-Flavor", tc.flavor)
+		}
+		rr := httptest.NewRecorder()
+		h.handler().ServeHTTP(rr, req)
+		if rr.Code != tc.code || rr.Body.String() != tc.body {
+			t.Errorf("%s returned unexpected response: got %v %q want %v %q", tc.path, rr.Code, rr.Body.String(), tc.code, tc.body)
+		}
+		if rr.Header().Get("ETag") != "upstream-etag" {
+			t.Errorf("%s returned unexpected etag: got %v", tc.path, rr.Header().Get("ETag"))
+		}
+	}
+	if n := strings.Count(accessLog.String(), "\n"); n != 3 {
+		t.Errorf("unexpected number of access log lines: got %d want %d", n, 3)
+	}
+
+	upstream.Close()
+	req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/project/project-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	h.handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadGateway)
+	}
+
+	for _, sc := range []*ServerConfig{
+		{ProxyTo: "metadata.google.internal"},
+		{ProxyTo: "http://metadata.google.internal", ReplayDir: t.TempDir()},
+	} {
+		if _, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, &Claims{}); err == nil {
+			t.Errorf("expected error for config %+v", sc)
+		}
+	}
+}
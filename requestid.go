@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDHeader     = "X-Metadata-Request-ID"
+	clientRequestHeader = "X-Request-ID"
+	correlationIDHeader = "X-Correlation-ID"
+
+	// RequestIDKey is the key the request id is logged with for every log line emitted while serving a request
+	RequestIDKey = "requestID"
+
+	maxRequestIDLength = 128
+)
+
+type requestIDContextKey struct{}
+
+// RequestIDFromContext returns the id of the request being served or an empty string
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// validRequestID accepts client provided ids of printable ASCII only so they can be logged safely
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID assigns every request an id which is returned in the X-Metadata-Request-ID header and logged with
+// every line for the request.  An X-Request-ID or X-Correlation-ID sent by the client is used as the id.
+func (h *MetadataServer) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(clientRequestHeader)
+		if !validRequestID(id) {
+			id = r.Header.Get(correlationIDHeader)
+		}
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	})
+}
+
+// requestLogger adds the request id to every log line
+type requestLogger struct {
+	Logger
+	id string
+}
+
+func (l requestLogger) with(keysAndValues []interface{}) []interface{} {
+	return append([]interface{}{RequestIDKey, l.id}, keysAndValues...)
+}
+
+func (l requestLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.Logger.Debug(msg, l.with(keysAndValues)...)
+}
+
+func (l requestLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.Logger.Info(msg, l.with(keysAndValues)...)
+}
+
+func (l requestLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.Logger.Warn(msg, l.with(keysAndValues)...)
+}
+
+func (l requestLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.Logger.Error(msg, l.with(keysAndValues)...)
+}
+
+// contextLog returns the Logger for the request served with ctx
+func (h *MetadataServer) contextLog(ctx context.Context) Logger {
+	id := RequestIDFromContext(ctx)
+	if id == "" {
+		return h.log()
+	}
+	return requestLogger{Logger: h.log(), id: id}
+}
+
+// requestLog returns the Logger for r
+func (h *MetadataServer) requestLog(r *http.Request) Logger {
+	return h.contextLog(r.Context())
+}
@@ -0,0 +1,84 @@
+package mds
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"golang.org/x/oauth2/google"
+)
+
+func TestRequestID(t *testing.T) {
+	l := &recordingLogger{}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project"), WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"generated", nil, ""},
+		{"request id", map[string]string{"X-Request-ID": "client-id"}, "client-id"},
+		{"correlation id", map[string]string{"X-Correlation-ID": "correlation-id"}, "correlation-id"},
+		{"request id preferred", map[string]string{"X-Request-ID": "client-id", "X-Correlation-ID": "correlation-id"}, "client-id"},
+		{"invalid request id", map[string]string{"X-Request-ID": "foo bar"}, ""},
+		{"too long", map[string]string{"X-Request-ID": strings.Repeat("a", maxRequestIDLength+1)}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/project/project-id", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			h.handler().ServeHTTP(rr, req)
+
+			got := rr.Header().Get("X-Metadata-Request-ID")
+			if tc.want == "" {
+				if _, err := uuid.Parse(got); err != nil {
+					t.Errorf("expected a generated request id, got %q", got)
+				}
+			} else if got != tc.want {
+				t.Errorf("unexpected request id: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequestIDLogged(t *testing.T) {
+	l := &recordingLogger{}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project"), WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/does-not-exist", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Header.Set("X-Correlation-ID", "correlation-id")
+	rr := httptest.NewRecorder()
+	h.handler().ServeHTTP(rr, req)
+
+	if len(l.entries) == 0 {
+		t.Fatalf("no log entries recorded")
+	}
+	for _, e := range l.entries {
+		if len(e.keysAndValues) < 2 || e.keysAndValues[0] != RequestIDKey || e.keysAndValues[1] != "correlation-id" {
+			t.Errorf("log entry %q does not carry the request id: %v", e.msg, e.keysAndValues)
+		}
+	}
+
+	if got := RequestIDFromContext(context.Background()); got != "" {
+		t.Errorf("unexpected request id outside of a request: %q", got)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ResponseFormatter encodes the metadata values served by the HTTP and gRPC APIs.  Access and identity tokens and
+// certificates are not metadata values and are always served in their own format.
+type ResponseFormatter interface {
+	// FormatScalar encodes a single value, eg /computeMetadata/v1/project/project-id
+	FormatScalar(v string) (body []byte, contentType string)
+	// FormatDirectory encodes the entries of a directory; entries which are directories end with a slash
+	FormatDirectory(keys []string) (body []byte, contentType string)
+	// FormatRecursive encodes a directory requested with ?recursive=true.  A nil body is answered with a 500.
+	FormatRecursive(v interface{}) (body []byte, contentType string)
+}
+
+// WithResponseFormatter encodes metadata values with f instead of DefaultResponseFormatter
+func WithResponseFormatter(f ResponseFormatter) Option {
+	return func(h *MetadataServer) {
+		h.formatter = f
+	}
+}
+
+// DefaultResponseFormatter encodes values like the GCE metadata server: scalars as text, directories one entry per
+// line and recursive directories as JSON
+type DefaultResponseFormatter struct{}
+
+func (DefaultResponseFormatter) FormatScalar(v string) ([]byte, string) {
+	return []byte(v), "application/text"
+}
+
+func (DefaultResponseFormatter) FormatDirectory(keys []string) ([]byte, string) {
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "\n")
+	}
+	return []byte(b.String()), "application/text"
+}
+
+func (DefaultResponseFormatter) FormatRecursive(v interface{}) ([]byte, string) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, ""
+	}
+	return body, "application/json"
+}
+
+func (h *MetadataServer) responseFormatter() ResponseFormatter {
+	if h.formatter == nil {
+		return DefaultResponseFormatter{}
+	}
+	return h.formatter
+}
+
+// writeScalar serves a single value with the ETag of its encoding
+func (h *MetadataServer) writeScalar(w http.ResponseWriter, v string) {
+	body, contentType := h.responseFormatter().FormatScalar(v)
+	writeFormatted(w, body, contentType)
+}
+
+// writeDirectory serves the entries of a directory with the ETag of their encoding
+func (h *MetadataServer) writeDirectory(w http.ResponseWriter, keys []string) {
+	body, contentType := h.responseFormatter().FormatDirectory(keys)
+	writeFormatted(w, body, contentType)
+}
+
+// writeRecursive serves v as the contents of a directory requested with ?recursive=true
+func (h *MetadataServer) writeRecursive(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, contentType := h.responseFormatter().FormatRecursive(v)
+	if body == nil {
+		h.requestLog(r).Error("Error encoding recursive response", "path", r.URL.Path)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/html; charset=UTF-8")
+		return
+	}
+	writeFormatted(w, body, contentType)
+}
+
+func writeFormatted(w http.ResponseWriter, body []byte, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header()["ETag"] = []string{getETag(body)}
+	w.Write(body)
+}
@@ -0,0 +1,84 @@
+package mds
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// jsonFormatter serves every value as JSON
+type jsonFormatter struct {
+	DefaultResponseFormatter
+}
+
+func (jsonFormatter) FormatScalar(v string) ([]byte, string) {
+	body, _ := json.Marshal(v)
+	return body, "application/json"
+}
+
+func (jsonFormatter) FormatDirectory(keys []string) ([]byte, string) {
+	body, _ := json.Marshal(keys)
+	return body, "application/json"
+}
+
+// failingFormatter cannot encode recursive directories
+type failingFormatter struct {
+	DefaultResponseFormatter
+}
+
+func (failingFormatter) FormatRecursive(v interface{}) ([]byte, string) {
+	return nil, ""
+}
+
+func TestDefaultResponseFormatter(t *testing.T) {
+	f := DefaultResponseFormatter{}
+	if body, ct := f.FormatScalar("some-project"); string(body) != "some-project" || ct != "application/text" {
+		t.Errorf("unexpected scalar: got %q %q", body, ct)
+	}
+	if body, ct := f.FormatDirectory([]string{"attributes/", "project-id"}); string(body) != "attributes/\nproject-id\n" || ct != "application/text" {
+		t.Errorf("unexpected directory: got %q %q", body, ct)
+	}
+	if body, _ := f.FormatDirectory(nil); len(body) != 0 {
+		t.Errorf("unexpected empty directory: got %q", body)
+	}
+	if body, ct := f.FormatRecursive(map[string]string{"a": "b"}); string(body) != `{"a":"b"}` || ct != "application/json" {
+		t.Errorf("unexpected recursive directory: got %q %q", body, ct)
+	}
+}
+
+func TestWithResponseFormatter(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}), WithResponseFormatter(jsonFormatter{}))
+
+	for path, want := range map[string]string{
+		"/computeMetadata/v1/project/project-id":                                 `"some-project"`,
+		"/computeMetadata/v1/project/":                                           `["attributes/","numeric-project-id","project-id"]`,
+		"/computeMetadata/v1/instance/service-accounts/":                         `["default/","metadata-sa@some-project.iam.gserviceaccount.com/"]`,
+		"/computeMetadata/v1/instance/service-accounts/default/email":            `"metadata-sa@some-project.iam.gserviceaccount.com"`,
+		"/computeMetadata/v1/project/attributes/?recursive=true":                 `{}`,
+		"/computeMetadata/v1/instance/service-accounts/default/scopes":           `""`,
+		"/computeMetadata/v1/instance/service-accounts/default/?recursive=false": `["aliases/","email","identity","scopes/","token"]`,
+	} {
+		resp, body, err := getMetadata(s.URL() + path)
+		if err != nil {
+			t.Fatalf("error getting %s %v", path, err)
+		}
+		if resp.StatusCode != http.StatusOK || body != want || resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: unexpected response: got %v %q %q want %q", path, resp.StatusCode, resp.Header.Get("Content-Type"), body, want)
+		}
+		if resp.Header.Get("ETag") != getETag([]byte(body)) {
+			t.Errorf("%s: ETag does not match the formatted body", path)
+		}
+	}
+}
+
+func TestResponseFormatterRecursiveError(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}), WithResponseFormatter(failingFormatter{}))
+
+	resp, _, err := getMetadata(s.URL() + "/computeMetadata/v1/project/?recursive=true")
+	if err != nil {
+		t.Fatalf("error getting project %v", err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("unexpected status code: got %v want %v", resp.StatusCode, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// claimsSchema is the output of GenerateClaimsJSONSchema(); it is checked to be up to date by the tests and
+// refreshed with `go test -run TestClaimsJSONSchema -update-schema`
+//
+//go:embed claims.schema.json
+var claimsSchema []byte
+
+// jsonSchema is the subset of JSON Schema draft-07 used to describe Claims
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 interface{}            `json:"type"`
+	Format               string                 `json:"format,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Minimum              *int                   `json:"minimum,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+}
+
+// claimsSchemaField adds the constraints of a Claims field which are not expressed by its Go type.  Fields are
+// keyed by their dotted JSON path, with `*` for map values and `[]` for array items.
+type claimsSchemaField struct {
+	description string
+	required    []string
+	format      string
+	pattern     string
+	enum        []string
+}
+
+var claimsSchemaFields = map[string]claimsSchemaField{
+	"":                   {required: []string{"computeMetadata"}},
+	"computeMetadata":    {required: []string{"v1"}},
+	"computeMetadata.v1": {required: []string{"instance"}},
+
+	"computeMetadata.v1.instance":                  {required: []string{"serviceAccounts"}},
+	"computeMetadata.v1.instance.guestAttributes":  {description: "initial guest attributes keyed by namespace, then key; writable at runtime"},
+	"computeMetadata.v1.instance.image":            {pattern: optionalPattern(imageRegex.String())},
+	"computeMetadata.v1.instance.machineType":      {pattern: optionalPattern(machineTypeRegex.String())},
+	"computeMetadata.v1.instance.maintenanceEvent": {enum: []string{"", maintenanceEventNone, maintenanceEventMigrateOnHost, maintenanceEventTerminateOnHost}},
+	"computeMetadata.v1.instance.region":           {description: "derived from the zone if unset", pattern: optionalPattern(instanceRegionRegex.String())},
+	"computeMetadata.v1.instance.zone":             {pattern: optionalPattern(instanceZoneRegex.String())},
+
+	"computeMetadata.v1.instance.scheduling.automaticRestart":  {pattern: "^([Tt][Rr][Uu][Ee]|[Ff][Aa][Ll][Ss][Ee])?$"},
+	"computeMetadata.v1.instance.scheduling.onHostMaintenance": {enum: []string{"", "MIGRATE", "TERMINATE"}},
+	"computeMetadata.v1.instance.scheduling.preemptible":       {enum: []string{"", "TRUE", "FALSE"}},
+
+	"computeMetadata.v1.instance.serviceAccounts": {
+		description: "service accounts keyed by email or alias; the default account is used for application default credentials",
+		required:    []string{"default"},
+	},
+	"computeMetadata.v1.instance.serviceAccounts.*":           {required: []string{"email"}},
+	"computeMetadata.v1.instance.serviceAccounts.*.email":     {format: "email"},
+	"computeMetadata.v1.instance.serviceAccounts.*.scopes.[]": {format: "uri"},
+}
+
+func optionalPattern(p string) string {
+	return "^$|" + p
+}
+
+// GenerateClaimsJSONSchema returns a JSON Schema (draft-07) document describing the config file format of Claims.
+//
+// The metadata path each field is served at is derived from its `altjson` tag.  The schema requires the fields
+// validated by NewMetadataServer() and UpdateClaims(), eg the default service account and its email.
+func GenerateClaimsJSONSchema() ([]byte, error) {
+	s := claimsFieldSchema(reflect.TypeOf(Claims{}), "", "")
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+	s.Title = "gce_metadata_server claims"
+	s.Description = "Metadata values returned by the GCE metadata server emulator, in the format of " +
+		"`curl -H 'Metadata-Flavor: Google' http://metadata/computeMetadata/v1/?recursive=true`"
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ClaimsJSONSchema returns the schema of GenerateClaimsJSONSchema() embedded in the binary
+func ClaimsJSONSchema() []byte {
+	return bytes.Clone(claimsSchema)
+}
+
+// claimsFieldSchema describes a value of type t at the dotted JSON path key, served at the metadata path
+func claimsFieldSchema(t reflect.Type, key, path string) *jsonSchema {
+	s := &jsonSchema{}
+	switch t.Kind() {
+	case reflect.Struct:
+		s.Type = "object"
+		s.Properties = map[string]*jsonSchema{}
+		s.AdditionalProperties = false
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			alt, _, _ := strings.Cut(f.Tag.Get("altjson"), ",")
+			s.Properties[name] = claimsFieldSchema(f.Type, strings.TrimPrefix(key+"."+name, "."), path+"/"+alt)
+		}
+	// nil maps and slices are encoded as null
+	case reflect.Map:
+		s.Type = []string{"object", "null"}
+		s.AdditionalProperties = claimsFieldSchema(t.Elem(), key+".*", path+"/<key>")
+	case reflect.Slice, reflect.Array:
+		s.Type = []string{"array", "null"}
+		s.Items = claimsFieldSchema(t.Elem(), key+".[]", path+"/<index>")
+	case reflect.String:
+		s.Type = "string"
+	case reflect.Bool:
+		s.Type = "boolean"
+		if t == reflect.TypeOf(GCEBool(false)) {
+			s.Type = []string{"boolean", "string"}
+			s.Pattern = "^(TRUE|FALSE)$"
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s.Type = "integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s.Type = "integer"
+		s.Minimum = new(int)
+	}
+
+	// the top level objects are not served by themselves
+	if path != "" && path != "/computeMetadata" {
+		s.Description = "served at " + path
+	}
+	if f, ok := claimsSchemaFields[key]; ok {
+		if f.description != "" {
+			s.Description = strings.TrimPrefix(s.Description+"; "+f.description, "; ")
+		}
+		if len(f.required) > 0 {
+			// a null map would satisfy the required keys
+			s.Type = "object"
+			s.Required = f.required
+		}
+		s.Format = f.format
+		s.Pattern = f.pattern
+		s.Enum = f.enum
+	}
+	return s
+}
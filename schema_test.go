@@ -0,0 +1,91 @@
+package mds
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+var updateSchema = flag.Bool("update-schema", false, "rewrite claims.schema.json with the output of GenerateClaimsJSONSchema()")
+
+func validateAgainstClaimsSchema(t *testing.T, doc []byte) *gojsonschema.Result {
+	t.Helper()
+	schema, err := GenerateClaimsJSONSchema()
+	if err != nil {
+		t.Fatalf("error generating schema %v", err)
+	}
+	res, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schema), gojsonschema.NewBytesLoader(doc))
+	if err != nil {
+		t.Fatalf("error validating document %v", err)
+	}
+	return res
+}
+
+func TestClaimsJSONSchema(t *testing.T) {
+	schema, err := GenerateClaimsJSONSchema()
+	if err != nil {
+		t.Fatalf("error generating schema %v", err)
+	}
+	if *updateSchema {
+		if err := os.WriteFile("claims.schema.json", schema, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(ClaimsJSONSchema(), schema) {
+		t.Errorf("claims.schema.json is out of date, run `go test -run TestClaimsJSONSchema -update-schema`")
+	}
+
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(schema, &doc); err != nil {
+		t.Fatalf("error parsing schema %v", err)
+	}
+	if doc["$schema"] != "http://json-schema.org/draft-07/schema#" {
+		t.Errorf("unexpected $schema: got %v", doc["$schema"])
+	}
+
+	data, err := os.ReadFile("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := validateAgainstClaimsSchema(t, data); !res.Valid() {
+		t.Errorf("config.json does not match the schema: %v", res.Errors())
+	}
+
+	data, err = json.Marshal(projectClaims("some-project"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := validateAgainstClaimsSchema(t, data); !res.Valid() {
+		t.Errorf("claims do not match the schema: %v", res.Errors())
+	}
+}
+
+func TestClaimsJSONSchemaErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		doc  string
+		want string
+	}{
+		"no default service account": {`{"computeMetadata":{"v1":{"instance":{"serviceAccounts":{}}}}}`, "default"},
+		"null service accounts":      {`{"computeMetadata":{"v1":{"instance":{"serviceAccounts":null}}}}`, "serviceAccounts"},
+		"no email":                   {`{"computeMetadata":{"v1":{"instance":{"serviceAccounts":{"default":{}}}}}}`, "email"},
+		"invalid email":              {`{"computeMetadata":{"v1":{"instance":{"serviceAccounts":{"default":{"email":"metadata-sa"}}}}}}`, "email"},
+		"unknown field":              {`{"computeMetadata":{"v1":{"instance":{"serviceAccounts":{"default":{"email":"a@b.com"}},"zones":""}}}}`, "zones"},
+		"wrong type":                 {`{"computeMetadata":{"v1":{"instance":{"serviceAccounts":{"default":{"email":"a@b.com"}},"preempted":"no"}}}}`, "preempted"},
+		"invalid zone":               {`{"computeMetadata":{"v1":{"instance":{"serviceAccounts":{"default":{"email":"a@b.com"}},"zone":"us-central1-a"}}}}`, "zone"},
+		"invalid scheduling":         {`{"computeMetadata":{"v1":{"instance":{"serviceAccounts":{"default":{"email":"a@b.com"}},"scheduling":{"preemptible":"yes"}}}}}`, "preemptible"},
+	} {
+		res := validateAgainstClaimsSchema(t, []byte(tc.doc))
+		if res.Valid() {
+			t.Errorf("%s: expected document to be invalid", name)
+			continue
+		}
+		if !strings.Contains(res.Errors()[0].String(), tc.want) {
+			t.Errorf("%s: expected error to mention %q: got %v", name, tc.want, res.Errors())
+		}
+	}
+}
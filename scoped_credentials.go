@@ -0,0 +1,140 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// errScopeUnavailable is returned for access_tokens of the default service account requested with a scope which
+// neither ServerConfig.ScopedCredentials nor the scopes of the account in the claims cover
+var errScopeUnavailable = errors.New("scope is not available")
+
+// errScopeNotGranted is returned for access_tokens requested with a scope which the service account in the claims
+// does not list, unless ServerConfig.AllowDynamicScopes is set
+var errScopeNotGranted = errors.New("scope is not granted to the service account")
+
+// downscopedScopes checks the scopes an access_token for account is requested with against the scopes of the account
+// in the claims.  It returns the scopes the served token holds and the scopes to fetch it with, which are nil if the
+// default token of the account is served: the requested scopes are all of the account's scopes or its credentials
+// cannot be scoped.  Requested scopes are ignored if the account lists no scopes.
+func (h *MetadataServer) downscopedScopes(account string, requested []string) (granted, fetch []string, err error) {
+	configured := h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[account].Scopes
+	if len(requested) == 0 || len(configured) == 0 {
+		return nil, nil, nil
+	}
+	proper := false
+	for _, scope := range configured {
+		if !containsScope(requested, scope) {
+			proper = true
+		}
+	}
+	for _, scope := range requested {
+		if !containsScope(configured, scope) {
+			return nil, nil, fmt.Errorf("%w: %s", errScopeNotGranted, scope)
+		}
+	}
+	if !proper {
+		return requested, nil, nil
+	}
+	if !h.canScopeCredentials(account) {
+		return configured, nil, nil
+	}
+	return requested, requested, nil
+}
+
+// canScopeCredentials reports if fetchAccessToken() can get an access_token for account with other scopes than the
+// ones of its credentials
+func (h *MetadataServer) canScopeCredentials(account string) bool {
+	if _, ok := h.ServerConfig.TPMHandles[account]; ok {
+		return false
+	}
+	if account != defaultServiceAccount {
+		creds := h.credentials(account)
+		return creds != nil && len(creds.JSON) > 0
+	}
+	return h.ServerConfig.Impersonate || h.ServerConfig.Federate || h.ServerConfig.UseTPM || (h.Creds != nil && len(h.Creds.JSON) > 0)
+}
+
+// scopedCredentialsKey returns the ServerConfig.ScopedCredentials key to get an access_token for scopes with, or
+// "" if the default credentials cover them.
+//
+// A key covers the scope it names and the scopes below it, eg `.../auth/devstorage` covers
+// `.../auth/devstorage.read_only`; the longest key wins.  Scopes without a key are covered by the default credentials
+// if the default service account lists them.  All scopes of a request must be covered by the same credentials.
+func (h *MetadataServer) scopedCredentialsKey(scopes []string) (string, error) {
+	defaultScopes := h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[defaultServiceAccount].Scopes
+	key := ""
+	for i, scope := range scopes {
+		k := ""
+		for candidate := range h.ServerConfig.ScopedCredentials {
+			if (scope == candidate || strings.HasPrefix(scope, candidate+".")) && len(candidate) > len(k) {
+				k = candidate
+			}
+		}
+		if k == "" && !containsScope(defaultScopes, scope) {
+			return "", fmt.Errorf("%w: no credentials configured for scope %s", errScopeUnavailable, scope)
+		}
+		if i > 0 && k != key {
+			return "", fmt.Errorf("%w: scopes %s and %s are served by different credentials", errScopeUnavailable, scopes[0], scope)
+		}
+		key = k
+	}
+	return key, nil
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchScopedAccessToken gets a new access_token for scopes from ServerConfig.ScopedCredentials[key].  Credentials
+// from a service account key are scoped to the requested scopes, other credential sources are used as they are.
+func (h *MetadataServer) fetchScopedAccessToken(ctx context.Context, key string, scopes []string) (*oauth2.Token, error) {
+	h.tokenMutex.Lock()
+	defer h.tokenMutex.Unlock()
+
+	creds := h.ServerConfig.ScopedCredentials[key]
+	ts := creds.TokenSource
+	if len(creds.JSON) > 0 {
+		scoped, err := google.CredentialsFromJSON(ctx, creds.JSON, scopes...)
+		if err != nil {
+			h.contextLog(ctx).Error("Unable to parse scoped credentials", "scope", key, "error", err)
+			return nil, err
+		}
+		ts = scoped.TokenSource
+	}
+
+	h.tokenRefreshed(accessTokenType)
+	if h.ServerConfig.OnTokenRefresh != nil {
+		h.ServerConfig.OnTokenRefresh(defaultServiceAccount)
+	}
+	tok, err := tokenWithContext(ctx, ts)
+	if err != nil {
+		h.contextLog(ctx).Error("could not get Token", "scope", key, "error", err)
+		return nil, err
+	}
+	return tok, nil
+}
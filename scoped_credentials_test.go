@@ -0,0 +1,163 @@
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	storageScope         = "https://www.googleapis.com/auth/devstorage"
+	storageReadOnlyScope = "https://www.googleapis.com/auth/devstorage.read_only"
+	bigqueryScope        = "https://www.googleapis.com/auth/bigquery"
+)
+
+func staticCredentials(token string) *google.Credentials {
+	return &google.Credentials{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token, Expiry: time.Now().Add(time.Hour)})}
+}
+
+func scopedToken(t *testing.T, h *MetadataServer, scopes ...string) *httptest.ResponseRecorder {
+	path := "/computeMetadata/v1/instance/service-accounts/default/token"
+	if len(scopes) > 0 {
+		path += "?scopes=" + url.QueryEscape(strings.Join(scopes, ","))
+	}
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	h.handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestScopedCredentials(t *testing.T) {
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = serviceAccountDetails{
+		Email:  "metadata-sa@some-project.iam.gserviceaccount.com",
+		Scopes: []string{cloudPlatformScope},
+	}
+	sc := &ServerConfig{ScopedCredentials: map[string]*google.Credentials{
+		storageScope:         staticCredentials("storage-token"),
+		storageReadOnlyScope: staticCredentials("storage-read-only-token"),
+	}}
+	h, err := NewMetadataServer(context.Background(), sc, staticCredentials("default-token"), claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for _, tc := range []struct {
+		scopes []string
+		want   string
+	}{
+		{nil, "default-token"},
+		{[]string{cloudPlatformScope}, "default-token"},
+		{[]string{storageScope}, "storage-token"},
+		{[]string{storageScope + ".read_write"}, "storage-token"},
+		{[]string{storageReadOnlyScope}, "storage-read-only-token"},
+	} {
+		rr := scopedToken(t, h, tc.scopes...)
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), tc.want) {
+			t.Errorf("%v: unexpected response: got %v %s want %s", tc.scopes, rr.Code, rr.Body.String(), tc.want)
+		}
+	}
+
+	for _, scopes := range [][]string{
+		{bigqueryScope},
+		{storageScope + "_admin"},
+		{storageScope, cloudPlatformScope},
+	} {
+		rr := scopedToken(t, h, scopes...)
+		if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "scope is not available") {
+			t.Errorf("%v: unexpected response: got %v %s want %v", scopes, rr.Code, rr.Body.String(), http.StatusForbidden)
+		}
+	}
+}
+
+func TestScopedCredentialsValidation(t *testing.T) {
+	for _, sc := range []*ServerConfig{
+		{ScopedCredentials: map[string]*google.Credentials{"": staticCredentials("token")}},
+		{ScopedCredentials: map[string]*google.Credentials{storageScope: nil}},
+	} {
+		if _, err := NewMetadataServer(context.Background(), sc, staticCredentials("default-token"), projectClaims("some-project")); err == nil {
+			t.Errorf("expected error for ScopedCredentials %v", sc.ScopedCredentials)
+		}
+	}
+}
+
+// scopeEchoCredentials returns service account key credentials whose access_tokens name the scopes they were requested with
+func scopeEchoCredentials(t *testing.T) *google.Credentials {
+	oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(r.PostFormValue("assertion"), claims); err != nil {
+			t.Errorf("error parsing assertion %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": fmt.Sprintf("token-for:%v", claims["scope"]), "token_type": "Bearer", "expires_in": 3600})
+	}))
+	t.Cleanup(oauth.Close)
+	creds, err := google.CredentialsFromJSON(context.Background(), serviceAccountKeyJSON(t, oauth.URL), cloudPlatformScope)
+	if err != nil {
+		t.Fatalf("error parsing credentials %v", err)
+	}
+	return creds
+}
+
+func TestDownscopedToken(t *testing.T) {
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = serviceAccountDetails{
+		Email:  "metadata-sa@some-project.iam.gserviceaccount.com",
+		Scopes: []string{cloudPlatformScope, storageReadOnlyScope},
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, scopeEchoCredentials(t), claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for _, tc := range []struct {
+		scopes    []string
+		wantToken string
+		wantScope string
+	}{
+		{nil, "token-for:" + cloudPlatformScope, ""},
+		{[]string{storageReadOnlyScope}, "token-for:" + storageReadOnlyScope, storageReadOnlyScope},
+		{[]string{storageReadOnlyScope, cloudPlatformScope}, "token-for:" + cloudPlatformScope, storageReadOnlyScope + " " + cloudPlatformScope},
+	} {
+		rr := scopedToken(t, h, tc.scopes...)
+		var tok metadataToken
+		if err := json.Unmarshal(rr.Body.Bytes(), &tok); rr.Code != http.StatusOK || err != nil {
+			t.Fatalf("%v: unexpected response: got %v %s", tc.scopes, rr.Code, rr.Body.String())
+		}
+		if tok.AccessToken != tc.wantToken || tok.Scope != tc.wantScope {
+			t.Errorf("%v: unexpected token: got %q scope %q want %q scope %q", tc.scopes, tok.AccessToken, tok.Scope, tc.wantToken, tc.wantScope)
+		}
+	}
+
+	for _, scopes := range [][]string{{bigqueryScope}, {storageReadOnlyScope, storageScope}} {
+		rr := scopedToken(t, h, scopes...)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "scope is not granted") {
+			t.Errorf("%v: unexpected response: got %v %s want %v", scopes, rr.Code, rr.Body.String(), http.StatusBadRequest)
+		}
+	}
+
+	// credentials which cannot be scoped serve their token with all scopes of the account
+	h, err = NewMetadataServer(context.Background(), &ServerConfig{}, staticCredentials("default-token"), claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	rr := scopedToken(t, h, storageReadOnlyScope)
+	var tok metadataToken
+	if err := json.Unmarshal(rr.Body.Bytes(), &tok); err != nil || tok.AccessToken != "default-token" || tok.Scope != cloudPlatformScope+" "+storageReadOnlyScope {
+		t.Errorf("unexpected token: got %v %s", rr.Code, rr.Body.String())
+	}
+}
@@ -23,18 +23,29 @@ package mds
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
+	"math"
+	"math/big"
 	"net"
+	"path"
 	"reflect"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"context"
 	"fmt"
+	"html"
 
 	"net/http"
 	"net/url"
@@ -42,7 +53,6 @@ import (
 	"strings"
 
 	jwt "github.com/golang-jwt/jwt/v5"
-	"github.com/golang/glog"
 	tpmjwt "github.com/salrashid123/golang-jwt-tpm"
 	saltpm "github.com/salrashid123/oauth2/tpm"
 	"golang.org/x/net/http2"
@@ -52,6 +62,7 @@ import (
 	"google.golang.org/api/impersonate"
 
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2/google"
 
 	"github.com/google/go-tpm-tools/client"
@@ -62,8 +73,6 @@ import (
 	iamcredentialspb "cloud.google.com/go/iam/credentials/apiv1/credentialspb"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Configures and manages the server and is used as a receiver to start and stop the server.
@@ -73,30 +82,58 @@ import (
 // like the port and interface to use
 type MetadataServer struct {
 	tokenMutex   sync.Mutex
+	stateMutex   sync.RWMutex // guards Creds and Claims; held for read while a request is being served
+	changeMutex  sync.Mutex
+	changed      chan struct{} // closed and replaced whenever claims change to wake up ?wait_for_change requests
+	shutdown     chan struct{} // closed by ShutdownContext() to release ?wait_for_change requests
+	faultMutex   sync.RWMutex  // guards ServerConfig.FaultConfig
+	latencyMutex sync.RWMutex  // guards ServerConfig.LatencyConfig
+
+	guestMutex      sync.RWMutex                 // guards guestAttributes
+	guestAttributes map[string]map[string]string // guest attributes written through PUT and DELETE, initialized from the claims
+
+	adminSrv      *http.Server
+	adminListener net.Listener
+	metricsSrv    *http.Server // serves ServerConfig.MetricsPath on ServerConfig.MetricsPort
+	stats         requestStats // counters served by the admin API
+
+	accessLogMutex sync.Mutex // serializes writes to ServerConfig.AccessLog
+
+	instanceID uint64 // served if the claims do not set an instance id; generated once by NewMetadataServer()
+
+	spotVMSet bool // set by SetSpotVM(); until then a preempted instance is served as a Spot VM
+
+	claimsValidator ClaimsValidator // set by WithClaimsValidator(); nil skips validation
+
+	tokenCache tokenCache // access_tokens returned to clients, see getAccessToken()
+
+	namedCredentials map[string]*google.Credentials // copy of ServerConfig.NamedCredentials; entries are replaced by invalidateCredentials()
+
+	tpmSessions tpmSessions // opened on the first access_token for each ServerConfig.TPMHandles handle
+
+	identityLimiter *identityRateLimiter // nil unless ServerConfig.IdentityRateLimit or GlobalIdentityRateLimit is set
+	pathLimiter     *pathRateLimiter     // nil unless ServerConfig.PathRateLimits or GlobalRateLimit is set
+
+	tracer trace.Tracer // set by WithTracerProvider(); nil disables tracing
+
+	formatter ResponseFormatter // set by WithResponseFormatter(); nil uses DefaultResponseFormatter
+
+	watchMutex     sync.Mutex // guards configWatchers
+	configWatchers []func()   // stop functions of the watchers started by AttachConfigWatcher()
+
 	srv          *http.Server
+	listeners    []net.Listener
+	tlsConfig    *tls.Config // set if the metadata listeners serve TLS
 	initNew      bool
+	logger       Logger
+	metrics      *serverMetrics      // prometheus collectors; nil if metrics are disabled
+	vaultConfig  *VaultConfig        // set by WithVaultCredentials()
+	ready        atomic.Bool         // set once a token was successfully fetched from the credential source
 	Creds        *google.Credentials // credentials to use
 	Claims       Claims              // values for the runtime attributes and values the metadata server returns
 	ServerConfig ServerConfig        // base system configuration (listen interface, port, etc)
 }
 
-var (
-	// hostHeaders = []string{"metadata", "metadata.google.internal", "169.254.169.254"}
-
-	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "metadata_endpoint_latency_seconds",
-		Help: "Duration of HTTP requests.",
-	}, []string{"path"})
-
-	pathReqs = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "metadata_endpoint_path_requests",
-			Help: "backend status, partitioned by status code and path.",
-		},
-		[]string{"code", "path"},
-	)
-)
-
 const (
 	emailScope                = "https://www.googleapis.com/auth/userinfo.email"
 	cloudPlatformScope        = "https://www.googleapis.com/auth/cloud-platform"
@@ -106,10 +143,20 @@ const (
 	googleProjectNumber       = "GOOGLE_NUMERIC_PROJECT_ID"
 	googleServiceAccountEmail = "GOOGLE_SERVICE_ACCOUNT"
 
+	defaultServiceAccount = "default"
+	defaultCPUPlatform    = "Unknown CPU Platform" // reported by GCE for platforms it cannot identify
+	defaultInstanceName   = "metadata-emulator"    // served if neither the instance name nor its hostname are set
+
+	maintenanceEventNone            = "NONE"
+	maintenanceEventMigrateOnHost   = "MIGRATE_ON_HOST_MAINTENANCE"
+	maintenanceEventTerminateOnHost = "TERMINATE_ON_HOST_MAINTENANCE"
+
 	defaultMetricsPath      = "/metrics"
 	defaultMetricsInterface = "127.0.0.1"
 	defaultMetricsPort      = "9000"
 
+	defaultDomainSocketMode os.FileMode = 0660
+
 	metadata404Body = `
 <!DOCTYPE html>
 <html lang=en>
@@ -123,38 +170,137 @@ const (
 	<p><b>404.</b> <ins>That’s an error.</ins>
 	<p>The requested URL <code>/computeMetadata/v1/project/attributes/ssh-keysd</code> was not found on this server.  <ins>That’s all we know.</ins>
 `
+
+	// the request path is inserted into <code></code>
+	metadata403Body = `
+<!DOCTYPE html>
+<html lang=en>
+	<meta charset=utf-8>
+	<meta name=viewport content="initial-scale=1, minimum-scale=1, width=device-width">
+	<title>Error 403 (Forbidden)!!1</title>
+	<style>
+		*{margin:0;padding:0}html,code{font:15px/22px arial,sans-serif}html{background:#fff;color:#222;padding:15px}body{margin:7% auto 0;max-width:390px;min-height:180px;padding:30px 0 15px}* > body{background:url(//www.google.com/images/errors/robot.png) 100% 5px no-repeat;padding-right:205px}p{margin:11px 0 22px;overflow:hidden}ins{color:#777;text-decoration:none}a img{border:0}@media screen and (max-width:772px){body{background:none;margin-top:0;max-width:none;padding-right:0}}#logo{background:url(//www.google.com/images/branding/googlelogo/1x/googlelogo_color_150x54dp.png) no-repeat;margin-left:-5px}@media only screen and (min-resolution:192dpi){#logo{background:url(//www.google.com/images/branding/googlelogo/2x/googlelogo_color_150x54dp.png) no-repeat 0% 0%/100% 100%;-moz-border-image:url(//www.google.com/images/branding/googlelogo/2x/googlelogo_color_150x54dp.png) 0}}@media only screen and (-webkit-min-device-pixel-ratio:2){#logo{background:url(//www.google.com/images/branding/googlelogo/2x/googlelogo_color_150x54dp.png) no-repeat;-webkit-background-size:100% 100%}}#logo{display:inline-block;height:54px;width:150px}
+	</style>
+	<a href=//www.google.com/><span id=logo aria-label=Google></span></a>
+	<p><b>403.</b> <ins>That’s an error.</ins>
+	<p>Your client does not have permission to get URL <code></code> from this server. Missing Metadata-Flavor:Google header. <ins>That’s all we know.</ins>
+`
 )
 
+// metadataAPIVersions are listed at /computeMetadata/
+var metadataAPIVersions = []string{"v1"}
+
 // Configures the base runtime for the metadata server.
 // Set the port, bind-address and what mode this server will acquire credentials through
 type ServerConfig struct {
+	// Deprecated: use Listeners
 	BindInterface string // interface to bind to (default 127.0.0.1)
-	Port          string // port to listen on (default :8080)
-	DomainSocket  string // toggle if unix domain sockets should be used.
+	// Deprecated: use Listeners
+	Port string // port to listen on (default :8080)
+	// Deprecated: use Listeners
+	DomainSocket string // toggle if unix domain sockets should be used.
+
+	Listeners []ListenerSpec // addresses to listen on simultaneously; if set, BindInterface, Port and DomainSocket are ignored (default: nil)
+
+	DomainSocketMode os.FileMode // permissions of the unix socket files, which are removed on shutdown (default: 0660)
 
 	MetricsEnabled   bool   // flag if prometheus metrics are enabled (default false)
 	MetricsInterface string // interface to bind for metrics (default 127.0.0.1)
 	MetricsPort      string // port for the metrics prometheus endpoint (default :9000)
 	MetricsPath      string // path for metrics endpoint (default /metrics)
 
+	PathPrefix string // if set, serve the metadata paths and the admin API below this path, eg /gce-metadata/computeMetadata/v1/; /healthz, /readyz and metrics are not prefixed (default: "")
+
+	AdminInterface string // interface to bind for the admin API (default 127.0.0.1)
+	AdminPort      string // if set, serve the admin API on this port; use "0" to pick a free port (default: "")
+	AdminToken     string // if set, admin API requests must send `Authorization: Bearer <AdminToken>` (default: "")
+
+	GRPCPort string // port on BindInterface (or 127.0.0.1 if it is empty) to serve the gRPC API of NewGRPCMetadataServer() on; use "0" to pick a free port (default: "")
+
 	Impersonate        bool // toggle if provided default credentials should be impersonated (default: false)
 	Federate           bool // toggle if workload federation should be used (default: false)
 	AllowDynamicScopes bool // toggle if dynamic scopes are enabled for access_tokens (default: false)
 
+	AllowArbitraryProjectID bool // toggle if project ids which do not follow the GCP naming rules are accepted (default: false)
+
+	ExpandConfigEnv bool   // toggle if AttachConfigWatcher() and ReloadConfigFile() expand environment variables in config file values, see ClaimsFromFile() (default: false)
+	ConfigFormat    string // format of the config file read by AttachConfigWatcher() and ReloadConfigFile(): json, yaml, toml or auto (default: from the file extension, see ConfigFormatForFile())
+
+	EnforceMetadataFlavor *bool // if set to false, requests without the `Metadata-Flavor: Google` header are served instead of rejected with a 403 (default: true)
+
+	ImpersonateDelegates []string // service accounts in the delegation chain to the default service account; requires Impersonate (default: nil)
+
 	UseTPM           bool   // toggle if TPM should be used for credentials (default: false)
 	TPMPath          string // path to the TPM (default /dev/tpm0)
 	PCRs             []int  // list of TPM PCR banks the key is bound to.  If set, the library will attempt to apply PCRSessionPolicy (default: nil)
 	PersistentHandle int    // persistent handle for the TPM pointing to the credentials (default: 0)
-}
 
-func prometheusMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		route := mux.CurrentRoute(r)
-		path, _ := route.GetPathTemplate()
-		timer := prometheus.NewTimer(httpDuration.WithLabelValues(path))
-		next.ServeHTTP(w, r)
-		timer.ObserveDuration()
-	})
+	// persistent TPM handle of the key of each service account keyed by its alias in Claims, eg {"reader": 0x81008001}.
+	// Cannot include "default", which uses PersistentHandle or the credentials passed to NewMetadataServer() (default: nil)
+	TPMHandles map[string]int
+
+	PKCS11LibPath  string // if set, sign tokens with a key held in a PKCS#11 token using this module (default: "")
+	PKCS11SlotID   uint   // slot of the PKCS#11 token holding the key (default: 0)
+	PKCS11PIN      string // user PIN of the PKCS#11 token (default: "")
+	PKCS11KeyLabel string // CKA_LABEL of the service account private key on the PKCS#11 token (default: "")
+
+	KubernetesSATokenFile   string // if set, exchange the projected Kubernetes service account token in this file for federated access_tokens (default: "")
+	KubernetesTokenAudience string // STS audience of the workload identity provider the Kubernetes token is exchanged with (default: "")
+
+	TokenFilePath string // if set, serve the JWT in this file as the access_token and read it again before it expires, see TokenFileTokenSource() (default: "")
+
+	FederationConfig *FederationConfig // if set, exchange a token from an external identity provider for federated access_tokens without a credentials file (default: nil)
+
+	CredentialCommand            []string      // if set, run this command to acquire tokens instead of using the provided credentials (default: nil)
+	CredentialCommandExpiryDelta time.Duration // run the CredentialCommand again when its token expires within this duration (default: 10s)
+
+	TokenTTL       time.Duration        // if set, access_tokens are reported to expire after at most this duration to exercise client refresh logic (default: 0)
+	OnTokenRefresh func(account string) // if set, called with the service account alias each time an access_token is requested from the credential source; must not block (default: nil)
+
+	SkipPrefetch bool // if set, Start() does not fetch a token to check the credentials, eg if there is no network access at startup (default: false)
+
+	RecordDir      string // if set, proxy all requests to a real metadata server and save the responses to this directory (default: "")
+	RecordUpstream string // metadata server to record responses from (default: http://metadata.google.internal)
+	ReplayDir      string // if set, serve responses previously saved with RecordDir from this directory instead of the claims (default: "")
+
+	ProxyTo string // if set, forward all requests unmodified to this metadata server instead of serving the claims, eg http://metadata.google.internal (default: "")
+
+	FaultConfig   FaultConfig   // simulated errors for chaos testing; can be changed at runtime with UpdateFaultConfig() (default: no faults)
+	LatencyConfig LatencyConfig // simulated response latency per path prefix; can be changed at runtime with SetLatencyConfig() (default: nil)
+
+	IdentityRateLimit       RateLimitConfig // if set, id_token requests for the same audience above this rate are rejected with a 429 (default: no limit)
+	GlobalIdentityRateLimit RateLimitConfig // if set, id_token requests for all audiences combined above this rate are rejected with a 429 (default: no limit)
+
+	PathRateLimits  map[string]RateLimit // metadata requests for each path above its rate are rejected with a 429, eg for /computeMetadata/v1/instance/service-accounts/default/token (default: nil)
+	GlobalRateLimit RateLimit            // if set, metadata requests for all paths combined above this rate are rejected with a 429; checked after PathRateLimits (default: no limit)
+
+	ReadHeaderTimeout time.Duration // time to read the request headers on the metadata and admin listeners; a negative value disables the timeout (default: 5s)
+	ReadTimeout       time.Duration // time to read the whole request; a negative value disables the timeout (default: 10s)
+	WriteTimeout      time.Duration // time to write the response, except for `?wait_for_change=true` requests; a negative value disables the timeout (default: 30s)
+
+	MaxRequestBodySize      int64 // request bodies of the metadata listeners above this many bytes are rejected with a 413 (default: 65536)
+	AdminMaxRequestBodySize int64 // request bodies of the admin API above this many bytes are rejected with a 413 (default: 1048576)
+
+	RequiredBearerToken    string   // if set, requests must carry `Authorization: Bearer <token>` or are rejected with a 401 (default: "")
+	BearerTokenExemptPaths []string // path.Match patterns of paths served without RequiredBearerToken, eg /healthz or /computeMetadata/v1/instance/service-accounts/*/identity (default: nil)
+
+	TLSCertFile string      // PEM certificate (chain) to serve the metadata listeners with TLS; requires TLSKeyFile (default: "")
+	TLSKeyFile  string      // PEM private key for TLSCertFile (default: "")
+	TLSConfig   *tls.Config // TLS configuration to serve the metadata listeners with; takes precedence over TLSCertFile and TLSKeyFile (default: nil)
+
+	AccessLog io.Writer // if set, write one JSON access log line per request, including requests rejected for a missing Metadata-Flavor header (default: nil)
+
+	IDTokenSigningKey crypto.Signer // if set, id_tokens are signed locally with this RSA or P-256 EC key and its public key is served at /.well-known/jwks.json (default: nil)
+
+	// credentials of each service account keyed by its alias in Claims.  Must include "default", which is used
+	// instead of the credentials passed to NewMetadataServer() (default: nil)
+	NamedCredentials map[string]*google.Credentials
+
+	// credentials for access_tokens of the default service account requested with ?scopes=, keyed by scope URL.  The
+	// most specific key covering the requested scopes is used, eg `https://www.googleapis.com/auth/devstorage`
+	// covers `https://www.googleapis.com/auth/devstorage.read_only`; scopes of the default service account in the
+	// claims fall back to the default credentials.  Other scopes are rejected with a 403 (default: nil)
+	ScopedCredentials map[string]*google.Credentials
 }
 
 func httpError(w http.ResponseWriter, error string, code int, contentType string) {
@@ -169,16 +315,33 @@ func httpError(w http.ResponseWriter, error string, code int, contentType string
 type metadataToken struct {
 	AccessToken string `json:"access_token"`
 	// metadata server returns an "expires_in" while oauth2.Token returns Expiry time.time
-	ExpiresIn int    `json:"expires_in"`
-	TokenType string `json:"token_type"`
+	ExpiresIn  int    `json:"expires_in"`
+	ExpiryTime string `json:"expiry_time"` // RFC3339 UTC time expires_in seconds from now
+	TokenType  string `json:"token_type"`
+	Scope      string `json:"scope,omitempty"` // space separated; only set for tokens requested with ?scopes=
+}
+
+// fullMetadataToken is the access_token response for ?token_format=full
+type fullMetadataToken struct {
+	*metadataToken
+	TokenHandle string `json:"token_handle"` // identifies the token, eg in logs, without revealing it
+	Email       string `json:"email"`        // service account the token was issued for
+}
+
+// tokenHandle returns the first 16 bytes of the SHA-256 of the access_token as hex
+func tokenHandle(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:16])
 }
 
 type serviceAccountDetails struct {
 	Aliases  []string `json:"aliases" altjson:"aliases"`
 	Email    string   `json:"email" altjson:"email"`
-	Identity string   `json:"identity" altjson:"identity"`
+	Identity string   `json:"identity,omitempty" altjson:"identity"` // not served, only listed
 	Scopes   []string `json:"scopes" altjson:"scopes"`
-	Token    string   `json:"token" altjson:"token"`
+	Token    string   `json:"token,omitempty" altjson:"token"` // not served, only listed
+
+	X509Cert string `json:"x509Cert,omitempty" altjson:"x509,omitempty"` // PEM encoded certificate served as DER, see LoadX509FromFile()
 }
 
 // Base claims returned by the metadata server
@@ -201,60 +364,113 @@ type V1 struct {
 }
 
 type Instance struct {
-	Attributes  map[string]string `json:"attributes"  altjson:"attributes"`
-	CPUPlatform string            `json:"cpuPlatform"  altjson:"cpu-platform"`
-	Description string            `json:"description"  altjson:"description"`
-	Disks       []struct {
-		DeviceName string `json:"deviceName"  altjson:"device-name"`
-		Index      int    `json:"index"  altjson:"index"`
-		Interface  string `json:"interface"  altjson:"interface"`
-		Mode       string `json:"mode"  altjson:"mode"`
-		Type       string `json:"type"  altjson:"type"`
-	} `json:"disks"  altjson:"disks"`
-	GuestAttributes struct {
-	} `json:"guestAttributes"  altjson:"guest-attributes"` // Guest attributes endpoint access is disabled.
-	Hostname string `json:"hostname"  altjson:"hostname"`
-	ID       int64  `json:"id"  altjson:"id"`
-	Image    string `json:"image"  altjson:"image"`
-	Licenses []struct {
+	Attributes            map[string]string             `json:"attributes"  altjson:"attributes"`
+	CPUPlatform           string                        `json:"cpuPlatform"  altjson:"cpu-platform"`
+	ConfidentialComputing ConfidentialComputingMetadata `json:"confidentialComputing" altjson:"confidential-computing"` // served only if enabled
+	Description           string                        `json:"description"  altjson:"description"`
+	Disks                 []DiskMetadata                `json:"disks"  altjson:"disks"`
+	GuestAttributes       map[string]map[string]string  `json:"guestAttributes"  altjson:"guest-attributes"` // initial values keyed by namespace, then key; writable at runtime
+	Hostname              string                        `json:"hostname"  altjson:"hostname"`
+	ID                    uint64                        `json:"id"  altjson:"id"`
+	Image                 string                        `json:"image"  altjson:"image"`
+	Labels                map[string]string             `json:"labels" altjson:"labels"`
+	Licenses              []struct {
 		ID string `json:"id"  altjson:"id"`
 	} `json:"licenses" altjson:"licenses"`
-	MachineType       string `json:"machineType" altjson:"machine-type"`
-	MaintenanceEvent  string `json:"maintenanceEvent" altjson:"maintenence-event"`
-	Name              string `json:"name" altjson:"name"`
-	NetworkInterfaces []struct {
-		AccessConfigs []struct {
-			ExternalIP string `json:"externalIp" altjson:"external-ip"`
-			Type       string `json:"type" altjson:"type"`
-		} `json:"accessConfigs" altjson:"access-configs"`
-		DNSServers        []string `json:"dnsServers" altjson:"dns-servers"`
-		ForwardedIps      []string `json:"forwardedIps" altjson:"forwarded-ips"`
-		Gateway           string   `json:"gateway" altjson:"gateway"`
-		IP                string   `json:"ip" altjson:"ip"`
-		IPAliases         []string `json:"ipAliases" altjson:"ip-aliases"`
-		Mac               string   `json:"mac" altjson:"mac"`
-		Mtu               int      `json:"mtu" altjson:"mtu"`
-		Network           string   `json:"network" altjson:"network"`
-		Subnetmask        string   `json:"subnetmask" altjson:"subnetmask"`
-		TargetInstanceIps []string `json:"targetInstanceIps" altjson:"target-instance-ips"`
-	} `json:"networkInterfaces" altjson:"network-interfaces"`
+	MachineType       string             `json:"machineType" altjson:"machine-type"`
+	MaintenanceEvent  string             `json:"maintenanceEvent" altjson:"maintenance-event"` // NONE, MIGRATE_ON_HOST_MAINTENANCE or TERMINATE_ON_HOST_MAINTENANCE (default: NONE)
+	Name              string             `json:"name" altjson:"name"`
+	NetworkInterfaces []NetworkInterface `json:"networkInterfaces" altjson:"network-interfaces"`
 	PartnerAttributes struct {
 	} `json:"partnerAttributes" altjson:"partner-attributes"`
-	Preempted        string `json:"preempted"  altjson:"preempted"`
-	RemainingCPUTime int    `json:"remainingCpuTime" altjson:"remaining-cpu-time"`
-	Scheduling       struct {
-		AutomaticRestart  string `json:"automaticRestart" altjson:"automatic-restart"`
-		OnHostMaintenance string `json:"onHostMaintenance" altjson:"on-host-maintenence"`
-		Preemptible       string `json:"preemptible" altjson:"preemptible"`
-	} `json:"scheduling" altjson:"scheduling"`
-	ServiceAccounts map[string]serviceAccountDetails `json:"serviceAccounts" altjson:"service-accounts"`
-	Tags            []string                         `json:"tags" altjson:"tags"`
-	VirtualClock    struct {
+	Preempted        GCEBool                          `json:"preempted"  altjson:"preempted"`
+	Region           string                           `json:"region" altjson:"region"` // derived from Zone if unset
+	RemainingCPUTime int                              `json:"remainingCpuTime" altjson:"remaining-cpu-time"`
+	Scheduling       SchedulingMetadata               `json:"scheduling" altjson:"scheduling"`
+	ServiceAccounts  map[string]serviceAccountDetails `json:"serviceAccounts" altjson:"service-accounts"`
+	SpotVM           bool                             `json:"spotVm" altjson:"spot-vm"` // also served as TRUE once preempted unless set with SetSpotVM()
+	Tags             []string                         `json:"tags" altjson:"tags"`
+	VirtualClock     struct {
 		DriftToken string `json:"driftToken" altjson:"drift-token"`
 	} `json:"virtualClock" altjson:"virtual-clock"`
 	Zone string `json:"zone" altjson:"zone"`
 }
 
+// GCEBool is a boolean encoded in JSON as "TRUE" or "FALSE" like the GCE metadata server does.  It also decodes
+// JSON booleans.
+type GCEBool bool
+
+func (b GCEBool) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strings.ToUpper(strconv.FormatBool(bool(b))))
+}
+
+func (b *GCEBool) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*b = GCEBool(v)
+	case string:
+		switch v {
+		case "TRUE":
+			*b = true
+		case "FALSE":
+			*b = false
+		default:
+			return fmt.Errorf("invalid boolean %q, must be TRUE or FALSE", v)
+		}
+	default:
+		return fmt.Errorf("invalid boolean %s, must be TRUE or FALSE", data)
+	}
+	return nil
+}
+
+// ConfidentialComputingMetadata served under /computeMetadata/v1/instance/confidential-computing/ of Confidential VMs
+type ConfidentialComputingMetadata struct {
+	Enabled           bool   `json:"enabled" altjson:"enabled"`                      // the subtree returns a 404 unless set
+	Technology        string `json:"technology" altjson:"technology"`                // eg AMD-SEV, AMD-SEV-SNP or INTEL-TDX
+	AttestationReport string `json:"attestationReport" altjson:"attestation-report"` // base64 encoded
+}
+
+// SchedulingMetadata served under /computeMetadata/v1/instance/scheduling/
+type SchedulingMetadata struct {
+	AutomaticRestart  string `json:"automaticRestart" altjson:"automatic-restart"`    // true or false
+	OnHostMaintenance string `json:"onHostMaintenance" altjson:"on-host-maintenance"` // MIGRATE or TERMINATE
+	Preemptible       string `json:"preemptible" altjson:"preemptible"`               // TRUE or FALSE
+}
+
+// DiskMetadata served under /computeMetadata/v1/instance/disks/<index>/
+type DiskMetadata struct {
+	DeviceName string `json:"deviceName"  altjson:"device-name"`
+	Index      int    `json:"index"  altjson:"index"`
+	Interface  string `json:"interface"  altjson:"interface"`
+	Mode       string `json:"mode"  altjson:"mode"`
+	Type       string `json:"type"  altjson:"type"`
+}
+
+// NetworkInterface served under /computeMetadata/v1/instance/network-interfaces/<index>/
+type NetworkInterface struct {
+	AccessConfigs     []AccessConfig `json:"accessConfigs" altjson:"access-configs"`
+	DNSServers        []string       `json:"dnsServers" altjson:"dns-servers"`
+	ForwardedIps      []string       `json:"forwardedIps" altjson:"forwarded-ips"`
+	Gateway           string         `json:"gateway" altjson:"gateway"`
+	IP                string         `json:"ip" altjson:"ip"`
+	IPAliases         []string       `json:"ipAliases" altjson:"ip-aliases"`
+	Mac               string         `json:"mac" altjson:"mac"`
+	Mtu               int            `json:"mtu" altjson:"mtu"`
+	Network           string         `json:"network" altjson:"network"`
+	Subnetmask        string         `json:"subnetmask" altjson:"subnetmask"`
+	TargetInstanceIps []string       `json:"targetInstanceIps" altjson:"target-instance-ips"`
+}
+
+// AccessConfig of a NetworkInterface, ie its external address
+type AccessConfig struct {
+	ExternalIP string `json:"externalIp" altjson:"external-ip"`
+	Type       string `json:"type" altjson:"type"`
+}
+
 // OSLogin configuration to apply
 type OSlogin struct {
 	Authenticate struct {
@@ -270,18 +486,101 @@ type Project struct {
 	ProjectID        string            `json:"projectId" altjson:"project-id"`
 }
 
+// ListenerSpec is one address the metadata server listens on
+type ListenerSpec struct {
+	Network string // "tcp" or "unix"
+	Address string // host:port for tcp or the socket file path for unix
+}
+
+// domainSocketMode returns the permissions unix socket files are created with
+func (h *MetadataServer) domainSocketMode() os.FileMode {
+	if h.ServerConfig.DomainSocketMode == 0 {
+		return defaultDomainSocketMode
+	}
+	return h.ServerConfig.DomainSocketMode
+}
+
+// removeSockets deletes the socket files of the unix listeners
+func (h *MetadataServer) removeSockets() {
+	for _, l := range h.listeners {
+		if a := l.Addr(); a.Network() == "unix" {
+			if err := os.Remove(a.String()); err != nil && !errors.Is(err, os.ErrNotExist) {
+				h.log().Error("Unable to remove socket file", "address", a.String(), "error", err)
+			}
+		}
+	}
+}
+
+// listenerSpecs returns ServerConfig.Listeners or the equivalent of the deprecated BindInterface, Port and DomainSocket fields
+func (h *MetadataServer) listenerSpecs() []ListenerSpec {
+	if len(h.ServerConfig.Listeners) > 0 {
+		return h.ServerConfig.Listeners
+	}
+	if h.ServerConfig.DomainSocket != "" {
+		h.log().Info("domain socket specified, ignoring TCP listeners", "socket", h.ServerConfig.DomainSocket)
+		return []ListenerSpec{{Network: "unix", Address: h.ServerConfig.DomainSocket}}
+	}
+	return []ListenerSpec{{Network: "tcp", Address: fmt.Sprintf("%s%s", h.ServerConfig.BindInterface, h.ServerConfig.Port)}}
+}
+
+// validateProjectID checks the project id of the claims unless AllowArbitraryProjectID is set.
+// Claims without a project id are accepted.
+func (c *ServerConfig) validateProjectID(claims *Claims) error {
+	id := claims.ComputeMetadata.V1.Project.ProjectID
+	if id == "" || c.AllowArbitraryProjectID {
+		return nil
+	}
+	return validateProjectID(id)
+}
+
+// credentialSources returns the sources configured for the default credentials; each one replaces the credentials,
+// so NewMetadataServer() accepts at most one.  creds are the credentials passed to NewMetadataServer() and vault
+// reports if `WithVaultCredentials()` is set.
+func (c *ServerConfig) credentialSources(creds *google.Credentials, vault bool) []string {
+	var sources []string
+	if len(c.NamedCredentials) > 0 {
+		sources = append(sources, "NamedCredentials")
+	} else if creds != nil {
+		sources = append(sources, "credentials")
+	}
+	if vault {
+		sources = append(sources, "WithVaultCredentials()")
+	}
+	if c.PKCS11LibPath != "" {
+		sources = append(sources, "PKCS11LibPath")
+	}
+	if c.KubernetesSATokenFile != "" {
+		sources = append(sources, "KubernetesSATokenFile")
+	}
+	if c.TokenFilePath != "" {
+		sources = append(sources, "TokenFilePath")
+	}
+	if c.FederationConfig != nil {
+		sources = append(sources, "FederationConfig")
+	}
+	if len(c.CredentialCommand) > 0 {
+		sources = append(sources, "CredentialCommand")
+	}
+	return sources
+}
+
+// enforceMetadataFlavor reports if requests must send `Metadata-Flavor: Google`
+func (h *MetadataServer) enforceMetadataFlavor() bool {
+	return h.ServerConfig.EnforceMetadataFlavor == nil || *h.ServerConfig.EnforceMetadataFlavor
+}
+
 func (h *MetadataServer) checkMetadataHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		glog.V(10).Infof("Got Request: path[%s] query[%s]", r.URL.Path, r.URL.RawQuery)
+		h.requestLog(r).Debug("Got Request", "path", r.URL.Path, "query", r.URL.RawQuery)
 
 		if r.URL.Query().Has("recursive") {
 			if strings.ToLower(r.URL.Query().Get("recursive")) == "true" {
-				glog.Warning("WARNING: ?recursive=true has limited depth support; check handler implementation")
+				h.requestLog(r).Warn("?recursive=true has limited depth support; check handler implementation")
 			}
 		}
 		if r.URL.Query().Has("alt") {
-			glog.Warning("WARNING: ?alt=text|json has limited support; check handler implementation")
+			h.requestLog(r).Warn("?alt=text|json has limited support; check handler implementation")
 		}
 
 		w.Header().Add("Server", "Metadata Server for VM")
@@ -297,12 +596,16 @@ func (h *MetadataServer) checkMetadataHeaders(next http.Handler) http.Handler {
 
 		flavor := r.Header.Get("Metadata-Flavor")
 
+		if !h.enforceMetadataFlavor() {
+			next.ServeHTTP(w, r)
+			return
+		}
 		if flavor == "" && r.RequestURI != "/" {
-			httpError(w, "Missing required header \"Metadata-Flavor\": \"Google\"", http.StatusForbidden, "text/html; charset=UTF-8")
+			httpError(w, strings.Replace(metadata403Body, "<code></code>", "<code>"+html.EscapeString(r.URL.Path)+"</code>", 1), http.StatusForbidden, "text/html; charset=UTF-8")
 			return
 		}
 		if flavor != "Google" && r.RequestURI != "/" {
-			glog.Errorf("Incorrect metadata flavor provided %s", flavor)
+			h.requestLog(r).Error("Incorrect metadata flavor provided", "flavor", flavor)
 			h.notFound(w, r)
 			return
 		}
@@ -311,17 +614,34 @@ func (h *MetadataServer) checkMetadataHeaders(next http.Handler) http.Handler {
 	})
 }
 
-func (h *MetadataServer) pathListFields(b interface{}) string {
+// pathListFields returns the directory entries of the altjson fields of b; entries for structs, maps and lists end
+// with a slash
+func (h *MetadataServer) pathListFields(b interface{}) []string {
 	val := reflect.ValueOf(b)
-	var resp string
+	var keys []string
 	for i := 0; i < val.Type().NumField(); i++ {
-		if val.Type().Field(i).Type.Kind() == reflect.Int64 || val.Type().Field(i).Type.Kind() == reflect.String || val.Type().Field(i).Type.Kind() == reflect.Int {
-			resp = resp + val.Type().Field(i).Tag.Get("altjson") + "\n"
-		} else {
-			resp = resp + val.Type().Field(i).Tag.Get("altjson") + "/\n"
+		name, opts, _ := strings.Cut(val.Type().Field(i).Tag.Get("altjson"), ",")
+		if opts == "omitempty" && val.Field(i).IsZero() {
+			continue
 		}
+		switch val.Type().Field(i).Type.Kind() {
+		case reflect.Int64, reflect.String, reflect.Int, reflect.Uint64, reflect.Bool:
+			keys = append(keys, name)
+		default:
+			keys = append(keys, name+"/")
+		}
+	}
+	return keys
+}
+
+// listKeys returns the keys of a metadata directory in sorted order so the ETag is stable
+func listKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
-	return resp
+	sort.Strings(keys)
+	return keys
 }
 
 func getETag(body []byte) string {
@@ -331,85 +651,66 @@ func getETag(body []byte) string {
 }
 
 func (h *MetadataServer) rootHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/text")
-	resp := h.pathListFields(h.Claims)
-	fmt.Fprint(w, resp)
+	h.writeDirectory(w, h.pathListFields(h.Claims))
 }
 
 func (h *MetadataServer) notFound(w http.ResponseWriter, r *http.Request) {
-	glog.Infof("%s called but is not implemented", r.URL.Path)
+	h.requestLog(r).Info("path called but is not implemented", "path", r.URL.Path)
 	httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 }
 
+// computeMetadataHandler lists the supported API versions; clients probe it to detect a metadata server
 func (h *MetadataServer) computeMetadataHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/text")
-	resp := h.pathListFields(h.Claims.ComputeMetadata)
-	w.Write([]byte(resp))
+	keys := make([]string, len(metadataAPIVersions))
+	for i, v := range metadataAPIVersions {
+		keys[i] = v + "/"
+	}
+	h.writeDirectory(w, keys)
 }
 
 func (h *MetadataServer) computeMetadatav1Handler(w http.ResponseWriter, r *http.Request) {
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1) {
+	v1 := h.Claims.ComputeMetadata.V1
+	v1.Instance = h.recursiveInstance()
+	if v1.Project.Attributes == nil {
+		v1.Project.Attributes = map[string]string{}
+	}
+	if h.handleRecursion(w, r, v1) {
 		return
 	}
-	w.Header().Set("Content-Type", "application/text")
-	resp := h.pathListFields(h.Claims.ComputeMetadata.V1)
-	e := getETag([]byte(resp))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(resp))
+	h.writeDirectory(w, h.pathListFields(h.Claims.ComputeMetadata.V1))
 }
 
 func (h *MetadataServer) computeMetadatav1ProjectHandler(w http.ResponseWriter, r *http.Request) {
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Project) {
+	project := h.Claims.ComputeMetadata.V1.Project
+	if project.Attributes == nil {
+		project.Attributes = map[string]string{}
+	}
+	if h.handleRecursion(w, r, project) {
 		return
 	}
-	w.Header().Set("Content-Type", "application/text")
-	resp := h.pathListFields(h.Claims.ComputeMetadata.V1.Project)
-	e := getETag([]byte(resp))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(resp))
+	h.writeDirectory(w, h.pathListFields(h.Claims.ComputeMetadata.V1.Project))
 }
 
 func (h *MetadataServer) computeMetadatav1ProjectProjectIDHandler(w http.ResponseWriter, r *http.Request) {
-	var resp []byte
-	w.Header().Set("Content-Type", "application/text")
+	resp := h.Claims.ComputeMetadata.V1.Project.ProjectID
 	if os.Getenv(googleProjectID) != "" {
-		resp = []byte(os.Getenv(googleProjectID))
-
-	} else {
-		resp = []byte(h.Claims.ComputeMetadata.V1.Project.ProjectID)
+		resp = os.Getenv(googleProjectID)
 	}
-	e := getETag(resp)
-	w.Header()["ETag"] = []string{e}
-	w.Write(resp)
+	h.writeScalar(w, resp)
 }
 
 func (h *MetadataServer) computeMetadatav1ProjectNumericProjectIDHandler(w http.ResponseWriter, r *http.Request) {
-	var resp []byte
-	w.Header().Set("Content-Type", "application/text")
+	resp := strconv.FormatInt(h.Claims.ComputeMetadata.V1.Project.NumericProjectID, 10)
 	if os.Getenv(googleProjectNumber) != "" {
-		resp = []byte(os.Getenv(googleProjectNumber))
-	} else {
-		resp = []byte(strconv.FormatInt(h.Claims.ComputeMetadata.V1.Project.NumericProjectID, 10))
+		resp = os.Getenv(googleProjectNumber)
 	}
-	e := getETag(resp)
-	w.Header()["ETag"] = []string{e}
-	w.Write(resp)
+	h.writeScalar(w, resp)
 }
 
 func (h *MetadataServer) handleRecursion(w http.ResponseWriter, r *http.Request, s interface{}) bool {
 	if r.URL.Query().Has("recursive") {
 		if strings.ToLower(r.URL.Query().Get("recursive")) == "true" {
-			jsonResponse, err := json.Marshal(s)
-			if err != nil {
-				glog.Errorf("Error marshalling json: %v\n", err)
-				httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/html; charset=UTF-8")
-				return true
-			}
-			w.Header().Set("Content-Type", "application/json")
-			e := getETag(jsonResponse)
-			w.Header()["ETag"] = []string{e}
-			w.WriteHeader(http.StatusOK)
-			w.Write(jsonResponse)
+			h.writeRecursive(w, r, s)
 			return true
 		}
 	}
@@ -424,18 +725,15 @@ func (h *MetadataServer) handleBasePathRedirect(w http.ResponseWriter, r *http.R
 }
 
 func (h *MetadataServer) computeMetadatav1ProjectAttributesHandler(w http.ResponseWriter, r *http.Request) {
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Project.Attributes) {
-		return
+	attributes := h.Claims.ComputeMetadata.V1.Project.Attributes
+	if attributes == nil {
+		// a project without common metadata returns an empty object, not null
+		attributes = map[string]string{}
 	}
-	var keys string
-	for k, _ := range h.Claims.ComputeMetadata.V1.Project.Attributes {
-		keys = keys + k + "\n"
+	if h.handleRecursion(w, r, attributes) {
+		return
 	}
-	w.Header().Set("Content-Type", "application/text")
-
-	e := getETag([]byte(keys))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(keys))
+	h.writeDirectory(w, listKeys(attributes))
 }
 
 func (h *MetadataServer) computeMetadatav1ProjectAttributesKeyHandler(w http.ResponseWriter, r *http.Request) {
@@ -443,146 +741,280 @@ func (h *MetadataServer) computeMetadatav1ProjectAttributesKeyHandler(w http.Res
 	// todo: ?alt=json returns content-type=application/json but the payload is text..
 	vars := mux.Vars(r)
 	if val, ok := h.Claims.ComputeMetadata.V1.Project.Attributes[vars["key"]]; ok {
-		e := getETag([]byte(val))
-		w.Header()["ETag"] = []string{e}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(val))
+		h.writeScalar(w, val)
 	} else {
-		w.WriteHeader(http.StatusNotFound)
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		fmt.Fprint(w, metadata404Body)
+		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
+	}
+}
+
+// serviceAccount returns the alias of the service account addressed by acct, which is either its alias or its email
+func (h *MetadataServer) serviceAccount(acct string) (string, bool) {
+	if acct == defaultServiceAccount {
+		return acct, true
+	}
+	if _, ok := h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[acct]; ok {
+		return acct, true
 	}
+	for alias, sa := range h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts {
+		if sa.Email != "" && sa.Email == acct {
+			return alias, true
+		}
+	}
+	return "", false
 }
 
 func (h *MetadataServer) getServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
-	var resp []byte
 	vars := mux.Vars(r)
+	account, ok := h.serviceAccount(vars["acct"])
+	if !ok {
+		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
+		return
+	}
+	sa := h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[account]
 	switch vars["key"] {
 
 	case "aliases":
-		w.Header().Set("Content-Type", "application/text")
-		resp = []byte("default")
+		// one alias per line without a trailing newline
+		h.writeScalar(w, strings.Join(h.recursiveServiceAccount(account).Aliases, "\n"))
+	case "x509":
+		if sa.X509Cert == "" {
+			httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
+			return
+		}
+		der, err := x509DER(sa.X509Cert)
+		if err != nil {
+			h.requestLog(r).Error("Error decoding x509 certificate", "account", account, "error", err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/plain; charset=UTF-8")
+			return
+		}
+		writeFormatted(w, der, "application/x-x509-user-cert")
 	case "email":
-		w.Header().Set("Content-Type", "application/text")
-		if os.Getenv(googleServiceAccountEmail) != "" {
-			resp = []byte(os.Getenv(googleServiceAccountEmail))
-		} else {
-			resp = []byte(h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Email)
+		email := sa.Email
+		if account == defaultServiceAccount && os.Getenv(googleServiceAccountEmail) != "" {
+			email = os.Getenv(googleServiceAccountEmail)
 		}
+		h.writeScalar(w, email)
 	case "identity":
-		k, ok := r.URL.Query()["audience"]
-		if !ok {
-			if h.ServerConfig.MetricsEnabled {
-				defer pathReqs.WithLabelValues(http.StatusText(http.StatusBadRequest), r.URL.Path).Inc()
-			}
-			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest, "text/html")
-			fmt.Fprint(w, "non-empty audience parameter required")
+		// like GCE the last audience parameter wins
+		k := r.URL.Query()["audience"]
+		if len(k) == 0 || k[len(k)-1] == "" {
+			httpError(w, "non-empty audience parameter required", http.StatusBadRequest, "text/html")
 			return
 		}
-		idtok, err := h.getIDToken(k[0])
-		if err != nil {
-			if h.ServerConfig.MetricsEnabled {
-				defer pathReqs.WithLabelValues(http.StatusText(http.StatusInternalServerError), r.URL.Path).Inc()
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = idTokenFormatStandard
+		}
+		if format != idTokenFormatStandard && format != idTokenFormatFull {
+			httpError(w, "format must be standard or full", http.StatusBadRequest, "text/html")
+			return
+		}
+		if h.identityLimiter != nil {
+			if ok, wait := h.identityLimiter.allow(k[len(k)-1]); !ok {
+				h.requestLog(r).Info("id_token request rate limited", "audience", k[len(k)-1], "retryAfter", wait)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				httpError(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests, "text/html")
+				return
 			}
+		}
+		idtok, err := h.getIDToken(r.Context(), account, k[len(k)-1], format)
+		if err != nil {
 			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/html")
 			return
 		}
-		if h.ServerConfig.MetricsEnabled {
-			defer pathReqs.WithLabelValues(http.StatusText(http.StatusOK), r.URL.Path).Inc()
-		}
 		w.Header().Set("Content-Type", "text/html")
 		fmt.Fprint(w, idtok)
 		return
 	case "scopes":
-		var scopes string
-		for _, e := range h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Scopes {
-			scopes = scopes + e + "\n"
-		}
-		w.Header().Set("Content-Type", "application/text")
-		resp = []byte(scopes)
+		// one scope per line without a trailing newline
+		h.writeScalar(w, strings.Join(sa.Scopes, "\n"))
 	case "token":
+		format := r.URL.Query().Get("token_format")
+		if format == "" {
+			format = idTokenFormatStandard
+		}
+		if format != idTokenFormatStandard && format != idTokenFormatFull {
+			httpError(w, "token_format must be standard or full", http.StatusBadRequest, "application/text")
+			return
+		}
 
 		var scopes []string
 		k, ok := r.URL.Query()["scopes"]
 		if ok {
-			glog.V(10).Infof("access_token requested with scopes: [%s]", scopes)
+			h.requestLog(r).Debug("access_token requested with scopes", "scopes", k[0])
 			scopes = strings.Split(k[0], ",")
 		}
-		tok, err := h.getAccessToken(scopes)
+		tok, err := h.getAccessToken(r.Context(), account, scopes)
+		if errors.Is(err, errScopeUnavailable) {
+			h.requestLog(r).Info("access_token requested for an unavailable scope", "error", err)
+			httpError(w, err.Error(), http.StatusForbidden, "application/text")
+			return
+		}
+		if errors.Is(err, errScopeNotGranted) {
+			h.requestLog(r).Info("access_token requested for a scope the service account does not have", "error", err)
+			httpError(w, err.Error(), http.StatusBadRequest, "application/text")
+			return
+		}
 		if err != nil {
-			if h.ServerConfig.MetricsEnabled {
-				defer pathReqs.WithLabelValues(http.StatusText(http.StatusInternalServerError), r.URL.Path).Inc()
-			}
-			glog.Errorf("Error getting Token %v\n", err)
+			h.requestLog(r).Error("Error getting Token", "error", err)
 			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "application/text")
 			return
 		}
-		js, err := json.Marshal(tok)
+		var resp interface{} = tok
+		if format == idTokenFormatFull {
+			resp = fullMetadataToken{metadataToken: tok, TokenHandle: tokenHandle(tok.AccessToken), Email: h.recursiveServiceAccount(account).Email}
+		}
+		js, err := json.Marshal(resp)
 		if err != nil {
-			if h.ServerConfig.MetricsEnabled {
-				defer pathReqs.WithLabelValues(http.StatusText(http.StatusInternalServerError), r.URL.Path).Inc()
-			}
-			glog.Errorf("Error unmarshalling Token %v\n", err)
+			h.requestLog(r).Error("Error unmarshalling Token", "error", err)
 			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "application/text")
 			return
 		}
-		if h.ServerConfig.MetricsEnabled {
-			defer pathReqs.WithLabelValues(http.StatusText(http.StatusOK), r.URL.Path).Inc()
-		}
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(js)
-		return
 
 	default:
 		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound, "text/html; charset=UTF-8")
-		return
 	}
+}
 
-	e := getETag([]byte(resp))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(resp))
+// credentials returns the credentials of the service account alias or nil if there are none
+func (h *MetadataServer) credentials(account string) *google.Credentials {
+	if account == defaultServiceAccount {
+		return h.Creds
+	}
+	return h.namedCredentials[account]
 }
 
-func (h *MetadataServer) getAccessToken(scopes []string) (*metadataToken, error) {
-	h.tokenMutex.Lock()
-	defer h.tokenMutex.Unlock()
+// impersonateCredentialsConfig returns the config to impersonate the default service account with scopes
+func (h *MetadataServer) impersonateCredentialsConfig(scopes []string) impersonate.CredentialsConfig {
+	return impersonate.CredentialsConfig{
+		TargetPrincipal: h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Email,
+		Scopes:          scopes,
+		Delegates:       h.ServerConfig.ImpersonateDelegates,
+	}
+}
 
-	var ts oauth2.TokenSource
+// impersonateIDTokenConfig returns the config to issue id_tokens for audience as the default service account
+func (h *MetadataServer) impersonateIDTokenConfig(audience, format string) impersonate.IDTokenConfig {
+	return impersonate.IDTokenConfig{
+		TargetPrincipal: h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Email,
+		Audience:        audience,
+		IncludeEmail:    format == idTokenFormatFull,
+		Delegates:       h.ServerConfig.ImpersonateDelegates,
+	}
+}
+
+func (h *MetadataServer) getAccessToken(ctx context.Context, account string, scopes []string) (*metadataToken, error) {
+	var tok *oauth2.Token
+	var err error
+	var granted []string // scopes reported in the response
 	if os.Getenv(googleAccessToken) != "" {
-		ts = oauth2.StaticTokenSource(&oauth2.Token{
+		tok = &oauth2.Token{
 			AccessToken: os.Getenv(googleAccessToken),
 			Expiry:      time.Now().Add(time.Second * 3600),
 			TokenType:   "Bearer",
-		})
+		}
+	} else {
+		granted = scopes
+		scopedKey := ""
+		if account == defaultServiceAccount && len(scopes) != 0 && len(h.ServerConfig.ScopedCredentials) > 0 {
+			scopedKey, err = h.scopedCredentialsKey(scopes)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if scopedKey == "" && !h.ServerConfig.AllowDynamicScopes {
+			// the scopes parameter selects a subset of the scopes of the account in the claims
+			granted, scopes, err = h.downscopedScopes(account, scopes)
+			if err != nil {
+				return nil, err
+			}
+		}
+		key := tokenCacheKey(account, scopes)
+		var ok bool
+		if tok, ok = h.tokenCache.cached(key); !ok {
+			tok, err = h.tokenCache.token(ctx, key, h.ServerConfig.TokenTTL, func(ctx context.Context) (*oauth2.Token, error) {
+				if scopedKey != "" {
+					return h.fetchScopedAccessToken(ctx, scopedKey, scopes)
+				}
+				return h.fetchAccessToken(ctx, account, scopes)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	h.ready.Store(true)
+	now := time.Now().UTC()
+	diff := tok.Expiry.Sub(now)
+	if ttl := h.ServerConfig.TokenTTL; ttl > 0 && (tok.Expiry.IsZero() || diff > ttl) {
+		diff = ttl
+	}
+	h.metrics.tokenExpiresIn(diff)
+	expiresIn := int(diff.Round(time.Second).Seconds())
+	return &metadataToken{
+		AccessToken: tok.AccessToken,
+		ExpiresIn:   expiresIn,
+		ExpiryTime:  time.Now().UTC().Add(time.Duration(expiresIn) * time.Second).Format(time.RFC3339),
+		TokenType:   "Bearer",
+		Scope:       strings.Join(granted, " "),
+	}, nil
+}
+
+// fetchAccessToken gets a new access_token for the account from its credential source
+func (h *MetadataServer) fetchAccessToken(ctx context.Context, account string, scopes []string) (*oauth2.Token, error) {
+	if handle, ok := h.ServerConfig.TPMHandles[account]; ok {
+		// each handle is locked on its own, see tpmSessions
+		h.tokenRefreshed(accessTokenType)
+		if h.ServerConfig.OnTokenRefresh != nil {
+			h.ServerConfig.OnTokenRefresh(account)
+		}
+		return h.tpmHandleToken(ctx, account, handle)
+	}
+
+	h.tokenMutex.Lock()
+	defer h.tokenMutex.Unlock()
 
-	} else if h.ServerConfig.AllowDynamicScopes && len(scopes) != 0 {
+	var ts oauth2.TokenSource
+	if account != defaultServiceAccount {
+		creds := h.credentials(account)
+		if creds == nil {
+			return nil, fmt.Errorf("no credentials configured for service account %s", account)
+		}
+		ts = creds.TokenSource
+		if len(scopes) != 0 && len(creds.JSON) > 0 {
+			scoped, err := google.CredentialsFromJSON(ctx, creds.JSON, scopes...)
+			if err != nil {
+				h.contextLog(ctx).Error("Unable to parse credentials", "account", account, "error", err)
+				return nil, err
+			}
+			ts = scoped.TokenSource
+		}
+	} else if len(scopes) != 0 {
 
 		var err error
-		ctx := context.Background()
 		if h.ServerConfig.Impersonate {
-			glog.Infoln("Using Service Account Impersonation")
+			h.contextLog(ctx).Info("Using Service Account Impersonation")
 
-			ts, err = impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
-				TargetPrincipal: h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Email,
-				Scopes:          scopes,
-			})
+			ts, err = impersonate.CredentialsTokenSource(ctx, h.impersonateCredentialsConfig(scopes))
 			if err != nil {
-				glog.Errorf("Unable to create Impersonated TokenSource %v ", err)
+				h.contextLog(ctx).Error("Unable to create Impersonated TokenSource", "error", err)
 				return nil, err
 			}
 		} else if h.ServerConfig.Federate {
-			glog.Infoln("Using Workload Identity Federation")
+			h.contextLog(ctx).Info("Using Workload Identity Federation")
 
 			if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
-				glog.Error("GOOGLE_APPLICATION_CREDENTIAL must be set with --federate")
+				h.contextLog(ctx).Error("GOOGLE_APPLICATION_CREDENTIAL must be set with --federate")
 				return nil, err
 			}
 
-			glog.Infof("Federation path: %s", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+			h.contextLog(ctx).Info("Using federation configuration", "path", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
 			var err error
 			creds, err := google.FindDefaultCredentials(ctx, scopes...)
 			if err != nil {
-				glog.Errorf("Unable load federated credentials %v", err)
+				h.contextLog(ctx).Error("Unable load federated credentials", "error", err)
 				return nil, err
 			}
 			ts = creds.TokenSource
@@ -598,22 +1030,21 @@ func (h *MetadataServer) getAccessToken(scopes []string) (*metadataToken, error)
 			})
 
 			if err != nil {
-				glog.Errorf("ERROR:  could not initialize Key: %v", err)
+				h.contextLog(ctx).Error("could not initialize Key", "error", err)
 				return nil, err
 			}
 
 			if err != nil {
-				glog.Error(os.Stderr, "error creating tpm tokensource%v\n", err)
+				h.contextLog(ctx).Error("error creating tpm tokensource", "error", err)
 				return nil, err
 			}
 		} else {
-			glog.Infoln("Using serviceAccountFile for credentials")
+			h.contextLog(ctx).Info("Using serviceAccountFile for credentials")
 			var err error
-			ctx := context.Background()
 			data := h.Creds.JSON
 			creds, err := google.CredentialsFromJSON(ctx, data, scopes...)
 			if err != nil {
-				glog.Errorf("Unable to parse serviceAccountFile %v ", err)
+				h.contextLog(ctx).Error("Unable to parse serviceAccountFile", "error", err)
 				return nil, err
 			}
 			ts = creds.TokenSource
@@ -622,21 +1053,21 @@ func (h *MetadataServer) getAccessToken(scopes []string) (*metadataToken, error)
 		ts = h.Creds.TokenSource
 	}
 
-	tok, err := ts.Token()
+	h.tokenRefreshed(accessTokenType)
+	if h.ServerConfig.OnTokenRefresh != nil {
+		h.ServerConfig.OnTokenRefresh(account)
+	}
+	tok, err := tokenWithContext(ctx, ts)
 	if err != nil {
-		glog.Errorf("ERROR:  could not get Token: %v", err)
+		h.contextLog(ctx).Error("could not get Token", "error", err)
 		return nil, err
 	}
-	now := time.Now().UTC()
-	diff := tok.Expiry.Sub(now)
-	return &metadataToken{
-		AccessToken: tok.AccessToken,
-		ExpiresIn:   int(diff.Round(time.Second).Seconds()),
-		TokenType:   "Bearer",
-	}, nil
+	return tok, nil
 }
 
-func (h *MetadataServer) getIDToken(targetAudience string) (string, error) {
+// getIDToken returns an id_token for the account.  format is only honored by tokens the emulator signs itself or
+// requests from the IAM credentials API; tokens minted by Google from a service account key always include the email.
+func (h *MetadataServer) getIDToken(ctx context.Context, account, targetAudience, format string) (string, error) {
 	h.tokenMutex.Lock()
 	defer h.tokenMutex.Unlock()
 
@@ -644,21 +1075,46 @@ func (h *MetadataServer) getIDToken(targetAudience string) (string, error) {
 	var err error
 
 	if os.Getenv(googleIDToken) != "" {
+		h.ready.Store(true)
 		return os.Getenv(googleIDToken), nil
 	}
 
-	ctx := context.Background()
-	if h.ServerConfig.Impersonate {
+	if h.ServerConfig.IDTokenSigningKey != nil {
+		tok, err := h.signIDToken(account, targetAudience, format)
+		if err != nil {
+			h.contextLog(ctx).Error("could not sign id_token", "error", err)
+			return "", err
+		}
+		h.ready.Store(true)
+		return tok, nil
+	}
 
-		idTokenSource, err = impersonate.IDTokenSource(ctx,
-			impersonate.IDTokenConfig{
-				TargetPrincipal: h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Email,
-				Audience:        targetAudience,
-				IncludeEmail:    true,
-			},
-		)
+	h.tokenRefreshed(idTokenType)
+	creds := h.credentials(account)
+	if creds == nil {
+		return "", fmt.Errorf("no credentials configured for service account %s", account)
+	}
+	if its, ok := creds.TokenSource.(idTokenIssuer); ok {
+		tok, err := its.IDToken(targetAudience)
 		if err != nil {
-			glog.Errorln(err)
+			h.contextLog(ctx).Error("could not generate ID Token", "error", err)
+			return "", fmt.Errorf("could not generateID Token %w", err)
+		}
+		h.ready.Store(true)
+		return tok, nil
+	}
+
+	if account != defaultServiceAccount {
+		idTokenSource, err = idtoken.NewTokenSource(ctx, targetAudience, idtoken.WithCredentialsJSON(creds.JSON))
+		if err != nil {
+			h.contextLog(ctx).Error("Error getting tokenSource", "account", account, "error", err)
+			return "", fmt.Errorf("could not get id_token %v", err)
+		}
+	} else if h.ServerConfig.Impersonate {
+
+		idTokenSource, err = impersonate.IDTokenSource(ctx, h.impersonateIDTokenConfig(targetAudience, format))
+		if err != nil {
+			h.contextLog(ctx).Error("could not generate ID Token", "error", err)
 			return "", fmt.Errorf("could not generateID Token %v", err)
 		}
 	} else if h.ServerConfig.Federate {
@@ -672,11 +1128,11 @@ func (h *MetadataServer) getIDToken(targetAudience string) (string, error) {
 		req := &iamcredentialspb.GenerateIdTokenRequest{
 			Name:         fmt.Sprintf("projects/-/serviceAccounts/%s", h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Email),
 			Audience:     targetAudience,
-			IncludeEmail: true,
+			IncludeEmail: format == idTokenFormatFull,
 		}
 		resp, err := cr.GenerateIdToken(ctx, req)
 		if err != nil {
-			glog.Errorln(err)
+			h.contextLog(ctx).Error("could not generate ID Token", "error", err)
 			return "", fmt.Errorf("could not generateID Token %v", err)
 		}
 
@@ -686,16 +1142,16 @@ func (h *MetadataServer) getIDToken(targetAudience string) (string, error) {
 	} else if h.ServerConfig.UseTPM {
 		rwc, err := tpm2.OpenTPM(h.ServerConfig.TPMPath)
 		if err != nil {
-			glog.Errorf("can't open TPM %s: %v", h.ServerConfig.TPMPath, err)
+			h.contextLog(ctx).Error("can't open TPM", "path", h.ServerConfig.TPMPath, "error", err)
 			return "", err
 		}
 		defer rwc.Close()
 
 		var k *client.Key
 		if len(h.ServerConfig.PCRs) > 0 {
-			s, err := client.NewPCRSession(rwc, tpm2.PCRSelection{tpm2.AlgSHA256, h.ServerConfig.PCRs})
+			s, err := client.NewPCRSession(rwc, tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: h.ServerConfig.PCRs})
 			if err != nil {
-				glog.Errorf("Unable to initialize PCRSession: %v", err)
+				h.contextLog(ctx).Error("Unable to initialize PCRSession", "error", err)
 				return "", err
 			}
 			k, err = client.LoadCachedKey(rwc, tpmutil.Handle(h.ServerConfig.PersistentHandle), s)
@@ -704,7 +1160,7 @@ func (h *MetadataServer) getIDToken(targetAudience string) (string, error) {
 			k, err = client.LoadCachedKey(rwc, tpmutil.Handle(h.ServerConfig.PersistentHandle), client.NullSession{})
 		}
 		if err != nil {
-			glog.Errorf("ERROR:  could not initialize Key: %v", err)
+			h.contextLog(ctx).Error("could not initialize Key", "error", err)
 			return "", err
 		}
 		defer k.Close()
@@ -732,7 +1188,6 @@ func (h *MetadataServer) getIDToken(targetAudience string) (string, error) {
 		jwt.MarshalSingleStringAsArray = false
 		token := jwt.NewWithClaims(tpmjwt.SigningMethodTPMRS256, claims)
 
-		ctx := context.Background()
 		config := &tpmjwt.TPMConfig{
 			TPMDevice: rwc,
 			Key:       k,
@@ -740,13 +1195,13 @@ func (h *MetadataServer) getIDToken(targetAudience string) (string, error) {
 
 		keyctx, err := tpmjwt.NewTPMContext(ctx, config)
 		if err != nil {
-			glog.Errorf("Unable to initialize tpmJWT: %v", err)
+			h.contextLog(ctx).Error("Unable to initialize tpmJWT", "error", err)
 			return "", err
 		}
 
 		tokenString, err := token.SignedString(keyctx)
 		if err != nil {
-			glog.Errorf("Error signing %v", err)
+			h.contextLog(ctx).Error("Error signing", "error", err)
 			return "", err
 		}
 
@@ -758,23 +1213,23 @@ func (h *MetadataServer) getIDToken(targetAudience string) (string, error) {
 
 		hreq, err := http.NewRequest(http.MethodPost, "https://oauth2.googleapis.com/token", bytes.NewBufferString(data.Encode()))
 		if err != nil {
-			glog.Errorf("Error: Unable to generate token Request, %v\n", err)
+			h.contextLog(ctx).Error("Unable to generate token Request", "error", err)
 			return "", err
 		}
 		hreq.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 		resp, err := client.Do(hreq)
 		if err != nil {
-			glog.Errorf("Error: unable to POST token request, %v\n", err)
+			h.contextLog(ctx).Error("unable to POST token request", "error", err)
 			return "", err
 		}
 
 		if resp.StatusCode != http.StatusOK {
 			f, err := io.ReadAll(resp.Body)
 			if err != nil {
-				glog.Errorf("Error Reading response body, %v\n", err)
+				h.contextLog(ctx).Error("Error Reading response body", "error", err)
 				return "", err
 			}
-			glog.Errorf("Error: Token Request error:, %s\n", f)
+			h.contextLog(ctx).Error("Token Request error", "response", string(f))
 			return "", fmt.Errorf("Error response from oauth2 %s\n", f)
 		}
 		defer resp.Body.Close()
@@ -788,334 +1243,673 @@ func (h *MetadataServer) getIDToken(targetAudience string) (string, error) {
 		if err != nil {
 			return "", err
 		}
+		h.ready.Store(true)
 		return ret.IdToken, nil
 	} else {
 		idTokenSource, err = idtoken.NewTokenSource(ctx, targetAudience, idtoken.WithCredentialsJSON(h.Creds.JSON))
 		if err != nil {
-			glog.Errorf("Error getting tokenSource %v\n")
+			h.contextLog(ctx).Error("Error getting tokenSource", "error", err)
 			return "", fmt.Errorf("could not get id_token %v", err)
 		}
 	}
-	tok, err := idTokenSource.Token()
+	tok, err := tokenWithContext(ctx, idTokenSource)
 	if err != nil {
-		glog.Error(err)
+		h.contextLog(ctx).Error("could not get id_token", "error", err)
 		return "", err
 	}
+	h.ready.Store(true)
 	return tok.AccessToken, nil
 }
 
 func (h *MetadataServer) listServiceAccountsIndexHandler(w http.ResponseWriter, r *http.Request) {
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts) {
+	if h.handleRecursion(w, r, h.recursiveServiceAccounts()) {
 		return
 	}
-	var keys string
-	for k, _ := range h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts {
-		keys = keys + k + "\n"
+	h.writeDirectory(w, h.serviceAccountEntries())
+}
+
+// serviceAccountEntries lists every alias and email a service account can be addressed by, each with a trailing slash.
+// Like GCE `default/` comes first; the remaining entries are sorted.
+func (h *MetadataServer) serviceAccountEntries() []string {
+	seen := map[string]bool{}
+	var entries []string
+	for alias, sa := range h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts {
+		email := sa.Email
+		if alias == defaultServiceAccount && os.Getenv(googleServiceAccountEmail) != "" {
+			email = os.Getenv(googleServiceAccountEmail)
+		}
+		for _, k := range []string{alias, email} {
+			if k != "" && k != defaultServiceAccount && !seen[k] {
+				seen[k] = true
+				entries = append(entries, k+"/")
+			}
+		}
+	}
+	sort.Strings(entries)
+	if _, ok := h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[defaultServiceAccount]; ok {
+		entries = append([]string{defaultServiceAccount + "/"}, entries...)
 	}
-	w.Header().Set("Content-Type", "application/text")
-	e := getETag([]byte(keys))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(keys))
+	return entries
 }
 
 func (h *MetadataServer) listServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[vars["acct"]]) {
+	account, ok := h.serviceAccount(vars["acct"])
+	if !ok {
+		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	keys := h.pathListFields(h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[vars["acct"]])
-	w.Header().Set("Content-Type", "application/text")
-	e := getETag([]byte(keys))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(keys))
-}
+	if h.handleRecursion(w, r, h.recursiveServiceAccount(account)) {
+		return
+	}
+	h.writeDirectory(w, h.pathListFields(h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[account]))
+}
+
+// recursiveServiceAccount returns the service account alias as served with ?recursive=true
+func (h *MetadataServer) recursiveServiceAccount(account string) serviceAccountDetails {
+	sa := h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[account]
+	ret := serviceAccountDetails{Aliases: []string{account}, Email: sa.Email, Scopes: sa.Scopes}
+	if account == defaultServiceAccount && os.Getenv(googleServiceAccountEmail) != "" {
+		ret.Email = os.Getenv(googleServiceAccountEmail)
+	}
+	if ret.Email != "" && ret.Email != account {
+		// the account is also served under its email
+		ret.Aliases = append(ret.Aliases, ret.Email)
+	}
+	if ret.Scopes == nil {
+		// a service account without scopes returns an empty array, not null
+		ret.Scopes = []string{}
+	}
+	return ret
+}
+
+// recursiveServiceAccounts returns every service account keyed by its alias and its email, like GCE
+func (h *MetadataServer) recursiveServiceAccounts() map[string]serviceAccountDetails {
+	ret := map[string]serviceAccountDetails{}
+	for alias := range h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts {
+		sa := h.recursiveServiceAccount(alias)
+		ret[alias] = sa
+		if _, ok := ret[sa.Email]; sa.Email != "" && !ok {
+			ret[sa.Email] = sa
+		}
+	}
+	return ret
+}
+
+// recursiveInstance returns the instance claims as served with ?recursive=true, with the values GCE reports for unset
+// fields.  Lists are always arrays and maps always objects, never null.
+func (h *MetadataServer) recursiveInstance() Instance {
+	instance := h.Claims.ComputeMetadata.V1.Instance
+	if instance.Tags == nil {
+		// an instance without network tags returns an empty array, not null
+		instance.Tags = []string{}
+	}
+	if instance.Labels == nil {
+		instance.Labels = map[string]string{}
+	}
+	if instance.Attributes == nil {
+		instance.Attributes = map[string]string{}
+	}
+	if instance.Disks == nil {
+		instance.Disks = []DiskMetadata{}
+	}
+	if instance.Licenses == nil {
+		instance.Licenses = []struct {
+			ID string `json:"id"  altjson:"id"`
+		}{}
+	}
+	nics := make([]NetworkInterface, len(instance.NetworkInterfaces))
+	for i, nic := range instance.NetworkInterfaces {
+		nics[i] = recursiveNetworkInterface(nic)
+	}
+	instance.NetworkInterfaces = nics
+	instance.ServiceAccounts = h.recursiveServiceAccounts()
+
+	// guest attributes written at runtime replace the ones from the claims
+	h.guestMutex.RLock()
+	instance.GuestAttributes = copyGuestAttributes(h.guestAttributes)
+	h.guestMutex.RUnlock()
+	if instance.CPUPlatform == "" {
+		instance.CPUPlatform = defaultCPUPlatform
+	}
+	if instance.MaintenanceEvent == "" {
+		instance.MaintenanceEvent = maintenanceEventNone
+	}
+	if instance.Region == "" {
+		instance.Region = regionFromZone(instance.Zone)
+	}
+	if instance.ID == 0 {
+		instance.ID = h.instanceID
+	}
+	instance.SpotVM = h.spotVM()
+	if instance.Name == "" {
+		// the first label of a configured hostname; hostname defaults are derived from the name instead
+		instance.Name, _, _ = strings.Cut(instance.Hostname, ".")
+		if instance.Name == "" {
+			instance.Name = defaultInstanceName
+		}
+	}
+	if instance.Hostname == "" {
+		instance.Hostname = h.defaultHostname()
+	}
+	return instance
+}
+
+// recursiveNetworkInterface returns the network interface with empty arrays for its unset lists
+func recursiveNetworkInterface(nic NetworkInterface) NetworkInterface {
+	for _, l := range []*[]string{&nic.DNSServers, &nic.ForwardedIps, &nic.IPAliases, &nic.TargetInstanceIps} {
+		if *l == nil {
+			*l = []string{}
+		}
+	}
+	if nic.AccessConfigs == nil {
+		nic.AccessConfigs = []AccessConfig{}
+	}
+	return nic
+}
+
+// defaultHostname returns the zonal DNS name `<instance>.<zone>.c.<project>.internal` of the instance, or the
+// name of this host if the instance name, zone or project id are not set
+func (h *MetadataServer) defaultHostname() string {
+	name := h.Claims.ComputeMetadata.V1.Instance.Name
+	zone := h.Claims.ComputeMetadata.V1.Instance.Zone
+	projectID := h.Claims.ComputeMetadata.V1.Project.ProjectID
+	if name != "" && projectID != "" && instanceZoneRegex.MatchString(zone) {
+		return fmt.Sprintf("%s.%s.c.%s.internal", name, path.Base(zone), projectID)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		h.log().Error("Unable to get hostname", "error", err)
+	}
+	return hostname
+}
+
+// randomInstanceID returns a random 19 digit instance id, like the ones GCE assigns
+func randomInstanceID() (uint64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(9e18))
+	if err != nil {
+		return 0, fmt.Errorf("unable to generate instance id: %w", err)
+	}
+	return n.Uint64() + 1e18, nil
+}
+
+// regionFromZone returns the `projects/<numericProjectId>/regions/<region>` containing a
+// `projects/<numericProjectId>/zones/<zone>` value, or an empty string if the zone is malformed
+func regionFromZone(zone string) string {
+	m := instanceZoneRegex.FindStringSubmatch(zone)
+	if m == nil {
+		return ""
+	}
+	return fmt.Sprintf("projects/%s/regions/%s", m[1], m[2])
+}
 
 func (h *MetadataServer) computeMetadatav1InstanceHandler(w http.ResponseWriter, r *http.Request) {
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Instance) {
+	if h.handleRecursion(w, r, h.recursiveInstance()) {
 		return
 	}
-	resp := h.pathListFields(h.Claims.ComputeMetadata.V1.Instance)
-	w.Header().Set("Content-Type", "application/text")
-	e := getETag([]byte(resp))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(resp))
-
+	var keys []string
+	for _, k := range h.pathListFields(h.Claims.ComputeMetadata.V1.Instance) {
+		// only Confidential VMs serve the confidential-computing subtree
+		if k != "confidential-computing/" || h.Claims.ComputeMetadata.V1.Instance.ConfidentialComputing.Enabled {
+			keys = append(keys, k)
+		}
+	}
+	h.writeDirectory(w, keys)
 }
 
 func (h *MetadataServer) computeMetadatav1InstanceKeyHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	var res []byte
-	var err error
-
-	// default content-type
-	w.Header().Set("Content-Type", "application/text")
+	var res string
 	switch vars["key"] {
 	case "id":
-		res = []byte(strconv.FormatInt(h.Claims.ComputeMetadata.V1.Instance.ID, 10))
+		res = strconv.FormatUint(h.recursiveInstance().ID, 10)
 	case "name":
-		res = []byte(h.Claims.ComputeMetadata.V1.Instance.Name)
+		res = h.recursiveInstance().Name
 	case "hostname":
-		res = []byte(h.Claims.ComputeMetadata.V1.Instance.Hostname)
+		res = h.recursiveInstance().Hostname
 	case "zone":
-		res = []byte(h.Claims.ComputeMetadata.V1.Instance.Zone)
+		res = h.Claims.ComputeMetadata.V1.Instance.Zone
+	case "region":
+		res = h.recursiveInstance().Region
 	case "machine-type":
-		res = []byte(h.Claims.ComputeMetadata.V1.Instance.MachineType)
+		res = h.Claims.ComputeMetadata.V1.Instance.MachineType
+	case "image":
+		res = h.Claims.ComputeMetadata.V1.Instance.Image
+	case "description":
+		// an empty description is served as an empty value, not a 404
+		res = h.Claims.ComputeMetadata.V1.Instance.Description
+	case "cpu-platform":
+		res = h.recursiveInstance().CPUPlatform
+	case "preempted":
+		res = strings.ToUpper(strconv.FormatBool(bool(h.Claims.ComputeMetadata.V1.Instance.Preempted)))
+	case "spot-vm":
+		res = strings.ToUpper(strconv.FormatBool(h.spotVM()))
+	case "maintenance-event":
+		res = h.recursiveInstance().MaintenanceEvent
 	case "tags":
-		res, err = json.Marshal(h.Claims.ComputeMetadata.V1.Instance.Tags)
-		if err != nil {
-			glog.Errorf("Error converting value to JSON %v\n", err)
-			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError, "text/plain; charset=UTF-8")
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
+		// tags are only served like a recursive directory, individual tags are not addressable
+		h.writeRecursive(w, r, h.recursiveInstance().Tags)
+		return
 	default:
 		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	e := getETag(res)
-	w.Header()["ETag"] = []string{e}
-	w.Write(res)
+	h.writeScalar(w, res)
 }
 
 func (h *MetadataServer) computeMetadatav1InstanceAttributesHandler(w http.ResponseWriter, r *http.Request) {
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Instance.Attributes) {
-		return
+	attributes := h.Claims.ComputeMetadata.V1.Instance.Attributes
+	if attributes == nil {
+		// an instance without custom metadata returns an empty object, not null
+		attributes = map[string]string{}
 	}
-	var keys string
-	for k, _ := range h.Claims.ComputeMetadata.V1.Instance.Attributes {
-		keys = keys + k + "\n"
+	if h.handleRecursion(w, r, attributes) {
+		return
 	}
-	w.Header().Set("Content-Type", "application/text")
-
-	e := getETag([]byte(keys))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(keys))
+	h.writeDirectory(w, listKeys(attributes))
 }
 
 func (h *MetadataServer) computeMetadatav1InstanceAttributesKeyHandler(w http.ResponseWriter, r *http.Request) {
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Instance.Attributes) {
+	// recursion isn't applicable, attribute values are always returned as text
+	vars := mux.Vars(r)
+	if val, ok := h.Claims.ComputeMetadata.V1.Instance.Attributes[vars["key"]]; ok {
+		h.writeScalar(w, val)
+	} else {
+		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
+	}
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	labels := h.Claims.ComputeMetadata.V1.Instance.Labels
+	if labels == nil {
+		// an instance without labels returns an empty object, not null
+		labels = map[string]string{}
+	}
+	if h.handleRecursion(w, r, labels) {
 		return
 	}
+	h.writeDirectory(w, listKeys(labels))
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceLabelsKeyHandler(w http.ResponseWriter, r *http.Request) {
+	// recursion isn't applicable, label values are always returned as text
 	vars := mux.Vars(r)
-	if val, ok := h.Claims.ComputeMetadata.V1.Instance.Attributes[vars["key"]]; ok {
-		e := getETag([]byte(val))
-		w.Header()["ETag"] = []string{e}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(val))
+	if val, ok := h.Claims.ComputeMetadata.V1.Instance.Labels[vars["key"]]; ok {
+		h.writeScalar(w, val)
 	} else {
-		w.WriteHeader(http.StatusNotFound)
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		fmt.Fprint(w, metadata404Body)
+		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 	}
 }
 
-func (h *MetadataServer) computeMetadatav1InstanceNetworkHandler(w http.ResponseWriter, r *http.Request) {
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces) {
+func (h *MetadataServer) computeMetadatav1InstanceSchedulingHandler(w http.ResponseWriter, r *http.Request) {
+	scheduling := h.Claims.ComputeMetadata.V1.Instance.Scheduling
+	if h.handleRecursion(w, r, scheduling) {
 		return
 	}
+	h.writeDirectory(w, h.pathListFields(scheduling))
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceSchedulingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	scheduling := h.Claims.ComputeMetadata.V1.Instance.Scheduling
 	var resp string
-	for i, _ := range h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces {
-		resp = resp + fmt.Sprintf("%d/\n", i)
+	switch mux.Vars(r)["key"] {
+	case "automatic-restart":
+		resp = scheduling.AutomaticRestart
+	case "on-host-maintenance":
+		resp = scheduling.OnHostMaintenance
+	case "preemptible":
+		resp = scheduling.Preemptible
+	default:
+		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
+		return
 	}
-	w.Header().Set("Content-Type", "application/text")
-	e := getETag([]byte(resp))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(resp))
+	h.writeScalar(w, resp)
 }
 
-func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	i, err := strconv.Atoi(vars["index"])
-	if err != nil {
+func (h *MetadataServer) computeMetadatav1InstanceConfidentialComputingHandler(w http.ResponseWriter, r *http.Request) {
+	cc := h.Claims.ComputeMetadata.V1.Instance.ConfidentialComputing
+	// only Confidential VMs serve the subtree
+	if !cc.Enabled {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	if len(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces) < i+1 {
+	if h.handleRecursion(w, r, cc) {
+		return
+	}
+	h.writeDirectory(w, h.pathListFields(cc))
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceConfidentialComputingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	cc := h.Claims.ComputeMetadata.V1.Instance.ConfidentialComputing
+	var resp string
+	switch mux.Vars(r)["key"] {
+	case "enabled":
+		resp = strings.ToUpper(strconv.FormatBool(cc.Enabled))
+	case "technology":
+		resp = cc.Technology
+	case "attestation-report":
+		resp = cc.AttestationReport
+	}
+	if !cc.Enabled || resp == "" {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i]) {
+	h.writeScalar(w, resp)
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceVirtualClockHandler(w http.ResponseWriter, r *http.Request) {
+	virtualClock := h.Claims.ComputeMetadata.V1.Instance.VirtualClock
+	if h.handleRecursion(w, r, virtualClock) {
 		return
 	}
-	resp := h.pathListFields(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i])
-	w.Header().Set("Content-Type", "application/text")
-	e := getETag([]byte(resp))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(resp))
+	var keys []string
+	if virtualClock.DriftToken != "" {
+		keys = h.pathListFields(virtualClock)
+	}
+	h.writeDirectory(w, keys)
 }
 
-func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceKeyHandler(w http.ResponseWriter, r *http.Request) {
-	var resp []byte
-	vars := mux.Vars(r)
-	i, err := strconv.Atoi(vars["index"])
-	if err != nil {
+func (h *MetadataServer) computeMetadatav1InstanceVirtualClockKeyHandler(w http.ResponseWriter, r *http.Request) {
+	token := h.Claims.ComputeMetadata.V1.Instance.VirtualClock.DriftToken
+	// VMs without a virtual clock do not serve a drift token
+	if mux.Vars(r)["key"] != "drift-token" || token == "" {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	if len(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces) < i+1 {
+	h.writeScalar(w, token)
+}
+
+// disk returns the disk at the {index} route variable
+func (h *MetadataServer) disk(vars map[string]string) (*DiskMetadata, bool) {
+	i, err := strconv.Atoi(vars["index"])
+	if err != nil || i < 0 || i >= len(h.Claims.ComputeMetadata.V1.Instance.Disks) {
+		return nil, false
+	}
+	return &h.Claims.ComputeMetadata.V1.Instance.Disks[i], true
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceDisksHandler(w http.ResponseWriter, r *http.Request) {
+	disks := h.Claims.ComputeMetadata.V1.Instance.Disks
+	if disks == nil {
+		disks = []DiskMetadata{}
+	}
+	if h.handleRecursion(w, r, disks) {
+		return
+	}
+	keys := make([]string, len(disks))
+	for i := range keys {
+		keys[i] = strconv.Itoa(i) + "/"
+	}
+	h.writeDirectory(w, keys)
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceDiskHandler(w http.ResponseWriter, r *http.Request) {
+	d, ok := h.disk(mux.Vars(r))
+	if !ok {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	switch vars["key"] {
-	// case "access-configs":
-	// 	h.handleBasePathRedirect(w, r)
-	// 	return
-	case "dns-servers":
-		// gce metadata server default returns "application/text" for dns-servers
-		resp = []byte(strings.Join(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].DNSServers, "\n"))
-	case "forwarded-ips":
-		h.handleBasePathRedirect(w, r)
+	if h.handleRecursion(w, r, d) {
 		return
-	case "gateway":
-		resp = []byte(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].Gateway)
-	case "ip":
-		resp = []byte(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].IP)
-	case "ip-aliases":
-		h.handleBasePathRedirect(w, r)
+	}
+	h.writeDirectory(w, h.pathListFields(*d))
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceDiskKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var resp string
+	vars := mux.Vars(r)
+	d, ok := h.disk(vars)
+	if !ok {
+		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
-	case "mac":
-		resp = []byte(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].Mac)
-	case "mtu":
-		resp = []byte(strconv.Itoa(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].Mtu))
-	case "network":
-		resp = []byte(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].Network)
-	case "subnet-mask":
-		resp = []byte(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].Subnetmask)
+	}
+	switch vars["key"] {
+	case "device-name":
+		resp = d.DeviceName
+	case "index":
+		resp = strconv.Itoa(d.Index)
+	case "interface":
+		resp = d.Interface
+	case "mode":
+		resp = d.Mode
+	case "type":
+		resp = d.Type
 	default:
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	w.Header().Set("Content-Type", "application/text")
-	e := getETag([]byte(resp))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(resp))
+	h.writeScalar(w, resp)
 }
 
-func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceAccessConfigsHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
+// networkInterface returns the interface at the {index} route variable
+func (h *MetadataServer) networkInterface(vars map[string]string) (*NetworkInterface, bool) {
 	i, err := strconv.Atoi(vars["index"])
-	if err != nil {
-		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
+	if err != nil || i < 0 || i >= len(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces) {
+		return nil, false
+	}
+	return &h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i], true
+}
+
+// accessConfig returns the access config at the {index} and {index2} route variables
+func (h *MetadataServer) accessConfig(vars map[string]string) (*AccessConfig, bool) {
+	ni, ok := h.networkInterface(vars)
+	if !ok {
+		return nil, false
+	}
+	k, err := strconv.Atoi(vars["index2"])
+	if err != nil || k < 0 || k >= len(ni.AccessConfigs) {
+		return nil, false
+	}
+	return &ni.AccessConfigs[k], true
+}
+
+// networkInterfaceList returns the address list directory named by the {key} route variable
+func networkInterfaceList(ni *NetworkInterface, key string) ([]string, bool) {
+	switch key {
+	case "forwarded-ips":
+		return ni.ForwardedIps, true
+	case "ip-aliases":
+		return ni.IPAliases, true
+	case "target-instance-ips":
+		return ni.TargetInstanceIps, true
+	default:
+		return nil, false
+	}
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceNetworkHandler(w http.ResponseWriter, r *http.Request) {
+	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces) {
 		return
 	}
-	if len(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces) < i+1 {
+	keys := make([]string, len(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces))
+	for i := range keys {
+		keys[i] = strconv.Itoa(i) + "/"
+	}
+	h.writeDirectory(w, keys)
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceHandler(w http.ResponseWriter, r *http.Request) {
+	ni, ok := h.networkInterface(mux.Vars(r))
+	if !ok {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].AccessConfigs) {
+	if h.handleRecursion(w, r, ni) {
 		return
 	}
-	var resp string
-	for i, _ := range h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].AccessConfigs {
-		resp = resp + fmt.Sprintf("%d/\n", i)
-	}
-	w.Header().Set("Content-Type", "application/text")
-	e := getETag([]byte(resp))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(resp))
+	h.writeDirectory(w, h.pathListFields(*ni))
 }
 
-func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceAccessConfigsIndexHandler(w http.ResponseWriter, r *http.Request) {
+func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var resp string
 	vars := mux.Vars(r)
-	i, err := strconv.Atoi(vars["index"])
-	if err != nil {
+	ni, ok := h.networkInterface(vars)
+	if !ok {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	if len(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces) < i+1 {
+	if _, ok := networkInterfaceList(ni, vars["key"]); ok {
+		h.handleBasePathRedirect(w, r)
+		return
+	}
+	switch vars["key"] {
+	case "dns-servers":
+		// gce metadata server default returns "application/text" for dns-servers
+		resp = strings.Join(ni.DNSServers, "\n")
+	case "gateway":
+		resp = ni.Gateway
+	case "ip":
+		resp = ni.IP
+	case "mac":
+		resp = ni.Mac
+	case "mtu":
+		resp = strconv.Itoa(ni.Mtu)
+	case "network":
+		resp = ni.Network
+	case "subnetmask":
+		resp = ni.Subnetmask
+	default:
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	k, err := strconv.Atoi(vars["index2"])
-	if err != nil {
+	h.writeScalar(w, resp)
+}
+
+// computeMetadatav1InstanceNetworkInterfaceListHandler lists the indexes of forwarded-ips/, ip-aliases/ and target-instance-ips/
+func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceListHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ni, ok := h.networkInterface(vars)
+	if !ok {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	if len(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].AccessConfigs) < k+1 {
+	list, ok := networkInterfaceList(ni, vars["key"])
+	if !ok {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-
-	if h.handleRecursion(w, r, h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].AccessConfigs[k]) {
+	if list == nil {
+		list = []string{}
+	}
+	if h.handleRecursion(w, r, list) {
 		return
 	}
-
-	resp := h.pathListFields(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].AccessConfigs[k])
-	w.Header().Set("Content-Type", "application/text")
-	e := getETag([]byte(resp))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(resp))
+	keys := make([]string, len(list))
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	h.writeDirectory(w, keys)
 }
 
-func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceAccessConfigsIndexRedirectHandler(w http.ResponseWriter, r *http.Request) {
+func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceListItemHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	i, err := strconv.Atoi(vars["index"])
-	if err != nil {
+	ni, ok := h.networkInterface(vars)
+	if !ok {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	if len(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces) < i+1 {
+	list, ok := networkInterfaceList(ni, vars["key"])
+	if !ok {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	k, err := strconv.Atoi(vars["index2"])
-	if err != nil {
+	i, err := strconv.Atoi(vars["item"])
+	if err != nil || i < 0 || i >= len(list) {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	if len(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].AccessConfigs) < k+1 {
+	h.writeScalar(w, list[i])
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceAccessConfigsHandler(w http.ResponseWriter, r *http.Request) {
+	ni, ok := h.networkInterface(mux.Vars(r))
+	if !ok {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	h.handleBasePathRedirect(w, r)
+	if h.handleRecursion(w, r, ni.AccessConfigs) {
+		return
+	}
+	keys := make([]string, len(ni.AccessConfigs))
+	for i := range keys {
+		keys[i] = strconv.Itoa(i) + "/"
+	}
+	h.writeDirectory(w, keys)
 }
 
-func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceAccessConfigsKeyHandler(w http.ResponseWriter, r *http.Request) {
-	var resp []byte
-	vars := mux.Vars(r)
-	i, err := strconv.Atoi(vars["index"])
-	if err != nil {
+func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceAccessConfigsIndexHandler(w http.ResponseWriter, r *http.Request) {
+	ac, ok := h.accessConfig(mux.Vars(r))
+	if !ok {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	if len(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces) < i+1 {
-		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
+	if h.handleRecursion(w, r, ac) {
 		return
 	}
-	k, err := strconv.Atoi(vars["index2"])
-	if err != nil {
+
+	h.writeDirectory(w, h.pathListFields(*ac))
+}
+
+func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceAccessConfigsIndexRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.accessConfig(mux.Vars(r)); !ok {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
+	h.handleBasePathRedirect(w, r)
+}
 
-	if len(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].AccessConfigs) < k+1 {
+func (h *MetadataServer) computeMetadatav1InstanceNetworkInterfaceAccessConfigsKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var resp string
+	vars := mux.Vars(r)
+	ac, ok := h.accessConfig(vars)
+	if !ok {
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
 
 	switch vars["key"] {
 	case "external-ip":
-		resp = []byte(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].AccessConfigs[k].ExternalIP)
+		resp = ac.ExternalIP
 	case "type":
-		resp = []byte(h.Claims.ComputeMetadata.V1.Instance.NetworkInterfaces[i].AccessConfigs[k].Type)
+		resp = ac.Type
 	default:
 		httpError(w, metadata404Body, http.StatusNotFound, "text/html; charset=UTF-8")
 		return
 	}
-	w.Header().Set("Content-Type", "application/text")
-	e := getETag([]byte(resp))
-	w.Header()["ETag"] = []string{e}
-	w.Write([]byte(resp))
+	h.writeScalar(w, resp)
 }
 
-// Start running the metadata server using the configuration provided through `NewMetadataServer()`
-func (h *MetadataServer) Start() error {
+// healthzHandler is a liveness check which always succeeds while the server is running
+func (h *MetadataServer) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
 
-	if !h.initNew {
-		return errors.New("metadata server was not created using NewMetadataServer()")
+// readyzHandler is a readiness check which succeeds only after a token was fetched from the credential source
+func (h *MetadataServer) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.ready.Load() {
+		httpError(w, "not ready", http.StatusServiceUnavailable, "text/plain; charset=utf-8")
+		return
 	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
 
+// drainRequests holds the state lock for the lifetime of a request so that Restart()
+// can wait for in-flight requests to complete before swapping credentials and claims
+func (h *MetadataServer) drainRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.stateMutex.RLock()
+		defer h.stateMutex.RUnlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// metadataRouter registers all metadata routes
+func (h *MetadataServer) metadataRouter() *mux.Router {
 	r := mux.NewRouter()
 	r.StrictSlash(false)
 
@@ -1130,15 +1924,43 @@ func (h *MetadataServer) Start() error {
 	r.Handle("/computeMetadata/v1/instance/network-interfaces/{index}/access-configs/{index2}", http.HandlerFunc(h.computeMetadatav1InstanceNetworkInterfaceAccessConfigsIndexRedirectHandler)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance/network-interfaces/{index}/access-configs/", http.HandlerFunc(h.computeMetadatav1InstanceNetworkInterfaceAccessConfigsHandler)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance/network-interfaces/{index}/access-configs", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/network-interfaces/{index}/{key}/{item}", http.HandlerFunc(h.computeMetadatav1InstanceNetworkInterfaceListItemHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/network-interfaces/{index}/{key}/", http.HandlerFunc(h.computeMetadatav1InstanceNetworkInterfaceListHandler)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance/network-interfaces/{index}/{key}", http.HandlerFunc(h.computeMetadatav1InstanceNetworkInterfaceKeyHandler)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance/network-interfaces/{index}/", http.HandlerFunc(h.computeMetadatav1InstanceNetworkInterfaceHandler)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance/network-interfaces/{index}", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance/network-interfaces/", http.HandlerFunc(h.computeMetadatav1InstanceNetworkHandler)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance/network-interfaces", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
 
+	r.Handle("/computeMetadata/v1/instance/disks/{index}/{key}", http.HandlerFunc(h.computeMetadatav1InstanceDiskKeyHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/disks/{index}/", http.HandlerFunc(h.computeMetadatav1InstanceDiskHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/disks/{index}", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/disks/", http.HandlerFunc(h.computeMetadatav1InstanceDisksHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/disks", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
+
+	r.Handle("/computeMetadata/v1/instance/guest-attributes/{namespace}/{key}", http.HandlerFunc(h.computeMetadatav1InstanceGuestAttributesKeyHandler)).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	r.Handle("/computeMetadata/v1/instance/guest-attributes/{namespace}/", http.HandlerFunc(h.computeMetadatav1InstanceGuestAttributesNamespaceHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/guest-attributes/{namespace}", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/guest-attributes/", http.HandlerFunc(h.computeMetadatav1InstanceGuestAttributesHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/guest-attributes", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
+
 	r.Handle("/computeMetadata/v1/instance/attributes/{key}", http.HandlerFunc(h.computeMetadatav1InstanceAttributesKeyHandler)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance/attributes/", http.HandlerFunc(h.computeMetadatav1InstanceAttributesHandler)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance/attributes", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
+
+	r.Handle("/computeMetadata/v1/instance/labels/{key}", http.HandlerFunc(h.computeMetadatav1InstanceLabelsKeyHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/labels/", http.HandlerFunc(h.computeMetadatav1InstanceLabelsHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/labels", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
+
+	r.Handle("/computeMetadata/v1/instance/scheduling/{key}", http.HandlerFunc(h.computeMetadatav1InstanceSchedulingKeyHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/scheduling/", http.HandlerFunc(h.computeMetadatav1InstanceSchedulingHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/scheduling", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/confidential-computing/{key}", http.HandlerFunc(h.computeMetadatav1InstanceConfidentialComputingKeyHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/confidential-computing/", http.HandlerFunc(h.computeMetadatav1InstanceConfidentialComputingHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/confidential-computing", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/virtual-clock/{key}", http.HandlerFunc(h.computeMetadatav1InstanceVirtualClockKeyHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/virtual-clock/", http.HandlerFunc(h.computeMetadatav1InstanceVirtualClockHandler)).Methods(http.MethodGet)
+	r.Handle("/computeMetadata/v1/instance/virtual-clock", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance/{key}", http.HandlerFunc(h.computeMetadatav1InstanceKeyHandler)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance/", http.HandlerFunc(h.computeMetadatav1InstanceHandler)).Methods(http.MethodGet)
 	r.Handle("/computeMetadata/v1/instance", http.HandlerFunc(h.handleBasePathRedirect)).Methods(http.MethodGet)
@@ -1160,31 +1982,128 @@ func (h *MetadataServer) Start() error {
 	r.Handle("/", http.HandlerFunc(h.rootHandler)).Methods(http.MethodGet)
 
 	r.NotFoundHandler = http.HandlerFunc(h.notFound)
+	return r
+}
 
+// handler returns the root http.Handler serving the metadata routes, health checks, OIDC discovery and metrics
+func (h *MetadataServer) handler() http.Handler {
+	r := h.metadataRouter()
 	m := http.NewServeMux()
-	r.Use(prometheusMiddleware)
-	m.Handle("/", h.checkMetadataHeaders(r))
+	r.Use(h.prometheusMiddleware)
+	r.Use(h.traceAccount)
+
+	// health checks are probed by orchestrators which do not send the Metadata-Flavor header
+	m.HandleFunc("/healthz", h.healthzHandler)
+	m.HandleFunc("/readyz", h.readyzHandler)
+	// OIDC verifiers do not send the Metadata-Flavor header either
+	m.HandleFunc(oidcDiscoveryPath, h.oidcDiscoveryHandler)
+	m.HandleFunc(jwksPath, h.jwksHandler)
+	if h.metrics != nil && h.metrics.path != "" {
+		m.Handle(h.metrics.path, h.metrics.handler())
+	}
+	var metadata http.Handler
+	switch {
+	case h.ServerConfig.ProxyTo != "" && h.ServerConfig.RecordDir == "":
+		metadata = h.proxyHandler()
+	case h.ServerConfig.ReplayDir != "":
+		metadata = h.checkMetadataHeaders(h.injectLatency(h.injectFaults(http.HandlerFunc(h.replayHandler))))
+	case h.ServerConfig.RecordDir != "":
+		metadata = h.checkMetadataHeaders(h.injectLatency(h.injectFaults(http.HandlerFunc(h.recordHandler))))
+	default:
+		metadata = h.checkMetadataHeaders(h.injectLatency(h.injectFaults(h.waitForChange(h.drainRequests(r)))))
+	}
+	m.Handle("/", stripPathPrefix(h.ServerConfig.PathPrefix, h.notFound, h.limitRequestRate(metadata)))
+	return h.requestID(h.traceRequests(h.accessLog(h.countRequests(h.limitRequestBody(h.requireBearerToken(m))))))
+}
 
-	var l net.Listener
-	var err error
+// prefetchToken gets a token from the credential source so invalid credentials fail Start() instead of the first request
+func (h *MetadataServer) prefetchToken() error {
+	if os.Getenv(googleAccessToken) != "" || h.ServerConfig.ReplayDir != "" || h.ServerConfig.ProxyTo != "" {
+		// tokens are not fetched from the credential source
+		return nil
+	}
+	if h.Creds == nil || h.Creds.TokenSource == nil {
+		return errors.New("unable to prefetch token: credentials have no token source")
+	}
+	if _, err := h.Creds.TokenSource.Token(); err != nil {
+		h.log().Error("Unable to prefetch token", "error", err)
+		return fmt.Errorf("unable to prefetch token from credentials: %w", err)
+	}
+	h.ready.Store(true)
+	return nil
+}
+
+// Start running the metadata server using the configuration provided through `NewMetadataServer()`.
+// Unless `SkipPrefetch` is set, Start fails if no token can be fetched from the credentials.
+func (h *MetadataServer) Start() error {
+
+	if !h.initNew {
+		return errors.New("metadata server was not created using NewMetadataServer()")
+	}
+	if !h.ServerConfig.SkipPrefetch {
+		if err := h.prefetchToken(); err != nil {
+			return err
+		}
+	}
 
-	h.srv = &http.Server{Handler: m}
+	h.srv = h.newHTTPServer(h.handler())
+	if h.tlsConfig != nil {
+		h.srv.TLSConfig = h.tlsConfig.Clone()
+	}
 	http2.ConfigureServer(h.srv, &http2.Server{})
+	h.resetShutdown()
 
-	if h.ServerConfig.DomainSocket != "" {
-		glog.Infof("domain socket specified, ignoring TCP listers, %s", h.ServerConfig.DomainSocket)
-		l, err = net.Listen("unix", h.ServerConfig.DomainSocket)
+	var listeners []net.Listener
+	for _, spec := range h.listenerSpecs() {
+		if spec.Network != "tcp" && spec.Network != "unix" {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("unsupported listener network %q", spec.Network)
+		}
+		h.log().Info("listening", "network", spec.Network, "address", spec.Address)
+		l, err := net.Listen(spec.Network, spec.Address)
 		if err != nil {
-			glog.Errorf("Error listening to domain socket: %v\n", err)
+			h.log().Error("Error listening", "network", spec.Network, "address", spec.Address, "error", err)
+			for _, l := range listeners {
+				l.Close()
+			}
 			return err
 		}
-	} else {
-		glog.Infof("tcp socket specified %s", fmt.Sprintf("%s%s", h.ServerConfig.BindInterface, h.ServerConfig.Port))
-		l, err = net.Listen("tcp", fmt.Sprintf("%s%s", h.ServerConfig.BindInterface, h.ServerConfig.Port))
+		if spec.Network == "unix" {
+			if err := os.Chmod(spec.Address, h.domainSocketMode()); err != nil {
+				h.log().Error("Error setting socket permissions", "address", spec.Address, "error", err)
+				l.Close()
+				for _, l := range listeners {
+					l.Close()
+				}
+				return err
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	h.listeners = listeners
+
+	if h.ServerConfig.AdminPort != "" {
+		if h.ServerConfig.AdminInterface == "" {
+			h.ServerConfig.AdminInterface = defaultAdminInterface
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort(h.ServerConfig.AdminInterface, h.ServerConfig.AdminPort))
 		if err != nil {
-			glog.Errorf("Error listening to tcp socket: %v\n", err)
+			h.log().Error("Error listening for admin API", "interface", h.ServerConfig.AdminInterface, "port", h.ServerConfig.AdminPort, "error", err)
+			for _, l := range listeners {
+				l.Close()
+			}
 			return err
 		}
+		h.log().Info("admin API listening", "address", l.Addr().String())
+		h.adminListener = l
+		h.adminSrv = h.newHTTPServer(h.requestID(NewAdminServer(h, h.ServerConfig.AdminToken)))
+		go func() {
+			if err := h.adminSrv.Serve(l); err != nil && err != http.ErrServerClosed {
+				h.log().Error("admin listener stopped", "error", err)
+			}
+		}()
 	}
 
 	if h.ServerConfig.MetricsEnabled {
@@ -1197,29 +2116,269 @@ func (h *MetadataServer) Start() error {
 		if h.ServerConfig.MetricsPort == "" {
 			h.ServerConfig.MetricsPort = defaultMetricsPort
 		}
+		mm := http.NewServeMux()
+		mm.Handle(h.ServerConfig.MetricsPath, h.metrics.handler())
+		metricsSrv := h.newHTTPServer(mm)
+		metricsSrv.Addr = fmt.Sprintf("%s:%s", h.ServerConfig.MetricsInterface, h.ServerConfig.MetricsPort)
+		h.metricsSrv = metricsSrv
 		go func() {
-			http.Handle(h.ServerConfig.MetricsPath, promhttp.Handler())
-			glog.Error(http.ListenAndServe(fmt.Sprintf("%s:%s", h.ServerConfig.MetricsInterface, h.ServerConfig.MetricsPort), nil))
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				h.log().Error("metrics listener stopped", "error", err)
+			}
 		}()
 	}
 
-	go func() {
-		if err := h.srv.Serve(l); err != nil && err != http.ErrServerClosed {
-			glog.Error("listen: %s\n", err)
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			var err error
+			if h.tlsConfig != nil {
+				err = h.srv.ServeTLS(l, "", "")
+			} else {
+				err = h.srv.Serve(l)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				h.log().Error("listen", "address", l.Addr().String(), "error", err)
+			}
+		}(l)
+	}
+
+	return nil
+}
+
+// TLSFingerprint returns the SHA-256 fingerprint of the TLS certificate served by the metadata listeners
+// as colon separated hex (the format of `openssl x509 -fingerprint -sha256`), or an empty string if TLS is not enabled
+func (h *MetadataServer) TLSFingerprint() string {
+	if h.tlsConfig == nil || len(h.tlsConfig.Certificates) == 0 || len(h.tlsConfig.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(h.tlsConfig.Certificates[0].Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// Restart replaces the credentials and claims used by a running metadata server.
+//
+// The listener stays bound while in-flight requests are drained before the new values are applied.
+// The new credentials are probed for a token first; if that fails an error is returned and the
+// existing credentials and claims are left in place.  The claims are validated and the state set at runtime is
+// reset like with `UpdateClaims()`.
+func (h *MetadataServer) Restart(creds *google.Credentials, claims *Claims) error {
+	if creds == nil || claims == nil {
+		return errors.New("credential and claims cannot be nil")
+	}
+
+	// static tokens provided through the environment bypass the credential source entirely
+	if os.Getenv(googleAccessToken) == "" {
+		if creds.TokenSource == nil {
+			return errors.New("credentials must provide a TokenSource")
+		}
+		if _, err := creds.TokenSource.Token(); err != nil {
+			h.log().Error("Unable to validate new credentials", "error", err)
+			return fmt.Errorf("could not validate credentials: %v", err)
 		}
-	}()
+	}
 
+	if err := h.replaceClaims(claims, func() { h.Creds = creds }); err != nil {
+		return err
+	}
+	h.tokenCache.invalidate()
+	if err := h.tpmSessions.close(); err != nil {
+		h.log().Error("Unable to close TPM sessions", "error", err)
+	}
+
+	h.notifyChange()
+	h.log().Info("Metadata server credentials and claims reloaded")
 	return nil
 }
 
-// Stop a running metadata server
+// UpdateClaims validates and atomically replaces the claims returned by the metadata server.
+// Requests in flight finish with the previous claims.  A copy of the claims is served, so the caller may keep
+// modifying them.
+// Guest attributes written at runtime are replaced with the ones from the new claims.
+//
+// Any request waiting on `?wait_for_change=true` is woken up and returns if its value changed.
+func (h *MetadataServer) UpdateClaims(claims *Claims) error {
+	if err := h.replaceClaims(claims, nil); err != nil {
+		return err
+	}
+	h.notifyChange()
+	return nil
+}
+
+// replaceClaims validates a copy of claims like UpdateClaims() and serves it in place of the current claims, resetting
+// the state changed at runtime.  If set, update is called with stateMutex held to replace more state along with the
+// claims.
+func (h *MetadataServer) replaceClaims(claims *Claims, update func()) error {
+	if claims == nil {
+		return errors.New("claims cannot be nil")
+	}
+	claims = claims.Clone()
+	if err := validateClaims(claims); err != nil {
+		return err
+	}
+	if err := h.ServerConfig.validateProjectID(claims); err != nil {
+		return err
+	}
+	if err := validateWith(h.claimsValidator, claims); err != nil {
+		return err
+	}
+
+	h.stateMutex.Lock()
+	h.Claims = *claims
+	h.spotVMSet = false
+	if update != nil {
+		update()
+	}
+	h.stateMutex.Unlock()
+	h.resetGuestAttributes(claims)
+	return nil
+}
+
+// SetPreempted sets the value of /computeMetadata/v1/instance/preempted to simulate the preemption of a Spot
+// or preemptible VM.  Any request waiting on `?wait_for_change=true` for the value is woken up.
+//
+// An instance whose scheduling is explicitly not preemptible cannot be preempted.
+func (h *MetadataServer) SetPreempted(v bool) error {
+	h.stateMutex.Lock()
+	if v && h.Claims.ComputeMetadata.V1.Instance.Scheduling.Preemptible == "FALSE" {
+		h.stateMutex.Unlock()
+		return errors.New("instance scheduling is not preemptible")
+	}
+	h.Claims.ComputeMetadata.V1.Instance.Preempted = GCEBool(v)
+	h.stateMutex.Unlock()
+
+	h.notifyChange()
+	h.log().Info("Instance preempted state changed", "preempted", v)
+	return nil
+}
+
+// SetSpotVM sets the value of /computeMetadata/v1/instance/spot-vm.  Once set, the value no longer follows
+// `SetPreempted()`.  Any request waiting on `?wait_for_change=true` for the value is woken up.
+//
+// An instance whose scheduling is explicitly not preemptible cannot be a Spot VM.
+func (h *MetadataServer) SetSpotVM(v bool) error {
+	h.stateMutex.Lock()
+	if v && h.Claims.ComputeMetadata.V1.Instance.Scheduling.Preemptible == "FALSE" {
+		h.stateMutex.Unlock()
+		return errors.New("instance scheduling is not preemptible")
+	}
+	h.Claims.ComputeMetadata.V1.Instance.SpotVM = v
+	h.spotVMSet = true
+	h.stateMutex.Unlock()
+
+	h.notifyChange()
+	h.log().Info("Instance spot VM state changed", "spotVM", v)
+	return nil
+}
+
+// spotVM returns the value of /computeMetadata/v1/instance/spot-vm: only Spot VMs are preempted, so a preempted
+// instance is one unless the value was set with SetSpotVM()
+func (h *MetadataServer) spotVM() bool {
+	instance := h.Claims.ComputeMetadata.V1.Instance
+	return instance.SpotVM || (bool(instance.Preempted) && !h.spotVMSet)
+}
+
+// SetVirtualClockDriftToken sets the value of /computeMetadata/v1/instance/virtual-clock/drift-token.  An empty
+// token is not served, like on VMs without a virtual clock.  Requests waiting for a change are released.
+func (h *MetadataServer) SetVirtualClockDriftToken(token string) {
+	h.stateMutex.Lock()
+	h.Claims.ComputeMetadata.V1.Instance.VirtualClock.DriftToken = token
+	h.stateMutex.Unlock()
+
+	h.notifyChange()
+	h.log().Info("Instance virtual clock drift token changed", "driftToken", token)
+}
+
+// SetMaintenanceEvent sets the value of /computeMetadata/v1/instance/maintenance-event to NONE,
+// MIGRATE_ON_HOST_MAINTENANCE or TERMINATE_ON_HOST_MAINTENANCE.  Requests waiting for a change are released, so
+// clients polling with `?wait_for_change=true` see the simulated host maintenance right away.
+func (h *MetadataServer) SetMaintenanceEvent(event string) error {
+	if err := validateMaintenanceEvent(event); err != nil {
+		return err
+	}
+	h.stateMutex.Lock()
+	h.Claims.ComputeMetadata.V1.Instance.MaintenanceEvent = event
+	h.stateMutex.Unlock()
+
+	h.notifyChange()
+	h.log().Info("Instance maintenance event changed", "maintenanceEvent", event)
+	return nil
+}
+
+// ExportConfig writes the current claims as a JSON document which can be loaded with `--configFile` or
+// `ClaimsFromReader()`, so a state set up with `UpdateClaims()`, `SetPreempted()` or guest attribute writes can be
+// saved and reused.  Guest attributes written at runtime and the generated instance id are included.
+//
+// Only claims are exported; server configuration such as FaultConfig is not part of the config file.
+func (h *MetadataServer) ExportConfig(w io.Writer) error {
+	h.stateMutex.RLock()
+	claims := h.Claims
+	h.stateMutex.RUnlock()
+
+	h.guestMutex.RLock()
+	claims.ComputeMetadata.V1.Instance.GuestAttributes = copyGuestAttributes(h.guestAttributes)
+	h.guestMutex.RUnlock()
+	if len(claims.ComputeMetadata.V1.Instance.GuestAttributes) == 0 {
+		claims.ComputeMetadata.V1.Instance.GuestAttributes = nil
+	}
+	if claims.ComputeMetadata.V1.Instance.ID == 0 {
+		// a server loading the config serves the same generated id
+		claims.ComputeMetadata.V1.Instance.ID = h.instanceID
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(claims)
+}
+
+// Stop a running metadata server and close all its listeners.  This is `ShutdownContext(context.Background())`.
 func (h *MetadataServer) Shutdown() error {
-	ctx := context.Background()
+	return h.ShutdownContext(context.Background())
+}
+
+// ShutdownContext stops a running metadata server and closes all its listeners.
+//
+// Requests blocked on `?wait_for_change=true` are answered with a 503 right away and in-flight requests
+// are drained until ctx is done.  If ctx expires first, the remaining connections are closed and ctx's error is returned.
+func (h *MetadataServer) ShutdownContext(ctx context.Context) error {
+	h.signalShutdown()
+	h.stopConfigWatchers()
+	if h.srv == nil {
+		// Start() failed before serving
+		return nil
+	}
+	defer h.removeSockets()
 	if err := h.srv.Shutdown(ctx); err != nil {
-		glog.Errorf("Server Shutdown Failed:%+v", err)
+		h.log().Error("Server Shutdown Failed", "error", err)
+		h.srv.Close()
 		return err
 	}
-	glog.Infoln("Server Exited Properly")
+	if h.adminSrv != nil {
+		if err := h.adminSrv.Shutdown(ctx); err != nil {
+			h.log().Error("Admin Server Shutdown Failed", "error", err)
+			return err
+		}
+	}
+	if h.metricsSrv != nil {
+		if err := h.metricsSrv.Shutdown(ctx); err != nil {
+			h.log().Error("Metrics Server Shutdown Failed", "error", err)
+			return err
+		}
+	}
+	if h.Creds != nil {
+		if c, ok := h.Creds.TokenSource.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				h.log().Error("Unable to close credential source", "error", err)
+			}
+		}
+	}
+	if err := h.tpmSessions.close(); err != nil {
+		h.log().Error("Unable to close TPM sessions", "error", err)
+	}
+	h.log().Info("Server Exited Properly")
 	return nil
 }
 
@@ -1229,21 +2388,247 @@ func (h *MetadataServer) Shutdown() error {
 //
 // - ServerConfig:  This configures the core/baseline runtime.  Specify the interface,port and credential scheme to use
 //
-// - google.Credentials:  Credentials to use for the access or id_token
+// - google.Credentials:  Credentials to use for the access or id_token.  Must be nil if ServerConfig.NamedCredentials, CredentialCommand, PKCS11LibPath, KubernetesSATokenFile, TokenFilePath, FederationConfig or `WithVaultCredentials()` provides them; only one of these may be set
 //
 // - Claims:  The runtime claims returned by the metadata server
-func NewMetadataServer(ctx context.Context, serverConfig *ServerConfig, creds *google.Credentials, claims *Claims) (*MetadataServer, error) {
+//
+// - Option:  Optional settings like `WithLogger()`
+func NewMetadataServer(ctx context.Context, serverConfig *ServerConfig, creds *google.Credentials, claims *Claims, opts ...Option) (*MetadataServer, error) {
 
 	// do some input validation here
-	if serverConfig == nil || creds == nil || claims == nil {
+	if serverConfig == nil || claims == nil {
 		return nil, errors.New("serverConfig, credential and claims cannot be nil")
 	}
+	claims = claims.Clone()
+	if err := validateInstance(&claims.ComputeMetadata.V1.Instance); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	if err := serverConfig.validateProjectID(claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	if serverConfig.RecordDir != "" && serverConfig.ReplayDir != "" {
+		return nil, errors.New("RecordDir and ReplayDir cannot both be set")
+	}
+	if serverConfig.ProxyTo != "" {
+		if serverConfig.ReplayDir != "" {
+			return nil, errors.New("ProxyTo and ReplayDir cannot both be set")
+		}
+		if u, err := url.Parse(serverConfig.ProxyTo); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("ProxyTo must be an absolute URL, got %q", serverConfig.ProxyTo)
+		}
+	}
+	if err := serverConfig.FaultConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := serverConfig.LatencyConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := serverConfig.IdentityRateLimit.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid IdentityRateLimit: %w", err)
+	}
+	if err := serverConfig.GlobalIdentityRateLimit.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid GlobalIdentityRateLimit: %w", err)
+	}
+	if err := validatePathRateLimits(serverConfig.PathRateLimits); err != nil {
+		return nil, err
+	}
+	if err := serverConfig.GlobalRateLimit.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid GlobalRateLimit: %w", err)
+	}
+	if err := validatePathPrefix(serverConfig.PathPrefix); err != nil {
+		return nil, err
+	}
+	if serverConfig.MaxRequestBodySize < 0 || serverConfig.AdminMaxRequestBodySize < 0 {
+		return nil, errors.New("MaxRequestBodySize and AdminMaxRequestBodySize cannot be negative")
+	}
+	if len(serverConfig.ImpersonateDelegates) > 0 && !serverConfig.Impersonate {
+		return nil, errors.New("ImpersonateDelegates requires Impersonate")
+	}
+	if len(serverConfig.NamedCredentials) > 0 {
+		if creds != nil {
+			return nil, errors.New("credentials cannot be passed to NewMetadataServer() if NamedCredentials is set")
+		}
+		creds = serverConfig.NamedCredentials[defaultServiceAccount]
+		if creds == nil {
+			return nil, errors.New("NamedCredentials must include credentials for the default service account")
+		}
+		for alias, c := range serverConfig.NamedCredentials {
+			if c == nil {
+				return nil, fmt.Errorf("NamedCredentials for service account %s cannot be nil", alias)
+			}
+			if _, ok := claims.ComputeMetadata.V1.Instance.ServiceAccounts[alias]; !ok && alias != defaultServiceAccount {
+				return nil, fmt.Errorf("NamedCredentials for service account %s which is not in the claims", alias)
+			}
+		}
+	}
+
+	if err := validateBearerTokenExemptPaths(serverConfig.BearerTokenExemptPaths); err != nil {
+		return nil, err
+	}
+	for scope, c := range serverConfig.ScopedCredentials {
+		if scope == "" {
+			return nil, errors.New("ScopedCredentials cannot have an empty scope")
+		}
+		if c == nil {
+			return nil, fmt.Errorf("ScopedCredentials for scope %s cannot be nil", scope)
+		}
+	}
+
+	handles := map[int]string{}
+	for alias, handle := range serverConfig.TPMHandles {
+		if alias == defaultServiceAccount {
+			return nil, errors.New("TPMHandles cannot include the default service account, use PersistentHandle")
+		}
+		if sa, ok := claims.ComputeMetadata.V1.Instance.ServiceAccounts[alias]; !ok || sa.Email == "" {
+			return nil, fmt.Errorf("TPMHandles for service account %s which is not in the claims or has no email", alias)
+		}
+		if _, ok := serverConfig.NamedCredentials[alias]; ok {
+			return nil, fmt.Errorf("service account %s cannot have both NamedCredentials and TPMHandles", alias)
+		}
+		if handle <= 0 {
+			return nil, fmt.Errorf("TPMHandles for service account %s must be a persistent handle, got %d", alias, handle)
+		}
+		if other, ok := handles[handle]; ok {
+			return nil, fmt.Errorf("service accounts %s and %s cannot use the same TPM handle %#x", other, alias, handle)
+		}
+		handles[handle] = alias
+	}
+
+	if (serverConfig.TLSCertFile == "") != (serverConfig.TLSKeyFile == "") {
+		return nil, errors.New("TLSCertFile and TLSKeyFile must be set together")
+	}
+	var tlsConfig *tls.Config
+	if serverConfig.TLSConfig != nil {
+		tlsConfig = serverConfig.TLSConfig
+	} else if serverConfig.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(serverConfig.TLSCertFile, serverConfig.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
 
 	h := &MetadataServer{
+		tlsConfig:    tlsConfig,
 		Creds:        creds,
 		Claims:       *claims,
 		ServerConfig: *serverConfig,
 		initNew:      true, // confirms the MetadataServer was started with NewMetadataServer()
+
+		guestAttributes: copyGuestAttributes(claims.ComputeMetadata.V1.Instance.GuestAttributes),
+
+		identityLimiter: newIdentityRateLimiter(serverConfig.IdentityRateLimit, serverConfig.GlobalIdentityRateLimit),
+		pathLimiter:     newPathRateLimiter(serverConfig.PathRateLimits, serverConfig.GlobalRateLimit),
+	}
+	id, err := randomInstanceID()
+	if err != nil {
+		return nil, err
+	}
+	h.instanceID = id
+	if len(serverConfig.NamedCredentials) > 0 {
+		// the map stays owned by the caller
+		h.namedCredentials = make(map[string]*google.Credentials, len(serverConfig.NamedCredentials))
+		for alias, c := range serverConfig.NamedCredentials {
+			h.namedCredentials[alias] = c
+		}
+	}
+	if serverConfig.MetricsEnabled {
+		h.metrics = newServerMetrics(prometheus.DefaultRegisterer)
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if err := validateWith(h.claimsValidator, claims); err != nil {
+		return nil, err
+	}
+	// validated after the options since WithTokenSigner() may set the key
+	if h.ServerConfig.IDTokenSigningKey != nil {
+		if _, err := signingMethod(h.ServerConfig.IDTokenSigningKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if sources := serverConfig.credentialSources(creds, h.vaultConfig != nil); len(sources) > 1 {
+		return nil, fmt.Errorf("only one source of credentials can be set, got %s", strings.Join(sources, ", "))
+	}
+	if h.vaultConfig != nil {
+		ts, err := NewVaultTokenSource(*h.vaultConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vault configuration: %w", err)
+		}
+		h.Creds = &google.Credentials{
+			ProjectID:   claims.ComputeMetadata.V1.Project.ProjectID,
+			TokenSource: ts,
+		}
+	}
+	if serverConfig.PKCS11LibPath != "" {
+		sa := claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"]
+		ts, err := NewPKCS11TokenSource(PKCS11Config{
+			LibPath:  serverConfig.PKCS11LibPath,
+			SlotID:   serverConfig.PKCS11SlotID,
+			PIN:      serverConfig.PKCS11PIN,
+			KeyLabel: serverConfig.PKCS11KeyLabel,
+			Email:    sa.Email,
+			Scopes:   sa.Scopes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		h.Creds = &google.Credentials{
+			ProjectID:   claims.ComputeMetadata.V1.Project.ProjectID,
+			TokenSource: ts,
+		}
+	}
+	if serverConfig.KubernetesSATokenFile != "" {
+		ts, err := NewKubernetesTokenFileTokenSource(KubernetesTokenConfig{
+			TokenFile: serverConfig.KubernetesSATokenFile,
+			Audience:  serverConfig.KubernetesTokenAudience,
+			Scopes:    claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Scopes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		h.Creds = &google.Credentials{
+			ProjectID:   claims.ComputeMetadata.V1.Project.ProjectID,
+			TokenSource: ts,
+		}
+	}
+	if serverConfig.TokenFilePath != "" {
+		if _, err := os.Stat(serverConfig.TokenFilePath); err != nil {
+			return nil, fmt.Errorf("unable to read token file: %w", err)
+		}
+		h.Creds = &google.Credentials{
+			ProjectID:   claims.ComputeMetadata.V1.Project.ProjectID,
+			TokenSource: TokenFileTokenSource(serverConfig.TokenFilePath, defaultTokenFileExpiryMargin),
+		}
+	}
+	if serverConfig.FederationConfig != nil {
+		cfg := *serverConfig.FederationConfig
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Scopes
+		}
+		ts, err := NewFederatedTokenSource(cfg)
+		if err != nil {
+			return nil, err
+		}
+		h.Creds = &google.Credentials{
+			ProjectID:   claims.ComputeMetadata.V1.Project.ProjectID,
+			TokenSource: ts,
+		}
+	}
+	if h.Creds == nil && len(serverConfig.CredentialCommand) == 0 {
+		return nil, errors.New("serverConfig, credential and claims cannot be nil")
+	}
+
+	if len(serverConfig.CredentialCommand) > 0 {
+		h.Creds = &google.Credentials{
+			ProjectID: claims.ComputeMetadata.V1.Project.ProjectID,
+			TokenSource: &ExternalCommandTokenSource{
+				Command:     serverConfig.CredentialCommand,
+				ExpiryDelta: serverConfig.CredentialCommandExpiryDelta,
+				Logger:      h.log(),
+			},
+		}
 	}
 	return h, nil
 }
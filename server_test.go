@@ -1,11 +1,31 @@
 package mds
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -79,6 +99,39 @@ func TestBasePathRedirectHandler(t *testing.T) {
 	}
 }
 
+func TestDirectoryListingHandlers(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for path, want := range map[string]string{
+		"/":                    "computeMetadata/\n",
+		"/computeMetadata/":    "v1/\n",
+		"/computeMetadata/v1/": "instance/\noslogin/\nproject/\n",
+	} {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addHeaders(*req)
+		rr := httptest.NewRecorder()
+		h.handler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != want {
+			t.Errorf("%s returned unexpected response: got %v %q want %q", path, rr.Code, rr.Body.String(), want)
+		}
+		if err := verifyResponseHeaders(*rr.Result()); err != nil {
+			t.Errorf("%s returned unexpected header: got %v", path, err)
+		}
+		if rr.Header().Get("Content-Type") != "application/text" {
+			t.Errorf("%s returned unexpected content type: got %v", path, rr.Header().Get("Content-Type"))
+		}
+		if path != "/" && rr.Header()["ETag"][0] != getETag([]byte(want)) {
+			t.Errorf("%s returned unexpected etag: got %v", path, rr.Header()["ETag"])
+		}
+	}
+}
+
 // TODO:  test all other endpoints.
 func TestProjectIDHandler(t *testing.T) {
 	expectedProjectID := "some-project-id"
@@ -119,6 +172,38 @@ func TestProjectIDHandler(t *testing.T) {
 	}
 }
 
+func TestArbitraryProjectID(t *testing.T) {
+	if _, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("MY_PROJECT")); err == nil {
+		t.Errorf("expected error for an invalid project id")
+	}
+
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project-id"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	if err := h.UpdateClaims(projectClaims("MY_PROJECT")); err == nil {
+		t.Errorf("expected error updating claims with an invalid project id")
+	}
+
+	h, err = NewMetadataServer(context.Background(), &ServerConfig{AllowArbitraryProjectID: true}, &google.Credentials{}, projectClaims("MY_PROJECT"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator with AllowArbitraryProjectID %v", err)
+	}
+	if err := h.UpdateClaims(projectClaims("fake")); err != nil {
+		t.Errorf("error updating claims with AllowArbitraryProjectID %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/project/project-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	h.handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "fake" {
+		t.Errorf("handler returned unexpected response: got %v %q want %q", rr.Code, rr.Body.String(), "fake")
+	}
+}
+
 func TestAccessTokenHandler(t *testing.T) {
 	expectedToken := "foo"
 	expireInSeconds := 60
@@ -160,10 +245,65 @@ func TestAccessTokenHandler(t *testing.T) {
 		t.Errorf("handler returned unexpected header: got %v", err)
 	}
 
-	resp := fmt.Sprintf("{\"access_token\":\"%s\",\"expires_in\":%d,\"token_type\":\"Bearer\"}", expectedToken, expireInSeconds)
-	if rr.Body.String() != resp {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), resp)
+	var tok metadataToken
+	if err := json.Unmarshal(rr.Body.Bytes(), &tok); err != nil {
+		t.Fatalf("error parsing token response %v", err)
+	}
+	if tok.AccessToken != expectedToken || tok.ExpiresIn != expireInSeconds || tok.TokenType != "Bearer" {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+	expiry, err := time.Parse(time.RFC3339, tok.ExpiryTime)
+	if err != nil {
+		t.Fatalf("error parsing expiry_time %q: %v", tok.ExpiryTime, err)
+	}
+	if d := time.Until(expiry) - time.Duration(tok.ExpiresIn)*time.Second; d < -2*time.Second || d > 2*time.Second {
+		t.Errorf("expiry_time %v does not match expires_in %d", expiry, tok.ExpiresIn)
+	}
+}
+
+func TestAccessTokenFormat(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, staticCredentials("some-token"), projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+	path := "/computeMetadata/v1/instance/service-accounts/default/token"
+
+	standard := []string{"access_token", "expires_in", "expiry_time", "token_type"}
+	for query, want := range map[string][]string{
+		"":                       standard,
+		"?token_format=standard": standard,
+		"?token_format=full":     append(standard, "email", "token_handle"),
+	} {
+		rr := requestPath(t, handler, path+query)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%q: returned wrong status code: got %v want %v", query, rr.Code, http.StatusOK)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%q: error parsing token response %v", query, err)
+		}
+		var keys []string
+		for k := range body {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		sort.Strings(want)
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("%q: unexpected fields: got %v want %v", query, keys, want)
+		}
+		if body["access_token"] != "some-token" {
+			t.Errorf("%q: unexpected access_token: got %v", query, body["access_token"])
+		}
+		if query == "?token_format=full" {
+			if body["email"] != "metadata-sa@some-project.iam.gserviceaccount.com" || body["token_handle"] != tokenHandle("some-token") || len(tokenHandle("some-token")) != 32 {
+				t.Errorf("unexpected full token response: got %s", rr.Body.String())
+			}
+		}
+	}
+
+	if rr := requestPath(t, handler, path+"?token_format=compact"); rr.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status code for an unknown token_format: got %v want %v", rr.Code, http.StatusBadRequest)
 	}
 }
 
@@ -312,7 +452,8 @@ func TestOnGCEHandler(t *testing.T) {
 		t.Errorf("error getting emulator port %v", err)
 	}
 	sc := &ServerConfig{
-		Port: fmt.Sprintf(":%d", p),
+		Port:         fmt.Sprintf(":%d", p),
+		SkipPrefetch: true,
 	}
 
 	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, &Claims{})
@@ -348,7 +489,8 @@ func TestProjectNumberHandler(t *testing.T) {
 		},
 	}
 	sc := &ServerConfig{
-		Port: fmt.Sprintf(":%d", p),
+		Port:         fmt.Sprintf(":%d", p),
+		SkipPrefetch: true,
 	}
 
 	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, cc)
@@ -375,7 +517,7 @@ func TestProjectNumberHandler(t *testing.T) {
 }
 
 func TestInstanceIDHandler(t *testing.T) {
-	expectedInstanceID := int64(123456)
+	expectedInstanceID := uint64(123456)
 	p, err := getFreePort()
 	if err != nil {
 		t.Errorf("error getting emulator port %v", err)
@@ -390,7 +532,8 @@ func TestInstanceIDHandler(t *testing.T) {
 		},
 	}
 	sc := &ServerConfig{
-		Port: fmt.Sprintf(":%d", p),
+		Port:         fmt.Sprintf(":%d", p),
+		SkipPrefetch: true,
 	}
 
 	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, cc)
@@ -415,3 +558,2002 @@ func TestInstanceIDHandler(t *testing.T) {
 			mid, expectedInstanceID)
 	}
 }
+
+func TestGeneratedInstanceID(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project-id"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	get := func() string {
+		req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/id", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		h.handler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		return rr.Body.String()
+	}
+
+	id := get()
+	if len(id) != 19 || strings.Trim(id, "0123456789") != "" {
+		t.Errorf("unexpected generated instance id: got %q", id)
+	}
+	if err := h.UpdateClaims(projectClaims("other-project-id")); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if got := get(); got != id {
+			t.Errorf("generated instance id changed: got %q want %q", got, id)
+		}
+	}
+
+	other, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project-id"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	if other.instanceID == h.instanceID {
+		t.Errorf("two servers generated the same instance id %d", h.instanceID)
+	}
+}
+
+type errorTokenSource struct{}
+
+func (errorTokenSource) Token() (*oauth2.Token, error) {
+	return nil, fmt.Errorf("invalid credentials")
+}
+
+func TestRestart(t *testing.T) {
+	initialToken := "foo"
+	rotatedToken := "bar"
+
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	sc := &ServerConfig{
+		Port: fmt.Sprintf(":%d", p),
+	}
+
+	creds := &google.Credentials{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{
+			AccessToken: initialToken,
+			Expiry:      time.Now().Add(time.Second * 60),
+			TokenType:   "Bearer",
+		})}
+
+	h, err := NewMetadataServer(context.Background(), sc, creds, &Claims{})
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err != nil {
+		t.Errorf("error starting emulator %v", err)
+	}
+	defer h.Shutdown()
+
+	t.Setenv("GCE_METADATA_HOST", fmt.Sprintf("127.0.0.1:%d", p))
+
+	rotatedCreds := &google.Credentials{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{
+			AccessToken: rotatedToken,
+			Expiry:      time.Now().Add(time.Second * 60),
+			TokenType:   "Bearer",
+		})}
+
+	if err := h.SetSpotVM(true); err != nil {
+		t.Fatalf("error setting spot-vm %v", err)
+	}
+	if err := h.Restart(rotatedCreds, &Claims{}); err == nil {
+		t.Errorf("expected error restarting with claims without a default service account")
+	}
+	err = h.Restart(rotatedCreds, projectClaims("some-project"))
+	if err != nil {
+		t.Errorf("error restarting emulator %v", err)
+	}
+
+	tok, err := google.ComputeTokenSource("default").Token()
+	if err != nil {
+		t.Errorf("error getting token %v", err)
+	}
+	if tok.AccessToken != rotatedToken {
+		t.Errorf("handler returned unexpected body: got %v want %v", tok.AccessToken, rotatedToken)
+	}
+
+	if h.spotVMSet {
+		t.Errorf("spot-vm set before the restart was not reset")
+	}
+
+	err = h.Restart(&google.Credentials{TokenSource: errorTokenSource{}}, projectClaims("some-project"))
+	if err == nil {
+		t.Errorf("expected error restarting with invalid credentials")
+	}
+
+	tok, err = google.ComputeTokenSource("default").Token()
+	if err != nil {
+		t.Errorf("error getting token %v", err)
+	}
+	if tok.AccessToken != rotatedToken {
+		t.Errorf("handler returned unexpected body: got %v want %v", tok.AccessToken, rotatedToken)
+	}
+}
+
+func TestHealthCheckHandlers(t *testing.T) {
+	creds := &google.Credentials{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{
+			AccessToken: "foo",
+			Expiry:      time.Now().Add(time.Second * 60),
+			TokenType:   "Bearer",
+		})}
+
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, creds, &Claims{})
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	// health checks must not require the Metadata-Flavor header
+	for path, expectedStatus := range map[string]int{
+		"/healthz": http.StatusOK,
+		"/readyz":  http.StatusServiceUnavailable,
+	} {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != expectedStatus {
+			t.Errorf("handler for %s returned wrong status code: got %v want %v", path, status, expectedStatus)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, "/readyz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if rr.Body.String() != "ok" {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), "ok")
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	socket := filepath.Join(t.TempDir(), "metadata.sock")
+	sc := &ServerConfig{
+		SkipPrefetch: true,
+		Listeners: []ListenerSpec{
+			{Network: "tcp", Address: fmt.Sprintf("127.0.0.1:%d", p)},
+			{Network: "unix", Address: socket},
+		},
+	}
+
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, &Claims{})
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err != nil {
+		t.Fatalf("error starting emulator %v", err)
+	}
+
+	unixClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	for name, c := range map[string]*http.Client{
+		"tcp":  http.DefaultClient,
+		"unix": unixClient,
+	} {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/", p), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("error calling %s listener %v", name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s listener returned wrong status code: got %v want %v", name, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	err = h.Shutdown()
+	if err != nil {
+		t.Errorf("error stopping emulator %v", err)
+	}
+	unixClient.CloseIdleConnections()
+	http.DefaultClient.CloseIdleConnections()
+
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p)); err == nil {
+		t.Errorf("expected tcp listener to be closed")
+	}
+	if _, err := net.Dial("unix", socket); err == nil {
+		t.Errorf("expected unix listener to be closed")
+	}
+}
+
+func TestDomainSocketMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode os.FileMode
+		want os.FileMode
+	}{
+		{0, 0660},
+		{0600, 0600},
+	} {
+		socket := filepath.Join(t.TempDir(), "metadata.sock")
+		sc := &ServerConfig{
+			SkipPrefetch:     true,
+			DomainSocket:     socket,
+			DomainSocketMode: tc.mode,
+		}
+		h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, &Claims{}, WithLogger(&recordingLogger{}))
+		if err != nil {
+			t.Fatalf("error creating emulator %v", err)
+		}
+		if err := h.Start(); err != nil {
+			t.Fatalf("error starting emulator %v", err)
+		}
+		fi, err := os.Stat(socket)
+		if err != nil {
+			t.Fatalf("error reading socket file %v", err)
+		}
+		if fi.Mode().Perm() != tc.want {
+			t.Errorf("unexpected socket permissions for mode %v: got %v want %v", tc.mode, fi.Mode().Perm(), tc.want)
+		}
+
+		if err := h.Shutdown(); err != nil {
+			t.Errorf("error stopping emulator %v", err)
+		}
+		if _, err := os.Stat(socket); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected socket file to be removed on shutdown: %v", err)
+		}
+	}
+}
+
+func TestInvalidListener(t *testing.T) {
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	sc := &ServerConfig{
+		Listeners: []ListenerSpec{
+			{Network: "tcp", Address: fmt.Sprintf("127.0.0.1:%d", p)},
+			{Network: "udp", Address: "127.0.0.1:0"},
+		},
+	}
+
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, &Claims{})
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err == nil {
+		h.Shutdown()
+		t.Fatalf("expected error starting emulator with an unsupported listener")
+	}
+
+	// the tcp listener opened before the failure must have been released
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", p))
+	if err != nil {
+		t.Errorf("expected tcp port to be released %v", err)
+	} else {
+		l.Close()
+	}
+}
+
+func TestUpdateClaimsValidation(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("before"))
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+
+	for _, c := range []*Claims{
+		nil,
+		{},
+		{ComputeMetadata: ComputeMetadata{V1: V1{Instance: Instance{ServiceAccounts: map[string]serviceAccountDetails{"default": {}}}}}},
+	} {
+		if err := h.UpdateClaims(c); err == nil {
+			t.Errorf("expected error updating claims %+v", c)
+		}
+	}
+	if h.Claims.ComputeMetadata.V1.Project.ProjectID != "before" {
+		t.Errorf("invalid claims should not be applied: got project %s", h.Claims.ComputeMetadata.V1.Project.ProjectID)
+	}
+}
+
+func TestUpdateClaimsConcurrent(t *testing.T) {
+	claimsFor := func(i int) *Claims {
+		c := projectClaims(fmt.Sprintf("project-%d", i))
+		c.ComputeMetadata.V1.Project.NumericProjectID = int64(i)
+		return c
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claimsFor(0))
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 100; i++ {
+			if err := h.UpdateClaims(claimsFor(i)); err != nil {
+				t.Errorf("error updating claims %v", err)
+			}
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/project/?recursive=true", nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				req.Header.Set("Metadata-Flavor", "Google")
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+
+				p := &Project{}
+				if err := json.Unmarshal(rr.Body.Bytes(), p); err != nil {
+					t.Errorf("error decoding project %v", err)
+					return
+				}
+				// both values are swapped together so a reader never sees a mix of two updates
+				if p.ProjectID != fmt.Sprintf("project-%d", p.NumericProjectID) {
+					t.Errorf("inconsistent project snapshot: %+v", p)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if h.Claims.ComputeMetadata.V1.Project.ProjectID != "project-100" {
+		t.Errorf("unexpected project after updates: got %s want %s", h.Claims.ComputeMetadata.V1.Project.ProjectID, "project-100")
+	}
+}
+
+func TestInstanceAttributesHandler(t *testing.T) {
+	claims := projectClaims("some-project-id")
+	claims.ComputeMetadata.V1.Instance.Attributes = map[string]string{
+		"foo":            "bar",
+		"startup-script": "#!/bin/bash\necho hello",
+		"enable-oslogin": "TRUE",
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims)
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/computeMetadata/v1/instance/attributes/")
+	if rr.Body.String() != "enable-oslogin\nfoo\nstartup-script\n" {
+		t.Errorf("handler returned unexpected body: got %q", rr.Body.String())
+	}
+
+	rr = get("/computeMetadata/v1/instance/attributes/?recursive=true")
+	if rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("handler returned unexpected content type: got %v", rr.Header().Get("Content-Type"))
+	}
+	attributes := map[string]string{}
+	err = json.Unmarshal(rr.Body.Bytes(), &attributes)
+	if err != nil {
+		t.Fatalf("error decoding attributes %v", err)
+	}
+	if len(attributes) != 3 || attributes["startup-script"] != "#!/bin/bash\necho hello" {
+		t.Errorf("handler returned unexpected attributes: got %v", attributes)
+	}
+
+	rr = get("/computeMetadata/v1/instance/attributes/foo")
+	if rr.Code != http.StatusOK || rr.Body.String() != "bar" {
+		t.Errorf("handler returned unexpected response: got %v %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Type") != "application/text" {
+		t.Errorf("handler returned unexpected content type: got %v", rr.Header().Get("Content-Type"))
+	}
+
+	rr = get("/computeMetadata/v1/instance/attributes/missing")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	updated := projectClaims("some-project-id")
+	updated.ComputeMetadata.V1.Instance.Attributes = map[string]string{"added": "at-runtime"}
+	err = h.UpdateClaims(updated)
+	if err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	rr = get("/computeMetadata/v1/instance/attributes/added")
+	if rr.Code != http.StatusOK || rr.Body.String() != "at-runtime" {
+		t.Errorf("handler returned unexpected response: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	err = h.UpdateClaims(projectClaims("some-project-id"))
+	if err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	rr = get("/computeMetadata/v1/instance/attributes/?recursive=true")
+	if rr.Body.String() != "{}" {
+		t.Errorf("handler returned unexpected body for empty attributes: got %q", rr.Body.String())
+	}
+}
+
+func TestInstanceLabelsHandler(t *testing.T) {
+	claims := projectClaims("some-project-id")
+	claims.ComputeMetadata.V1.Instance.Labels = map[string]string{
+		"env":  "dev",
+		"team": "platform",
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/computeMetadata/v1/instance/labels")
+	if rr.Code != http.StatusMovedPermanently {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusMovedPermanently)
+	}
+
+	rr = get("/computeMetadata/v1/instance/labels/")
+	if rr.Body.String() != "env\nteam\n" {
+		t.Errorf("handler returned unexpected body: got %q", rr.Body.String())
+	}
+	if rr.Header().Get("Content-Type") != "application/text" {
+		t.Errorf("handler returned unexpected content type: got %v", rr.Header().Get("Content-Type"))
+	}
+
+	rr = get("/computeMetadata/v1/instance/labels/?recursive=true")
+	if rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("handler returned unexpected content type: got %v", rr.Header().Get("Content-Type"))
+	}
+	labels := map[string]string{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &labels); err != nil {
+		t.Fatalf("error decoding labels %v", err)
+	}
+	if len(labels) != 2 || labels["team"] != "platform" {
+		t.Errorf("handler returned unexpected labels: got %v", labels)
+	}
+
+	rr = get("/computeMetadata/v1/instance/labels/env")
+	if rr.Code != http.StatusOK || rr.Body.String() != "dev" {
+		t.Errorf("handler returned unexpected response: got %v %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Type") != "application/text" {
+		t.Errorf("handler returned unexpected content type: got %v", rr.Header().Get("Content-Type"))
+	}
+
+	rr = get("/computeMetadata/v1/instance/labels/missing")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	updated := projectClaims("some-project-id")
+	updated.ComputeMetadata.V1.Instance.Labels = map[string]string{"added": "at-runtime"}
+	if err := h.UpdateClaims(updated); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	rr = get("/computeMetadata/v1/instance/labels/added")
+	if rr.Code != http.StatusOK || rr.Body.String() != "at-runtime" {
+		t.Errorf("handler returned unexpected response: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	if err := h.UpdateClaims(projectClaims("some-project-id")); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	rr = get("/computeMetadata/v1/instance/labels/?recursive=true")
+	if rr.Body.String() != "{}" {
+		t.Errorf("handler returned unexpected body for empty labels: got %q", rr.Body.String())
+	}
+}
+
+func TestInstanceSchedulingHandler(t *testing.T) {
+	claims := projectClaims("some-project-id")
+	claims.ComputeMetadata.V1.Instance.Scheduling = SchedulingMetadata{
+		AutomaticRestart:  "false",
+		OnHostMaintenance: "TERMINATE",
+		Preemptible:       "TRUE",
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for path, want := range map[string]string{
+		"/computeMetadata/v1/instance/scheduling/":                    "automatic-restart\non-host-maintenance\npreemptible\n",
+		"/computeMetadata/v1/instance/scheduling/automatic-restart":   "false",
+		"/computeMetadata/v1/instance/scheduling/on-host-maintenance": "TERMINATE",
+		"/computeMetadata/v1/instance/scheduling/preemptible":         "TRUE",
+	} {
+		rr := get(path)
+		if rr.Code != http.StatusOK || rr.Body.String() != want {
+			t.Errorf("%s returned unexpected response: got %v %q want %q", path, rr.Code, rr.Body.String(), want)
+		}
+		if rr.Header().Get("Content-Type") != "application/text" {
+			t.Errorf("%s returned unexpected content type: got %v", path, rr.Header().Get("Content-Type"))
+		}
+	}
+
+	rr := get("/computeMetadata/v1/instance/scheduling/?recursive=true")
+	if rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("handler returned unexpected content type: got %v", rr.Header().Get("Content-Type"))
+	}
+	if want := `{"automaticRestart":"false","onHostMaintenance":"TERMINATE","preemptible":"TRUE"}`; rr.Body.String() != want {
+		t.Errorf("handler returned unexpected body: got %s want %s", rr.Body.String(), want)
+	}
+
+	if rr := get("/computeMetadata/v1/instance/scheduling/missing"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	for _, s := range []SchedulingMetadata{
+		{Preemptible: "true"},
+		{OnHostMaintenance: "migrate"},
+		{AutomaticRestart: "yes"},
+	} {
+		invalid := projectClaims("some-project-id")
+		invalid.ComputeMetadata.V1.Instance.Scheduling = s
+		if err := h.UpdateClaims(invalid); err == nil {
+			t.Errorf("expected error updating claims with scheduling %+v", s)
+		}
+	}
+}
+
+func TestInstanceCPUPlatformHandler(t *testing.T) {
+	claims := projectClaims("some-project-id")
+	claims.ComputeMetadata.V1.Instance.CPUPlatform = "Intel Cascade Lake"
+	configured, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	unset, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project-id"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for h, want := range map[*MetadataServer]string{
+		configured: "Intel Cascade Lake",
+		unset:      "Unknown CPU Platform",
+	} {
+		for _, path := range []string{"/computeMetadata/v1/instance/cpu-platform", "/computeMetadata/v1/instance/?recursive=true"} {
+			req, err := http.NewRequest(http.MethodGet, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			rr := httptest.NewRecorder()
+			h.handler().ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("%s returned wrong status code: got %v want %v", path, rr.Code, http.StatusOK)
+				continue
+			}
+			got := rr.Body.String()
+			if strings.Contains(path, "recursive") {
+				instance := &Instance{}
+				if err := json.Unmarshal(rr.Body.Bytes(), instance); err != nil {
+					t.Fatalf("error decoding instance %v", err)
+				}
+				got = instance.CPUPlatform
+			}
+			if got != want {
+				t.Errorf("%s returned unexpected cpu platform: got %q want %q", path, got, want)
+			}
+		}
+	}
+}
+
+func TestInstanceMachineTypeHandler(t *testing.T) {
+	claims := projectClaims("some-project-id")
+	claims.ComputeMetadata.V1.Instance.MachineType = "projects/123456/machineTypes/n1-standard-4"
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/machine-type", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	h.handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "projects/123456/machineTypes/n1-standard-4" {
+		t.Errorf("handler returned unexpected response: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	for _, mtype := range []string{"n1-standard-4", "projects/some-project-id/machineTypes/n1-standard-4", "projects/123456/zones/us-central1-a"} {
+		invalid := projectClaims("some-project-id")
+		invalid.ComputeMetadata.V1.Instance.MachineType = mtype
+		if err := h.UpdateClaims(invalid); err == nil {
+			t.Errorf("expected error updating claims with machine type %q", mtype)
+		}
+	}
+}
+
+func TestInstanceImageHandler(t *testing.T) {
+	claims := projectClaims("some-project-id")
+	claims.ComputeMetadata.V1.Instance.Image = "projects/debian-cloud/global/images/debian-11-bullseye-v20231004"
+	configured, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	unset, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project-id"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for h, want := range map[*MetadataServer]string{
+		configured: "projects/debian-cloud/global/images/debian-11-bullseye-v20231004",
+		unset:      "",
+	} {
+		for _, path := range []string{"/computeMetadata/v1/instance/image", "/computeMetadata/v1/instance/?recursive=true"} {
+			req, err := http.NewRequest(http.MethodGet, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			rr := httptest.NewRecorder()
+			h.handler().ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("%s returned wrong status code: got %v want %v", path, rr.Code, http.StatusOK)
+				continue
+			}
+			got := rr.Body.String()
+			if strings.Contains(path, "recursive") {
+				instance := map[string]interface{}{}
+				if err := json.Unmarshal(rr.Body.Bytes(), &instance); err != nil {
+					t.Fatalf("error decoding instance %v", err)
+				}
+				image, ok := instance["image"].(string)
+				if !ok {
+					t.Errorf("%s returned a non-string image: %v", path, instance["image"])
+				}
+				got = image
+			}
+			if got != want {
+				t.Errorf("%s returned unexpected image: got %q want %q", path, got, want)
+			}
+		}
+	}
+
+	invalid := projectClaims("some-project-id")
+	invalid.ComputeMetadata.V1.Instance.Image = "debian-11-bullseye"
+	if _, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, invalid); err == nil {
+		t.Errorf("expected error creating emulator with an invalid image")
+	}
+}
+
+func TestInstanceHostnameHandler(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	explicit := projectClaims("some-project-id")
+	explicit.ComputeMetadata.V1.Instance.Hostname = "my-vm.example.internal"
+	derived := projectClaims("some-project-id")
+	derived.ComputeMetadata.V1.Instance.Name = "my-vm"
+	derived.ComputeMetadata.V1.Instance.Zone = "projects/123456/zones/us-central1-a"
+	unnamed := projectClaims("some-project-id")
+	unnamed.ComputeMetadata.V1.Instance.Zone = "projects/123456/zones/us-central1-a"
+
+	for claims, want := range map[*Claims]string{
+		explicit: "my-vm.example.internal",
+		derived:  "my-vm.us-central1-a.c.some-project-id.internal",
+		unnamed:  hostname,
+	} {
+		h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims, WithLogger(&recordingLogger{}))
+		if err != nil {
+			t.Fatalf("error creating emulator %v", err)
+		}
+		for _, path := range []string{"/computeMetadata/v1/instance/hostname", "/computeMetadata/v1/instance/?recursive=true"} {
+			req, err := http.NewRequest(http.MethodGet, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			rr := httptest.NewRecorder()
+			h.handler().ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("%s returned wrong status code: got %v want %v", path, rr.Code, http.StatusOK)
+				continue
+			}
+			got := rr.Body.String()
+			if strings.Contains(path, "recursive") {
+				instance := &Instance{}
+				if err := json.Unmarshal(rr.Body.Bytes(), instance); err != nil {
+					t.Fatalf("error decoding instance %v", err)
+				}
+				got = instance.Hostname
+			}
+			if got != want {
+				t.Errorf("%s returned unexpected hostname: got %q want %q", path, got, want)
+			}
+		}
+	}
+}
+
+func TestInstanceNameHandler(t *testing.T) {
+	named := projectClaims("some-project-id")
+	named.ComputeMetadata.V1.Instance.Name = "my-vm"
+	fromHostname := projectClaims("some-project-id")
+	fromHostname.ComputeMetadata.V1.Instance.Hostname = "other-vm.us-central1-a.c.some-project-id.internal"
+
+	for claims, want := range map[*Claims]string{
+		named:                            "my-vm",
+		fromHostname:                     "other-vm",
+		projectClaims("some-project-id"): "metadata-emulator",
+	} {
+		s := NewTestMetadataServer(t, claims)
+		_, body, err := getMetadata(s.URL() + "/computeMetadata/v1/instance/name")
+		if err != nil {
+			t.Fatalf("error getting instance name %v", err)
+		}
+		if body != want {
+			t.Errorf("handler returned unexpected name: got %q want %q", body, want)
+		}
+
+		_, body, err = getMetadata(s.URL() + "/computeMetadata/v1/instance/?recursive=true")
+		if err != nil {
+			t.Fatalf("error getting instance %v", err)
+		}
+		instance := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(body), &instance); err != nil {
+			t.Fatalf("error decoding instance %v", err)
+		}
+		if instance["name"] != want {
+			t.Errorf("recursive instance has unexpected name: got %v want %q", instance["name"], want)
+		}
+	}
+}
+
+func TestInstanceZoneRegionHandler(t *testing.T) {
+	derived := projectClaims("some-project-id")
+	derived.ComputeMetadata.V1.Instance.Zone = "projects/123456/zones/us-central1-a"
+	explicit := projectClaims("some-project-id")
+	explicit.ComputeMetadata.V1.Instance.Region = "projects/123456/regions/europe-west4"
+
+	for claims, want := range map[*Claims]string{
+		derived:  "projects/123456/regions/us-central1",
+		explicit: "projects/123456/regions/europe-west4",
+	} {
+		h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims, WithLogger(&recordingLogger{}))
+		if err != nil {
+			t.Fatalf("error creating emulator %v", err)
+		}
+		for path, want := range map[string]string{
+			"/computeMetadata/v1/instance/zone":   claims.ComputeMetadata.V1.Instance.Zone,
+			"/computeMetadata/v1/instance/region": want,
+		} {
+			req, err := http.NewRequest(http.MethodGet, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			rr := httptest.NewRecorder()
+			h.handler().ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK || rr.Body.String() != want {
+				t.Errorf("%s returned unexpected response: got %v %q want %q", path, rr.Code, rr.Body.String(), want)
+			}
+		}
+	}
+
+	for _, instance := range []Instance{
+		{Zone: "us-central1-a"},
+		{Zone: "projects/some-project-id/zones/us-central1-a"},
+		{Region: "us-central1"},
+		{Zone: "projects/123456/zones/us-central1-a", Region: "projects/123456/regions/europe-west4"},
+	} {
+		invalid := projectClaims("some-project-id")
+		invalid.ComputeMetadata.V1.Instance.Zone = instance.Zone
+		invalid.ComputeMetadata.V1.Instance.Region = instance.Region
+		if _, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, invalid, WithLogger(&recordingLogger{})); err == nil {
+			t.Errorf("expected error creating emulator with zone %q and region %q", instance.Zone, instance.Region)
+		}
+	}
+}
+
+func TestProjectAttributesHandler(t *testing.T) {
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	claims := projectClaims("some-project-id")
+	claims.ComputeMetadata.V1.Project.Attributes = map[string]string{
+		"ssh-keys":       "user:ssh-rsa AAAA user",
+		"enable-oslogin": "TRUE",
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{Port: fmt.Sprintf(":%d", p), SkipPrefetch: true}, &google.Credentials{}, claims)
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err != nil {
+		t.Errorf("error starting emulator %v", err)
+	}
+	defer h.Shutdown()
+
+	t.Setenv("GCE_METADATA_HOST", fmt.Sprintf("127.0.0.1:%d", p))
+
+	// the client library parses the newline separated directory listing
+	attrs, err := metadata.ProjectAttributes()
+	if err != nil {
+		t.Fatalf("error listing project attributes %v", err)
+	}
+	if len(attrs) != 2 || attrs[0] != "enable-oslogin" || attrs[1] != "ssh-keys" {
+		t.Errorf("unexpected project attributes: got %v", attrs)
+	}
+	val, err := metadata.ProjectAttributeValue("ssh-keys")
+	if err != nil {
+		t.Fatalf("error getting project attribute %v", err)
+	}
+	if val != "user:ssh-rsa AAAA user" {
+		t.Errorf("unexpected project attribute value: got %v", val)
+	}
+	_, err = metadata.ProjectAttributeValue("missing")
+	var notDefined metadata.NotDefinedError
+	if !errors.As(err, &notDefined) {
+		t.Errorf("expected NotDefinedError for missing attribute, got %v", err)
+	}
+
+	_, body, err := getMetadata(fmt.Sprintf("http://127.0.0.1:%d/computeMetadata/v1/project/?recursive=true", p))
+	if err != nil {
+		t.Fatalf("error getting project %v", err)
+	}
+	project := &Project{}
+	err = json.Unmarshal([]byte(body), project)
+	if err != nil {
+		t.Fatalf("error decoding project %v", err)
+	}
+	if project.ProjectID != "some-project-id" || project.Attributes["enable-oslogin"] != "TRUE" {
+		t.Errorf("recursive project response missing attributes: got %+v", project)
+	}
+}
+
+func TestProjectNumberPlainText(t *testing.T) {
+	claims, err := NewClaimsBuilder().
+		ProjectID("some-project-id").
+		NumericProjectID(123456789012).
+		DefaultServiceAccount("metadata-sa@some-project-id.iam.gserviceaccount.com").
+		Build()
+	if err != nil {
+		t.Fatalf("error building claims %v", err)
+	}
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{Port: fmt.Sprintf(":%d", p), SkipPrefetch: true}, &google.Credentials{}, claims)
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err != nil {
+		t.Errorf("error starting emulator %v", err)
+	}
+	defer h.Shutdown()
+
+	resp, body, err := getMetadata(fmt.Sprintf("http://127.0.0.1:%d/computeMetadata/v1/project/numeric-project-id", p))
+	if err != nil {
+		t.Fatalf("error getting numeric-project-id %v", err)
+	}
+	if body != "123456789012" {
+		t.Errorf("handler returned unexpected body: got %q want %q", body, "123456789012")
+	}
+	if resp.Header.Get("Content-Type") != "application/text" {
+		t.Errorf("handler returned unexpected content type: got %v", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestNetworkInterfacesHandler(t *testing.T) {
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	claims := projectClaims("some-project-id")
+	claims.ComputeMetadata.V1.Instance.NetworkInterfaces = []NetworkInterface{
+		{
+			AccessConfigs: []AccessConfig{
+				{ExternalIP: "34.1.2.3", Type: "ONE_TO_ONE_NAT"},
+			},
+			DNSServers:   []string{"169.254.169.254"},
+			ForwardedIps: []string{"10.128.0.100", "10.128.0.101"},
+			Gateway:      "10.128.0.1",
+			IP:           "10.128.0.2",
+			Mac:          "42:01:0a:80:00:02",
+			Mtu:          1460,
+			Network:      "projects/123456/networks/default",
+			Subnetmask:   "255.255.240.0",
+		},
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{Port: fmt.Sprintf(":%d", p), SkipPrefetch: true}, &google.Credentials{}, claims)
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err != nil {
+		t.Errorf("error starting emulator %v", err)
+	}
+	defer h.Shutdown()
+
+	t.Setenv("GCE_METADATA_HOST", fmt.Sprintf("127.0.0.1:%d", p))
+
+	internalIP, err := metadata.InternalIP()
+	if err != nil || internalIP != "10.128.0.2" {
+		t.Errorf("unexpected internal ip: got %v %v", internalIP, err)
+	}
+	externalIP, err := metadata.ExternalIP()
+	if err != nil || externalIP != "34.1.2.3" {
+		t.Errorf("unexpected external ip: got %v %v", externalIP, err)
+	}
+
+	base := fmt.Sprintf("http://127.0.0.1:%d/computeMetadata/v1/instance/network-interfaces/", p)
+	for path, want := range map[string]string{
+		"":                                      "0/\n",
+		"0/mac":                                 "42:01:0a:80:00:02",
+		"0/subnetmask":                          "255.255.240.0",
+		"0/mtu":                                 "1460",
+		"0/access-configs/":                     "0/\n",
+		"0/access-configs/0/type":               "ONE_TO_ONE_NAT",
+		"0/forwarded-ips/":                      "0\n1\n",
+		"0/forwarded-ips/1":                     "10.128.0.101",
+		"0/ip-aliases/":                         "",
+		"0/forwarded-ips/?recursive=true":       `["10.128.0.100","10.128.0.101"]`,
+		"0/access-configs/?recursive=true":      `[{"externalIp":"34.1.2.3","type":"ONE_TO_ONE_NAT"}]`,
+		"0/access-configs/0/?recursive=true":    `{"externalIp":"34.1.2.3","type":"ONE_TO_ONE_NAT"}`,
+		"0/target-instance-ips/?recursive=true": `[]`,
+	} {
+		resp, body, err := getMetadata(base + path)
+		if err != nil {
+			t.Fatalf("error getting %s %v", path, err)
+		}
+		if resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("unexpected response for %s: got %v %q want %q", path, resp.StatusCode, body, want)
+		}
+	}
+
+	_, body, err := getMetadata(base + "?recursive=true")
+	if err != nil {
+		t.Fatalf("error getting network interfaces %v", err)
+	}
+	var nis []NetworkInterface
+	err = json.Unmarshal([]byte(body), &nis)
+	if err != nil {
+		t.Fatalf("error decoding network interfaces %v", err)
+	}
+	if len(nis) != 1 || nis[0].IP != "10.128.0.2" || nis[0].AccessConfigs[0].ExternalIP != "34.1.2.3" {
+		t.Errorf("unexpected recursive network interfaces: got %+v", nis)
+	}
+
+	for _, path := range []string{"1/ip", "-1/ip", "0/access-configs/1/external-ip", "0/forwarded-ips/2", "0/unknown"} {
+		resp, _, err := getMetadata(base + path)
+		if err != nil {
+			t.Fatalf("error getting %s %v", path, err)
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("unexpected status code for %s: got %v want %v", path, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+}
+
+func TestDisksHandler(t *testing.T) {
+	claims := projectClaims("some-project-id")
+	claims.ComputeMetadata.V1.Instance.Disks = []DiskMetadata{
+		{DeviceName: "instance-1", Index: 0, Interface: "SCSI", Mode: "READ_WRITE", Type: "PERSISTENT-BALANCED"},
+		{DeviceName: "disk-1", Index: 1, Interface: "NVME", Mode: "READ_ONLY", Type: "PERSISTENT"},
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims)
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/disks/"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for path, want := range map[string]string{
+		"":              "0/\n1/\n",
+		"0/device-name": "instance-1",
+		"1/device-name": "disk-1",
+		"1/index":       "1",
+		"1/interface":   "NVME",
+		"1/mode":        "READ_ONLY",
+		"1/type":        "PERSISTENT",
+		"0/":            "device-name\nindex\ninterface\nmode\ntype\n",
+	} {
+		rr := get(path)
+		if rr.Code != http.StatusOK || rr.Body.String() != want {
+			t.Errorf("unexpected response for %s: got %v %q want %q", path, rr.Code, rr.Body.String(), want)
+		}
+	}
+
+	rr := get("?recursive=true")
+	if rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("handler returned unexpected content type: got %v", rr.Header().Get("Content-Type"))
+	}
+	want := `[{"deviceName":"instance-1","index":0,"interface":"SCSI","mode":"READ_WRITE","type":"PERSISTENT-BALANCED"},{"deviceName":"disk-1","index":1,"interface":"NVME","mode":"READ_ONLY","type":"PERSISTENT"}]`
+	if rr.Body.String() != want {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), want)
+	}
+
+	for _, path := range []string{"2/", "2/device-name", "-1/mode", "0/source"} {
+		if rr := get(path); rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code for %s: got %v want %v", path, rr.Code, http.StatusNotFound)
+		}
+	}
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1 like the one used by httptest.NewTLSServer
+func selfSignedCert(t *testing.T) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"Acme Co"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:              []string{"metadata.google.internal"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+func TestNamedServiceAccounts(t *testing.T) {
+	staticCreds := func(token string) *google.Credentials {
+		return &google.Credentials{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token, Expiry: time.Now().Add(time.Hour)})}
+	}
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["app"] = serviceAccountDetails{Email: "app@some-project.iam.gserviceaccount.com", Scopes: []string{cloudPlatformScope}}
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["unused"] = serviceAccountDetails{Email: "unused@some-project.iam.gserviceaccount.com"}
+	sc := &ServerConfig{
+		NamedCredentials: map[string]*google.Credentials{
+			"default": staticCreds("default-token"),
+			"app":     staticCreds("app-token"),
+		},
+	}
+	h, err := NewMetadataServer(context.Background(), sc, nil, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/computeMetadata/v1/instance/service-accounts/default/token", http.StatusOK, "default-token"},
+		{"/computeMetadata/v1/instance/service-accounts/app/token", http.StatusOK, "app-token"},
+		{"/computeMetadata/v1/instance/service-accounts/app@some-project.iam.gserviceaccount.com/token", http.StatusOK, "app-token"},
+		{"/computeMetadata/v1/instance/service-accounts/app/email", http.StatusOK, "app@some-project.iam.gserviceaccount.com"},
+		{"/computeMetadata/v1/instance/service-accounts/app/aliases", http.StatusOK, "app"},
+		{"/computeMetadata/v1/instance/service-accounts/app/scopes", http.StatusOK, cloudPlatformScope},
+		{"/computeMetadata/v1/instance/service-accounts/unused/token", http.StatusInternalServerError, ""},
+		{"/computeMetadata/v1/instance/service-accounts/missing/token", http.StatusNotFound, ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		h.handler().ServeHTTP(rr, req)
+
+		if rr.Code != tc.code {
+			t.Errorf("%s returned wrong status code: got %v want %v", tc.path, rr.Code, tc.code)
+			continue
+		}
+		if tc.body != "" && !strings.Contains(rr.Body.String(), tc.body) {
+			t.Errorf("%s returned unexpected body: got %v want %v", tc.path, rr.Body.String(), tc.body)
+		}
+	}
+}
+
+func TestServiceAccountsIndexHandler(t *testing.T) {
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["app"] = serviceAccountDetails{Email: "app@some-project.iam.gserviceaccount.com"}
+	sc := &ServerConfig{
+		NamedCredentials: map[string]*google.Credentials{
+			"default": {},
+			"app":     {},
+		},
+	}
+	h, err := NewMetadataServer(context.Background(), sc, nil, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for path, want := range map[string]string{
+		"/computeMetadata/v1/instance/service-accounts/":                                          "default/\napp/\napp@some-project.iam.gserviceaccount.com/\nmetadata-sa@some-project.iam.gserviceaccount.com/\n",
+		"/computeMetadata/v1/instance/service-accounts/app@some-project.iam.gserviceaccount.com/": "aliases/\nemail\nidentity\nscopes/\ntoken\n",
+	} {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		h.handler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != want {
+			t.Errorf("%s returned unexpected response: got %v %q want %q", path, rr.Code, rr.Body.String(), want)
+		}
+	}
+}
+
+func TestNamedCredentialsValidation(t *testing.T) {
+	creds := &google.Credentials{}
+	for _, sc := range []*ServerConfig{
+		{NamedCredentials: map[string]*google.Credentials{"app": creds}},
+		{NamedCredentials: map[string]*google.Credentials{"default": creds, "missing": creds}},
+		{NamedCredentials: map[string]*google.Credentials{"default": creds, "app": nil}},
+	} {
+		if _, err := NewMetadataServer(context.Background(), sc, nil, projectClaims("some-project")); err == nil {
+			t.Errorf("expected error for NamedCredentials %v", sc.NamedCredentials)
+		}
+	}
+	sc := &ServerConfig{NamedCredentials: map[string]*google.Credentials{"default": creds}}
+	if _, err := NewMetadataServer(context.Background(), sc, creds, projectClaims("some-project")); err == nil {
+		t.Errorf("expected error passing credentials together with NamedCredentials")
+	}
+}
+
+func TestCredentialSourcesValidation(t *testing.T) {
+	creds := &google.Credentials{TokenSource: testTokenSource{}}
+	for _, tc := range []struct {
+		sc    *ServerConfig
+		creds *google.Credentials
+		opts  []Option
+	}{
+		{&ServerConfig{TokenFilePath: "token", KubernetesSATokenFile: "sa-token"}, nil, nil},
+		{&ServerConfig{CredentialCommand: []string{"helper"}}, creds, nil},
+		{&ServerConfig{PKCS11LibPath: "libsofthsm2.so", FederationConfig: &FederationConfig{}}, nil, nil},
+		{&ServerConfig{NamedCredentials: map[string]*google.Credentials{"default": creds}, TokenFilePath: "token"}, nil, nil},
+		{&ServerConfig{TokenFilePath: "token"}, nil, []Option{WithVaultCredentials(VaultConfig{})}},
+	} {
+		_, err := NewMetadataServer(context.Background(), tc.sc, tc.creds, projectClaims("some-project"), tc.opts...)
+		if err == nil || !strings.Contains(err.Error(), "only one source of credentials") {
+			t.Errorf("expected error for more than one source of credentials: got %v", err)
+		}
+	}
+}
+
+func TestTokenTTL(t *testing.T) {
+	var mu sync.Mutex
+	refreshes := map[string]int{}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{
+		TokenTTL: 5 * time.Second,
+		OnTokenRefresh: func(account string) {
+			mu.Lock()
+			defer mu.Unlock()
+			refreshes[account]++
+		},
+	}, &google.Credentials{
+		TokenSource: oauth2.ReuseTokenSource(nil, testTokenSource{}),
+	}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		h.handler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		tok := &metadataToken{}
+		if err := json.Unmarshal(rr.Body.Bytes(), tok); err != nil {
+			t.Fatalf("error parsing token %v", err)
+		}
+		if tok.ExpiresIn != 5 {
+			t.Errorf("expires_in was not clamped to TokenTTL: got %d want %d", tok.ExpiresIn, 5)
+		}
+	}
+
+	// the token is cached for TokenTTL
+	mu.Lock()
+	defer mu.Unlock()
+	if refreshes["default"] != 1 || len(refreshes) != 1 {
+		t.Errorf("unexpected token refreshes: got %v want map[default:1]", refreshes)
+	}
+}
+
+func TestTokenTTLLongerThanExpiry(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{TokenTTL: 2 * time.Hour}, &google.Credentials{
+		TokenSource: testTokenSource{},
+	}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	tok, err := h.getAccessToken(context.Background(), defaultServiceAccount, nil)
+	if err != nil {
+		t.Fatalf("error getting token %v", err)
+	}
+	if tok.ExpiresIn > 3600 || tok.ExpiresIn < 3590 {
+		t.Errorf("expires_in exceeds the token expiry: got %d", tok.ExpiresIn)
+	}
+}
+
+func TestInstanceTagsHandler(t *testing.T) {
+	get := func(h *MetadataServer, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		h.handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	empty, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.Tags = []string{"http-server", "https-server"}
+	tagged, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for _, tc := range []struct {
+		h    *MetadataServer
+		path string
+		code int
+		want string
+	}{
+		{empty, "/computeMetadata/v1/instance/tags", http.StatusOK, "[]"},
+		{tagged, "/computeMetadata/v1/instance/tags", http.StatusOK, `["http-server","https-server"]`},
+		{tagged, "/computeMetadata/v1/instance/tags/0", http.StatusNotFound, ""},
+	} {
+		rr := get(tc.h, tc.path)
+		if rr.Code != tc.code {
+			t.Errorf("%s returned wrong status code: got %v want %v", tc.path, rr.Code, tc.code)
+			continue
+		}
+		if tc.want != "" {
+			if rr.Body.String() != tc.want {
+				t.Errorf("%s returned unexpected body: got %v want %v", tc.path, rr.Body.String(), tc.want)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("%s returned unexpected content type: got %v want %v", tc.path, ct, "application/json")
+			}
+		}
+	}
+
+	for _, path := range []string{"/computeMetadata/v1/instance/?recursive=true", "/computeMetadata/v1/?recursive=true"} {
+		rr := get(empty, path)
+		if !strings.Contains(rr.Body.String(), `"tags":[]`) {
+			t.Errorf("%s did not return empty tags: %s", path, rr.Body.String())
+		}
+		rr = get(tagged, path)
+		if !strings.Contains(rr.Body.String(), `"tags":["http-server","https-server"]`) {
+			t.Errorf("%s did not return the tags: %s", path, rr.Body.String())
+		}
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	cert, certPEM, keyPEM := selfSignedCert(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	sum := sha256.Sum256(cert.Certificate[0])
+	wantFingerprint := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	for name, sc := range map[string]*ServerConfig{
+		"files":     {TLSCertFile: certFile, TLSKeyFile: keyFile},
+		"TLSConfig": {TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}},
+	} {
+		p, err := getFreePort()
+		if err != nil {
+			t.Fatalf("error getting emulator port %v", err)
+		}
+		sc.Port = fmt.Sprintf(":%d", p)
+		sc.SkipPrefetch = true
+
+		h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("some-project"))
+		if err != nil {
+			t.Fatalf("%s: error creating emulator %v", name, err)
+		}
+		if fp := h.TLSFingerprint(); strings.ReplaceAll(fp, ":", "") != wantFingerprint || strings.Count(fp, ":") != 31 {
+			t.Errorf("%s: unexpected fingerprint %s", name, fp)
+		}
+		if err := h.Start(); err != nil {
+			t.Fatalf("%s: error starting emulator %v", name, err)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://127.0.0.1:%d/computeMetadata/v1/project/project-id", p), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: error calling TLS listener %v", name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: TLS listener returned wrong status code: got %v want %v", name, resp.StatusCode, http.StatusOK)
+		}
+		if resp.TLS == nil {
+			t.Errorf("%s: response was not served over TLS", name)
+		}
+		h.Shutdown()
+	}
+
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project"))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	if fp := h.TLSFingerprint(); fp != "" {
+		t.Errorf("unexpected fingerprint without TLS: %s", fp)
+	}
+	for _, sc := range []*ServerConfig{
+		{TLSCertFile: certFile},
+		{TLSCertFile: keyFile, TLSKeyFile: certFile},
+	} {
+		if _, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("some-project")); err == nil {
+			t.Errorf("expected error for TLS config %+v", sc)
+		}
+	}
+}
+
+func TestImpersonateDelegates(t *testing.T) {
+	delegates := []string{"delegate-1@some-project-id.iam.gserviceaccount.com", "delegate-2@some-project-id.iam.gserviceaccount.com"}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{Impersonate: true, ImpersonateDelegates: delegates}, &google.Credentials{}, projectClaims("some-project-id"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	cc := h.impersonateCredentialsConfig([]string{cloudPlatformScope})
+	if cc.TargetPrincipal != "metadata-sa@some-project-id.iam.gserviceaccount.com" || !reflect.DeepEqual(cc.Delegates, delegates) {
+		t.Errorf("unexpected impersonation config: got %+v", cc)
+	}
+	ic := h.impersonateIDTokenConfig("https://foo.bar", idTokenFormatFull)
+	if ic.TargetPrincipal != "metadata-sa@some-project-id.iam.gserviceaccount.com" || ic.Audience != "https://foo.bar" || !reflect.DeepEqual(ic.Delegates, delegates) {
+		t.Errorf("unexpected id_token impersonation config: got %+v", ic)
+	}
+
+	if _, err := NewMetadataServer(context.Background(), &ServerConfig{ImpersonateDelegates: delegates}, &google.Credentials{}, projectClaims("some-project-id")); err == nil {
+		t.Errorf("expected error for ImpersonateDelegates without Impersonate")
+	}
+}
+
+func TestStartPrefetch(t *testing.T) {
+	for name, creds := range map[string]*google.Credentials{
+		"no token source":    {},
+		"error token source": {TokenSource: errorTokenSource{}},
+	} {
+		sc := &ServerConfig{Listeners: []ListenerSpec{{Network: "tcp", Address: "127.0.0.1:0"}}}
+		h, err := NewMetadataServer(context.Background(), sc, creds, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+		if err != nil {
+			t.Fatalf("%s: error creating emulator %v", name, err)
+		}
+		if err := h.Start(); err == nil {
+			h.Shutdown()
+			t.Errorf("%s: expected error starting emulator", name)
+		}
+
+		sc.SkipPrefetch = true
+		h, err = NewMetadataServer(context.Background(), sc, creds, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+		if err != nil {
+			t.Fatalf("%s: error creating emulator %v", name, err)
+		}
+		if err := h.Start(); err != nil {
+			t.Errorf("%s: error starting emulator with SkipPrefetch %v", name, err)
+		}
+		h.Shutdown()
+	}
+
+	creds := &google.Credentials{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)})}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{Listeners: []ListenerSpec{{Network: "tcp", Address: "127.0.0.1:0"}}}, creds, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatalf("error starting emulator %v", err)
+	}
+	defer h.Shutdown()
+	if !h.ready.Load() {
+		t.Errorf("emulator is not ready after prefetching a token")
+	}
+}
+
+func TestServiceAccountEmailDuringUpdateClaims(t *testing.T) {
+	before, after := projectClaims("before-project"), projectClaims("after-project")
+	emails := map[string]bool{
+		before.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Email: true,
+		after.ComputeMetadata.V1.Instance.ServiceAccounts["default"].Email:  true,
+	}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, before, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			c := before
+			if i%2 == 0 {
+				c = after
+			}
+			if err := h.UpdateClaims(c); err != nil {
+				t.Errorf("error updating claims %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/email", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || !emails[rr.Body.String()] {
+			t.Errorf("handler returned unexpected response: got %v %q", rr.Code, rr.Body.String())
+		}
+		if rr.Header().Get("Content-Type") != "application/text" {
+			t.Errorf("handler returned unexpected content type: got %v", rr.Header().Get("Content-Type"))
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestServiceAccountScopesHandler(t *testing.T) {
+	claims := projectClaims("some-project")
+	sa := claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"]
+	sa.Scopes = []string{cloudPlatformScope, emailScope}
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = sa
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/computeMetadata/v1/instance/service-accounts/default/scopes")
+	if want := cloudPlatformScope + "\n" + emailScope; rr.Code != http.StatusOK || rr.Body.String() != want {
+		t.Errorf("handler returned unexpected response: got %v %q want %q", rr.Code, rr.Body.String(), want)
+	}
+	if rr.Header().Get("Content-Type") != "application/text" {
+		t.Errorf("handler returned unexpected content type: got %v", rr.Header().Get("Content-Type"))
+	}
+
+	recursive := &serviceAccountDetails{}
+	if err := json.Unmarshal(get("/computeMetadata/v1/instance/service-accounts/default/?recursive=true").Body.Bytes(), recursive); err != nil {
+		t.Fatalf("error decoding service account %v", err)
+	}
+	if !reflect.DeepEqual(recursive.Scopes, sa.Scopes) {
+		t.Errorf("unexpected recursive scopes: got %v want %v", recursive.Scopes, sa.Scopes)
+	}
+
+	// updated scopes are served right away
+	updated := projectClaims("some-project")
+	sa.Scopes = []string{emailScope}
+	updated.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = sa
+	if err := h.UpdateClaims(updated); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	if rr := get("/computeMetadata/v1/instance/service-accounts/default/scopes"); rr.Body.String() != emailScope {
+		t.Errorf("handler returned unexpected scopes after UpdateClaims: got %q want %q", rr.Body.String(), emailScope)
+	}
+
+	if err := h.UpdateClaims(projectClaims("some-project")); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	if rr := get("/computeMetadata/v1/instance/service-accounts/default/?recursive=true"); !strings.Contains(rr.Body.String(), `"scopes":[]`) {
+		t.Errorf("handler returned unexpected body for a service account without scopes: got %s", rr.Body.String())
+	}
+}
+
+func TestEnforceMetadataFlavor(t *testing.T) {
+	enforce, permissive := true, false
+	for _, tc := range []struct {
+		name           string
+		enforce        *bool
+		expectedStatus int
+	}{
+		{"default", nil, http.StatusForbidden},
+		{"strict", &enforce, http.StatusForbidden},
+		{"permissive", &permissive, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := NewMetadataServer(context.Background(), &ServerConfig{EnforceMetadataFlavor: tc.enforce}, &google.Credentials{}, projectClaims("some-project-id"), WithLogger(&recordingLogger{}))
+			if err != nil {
+				t.Fatalf("error creating emulator %v", err)
+			}
+			req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/project/project-id", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			h.handler().ServeHTTP(rr, req)
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if tc.expectedStatus == http.StatusOK {
+				if rr.Body.String() != "some-project-id" {
+					t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), "some-project-id")
+				}
+				return
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "text/html; charset=UTF-8" {
+				t.Errorf("unexpected content type: got %v", ct)
+			}
+			for _, want := range []string{"<title>Error 403 (Forbidden)!!1</title>", "get URL <code>/computeMetadata/v1/project/project-id</code> from this server. Missing Metadata-Flavor:Google header."} {
+				if !strings.Contains(rr.Body.String(), want) {
+					t.Errorf("expected body to contain %q: got %v", want, rr.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestVirtualClockDriftToken(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	url := s.URL() + "/computeMetadata/v1/instance/virtual-clock/drift-token"
+
+	resp, _, err := getMetadata(url)
+	if err != nil {
+		t.Fatalf("error getting drift-token %v", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status code without a drift token: got %v want %v", resp.StatusCode, http.StatusNotFound)
+	}
+	if _, body, _ := getMetadata(s.URL() + "/computeMetadata/v1/instance/virtual-clock/"); body != "" {
+		t.Errorf("unexpected virtual-clock listing without a drift token: %q", body)
+	}
+
+	s.SetVirtualClockDriftToken("3141592653")
+	resp, body, err := getMetadata(url)
+	if err != nil {
+		t.Fatalf("error getting drift-token %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || body != "3141592653" {
+		t.Errorf("unexpected response: got %v %q want %v %q", resp.StatusCode, body, http.StatusOK, "3141592653")
+	}
+	if _, body, _ := getMetadata(s.URL() + "/computeMetadata/v1/instance/virtual-clock/"); body != "drift-token\n" {
+		t.Errorf("unexpected virtual-clock listing: got %q want %q", body, "drift-token\n")
+	}
+	if resp, _, _ := getMetadata(s.URL() + "/computeMetadata/v1/instance/virtual-clock/other"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status code for an unknown key: got %v want %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestMaintenanceEvent(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	url := s.URL() + "/computeMetadata/v1/instance/maintenance-event"
+
+	resp, body, err := getMetadata(url)
+	if err != nil {
+		t.Fatalf("error getting maintenance-event %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || body != "NONE" {
+		t.Fatalf("unexpected default maintenance event: got %v %q", resp.StatusCode, body)
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, body, err := getMetadata(url + "?wait_for_change=true&last_etag=" + resp.Header.Get("ETag"))
+		done <- result{body, err}
+	}()
+	select {
+	case <-done:
+		t.Fatalf("wait_for_change returned before the maintenance event changed")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := s.SetMaintenanceEvent("MIGRATE_ON_HOST_MAINTENANCE"); err != nil {
+		t.Fatalf("error setting the maintenance event %v", err)
+	}
+	select {
+	case res := <-done:
+		if res.err != nil || res.body != "MIGRATE_ON_HOST_MAINTENANCE" {
+			t.Errorf("unexpected response after the change: got %q %v", res.body, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("wait_for_change did not return after the maintenance event changed")
+	}
+
+	if err := s.SetMaintenanceEvent("MIGRATE"); err == nil {
+		t.Errorf("expected error for an unknown maintenance event")
+	}
+	if _, body, _ := getMetadata(url); body != "MIGRATE_ON_HOST_MAINTENANCE" {
+		t.Errorf("invalid maintenance event was applied: got %q", body)
+	}
+}
+
+func TestServiceAccountAliases(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	email := "metadata-sa@some-project.iam.gserviceaccount.com"
+
+	for _, account := range []string{"default", email} {
+		resp, body, err := getMetadata(s.URL() + "/computeMetadata/v1/instance/service-accounts/" + account + "/aliases")
+		if err != nil {
+			t.Fatalf("error getting aliases %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: unexpected status code: got %v want %v", account, resp.StatusCode, http.StatusOK)
+		}
+		if strings.HasSuffix(body, "\n") {
+			t.Errorf("%s: aliases end with a newline: %q", account, body)
+		}
+		if aliases := strings.Split(body, "\n"); len(aliases) != 2 || aliases[0] != "default" || aliases[1] != email {
+			t.Errorf("%s: unexpected aliases: got %q want %q", account, aliases, []string{"default", email})
+		}
+	}
+}
+
+func TestRecursiveV1(t *testing.T) {
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.Disks = []DiskMetadata{{DeviceName: "persistent-disk-0", Index: 0}}
+	claims.ComputeMetadata.V1.Instance.NetworkInterfaces = []NetworkInterface{{IP: "10.128.0.2", AccessConfigs: []AccessConfig{{ExternalIP: "203.0.113.1", Type: "ONE_TO_ONE_NAT"}}}}
+	claims.ComputeMetadata.V1.Instance.GuestAttributes = map[string]map[string]string{"testing": {"key": "value"}}
+	s := NewTestMetadataServer(t, claims, WithLogger(&recordingLogger{}))
+
+	resp, body, err := getMetadata(s.URL() + "/computeMetadata/v1/?recursive=true")
+	if err != nil {
+		t.Fatalf("error getting the metadata tree %v", err)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected Content-Type: got %v", resp.Header.Get("Content-Type"))
+	}
+	tree := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(body), &tree); err != nil {
+		t.Fatalf("error decoding the metadata tree %v: %s", err, body)
+	}
+
+	// get follows a path of object keys and array indexes through the decoded tree
+	get := func(path ...interface{}) interface{} {
+		var v interface{} = tree
+		for _, p := range path {
+			switch k := p.(type) {
+			case string:
+				m, ok := v.(map[string]interface{})
+				if !ok {
+					t.Fatalf("%v: %v is not an object", path, v)
+				}
+				if v, ok = m[k]; !ok {
+					t.Fatalf("%v: %q is missing", path, k)
+				}
+			case int:
+				a, ok := v.([]interface{})
+				if !ok || k >= len(a) {
+					t.Fatalf("%v: %v is not an array with index %d", path, v, k)
+				}
+				v = a[k]
+			}
+		}
+		return v
+	}
+
+	for _, path := range [][]interface{}{
+		{"instance", "attributes"},
+		{"instance", "labels"},
+		{"instance", "guestAttributes", "testing"},
+		{"instance", "scheduling"},
+		{"instance", "virtualClock"},
+		{"instance", "serviceAccounts", "default"},
+		{"instance", "serviceAccounts", "metadata-sa@some-project.iam.gserviceaccount.com"},
+		{"oslogin", "authenticate"},
+		{"project", "attributes"},
+	} {
+		if _, ok := get(path...).(map[string]interface{}); !ok {
+			t.Errorf("%v is not an object", path)
+		}
+	}
+	for _, path := range [][]interface{}{
+		{"instance", "disks"},
+		{"instance", "licenses"},
+		{"instance", "tags"},
+		{"instance", "networkInterfaces"},
+		{"instance", "networkInterfaces", 0, "accessConfigs"},
+		{"instance", "networkInterfaces", 0, "dnsServers"},
+		{"instance", "networkInterfaces", 0, "forwardedIps"},
+		{"instance", "serviceAccounts", "default", "aliases"},
+		{"instance", "serviceAccounts", "default", "scopes"},
+	} {
+		if _, ok := get(path...).([]interface{}); !ok {
+			t.Errorf("%v is not an array", path)
+		}
+	}
+	for want, path := range map[string][]interface{}{
+		"some-project":      {"project", "projectId"},
+		"persistent-disk-0": {"instance", "disks", 0, "deviceName"},
+		"203.0.113.1":       {"instance", "networkInterfaces", 0, "accessConfigs", 0, "externalIp"},
+		"value":             {"instance", "guestAttributes", "testing", "key"},
+		"default":           {"instance", "serviceAccounts", "default", "aliases", 0},
+		"metadata-sa@some-project.iam.gserviceaccount.com": {"instance", "serviceAccounts", "default", "aliases", 1},
+	} {
+		if got := get(path...); got != want {
+			t.Errorf("%v: got %v want %v", path, got, want)
+		}
+	}
+	if _, ok := get("instance", "serviceAccounts", "default").(map[string]interface{})["token"]; ok {
+		t.Errorf("service accounts must not include a token")
+	}
+}
+
+func TestExportConfig(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	claims := projectClaims("other-project")
+	claims.ComputeMetadata.V1.Instance.Attributes = map[string]string{"enable-oslogin": "TRUE"}
+	if err := s.UpdateClaims(claims); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	if err := s.SetPreempted(true); err != nil {
+		t.Fatalf("error setting preempted %v", err)
+	}
+	if err := s.SetMaintenanceEvent("TERMINATE_ON_HOST_MAINTENANCE"); err != nil {
+		t.Fatalf("error setting the maintenance event %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPut, s.URL()+"/computeMetadata/v1/instance/guest-attributes/osconfig/state", strings.NewReader("running"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("error writing guest attribute %v %v", resp, err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportConfig(&buf); err != nil {
+		t.Fatalf("error exporting config %v", err)
+	}
+	exported, err := ClaimsFromReader(&buf, ConfigFormatJSON)
+	if err != nil {
+		t.Fatalf("error parsing exported config %v", err)
+	}
+	restored := NewTestMetadataServer(t, exported, WithLogger(&recordingLogger{}))
+
+	for _, path := range []string{
+		"/computeMetadata/v1/?recursive=true",
+		"/computeMetadata/v1/project/project-id",
+		"/computeMetadata/v1/instance/attributes/enable-oslogin",
+		"/computeMetadata/v1/instance/preempted",
+		"/computeMetadata/v1/instance/maintenance-event",
+		"/computeMetadata/v1/instance/guest-attributes/osconfig/state",
+	} {
+		want, wantBody, err := getMetadata(s.URL() + path)
+		if err != nil {
+			t.Fatalf("error getting %s %v", path, err)
+		}
+		got, gotBody, err := getMetadata(restored.URL() + path)
+		if err != nil {
+			t.Fatalf("error getting %s from the restored server %v", path, err)
+		}
+		if got.StatusCode != want.StatusCode || gotBody != wantBody || got.Header.Get("ETag") != want.Header.Get("ETag") {
+			t.Errorf("%s: restored server returned %v %q want %v %q", path, got.StatusCode, gotBody, want.StatusCode, wantBody)
+		}
+	}
+}
+
+func TestInstanceDescription(t *testing.T) {
+	claims := projectClaims("some-project")
+	s := NewTestMetadataServer(t, claims, WithLogger(&recordingLogger{}))
+	url := s.URL() + "/computeMetadata/v1/instance/description"
+
+	resp, body, err := getMetadata(url)
+	if err != nil {
+		t.Fatalf("error getting description %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || body != "" || resp.Header.Get("Content-Length") != "0" {
+		t.Errorf("unexpected response for an empty description: got %v Content-Length %q %q", resp.StatusCode, resp.Header.Get("Content-Length"), body)
+	}
+
+	claims = projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.Description = "cluster=blue role=worker"
+	if err := s.UpdateClaims(claims); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	if resp, body, err := getMetadata(url); err != nil || resp.StatusCode != http.StatusOK || body != "cluster=blue role=worker" {
+		t.Errorf("unexpected description: got %v %q", err, body)
+	}
+}
+
+func TestInstanceSpotVM(t *testing.T) {
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.SpotVM = true
+	s := NewTestMetadataServer(t, claims, WithLogger(&recordingLogger{}))
+
+	if _, body, err := getMetadata(s.URL() + "/computeMetadata/v1/instance/spot-vm"); err != nil || body != "TRUE" {
+		t.Errorf("unexpected spot-vm for a configured Spot VM: got %v %q", err, body)
+	}
+	_, body, err := getMetadata(s.URL() + "/computeMetadata/v1/instance/")
+	if err != nil {
+		t.Fatalf("error listing instance %v", err)
+	}
+	for _, want := range []string{"\nspot-vm\n", "\npreempted\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("instance directory does not list %q: got %q", strings.TrimSpace(want), body)
+		}
+	}
+
+	// a preempted instance is served as a Spot VM if the value was not set
+	claims = projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.Preempted = true
+	if err := s.UpdateClaims(claims); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	if _, body, err := getMetadata(s.URL() + "/computeMetadata/v1/instance/spot-vm"); err != nil || body != "TRUE" {
+		t.Errorf("unexpected spot-vm for a preempted instance: got %v %q", err, body)
+	}
+	if _, body, err := getMetadata(s.URL() + "/computeMetadata/v1/instance/?recursive=true"); err != nil || !strings.Contains(body, `"spotVm":true`) {
+		t.Errorf("recursive instance does not include spot-vm: got %v %q", err, body)
+	}
+}
+
+func TestInstanceConfidentialComputing(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	base := s.URL() + "/computeMetadata/v1/instance/confidential-computing/"
+
+	for _, path := range []string{"", "?recursive=true", "enabled", "technology"} {
+		if resp, _, err := getMetadata(base + path); err != nil || resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: unexpected response for a VM which is not confidential: got %v %v", path, resp.StatusCode, err)
+		}
+	}
+	if _, body, err := getMetadata(s.URL() + "/computeMetadata/v1/instance/"); err != nil || strings.Contains(body, "confidential-computing/") {
+		t.Errorf("instance directory lists confidential-computing for a VM which is not confidential: got %v %q", err, body)
+	}
+
+	report := base64.StdEncoding.EncodeToString([]byte("mock attestation report"))
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.ConfidentialComputing = ConfidentialComputingMetadata{Enabled: true, Technology: "AMD-SEV", AttestationReport: report}
+	if err := s.UpdateClaims(claims); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	for path, want := range map[string]string{
+		"":                   "enabled\ntechnology\nattestation-report\n",
+		"enabled":            "TRUE",
+		"technology":         "AMD-SEV",
+		"attestation-report": report,
+		"?recursive=true":    `{"enabled":true,"technology":"AMD-SEV","attestationReport":"` + report + `"}`,
+	} {
+		resp, body, err := getMetadata(base + path)
+		if err != nil || resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("%s: unexpected response: got %v %q want %q", path, err, body, want)
+		}
+	}
+	if _, body, err := getMetadata(s.URL() + "/computeMetadata/v1/instance/"); err != nil || !strings.Contains(body, "\nconfidential-computing/\n") {
+		t.Errorf("instance directory does not list confidential-computing: got %v %q", err, body)
+	}
+
+	claims.ComputeMetadata.V1.Instance.ConfidentialComputing.AttestationReport = "not base64!"
+	if err := s.UpdateClaims(claims); err == nil {
+		t.Errorf("expected error for an attestation report which is not base64 encoded")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	testAccessToken = "test-access-token"
+)
+
+// TestMetadataServer is a MetadataServer listening on a free port of 127.0.0.1 for use in unit tests
+type TestMetadataServer struct {
+	*MetadataServer
+}
+
+// testTokenSource issues a static access_token which is valid for an hour from the time it is requested
+type testTokenSource struct{}
+
+func (testTokenSource) Token() (*oauth2.Token, error) {
+	return &oauth2.Token{
+		AccessToken: testAccessToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(time.Hour),
+	}, nil
+}
+
+// NewTestMetadataServer starts a metadata server for claims on a free port of 127.0.0.1 which is shut down when the test ends.
+//
+// The server issues the access_token `test-access-token` and accepts any project id; pass options such as WithLogger
+// to customize it further.
+// The test fails immediately if the server cannot be started.
+func NewTestMetadataServer(t testing.TB, claims *Claims, opts ...Option) *TestMetadataServer {
+	t.Helper()
+
+	if claims == nil {
+		claims = &Claims{}
+	}
+	sc := &ServerConfig{
+		Listeners: []ListenerSpec{{Network: "tcp", Address: "127.0.0.1:0"}},
+
+		AllowArbitraryProjectID: true,
+	}
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{TokenSource: testTokenSource{}}, claims, opts...)
+	if err != nil {
+		t.Fatalf("error creating metadata server: %v", err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatalf("error starting metadata server: %v", err)
+	}
+	s := &TestMetadataServer{MetadataServer: h}
+	t.Cleanup(func() {
+		if err := s.Shutdown(); err != nil {
+			t.Errorf("error shutting down metadata server: %v", err)
+		}
+	})
+	return s
+}
+
+// Addr returns the host:port the server is listening on
+func (s *TestMetadataServer) Addr() string {
+	return s.listeners[0].Addr().String()
+}
+
+// URL returns the base URL of the server, eg `http://127.0.0.1:34567`
+func (s *TestMetadataServer) URL() string {
+	return "http://" + s.Addr()
+}
@@ -0,0 +1,46 @@
+package mds
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewTestMetadataServer(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+
+	if !strings.HasPrefix(s.Addr(), "127.0.0.1:") || strings.HasSuffix(s.Addr(), ":0") {
+		t.Errorf("unexpected address: %s", s.Addr())
+	}
+	if s.URL() != "http://"+s.Addr() {
+		t.Errorf("unexpected URL: got %s want %s", s.URL(), "http://"+s.Addr())
+	}
+
+	code, body := metadataRequest(t, s.URL()+"/computeMetadata/v1/project/project-id")
+	if code != http.StatusOK || body != "some-project" {
+		t.Errorf("unexpected response: got %d %q want %d %q", code, body, http.StatusOK, "some-project")
+	}
+
+	code, body = metadataRequest(t, s.URL()+"/computeMetadata/v1/instance/service-accounts/default/token")
+	if code != http.StatusOK {
+		t.Fatalf("token request returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+	tok := &metadataToken{}
+	if err := json.Unmarshal([]byte(body), tok); err != nil {
+		t.Fatalf("error parsing token %v", err)
+	}
+	if tok.AccessToken != testAccessToken || tok.ExpiresIn <= 0 {
+		t.Errorf("unexpected token: %+v", tok)
+	}
+}
+
+func TestNewTestMetadataServerCleanup(t *testing.T) {
+	var addr string
+	t.Run("server", func(t *testing.T) {
+		addr = NewTestMetadataServer(t, nil, WithLogger(&recordingLogger{})).URL()
+	})
+	if _, err := http.Get(addr + "/healthz"); err == nil {
+		t.Errorf("server at %s still running after the test finished", addr)
+	}
+}
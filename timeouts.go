@@ -0,0 +1,54 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultReadTimeout       = 10 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+)
+
+// timeoutOrDefault returns d, def if d is zero or no timeout if d is negative
+func timeoutOrDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// newHTTPServer returns a server for handler with the read and write timeouts of ServerConfig so slow clients
+// cannot hold connections open, eg by sending the request headers one byte at a time
+func (h *MetadataServer) newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: timeoutOrDefault(h.ServerConfig.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       timeoutOrDefault(h.ServerConfig.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:      timeoutOrDefault(h.ServerConfig.WriteTimeout, defaultWriteTimeout),
+	}
+}
+
+// clearWriteDeadline lifts the WriteTimeout of a request which is held open on purpose, eg by `?wait_for_change=true`
+func clearWriteDeadline(w http.ResponseWriter) {
+	// servers which do not support deadlines have no WriteTimeout to lift
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,83 @@
+package mds
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startWithTimeouts starts a metadata server on a free port with the timeouts of sc
+func startWithTimeouts(t *testing.T, sc *ServerConfig) *MetadataServer {
+	sc.Listeners = []ListenerSpec{{Network: "tcp", Address: "127.0.0.1:0"}}
+	sc.SkipPrefetch = true
+	h, err := NewMetadataServer(context.Background(), sc, staticCredentials("token"), projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatalf("error starting emulator %v", err)
+	}
+	t.Cleanup(func() { h.Shutdown() })
+	return h
+}
+
+func TestServerTimeouts(t *testing.T) {
+	h := startWithTimeouts(t, &ServerConfig{})
+	if h.srv.ReadHeaderTimeout != defaultReadHeaderTimeout || h.srv.ReadTimeout != defaultReadTimeout || h.srv.WriteTimeout != defaultWriteTimeout {
+		t.Errorf("unexpected default timeouts: got %v %v %v", h.srv.ReadHeaderTimeout, h.srv.ReadTimeout, h.srv.WriteTimeout)
+	}
+
+	h = startWithTimeouts(t, &ServerConfig{ReadHeaderTimeout: time.Second, ReadTimeout: 2 * time.Second, WriteTimeout: -1})
+	if h.srv.ReadHeaderTimeout != time.Second || h.srv.ReadTimeout != 2*time.Second || h.srv.WriteTimeout != 0 {
+		t.Errorf("unexpected timeouts: got %v %v %v", h.srv.ReadHeaderTimeout, h.srv.ReadTimeout, h.srv.WriteTimeout)
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	h := startWithTimeouts(t, &ServerConfig{ReadHeaderTimeout: 200 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", h.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET /computeMetadata/v1/project/project-id HTTP/1.1\r\nHost: metadata\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection was not closed by the server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("connection closed after %v", elapsed)
+	}
+}
+
+func TestWriteTimeoutWaitForChange(t *testing.T) {
+	h := startWithTimeouts(t, &ServerConfig{WriteTimeout: 200 * time.Millisecond})
+	url := fmt.Sprintf("http://%s/computeMetadata/v1/instance/preempted?wait_for_change=true&timeout_sec=1", h.listeners[0].Addr())
+
+	// the request is answered when timeout_sec elapses, after the write timeout
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error waiting for change %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "FALSE" {
+		t.Errorf("unexpected response: got %v %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	tokenCacheExpiryDelta = 30 * time.Second
+)
+
+// tokenCache holds the access_tokens returned to clients keyed by service account alias and scopes so concurrent
+// and repeated requests do not each call the credential source.  Concurrent misses for one key share one call.
+type tokenCache struct {
+	mu      sync.Mutex
+	entries map[string]tokenCacheEntry
+	gen     int                    // incremented by invalidate() so tokens fetched before are not stored
+	waiting map[string]int         // requests waiting for a token being fetched, by key
+	fetches map[string]*tokenFetch // calls to fetch in flight, by key
+	group   singleflight.Group
+}
+
+// tokenFetch is a call to the fetch function of token() shared by all requests waiting for it
+type tokenFetch struct {
+	cancel context.CancelFunc
+}
+
+type tokenCacheEntry struct {
+	tok     *oauth2.Token
+	expires time.Time // the token is fetched again after this time
+}
+
+// tokenCacheKey returns the cache key of the account and scopes; the order of the scopes is not significant
+func tokenCacheKey(account string, scopes []string) string {
+	sorted := append([]string{}, scopes...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, " ")))
+	return account + "/" + hex.EncodeToString(sum[:])
+}
+
+// token returns the cached token for key or calls fetch once for all concurrent callers.  Tokens are cached until
+// 30s before they expire, or for at most ttl if it is set; tokens without an expiry are not cached.  fetch is called
+// with a context that keeps the values of ctx but not its cancellation: the call is shared, so one caller giving up
+// must not fail it for the others.  Each caller returns when its own ctx is done and the call is cancelled once no
+// caller waits for it.
+func (c *tokenCache) token(ctx context.Context, key string, ttl time.Duration, fetch func(context.Context) (*oauth2.Token, error)) (*oauth2.Token, error) {
+	if tok, ok := c.cached(key); ok {
+		return tok, nil
+	}
+	c.mu.Lock()
+	gen := c.gen
+	if c.waiting == nil {
+		c.waiting = map[string]int{}
+	}
+	c.waiting[key]++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.waiting[key]--; c.waiting[key] == 0 {
+			delete(c.waiting, key)
+			if f, ok := c.fetches[key]; ok {
+				// nobody waits for the call any more; requests arriving now start a new one
+				c.group.Forget(key)
+				f.cancel()
+			}
+		}
+		c.mu.Unlock()
+	}()
+
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		fetchCtx, cancel := context.WithCancel(detachedContext{ctx})
+		f := &tokenFetch{cancel: cancel}
+		c.mu.Lock()
+		if c.fetches == nil {
+			c.fetches = map[string]*tokenFetch{}
+		}
+		c.fetches[key] = f
+		abandoned := c.waiting[key] == 0
+		c.mu.Unlock()
+		if abandoned {
+			cancel()
+		}
+		defer func() {
+			c.mu.Lock()
+			if c.fetches[key] == f {
+				delete(c.fetches, key)
+			}
+			c.mu.Unlock()
+			cancel()
+		}()
+
+		tok, err := fetch(fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+		if !tok.Expiry.IsZero() {
+			expires := tok.Expiry.Add(-tokenCacheExpiryDelta)
+			if limit := time.Now().Add(ttl); ttl > 0 && limit.Before(expires) {
+				expires = limit
+			}
+			c.mu.Lock()
+			if c.gen == gen {
+				if c.entries == nil {
+					c.entries = map[string]tokenCacheEntry{}
+				}
+				c.entries[key] = tokenCacheEntry{tok: tok, expires: expires}
+			}
+			c.mu.Unlock()
+		}
+		return tok, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*oauth2.Token), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// cached returns the token cached for key if it has not expired.  It does not allocate, so callers check it before
+// building the fetch closure for token().
+func (c *tokenCache) cached(key string) (*oauth2.Token, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok && time.Now().Before(e.expires) {
+		return e.tok, true
+	}
+	return nil, false
+}
+
+// invalidate drops all cached tokens; the result of calls in flight is returned but not cached
+func (c *tokenCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.gen++
+}
+
+// invalidateAccount drops the cached tokens of account and returns the number of requests waiting for a token of the
+// account being fetched.  They get the result of that call, but it is not cached and the next request fetches again.
+func (c *tokenCache) invalidateAccount(account string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := account + "/"
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+	pending := 0
+	for key, n := range c.waiting {
+		if strings.HasPrefix(key, prefix) {
+			pending += n
+			c.group.Forget(key)
+		}
+	}
+	c.gen++
+	return pending
+}
+
+// detachedContext carries the values of the wrapped context without its deadline and cancellation, like
+// context.WithoutCancel which needs go 1.21
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,399 @@
+package mds
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// countingTokenSource returns a new token valid for expiresIn on every call after a short delay
+type countingTokenSource struct {
+	calls     atomic.Int32
+	expiresIn time.Duration
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	n := s.calls.Add(1)
+	time.Sleep(20 * time.Millisecond)
+	return &oauth2.Token{
+		AccessToken: fmt.Sprintf("token-%d", n),
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(s.expiresIn),
+	}, nil
+}
+
+// fetch is the fetch function of tokenCache.token()
+func (s *countingTokenSource) fetch(context.Context) (*oauth2.Token, error) {
+	return s.Token()
+}
+
+func TestTokenCacheConcurrentRequests(t *testing.T) {
+	ts := &countingTokenSource{expiresIn: time.Hour}
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{TokenSource: ts}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	request := func() int {
+		req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for round := 0; round < 2; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if code := request(); code != http.StatusOK {
+					t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := ts.calls.Load(); n != 1 {
+			t.Errorf("round %d: unexpected number of upstream token calls: got %d want %d", round, n, 1)
+		}
+	}
+
+	if err := h.InvalidateToken(); err == nil {
+		t.Errorf("expected error invalidating a token source which cannot be invalidated")
+	}
+	if code := request(); code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+	if n := ts.calls.Load(); n != 2 {
+		t.Errorf("cached token was not dropped by InvalidateToken: got %d upstream calls want %d", n, 2)
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	var c tokenCache
+	ts := &countingTokenSource{expiresIn: time.Hour}
+
+	for _, scopes := range [][]string{{emailScope, cloudPlatformScope}, {cloudPlatformScope, emailScope}} {
+		tok, err := c.token(context.Background(), tokenCacheKey("default", scopes), 0, ts.fetch)
+		if err != nil {
+			t.Fatalf("error getting token %v", err)
+		}
+		if tok.AccessToken != "token-1" {
+			t.Errorf("unexpected token for scopes %v: got %v want %v", scopes, tok.AccessToken, "token-1")
+		}
+	}
+	for _, key := range []string{tokenCacheKey("default", []string{cloudPlatformScope}), tokenCacheKey("other", []string{emailScope, cloudPlatformScope})} {
+		if _, err := c.token(context.Background(), key, 0, ts.fetch); err != nil {
+			t.Fatalf("error getting token %v", err)
+		}
+	}
+	if n := ts.calls.Load(); n != 3 {
+		t.Errorf("unexpected number of upstream token calls: got %d want %d", n, 3)
+	}
+
+	// tokens about to expire or without an expiry are fetched again
+	for _, ts := range []oauth2.TokenSource{
+		&countingTokenSource{expiresIn: 20 * time.Second},
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "static"}),
+	} {
+		calls := 0
+		fetch := func(context.Context) (*oauth2.Token, error) {
+			calls++
+			return ts.Token()
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := c.token(context.Background(), "expiring", 0, fetch); err != nil {
+				t.Fatalf("error getting token %v", err)
+			}
+		}
+		if calls != 2 {
+			t.Errorf("unexpected number of upstream token calls: got %d want %d", calls, 2)
+		}
+	}
+
+	// ttl limits how long tokens are cached
+	ts = &countingTokenSource{expiresIn: time.Hour}
+	for i := 0; i < 2; i++ {
+		if _, err := c.token(context.Background(), "ttl", 10*time.Millisecond, ts.fetch); err != nil {
+			t.Fatalf("error getting token %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := ts.calls.Load(); n != 2 {
+		t.Errorf("token was cached longer than the ttl: got %d upstream calls want %d", n, 2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.token(ctx, "cancelled", 0, ts.fetch); err != context.Canceled {
+		t.Errorf("unexpected error for a cancelled request: got %v want %v", err, context.Canceled)
+	}
+}
+
+func TestTokenCacheCancelledCaller(t *testing.T) {
+	var c tokenCache
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (*oauth2.Token, error) {
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return &oauth2.Token{AccessToken: "shared", Expiry: time.Now().Add(time.Hour)}, nil
+	}
+	waitFor := func(n int) {
+		for {
+			c.mu.Lock()
+			waiting := c.waiting["key"]
+			c.mu.Unlock()
+			if waiting == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := c.token(ctx, "key", 0, fetch)
+		first <- err
+	}()
+	waitFor(1)
+	second := make(chan *oauth2.Token, 1)
+	go func() {
+		tok, err := c.token(context.Background(), "key", 0, fetch)
+		if err != nil {
+			t.Errorf("error getting token after the first caller cancelled: %v", err)
+		}
+		second <- tok
+	}()
+	waitFor(2)
+
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("unexpected error for the cancelled caller: got %v want %v", err, context.Canceled)
+	}
+	close(release)
+	if tok := <-second; tok == nil || tok.AccessToken != "shared" {
+		t.Errorf("second caller did not get the shared token: got %v", tok)
+	}
+}
+
+func TestTokenCacheHitAllocations(t *testing.T) {
+	var c tokenCache
+	ts := &countingTokenSource{expiresIn: time.Hour}
+	key := tokenCacheKey("default", nil)
+	if _, err := c.token(context.Background(), key, 0, ts.fetch); err != nil {
+		t.Fatalf("error getting token %v", err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, ok := c.cached(key); !ok {
+			t.Fatalf("token was not cached")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("cached token lookups allocate: got %v allocs want 0", allocs)
+	}
+}
+
+// discardLogger drops all messages so benchmarks do not measure the logger
+type discardLogger struct{}
+
+func (discardLogger) Debug(msg string, keysAndValues ...interface{}) {}
+func (discardLogger) Info(msg string, keysAndValues ...interface{})  {}
+func (discardLogger) Warn(msg string, keysAndValues ...interface{})  {}
+func (discardLogger) Error(msg string, keysAndValues ...interface{}) {}
+
+// tokenEndpointStub answers every request with the JSON document returned by resp
+func tokenEndpointStub(tb testing.TB, resp func() interface{}) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp())
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// stubTransport sends all requests to the host of a stub server
+type stubTransport struct {
+	url *url.URL
+}
+
+func (s stubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = s.url.Scheme, s.url.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// serviceAccountFileCredentials returns the credentials of a service account key file whose token_uri is a stub
+func serviceAccountFileCredentials(tb testing.TB) *google.Credentials {
+	oauth := tokenEndpointStub(tb, func() interface{} {
+		return map[string]interface{}{"access_token": "file-token", "token_type": "Bearer", "expires_in": 3600}
+	})
+	creds, err := google.CredentialsFromJSON(context.Background(), serviceAccountKeyJSON(tb, oauth.URL), cloudPlatformScope)
+	if err != nil {
+		tb.Fatalf("error parsing credentials %v", err)
+	}
+	return creds
+}
+
+// serviceAccountKeyJSON returns a service account key file which gets access_tokens from tokenURI
+func serviceAccountKeyJSON(tb testing.TB, tokenURI string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "some-project",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"client_email":   "metadata-sa@some-project.iam.gserviceaccount.com",
+		"token_uri":      tokenURI,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+// impersonatedCredentials returns credentials which impersonate the default service account at a stub IAM API
+func impersonatedCredentials(tb testing.TB) *google.Credentials {
+	iam := tokenEndpointStub(tb, func() interface{} {
+		return map[string]string{"accessToken": "impersonated-token", "expireTime": time.Now().Add(time.Hour).Format(time.RFC3339)}
+	})
+	u, err := url.Parse(iam.URL)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ts, err := impersonate.CredentialsTokenSource(context.Background(), impersonate.CredentialsConfig{
+		TargetPrincipal: "metadata-sa@some-project.iam.gserviceaccount.com",
+		Scopes:          []string{cloudPlatformScope},
+	}, option.WithHTTPClient(&http.Client{Transport: stubTransport{url: u}}))
+	if err != nil {
+		tb.Fatalf("error creating impersonated token source %v", err)
+	}
+	return &google.Credentials{TokenSource: ts}
+}
+
+// federatedCredentials returns credentials which exchange a subject token at a stub STS
+func federatedCredentials(tb testing.TB) *google.Credentials {
+	var exchanges atomic.Int32
+	sts := stsStub(tb, federationAudience, &exchanges)
+	tb.Cleanup(sts.Close)
+	tb.Setenv("OIDC_TOKEN", "env-token")
+	ts, err := NewFederatedTokenSource(FederationConfig{
+		ProjectNumber:   123,
+		Pool:            "pool",
+		Provider:        "oidc",
+		Scopes:          []string{cloudPlatformScope},
+		STSURL:          sts.URL,
+		SubjectTokenEnv: "OIDC_TOKEN",
+	})
+	if err != nil {
+		tb.Fatalf("error creating token source %v", err)
+	}
+	return &google.Credentials{TokenSource: ts}
+}
+
+// BenchmarkTokenEndpoint measures cached access_token requests to the HTTP server from concurrent clients; each
+// goroutine makes its share of b.N requests one after the other.
+func BenchmarkTokenEndpoint(b *testing.B) {
+	for _, backend := range []struct {
+		name  string
+		creds func(testing.TB) *google.Credentials
+	}{
+		{"file", serviceAccountFileCredentials},
+		{"impersonation", impersonatedCredentials},
+		{"federation", federatedCredentials},
+	} {
+		for _, goroutines := range []int{1, 16} {
+			b.Run(fmt.Sprintf("%s/goroutines=%d", backend.name, goroutines), func(b *testing.B) {
+				h, err := NewMetadataServer(context.Background(), &ServerConfig{}, backend.creds(b), projectClaims("some-project"), WithLogger(discardLogger{}))
+				if err != nil {
+					b.Fatalf("error creating emulator %v", err)
+				}
+				srv := httptest.NewServer(h.handler())
+				defer srv.Close()
+				tokenURL := srv.URL + "/computeMetadata/v1/instance/service-accounts/default/token"
+
+				// the first request fills the token cache
+				if resp, body, err := getMetadata(tokenURL); err != nil || resp.StatusCode != http.StatusOK {
+					b.Fatalf("error getting token %v %s", err, body)
+				}
+				client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: goroutines}}
+				defer client.CloseIdleConnections()
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				var wg sync.WaitGroup
+				for g := 0; g < goroutines; g++ {
+					requests := b.N / goroutines
+					if g < b.N%goroutines {
+						requests++
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; i < requests; i++ {
+							req, _ := http.NewRequest(http.MethodGet, tokenURL, nil)
+							req.Header.Set("Metadata-Flavor", "Google")
+							resp, err := client.Do(req)
+							if err != nil {
+								b.Error(err)
+								return
+							}
+							io.Copy(io.Discard, resp.Body)
+							resp.Body.Close()
+							if resp.StatusCode != http.StatusOK {
+								b.Errorf("unexpected status: got %v want %v", resp.StatusCode, http.StatusOK)
+								return
+							}
+						}
+					}()
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
+
+// BenchmarkTokenCacheHit measures the lookup of a cached token without the HTTP server
+func BenchmarkTokenCacheHit(b *testing.B) {
+	var c tokenCache
+	ts := &countingTokenSource{expiresIn: time.Hour}
+	key := tokenCacheKey("default", nil)
+	if _, err := c.token(context.Background(), key, 0, ts.fetch); err != nil {
+		b.Fatalf("error getting token %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.cached(key)
+		}
+	})
+}
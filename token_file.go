@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+const defaultTokenFileExpiryMargin = 10 * time.Second
+
+// tokenFileTokenSource serves the JWT in a file as the access_token, see TokenFileTokenSource()
+type tokenFileTokenSource struct {
+	path         string
+	expiryMargin time.Duration
+
+	mu  sync.Mutex
+	tok *oauth2.Token
+}
+
+// TokenFileTokenSource returns an oauth2.TokenSource which serves the JWT in path, eg a projected Kubernetes service
+// account token in /var/run/secrets/kubernetes.io/serviceaccount/token, as the access_token.  The JWT expires at its
+// `exp` claim and the file is read again expiryMargin before that, so a token rotated on disk is picked up.
+//
+// If the file cannot be read or does not hold a valid JWT, the last token read is returned until it expires.
+func TokenFileTokenSource(path string, expiryMargin time.Duration) oauth2.TokenSource {
+	return &tokenFileTokenSource{path: path, expiryMargin: expiryMargin}
+}
+
+func (s *tokenFileTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tok != nil && time.Until(s.tok.Expiry) > s.expiryMargin {
+		return s.tok, nil
+	}
+	tok, err := s.read()
+	if err != nil {
+		if s.tok != nil && time.Now().Before(s.tok.Expiry) {
+			return s.tok, nil
+		}
+		return nil, err
+	}
+	s.tok = tok
+	return tok, nil
+}
+
+// Invalidate drops the cached token so the next call to Token() reads the file again
+func (s *tokenFileTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tok = nil
+}
+
+// read returns the JWT in the file if it has not expired
+func (s *tokenFileTokenSource) read() (*oauth2.Token, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token file: %w", err)
+	}
+	raw := strings.TrimSpace(string(data))
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(raw, claims); err != nil {
+		return nil, fmt.Errorf("token file %s does not hold a JWT: %w", s.path, err)
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return nil, fmt.Errorf("token in %s has no valid exp claim", s.path)
+	}
+	if !time.Now().Before(exp.Time) {
+		return nil, fmt.Errorf("token in %s expired at %v", s.path, exp.Time)
+	}
+	return &oauth2.Token{AccessToken: raw, TokenType: "Bearer", Expiry: exp.Time}, nil
+}
@@ -0,0 +1,114 @@
+package mds
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// writeTokenFile writes a JWT for subject which expires after expiresIn
+func writeTokenFile(t *testing.T, path, subject string, expiresIn time.Duration) string {
+	tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   subject,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(tok+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestTokenFileTokenSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	first := writeTokenFile(t, path, "first", time.Hour)
+	ts := TokenFileTokenSource(path, time.Minute)
+
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatalf("error getting token %v", err)
+	}
+	if tok.AccessToken != first || tok.TokenType != "Bearer" || time.Until(tok.Expiry) < 59*time.Minute {
+		t.Errorf("unexpected token: got %+v", tok)
+	}
+
+	// the file is not read again while the token is valid
+	writeTokenFile(t, path, "second", time.Hour)
+	if tok, err := ts.Token(); err != nil || tok.AccessToken != first {
+		t.Errorf("token was read again before it expired: got %v %v", tok, err)
+	}
+
+	// a token within the expiry margin is replaced by the one on disk
+	short := writeTokenFile(t, path, "short", 3*time.Second)
+	ts = TokenFileTokenSource(path, 5*time.Second)
+	if tok, err := ts.Token(); err != nil || tok.AccessToken != short {
+		t.Fatalf("unexpected token: got %v %v", tok, err)
+	}
+	rotated := writeTokenFile(t, path, "rotated", time.Hour)
+	if tok, err := ts.Token(); err != nil || tok.AccessToken != rotated {
+		t.Errorf("rotated token was not read: got %v %v", tok, err)
+	}
+}
+
+func TestTokenFileTokenSourceUnreadable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	last := writeTokenFile(t, path, "last", 2*time.Second)
+	ts := TokenFileTokenSource(path, 5*time.Second)
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatalf("error getting token %v", err)
+	}
+
+	// the last good token is served until it expires
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := ts.Token(); err != nil || tok.AccessToken != last {
+		t.Errorf("last token was not served after the file was deleted: got %v %v", tok, err)
+	}
+	time.Sleep(time.Until(tok.Expiry) + 100*time.Millisecond)
+	if _, err := ts.Token(); err == nil {
+		t.Errorf("expected error once the last token expired")
+	}
+
+	for name, content := range map[string]string{
+		"not a JWT": "opaque-token",
+		"no exp":    "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiJmb28ifQ.c2ln",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := TokenFileTokenSource(path, time.Second).Token(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	writeTokenFile(t, path, "expired", -time.Minute)
+	if _, err := TokenFileTokenSource(path, time.Second).Token(); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("unexpected error for an expired token: got %v", err)
+	}
+}
+
+func TestTokenFilePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	want := writeTokenFile(t, path, "pod", time.Hour)
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{TokenFilePath: path}, nil, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	rr := serveToken(h, "default")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("unexpected response: got %v %s", rr.Code, rr.Body.String())
+	}
+
+	if _, err := NewMetadataServer(context.Background(), &ServerConfig{TokenFilePath: filepath.Join(t.TempDir(), "missing")}, nil, projectClaims("some-project")); err == nil {
+		t.Errorf("expected error for a missing token file")
+	}
+}
@@ -0,0 +1,102 @@
+package mds
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// slowTokenSource blocks in Token() until release is closed
+type slowTokenSource struct {
+	release chan struct{}
+}
+
+func (s *slowTokenSource) Token() (*oauth2.Token, error) {
+	<-s.release
+	return &oauth2.Token{AccessToken: "foo", Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+// slowContextTokenSource blocks in TokenContext() until the context is done and reports its error on cancelled
+type slowContextTokenSource struct {
+	slowTokenSource
+	cancelled chan error
+}
+
+func (s *slowContextTokenSource) TokenContext(ctx context.Context) (*oauth2.Token, error) {
+	select {
+	case <-ctx.Done():
+		s.cancelled <- ctx.Err()
+		return nil, ctx.Err()
+	case <-s.release:
+		return s.Token()
+	}
+}
+
+func TestTokenContextCancellation(t *testing.T) {
+	ts := &slowContextTokenSource{slowTokenSource{make(chan struct{})}, make(chan error, 1)}
+	defer close(ts.release)
+
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{TokenSource: ts}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	srv := httptest.NewServer(h.handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Fatalf("expected the request to time out")
+	}
+
+	select {
+	case err := <-ts.cancelled:
+		if err != context.Canceled {
+			t.Errorf("unexpected upstream context error: got %v want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("upstream token request was not cancelled with the client request")
+	}
+}
+
+func TestTokenWithoutContextSupport(t *testing.T) {
+	ts := &slowTokenSource{make(chan struct{})}
+	defer close(ts.release)
+
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{TokenSource: ts}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	done := make(chan int, 1)
+	go func() {
+		rr := httptest.NewRecorder()
+		h.handler().ServeHTTP(rr, req)
+		done <- rr.Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusInternalServerError {
+			t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusInternalServerError)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handler did not return when the request context was done")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/google/go-tpm-tools/client"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	saltpm "github.com/salrashid123/oauth2/tpm"
+	"golang.org/x/oauth2"
+)
+
+// tpmKeyConfig identifies the service account key persisted at one TPM handle
+type tpmKeyConfig struct {
+	Path   string
+	Handle uint32
+	PCRs   []int
+	Email  string
+	Scopes []string
+}
+
+// tpmKeySession mints access_tokens with the key of an open TPM session
+type tpmKeySession interface {
+	oauth2.TokenSource
+	io.Closer
+}
+
+// overridden in tests
+var openTPMKeySession = openTPMDeviceSession
+
+// tpmDeviceSession keeps the TPM and the loaded key open between tokens
+type tpmDeviceSession struct {
+	oauth2.TokenSource
+	rwc io.ReadWriteCloser
+	key *client.Key
+}
+
+func (s *tpmDeviceSession) Close() error {
+	s.key.Close()
+	return s.rwc.Close()
+}
+
+func openTPMDeviceSession(cfg tpmKeyConfig) (tpmKeySession, error) {
+	rwc, err := tpm2.OpenTPM(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open TPM %s: %w", cfg.Path, err)
+	}
+	var session client.Session = client.NullSession{}
+	if len(cfg.PCRs) > 0 {
+		session, err = client.NewPCRSession(rwc, tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: cfg.PCRs})
+		if err != nil {
+			rwc.Close()
+			return nil, fmt.Errorf("unable to create pcr session: %w", err)
+		}
+	}
+	k, err := client.LoadCachedKey(rwc, tpmutil.Handle(cfg.Handle), session)
+	if err != nil {
+		rwc.Close()
+		return nil, fmt.Errorf("unable to load key at handle %#x: %w", cfg.Handle, err)
+	}
+	ts, err := saltpm.TpmTokenSource(&saltpm.TpmTokenConfig{
+		TPMDevice:     rwc,
+		Key:           k,
+		Email:         cfg.Email,
+		Scopes:        cfg.Scopes,
+		UseOauthToken: true,
+	})
+	if err != nil {
+		k.Close()
+		rwc.Close()
+		return nil, err
+	}
+	return &tpmDeviceSession{TokenSource: ts, rwc: rwc, key: k}, nil
+}
+
+// tpmSessions holds the TPM session of each handle in ServerConfig.TPMHandles.  Each handle has its own lock so
+// tokens for different handles are minted concurrently.
+type tpmSessions struct {
+	mu      sync.Mutex
+	handles map[uint32]*tpmHandleSession
+}
+
+type tpmHandleSession struct {
+	mu      sync.Mutex
+	session tpmKeySession // nil until the first token for the handle is requested
+}
+
+func (s *tpmSessions) get(handle uint32) *tpmHandleSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handles == nil {
+		s.handles = map[uint32]*tpmHandleSession{}
+	}
+	hs, ok := s.handles[handle]
+	if !ok {
+		hs = &tpmHandleSession{}
+		s.handles[handle] = hs
+	}
+	return hs
+}
+
+// close closes all open sessions; they are opened again by the next token request
+func (s *tpmSessions) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, hs := range s.handles {
+		hs.mu.Lock()
+		if hs.session != nil {
+			errs = append(errs, hs.session.Close())
+			hs.session = nil
+		}
+		hs.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// closeHandle closes the session of handle if it is open; it is opened again by the next token request
+func (s *tpmSessions) closeHandle(handle uint32) error {
+	hs := s.get(handle)
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.session == nil {
+		return nil
+	}
+	err := hs.session.Close()
+	hs.session = nil
+	return err
+}
+
+// tpmHandleToken returns an access_token for account signed with the key at its ServerConfig.TPMHandles handle
+func (h *MetadataServer) tpmHandleToken(ctx context.Context, account string, handle int) (*oauth2.Token, error) {
+	hs := h.tpmSessions.get(uint32(handle))
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if hs.session == nil {
+		sa := h.Claims.ComputeMetadata.V1.Instance.ServiceAccounts[account]
+		s, err := openTPMKeySession(tpmKeyConfig{
+			Path:   h.ServerConfig.TPMPath,
+			Handle: uint32(handle),
+			PCRs:   h.ServerConfig.PCRs,
+			Email:  sa.Email,
+			Scopes: sa.Scopes,
+		})
+		if err != nil {
+			h.contextLog(ctx).Error("could not open TPM session", "account", account, "handle", fmt.Sprintf("%#x", handle), "error", err)
+			return nil, err
+		}
+		h.contextLog(ctx).Info("Opened TPM session", "account", account, "handle", fmt.Sprintf("%#x", handle))
+		hs.session = s
+	}
+
+	// not tokenWithContext(): a canceled request must not leave the session in use by another goroutine
+	tok, err := hs.session.Token()
+	if err != nil {
+		// the session may not be usable anymore, eg after the TPM was reset; open a new one for the next request
+		h.contextLog(ctx).Error("could not get Token", "account", account, "error", err)
+		hs.session.Close()
+		hs.session = nil
+		return nil, err
+	}
+	return tok, nil
+}
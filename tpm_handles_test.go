@@ -0,0 +1,208 @@
+package mds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// fakeTPM replaces openTPMKeySession with sessions which mint "<email>-<handle>" tokens
+type fakeTPM struct {
+	mu     sync.Mutex
+	opens  map[uint32]int
+	closes int
+	block  map[uint32]chan struct{} // Token() for the handle waits until the channel is closed
+	fail   map[uint32]bool          // Token() for the handle returns an error
+}
+
+func newFakeTPM(t *testing.T) *fakeTPM {
+	f := &fakeTPM{opens: map[uint32]int{}, block: map[uint32]chan struct{}{}, fail: map[uint32]bool{}}
+	open := openTPMKeySession
+	openTPMKeySession = func(cfg tpmKeyConfig) (tpmKeySession, error) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.opens[cfg.Handle]++
+		return &fakeTPMSession{tpm: f, cfg: cfg}, nil
+	}
+	t.Cleanup(func() {
+		openTPMKeySession = open
+	})
+	return f
+}
+
+func (f *fakeTPM) openCount(handle uint32) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.opens[handle]
+}
+
+type fakeTPMSession struct {
+	tpm *fakeTPM
+	cfg tpmKeyConfig
+}
+
+func (s *fakeTPMSession) Token() (*oauth2.Token, error) {
+	s.tpm.mu.Lock()
+	block, fail := s.tpm.block[s.cfg.Handle], s.tpm.fail[s.cfg.Handle]
+	s.tpm.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	if fail {
+		return nil, errors.New("TPM_RC_LOCKOUT")
+	}
+	return &oauth2.Token{AccessToken: fmt.Sprintf("%s-%#x", s.cfg.Email, s.cfg.Handle), Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func (s *fakeTPMSession) Close() error {
+	s.tpm.mu.Lock()
+	defer s.tpm.mu.Unlock()
+	s.tpm.closes++
+	return nil
+}
+
+func tpmHandlesClaims() *Claims {
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["reader"] = serviceAccountDetails{Email: "reader@some-project.iam.gserviceaccount.com"}
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["writer"] = serviceAccountDetails{Email: "writer@some-project.iam.gserviceaccount.com"}
+	return claims
+}
+
+func serveToken(h *MetadataServer, account string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/"+account+"/token", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	rr := httptest.NewRecorder()
+	h.handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTPMHandles(t *testing.T) {
+	f := newFakeTPM(t)
+	creds := &google.Credentials{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "default-token", Expiry: time.Now().Add(time.Hour)})}
+	sc := &ServerConfig{TPMHandles: map[string]int{"reader": 0x81008001, "writer": 0x81008002}}
+	h, err := NewMetadataServer(context.Background(), sc, creds, tpmHandlesClaims(), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	if n := f.openCount(0x81008001) + f.openCount(0x81008002); n != 0 {
+		t.Errorf("TPM sessions opened before the first token request: %d", n)
+	}
+
+	for account, want := range map[string]string{
+		"default": "default-token",
+		"reader":  "reader@some-project.iam.gserviceaccount.com-0x81008001",
+		"writer":  "writer@some-project.iam.gserviceaccount.com-0x81008002",
+		"writer@some-project.iam.gserviceaccount.com": "writer@some-project.iam.gserviceaccount.com-0x81008002",
+	} {
+		rr := serveToken(h, account)
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("%s: unexpected response: got %v %s want %s", account, rr.Code, rr.Body.String(), want)
+		}
+	}
+
+	// tokens are cached, the sessions stay open
+	h.tokenCache.invalidate()
+	serveToken(h, "reader")
+	if n := f.openCount(0x81008001); n != 1 {
+		t.Errorf("unexpected number of sessions opened for the reader handle: got %d want %d", n, 1)
+	}
+
+	if err := h.InvalidateToken(); err == nil {
+		t.Errorf("expected error invalidating static default credentials")
+	}
+	serveToken(h, "reader")
+	if n := f.openCount(0x81008001); n != 2 {
+		t.Errorf("session was not reopened after InvalidateToken(): got %d opens want %d", n, 2)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closes != 2 {
+		t.Errorf("unexpected number of closed sessions: got %d want %d", f.closes, 2)
+	}
+}
+
+func TestTPMHandlesConcurrent(t *testing.T) {
+	f := newFakeTPM(t)
+	release := make(chan struct{})
+	f.block[0x81008001] = release
+	sc := &ServerConfig{TPMHandles: map[string]int{"reader": 0x81008001, "writer": 0x81008002}}
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, tpmHandlesClaims(), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	blocked := make(chan *httptest.ResponseRecorder)
+	go func() {
+		blocked <- serveToken(h, "reader")
+	}()
+	for f.openCount(0x81008001) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveToken(h, "writer")
+	}()
+	select {
+	case rr := <-done:
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status for the writer token: got %v want %v", rr.Code, http.StatusOK)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("token for the writer handle waited for the reader handle")
+	}
+
+	close(release)
+	if rr := <-blocked; rr.Code != http.StatusOK {
+		t.Errorf("unexpected status for the reader token: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestTPMHandlesTokenError(t *testing.T) {
+	f := newFakeTPM(t)
+	f.fail[0x81008001] = true
+	sc := &ServerConfig{TPMHandles: map[string]int{"reader": 0x81008001}}
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, tpmHandlesClaims(), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	if rr := serveToken(h, "reader"); rr.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status: got %v want %v", rr.Code, http.StatusInternalServerError)
+	}
+	f.mu.Lock()
+	f.fail[0x81008001] = false
+	f.mu.Unlock()
+	if rr := serveToken(h, "reader"); rr.Code != http.StatusOK {
+		t.Errorf("unexpected status after the TPM recovered: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if n := f.openCount(0x81008001); n != 2 {
+		t.Errorf("failed session was not reopened: got %d opens want %d", n, 2)
+	}
+}
+
+func TestTPMHandlesValidation(t *testing.T) {
+	for _, sc := range []*ServerConfig{
+		{TPMHandles: map[string]int{"default": 0x81008001}},
+		{TPMHandles: map[string]int{"missing": 0x81008001}},
+		{TPMHandles: map[string]int{"reader": 0}},
+		{TPMHandles: map[string]int{"reader": 0x81008001, "writer": 0x81008001}},
+		{
+			TPMHandles:       map[string]int{"reader": 0x81008001},
+			NamedCredentials: map[string]*google.Credentials{"default": {}, "reader": {}},
+		},
+	} {
+		if _, err := NewMetadataServer(context.Background(), sc, nil, tpmHandlesClaims()); err == nil {
+			t.Errorf("expected error for TPMHandles %v", sc.TPMHandles)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/salrashid123/gce_metadata_server"
+
+// WithTracerProvider records a server span named `gce_metadata/<path>` for every request, eg
+// `gce_metadata/computeMetadata/v1/instance/service-accounts/default/token`.  Spans continue the trace of a W3C
+// `traceparent` request header and carry the `metadata.path`, `metadata.account` and `http.status_code` attributes.
+//
+// Without this option requests are not traced.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(h *MetadataServer) {
+		h.tracer = tp.Tracer(tracerName)
+	}
+}
+
+var tracePropagator = propagation.TraceContext{}
+
+// traceRequests starts the span of each request.  The traceparent header is replaced with the new span, so requests
+// forwarded to ProxyTo belong to the same trace.
+func (h *MetadataServer) traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := h.tracer.Start(ctx, "gce_metadata"+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("metadata.path", r.URL.Path)))
+		defer span.End()
+
+		r = r.WithContext(ctx)
+		r.Header = r.Header.Clone()
+		tracePropagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+
+		sw := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		span.SetAttributes(attribute.Int("http.status_code", sw.code))
+		if sw.code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.code))
+		}
+	})
+}
+
+// traceAccount adds the service account of service-accounts routes to the request span
+func (h *MetadataServer) traceAccount(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acct, ok := mux.Vars(r)["acct"]; ok && h.tracer != nil {
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("metadata.account", acct))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,97 @@
+package mds
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2/google"
+)
+
+func spanAttributes(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project"), WithLogger(&recordingLogger{}), WithTracerProvider(tp))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	handler := h.handler()
+
+	req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/email", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequest(http.MethodGet, "/computeMetadata/v1/project/project-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := sr.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("unexpected number of spans: got %d want %d", len(spans), 2)
+	}
+
+	s := spans[0]
+	if s.Name() != "gce_metadata/computeMetadata/v1/instance/service-accounts/default/email" || s.SpanKind() != trace.SpanKindServer {
+		t.Errorf("unexpected span: got %s %v", s.Name(), s.SpanKind())
+	}
+	if got := s.Parent().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" || s.SpanContext().TraceID().String() != got {
+		t.Errorf("span did not continue the trace of the traceparent header: got parent %s trace %s", got, s.SpanContext().TraceID())
+	}
+	attrs := spanAttributes(s)
+	for key, want := range map[attribute.Key]attribute.Value{
+		"metadata.path":    attribute.StringValue("/computeMetadata/v1/instance/service-accounts/default/email"),
+		"metadata.account": attribute.StringValue("default"),
+		"http.status_code": attribute.IntValue(http.StatusOK),
+	} {
+		if attrs[key] != want {
+			t.Errorf("unexpected attribute %s: got %v want %v", key, attrs[key].Emit(), want.Emit())
+		}
+	}
+
+	// requests rejected for a missing Metadata-Flavor header are traced too
+	s = spans[1]
+	attrs = spanAttributes(s)
+	if s.Parent().IsValid() || attrs["http.status_code"] != attribute.IntValue(http.StatusForbidden) {
+		t.Errorf("unexpected span for a rejected request: got parent %v status %v", s.Parent().IsValid(), attrs["http.status_code"].Emit())
+	}
+	if _, ok := attrs["metadata.account"]; ok {
+		t.Errorf("unexpected metadata.account attribute for a project request")
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "/computeMetadata/v1/project/project-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	h.handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || req.Header.Get("traceparent") != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("unexpected response without a tracer: got %v traceparent %q", rr.Code, req.Header.Get("traceparent"))
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultVaultTransitMount = "transit"
+	defaultVaultAppRoleMount = "approle"
+	vaultTokenExpiryDelta    = 10 * time.Second
+)
+
+// VaultConfig configures a VaultTokenSource.
+//
+// The service account private key is stored as an RSA key in Vault's transit engine.  Vault signs the
+// JWT assertion for the service account, which is then exchanged for tokens at TokenURL.
+type VaultConfig struct {
+	Address   string // Vault address, eg https://vault.example.com:8200
+	MountPath string // mount path of the transit engine (default: transit)
+	KeyName   string // transit key holding the service account private key
+	KeyID     string // service account private key id added as the JWT `kid` header (default: "")
+
+	Token            string // Vault token; if empty RoleID and SecretID are used to log in with AppRole
+	RoleID           string // AppRole role_id
+	SecretID         string // AppRole secret_id
+	AppRoleMountPath string // mount path of the AppRole auth method (default: approle)
+
+	Email    string   // service account email the assertion is issued for
+	Scopes   []string // scopes to request for access_tokens
+	TokenURL string   // token endpoint the assertion is exchanged at (default: https://oauth2.googleapis.com/token)
+
+	HTTPClient *http.Client // client used for Vault and token endpoint requests (default: http.DefaultClient)
+}
+
+// VaultError is returned when Vault rejects a request, eg with `permission denied` or for a missing key
+type VaultError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e *VaultError) Error() string {
+	return fmt.Sprintf("vault returned %d: %s", e.StatusCode, strings.Join(e.Errors, ", "))
+}
+
+// VaultTokenSource is an oauth2.TokenSource which signs service account assertions with a key held in Vault's transit engine
+type VaultTokenSource struct {
+	cfg VaultConfig
+
+	mu               sync.Mutex
+	vaultToken       string
+	vaultTokenExpiry time.Time // end of the AppRole token's lease; zero if it does not expire
+	tok              *oauth2.Token
+}
+
+// NewVaultTokenSource returns a VaultTokenSource for the provided configuration
+func NewVaultTokenSource(cfg VaultConfig) (*VaultTokenSource, error) {
+	if cfg.Address == "" || cfg.KeyName == "" || cfg.Email == "" {
+		return nil, errors.New("vault address, key name and service account email must be set")
+	}
+	if cfg.Token == "" && (cfg.RoleID == "" || cfg.SecretID == "") {
+		return nil, errors.New("either a vault token or AppRole role_id and secret_id must be set")
+	}
+	if cfg.MountPath == "" {
+		cfg.MountPath = defaultVaultTransitMount
+	}
+	if cfg.AppRoleMountPath == "" {
+		cfg.AppRoleMountPath = defaultVaultAppRoleMount
+	}
+	if cfg.TokenURL == "" {
+		cfg.TokenURL = defaultTokenURL
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	return &VaultTokenSource{cfg: cfg, vaultToken: cfg.Token}, nil
+}
+
+// WithVaultCredentials uses a VaultTokenSource for access and id_tokens instead of the credentials passed to `NewMetadataServer()`.
+// An invalid configuration is returned as an error by `NewMetadataServer()`.
+func WithVaultCredentials(cfg VaultConfig) Option {
+	return func(h *MetadataServer) {
+		h.vaultConfig = &cfg
+	}
+}
+
+// Token returns a cached access_token or signs a new assertion with Vault once it is about to expire
+func (s *VaultTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tok != nil && time.Until(s.tok.Expiry) > vaultTokenExpiryDelta {
+		return s.tok, nil
+	}
+	tok, err := s.assertion().accessToken(s.sign, s.cfg.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	s.tok = tok
+	return tok, nil
+}
+
+// IDToken returns an id_token for the audience issued to the service account
+func (s *VaultTokenSource) IDToken(audience string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.assertion().idToken(s.sign, audience)
+}
+
+// Invalidate drops the cached token so the next call to Token() fetches a new one
+func (s *VaultTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tok = nil
+}
+
+func (s *VaultTokenSource) assertion() *jwtAssertion {
+	return &jwtAssertion{
+		Email:    s.cfg.Email,
+		KeyID:    s.cfg.KeyID,
+		TokenURL: s.cfg.TokenURL,
+		Client:   s.cfg.HTTPClient,
+	}
+}
+
+// sign calls the transit sign endpoint and returns the raw signature.  With AppRole credentials, a new Vault token
+// is requested before the lease of the current one ends or once Vault rejects it.
+func (s *VaultTokenSource) sign(input []byte) ([]byte, error) {
+	appRole := s.cfg.Token == ""
+	if appRole && (s.vaultToken == "" || (!s.vaultTokenExpiry.IsZero() && time.Until(s.vaultTokenExpiry) <= vaultTokenExpiryDelta)) {
+		if err := s.login(); err != nil {
+			return nil, err
+		}
+	}
+	sig, err := s.transitSign(input)
+	var verr *VaultError
+	if appRole && errors.As(err, &verr) && verr.StatusCode == http.StatusForbidden {
+		// the token may have been revoked or its lease cut short; log in again once
+		if err := s.login(); err != nil {
+			return nil, err
+		}
+		return s.transitSign(input)
+	}
+	return sig, err
+}
+
+// transitSign signs the input with the transit key using the current Vault token
+func (s *VaultTokenSource) transitSign(input []byte) ([]byte, error) {
+	resp := &struct {
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}{}
+	path := fmt.Sprintf("/v1/%s/sign/%s/sha2-256", strings.Trim(s.cfg.MountPath, "/"), url.PathEscape(s.cfg.KeyName))
+	err := s.vaultRequest(path, map[string]string{
+		"input":               base64.StdEncoding.EncodeToString(input),
+		"signature_algorithm": "pkcs1v15",
+	}, resp)
+	if err != nil {
+		return nil, fmt.Errorf("error signing with vault key %s: %w", s.cfg.KeyName, err)
+	}
+
+	// signatures are returned as vault:v<version>:<base64 signature>
+	parts := strings.Split(resp.Data.Signature, ":")
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("unexpected signature format from vault key %s", s.cfg.KeyName)
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+// login exchanges the AppRole credentials for a Vault token
+func (s *VaultTokenSource) login() error {
+	s.vaultToken = ""
+	resp := &struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int64  `json:"lease_duration"`
+		} `json:"auth"`
+	}{}
+	path := fmt.Sprintf("/v1/auth/%s/login", strings.Trim(s.cfg.AppRoleMountPath, "/"))
+	err := s.vaultRequest(path, map[string]string{
+		"role_id":   s.cfg.RoleID,
+		"secret_id": s.cfg.SecretID,
+	}, resp)
+	if err != nil {
+		return fmt.Errorf("error logging in to vault with AppRole: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return errors.New("vault AppRole login did not return a token")
+	}
+	s.vaultToken = resp.Auth.ClientToken
+	s.vaultTokenExpiry = time.Time{}
+	if resp.Auth.LeaseDuration > 0 {
+		s.vaultTokenExpiry = time.Now().Add(time.Duration(resp.Auth.LeaseDuration) * time.Second)
+	}
+	return nil
+}
+
+func (s *VaultTokenSource) vaultRequest(path string, body interface{}, ret interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.cfg.Address, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.vaultToken != "" {
+		req.Header.Set("X-Vault-Token", s.vaultToken)
+	}
+	resp, err := s.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		verr := &VaultError{StatusCode: resp.StatusCode}
+		if err := json.Unmarshal(data, verr); err != nil || len(verr.Errors) == 0 {
+			verr.Errors = []string{http.StatusText(resp.StatusCode)}
+		}
+		return verr
+	}
+	return json.Unmarshal(data, ret)
+}
@@ -0,0 +1,271 @@
+package mds
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	vaultTestToken = "hvs.test-token"
+	vaultTestEmail = "vault-sa@some-project.iam.gserviceaccount.com"
+)
+
+// vaultStub emulates the Vault AppRole login and transit sign endpoints as well as the Google token endpoint
+type vaultStub struct {
+	*httptest.Server
+	logins    atomic.Int32
+	exchanges atomic.Int32
+	lease     atomic.Int64 // lease_duration of AppRole tokens in seconds
+	tokens    sync.Map     // client tokens accepted by the sign endpoint
+}
+
+// expire revokes every client token issued so far
+func (s *vaultStub) expire() {
+	s.tokens.Range(func(k, _ interface{}) bool {
+		s.tokens.Delete(k)
+		return true
+	})
+}
+
+func newVaultStub(t *testing.T) *vaultStub {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &vaultStub{}
+	s.lease.Store(3600)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/approle/login", func(w http.ResponseWriter, r *http.Request) {
+		req := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["role_id"] != "role" || req["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":["invalid role or secret ID"]}`)
+			return
+		}
+		token := fmt.Sprintf("%s-%d", vaultTestToken, s.logins.Add(1))
+		s.tokens.Store(token, true)
+		fmt.Fprintf(w, `{"auth":{"client_token":%q,"lease_duration":%d}}`, token, s.lease.Load())
+	})
+	mux.HandleFunc("/v1/transit/sign/", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.tokens.Load(r.Header.Get("X-Vault-Token")); !ok || r.URL.Path != "/v1/transit/sign/sa-key/sha2-256" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["1 error occurred:\n\t* permission denied\n\n"]}`)
+			return
+		}
+		req := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&req)
+		input, err := base64.StdEncoding.DecodeString(req["input"])
+		if err != nil || req["signature_algorithm"] != "pkcs1v15" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		digest := sha256.Sum256(input)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"data":{"signature":"vault:v1:%s"}}`, base64.StdEncoding.EncodeToString(sig))
+	})
+	mux.HandleFunc("/token", tokenEndpointHandler(&key.PublicKey, vaultTestEmail, &s.exchanges))
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// tokenEndpointHandler emulates the Google token endpoint: it verifies jwt-bearer assertions for the email
+// with pub and returns tokens derived from the requested scope or target_audience
+func tokenEndpointHandler(pub *rsa.PublicKey, email string, exchanges *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(r.FormValue("assertion"), claims, func(*jwt.Token) (interface{}, error) {
+			return pub, nil
+		}, jwt.WithValidMethods([]string{"RS256"}))
+		if err != nil || claims["iss"] != email || r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		exchanges.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if aud, ok := claims["target_audience"]; ok {
+			fmt.Fprintf(w, `{"id_token":"id-token-for-%s"}`, aud)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"access-token-for-%s","token_type":"Bearer","expires_in":3600}`, claims["scope"])
+	}
+}
+
+func (s *vaultStub) config() VaultConfig {
+	return VaultConfig{
+		Address:  s.URL,
+		KeyName:  "sa-key",
+		RoleID:   "role",
+		SecretID: "secret",
+		Email:    vaultTestEmail,
+		Scopes:   []string{cloudPlatformScope},
+		TokenURL: s.URL + "/token",
+	}
+}
+
+func TestVaultTokenSource(t *testing.T) {
+	stub := newVaultStub(t)
+
+	ts, err := NewVaultTokenSource(stub.config())
+	if err != nil {
+		t.Fatalf("error creating token source %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatalf("error getting token %v", err)
+		}
+		if want := "access-token-for-" + cloudPlatformScope; tok.AccessToken != want {
+			t.Errorf("unexpected access_token: got %v want %v", tok.AccessToken, want)
+		}
+	}
+	if n := stub.exchanges.Load(); n != 1 {
+		t.Errorf("token was not cached: got %d exchanges want %d", n, 1)
+	}
+
+	idToken, err := ts.IDToken("https://foo.bar")
+	if err != nil {
+		t.Fatalf("error getting id_token %v", err)
+	}
+	if idToken != "id-token-for-https://foo.bar" {
+		t.Errorf("unexpected id_token: got %v", idToken)
+	}
+	if n := stub.logins.Load(); n != 1 {
+		t.Errorf("unexpected number of AppRole logins: got %d want %d", n, 1)
+	}
+}
+
+func TestVaultTokenSourceAppRoleLogin(t *testing.T) {
+	stub := newVaultStub(t)
+
+	ts, err := NewVaultTokenSource(stub.config())
+	if err != nil {
+		t.Fatalf("error creating token source %v", err)
+	}
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("error getting token %v", err)
+	}
+
+	// a client token rejected by vault is replaced by logging in again
+	stub.expire()
+	ts.Invalidate()
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("error getting token after the vault token expired %v", err)
+	}
+	if n := stub.logins.Load(); n != 2 {
+		t.Errorf("unexpected number of AppRole logins: got %d want %d", n, 2)
+	}
+
+	// a client token whose lease is about to end is replaced before it is used, although vault still accepts it
+	stub.lease.Store(1)
+	stub.expire()
+	ts.Invalidate()
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("error getting token %v", err)
+	}
+	ts.Invalidate()
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("error getting token %v", err)
+	}
+	if n := stub.logins.Load(); n != 4 {
+		t.Errorf("unexpected number of AppRole logins: got %d want %d", n, 4)
+	}
+}
+
+func TestVaultTokenSourceErrors(t *testing.T) {
+	stub := newVaultStub(t)
+
+	cfg := stub.config()
+	cfg.RoleID, cfg.SecretID = "", ""
+	cfg.Token = "hvs.not-allowed"
+	ts, err := NewVaultTokenSource(cfg)
+	if err != nil {
+		t.Fatalf("error creating token source %v", err)
+	}
+	_, err = ts.Token()
+	var verr *VaultError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a VaultError, got %v", err)
+	}
+	if verr.StatusCode != http.StatusForbidden || len(verr.Errors) != 1 || !strings.Contains(verr.Errors[0], "permission denied") {
+		t.Errorf("unexpected vault error: %v", verr)
+	}
+
+	cfg = stub.config()
+	cfg.SecretID = "wrong"
+	ts, err = NewVaultTokenSource(cfg)
+	if err != nil {
+		t.Fatalf("error creating token source %v", err)
+	}
+	_, err = ts.Token()
+	if !errors.As(err, &verr) || verr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected AppRole login to fail with a VaultError, got %v", err)
+	}
+
+	for _, cfg := range []VaultConfig{
+		{KeyName: "sa-key", Token: "t", Email: vaultTestEmail},
+		{Address: stub.URL, Token: "t", Email: vaultTestEmail},
+		{Address: stub.URL, KeyName: "sa-key", Email: vaultTestEmail},
+		{Address: stub.URL, KeyName: "sa-key", Token: "t"},
+	} {
+		if _, err := NewVaultTokenSource(cfg); err == nil {
+			t.Errorf("expected error for config %+v", cfg)
+		}
+	}
+}
+
+func TestVaultCredentialsOption(t *testing.T) {
+	stub := newVaultStub(t)
+
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{}, nil, &Claims{}, WithVaultCredentials(stub.config()), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+
+	for path, want := range map[string]string{
+		"/computeMetadata/v1/instance/service-accounts/default/token":                             `{"access_token":"access-token-for-`,
+		"/computeMetadata/v1/instance/service-accounts/default/identity?audience=https://foo.bar": "id-token-for-https://foo.bar",
+	} {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		rr := httptest.NewRecorder()
+		h.handler().ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v", path, status, http.StatusOK)
+		}
+		if !strings.HasPrefix(rr.Body.String(), want) {
+			t.Errorf("handler returned unexpected body for %s: got %v want %v", path, rr.Body.String(), want)
+		}
+	}
+
+	_, err = NewMetadataServer(context.Background(), &ServerConfig{}, nil, &Claims{}, WithVaultCredentials(VaultConfig{}))
+	if err == nil {
+		t.Errorf("expected error for an invalid vault configuration")
+	}
+}
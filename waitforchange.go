@@ -0,0 +1,190 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bufferedResponse captures a handler's response so its ETag can be compared before
+// anything is written back to a long-polling client
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{
+		header: http.Header{},
+		code:   http.StatusOK,
+	}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	b.code = code
+}
+
+// etag returns the ETag set by the handler or a hash of the body if none was set
+func (b *bufferedResponse) etag() string {
+	// handlers set the ETag header in non-canonical form
+	if e, ok := b.header["ETag"]; ok && len(e) > 0 {
+		return e[0]
+	}
+	if e := b.header.Get("ETag"); e != "" {
+		return e
+	}
+	return getETag(b.body.Bytes())
+}
+
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(b.code)
+	w.Write(b.body.Bytes())
+}
+
+// changeChannel returns a channel which is closed the next time any metadata value changes
+func (h *MetadataServer) changeChannel() <-chan struct{} {
+	h.changeMutex.Lock()
+	defer h.changeMutex.Unlock()
+	if h.changed == nil {
+		h.changed = make(chan struct{})
+	}
+	return h.changed
+}
+
+// notifyChange wakes up all requests blocked on ?wait_for_change=true
+func (h *MetadataServer) notifyChange() {
+	h.changeMutex.Lock()
+	defer h.changeMutex.Unlock()
+	if h.changed != nil {
+		close(h.changed)
+	}
+	h.changed = make(chan struct{})
+}
+
+// shutdownChannel returns a channel which is closed once the server starts shutting down
+func (h *MetadataServer) shutdownChannel() <-chan struct{} {
+	h.changeMutex.Lock()
+	defer h.changeMutex.Unlock()
+	if h.shutdown == nil {
+		h.shutdown = make(chan struct{})
+	}
+	return h.shutdown
+}
+
+// signalShutdown releases all requests blocked on ?wait_for_change=true
+func (h *MetadataServer) signalShutdown() {
+	h.changeMutex.Lock()
+	defer h.changeMutex.Unlock()
+	if h.shutdown == nil {
+		h.shutdown = make(chan struct{})
+	}
+	select {
+	case <-h.shutdown:
+	default:
+		close(h.shutdown)
+	}
+}
+
+// resetShutdown lets long-polls block again after the server is restarted.  A channel which was not closed yet
+// is kept so Watch() channels opened before Start() are closed by Shutdown().
+func (h *MetadataServer) resetShutdown() {
+	h.changeMutex.Lock()
+	defer h.changeMutex.Unlock()
+	if h.shutdown != nil {
+		select {
+		case <-h.shutdown:
+		default:
+			return
+		}
+	}
+	h.shutdown = make(chan struct{})
+}
+
+// waitForChange implements the `?wait_for_change=true&last_etag=<etag>&timeout_sec=N` long-polling parameters.
+//
+// The request is evaluated and held until the ETag of the response differs from last_etag (or from the
+// current value if last_etag is not provided) or until timeout_sec elapses, whichever comes first.
+// Waiting requests get a 503 once the server shuts down.
+func (h *MetadataServer) waitForChange(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.ToLower(r.URL.Query().Get("wait_for_change")) != "true" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the request is held until the value changes, which can take longer than ServerConfig.WriteTimeout
+		clearWriteDeadline(w)
+
+		var timeout <-chan time.Time
+		if r.URL.Query().Has("timeout_sec") {
+			sec, err := strconv.Atoi(r.URL.Query().Get("timeout_sec"))
+			if err != nil || sec <= 0 {
+				httpError(w, "timeout_sec must be a positive integer", http.StatusBadRequest, "text/html; charset=UTF-8")
+				return
+			}
+			t := time.NewTimer(time.Duration(sec) * time.Second)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		shutdown := h.shutdownChannel()
+		lastETag := r.URL.Query().Get("last_etag")
+		for {
+			// acquire the channel before evaluating so a change in between is not missed
+			changed := h.changeChannel()
+
+			resp := newBufferedResponse()
+			next.ServeHTTP(resp, r)
+			etag := resp.etag()
+
+			if resp.code != http.StatusOK || (lastETag != "" && etag != lastETag) {
+				resp.writeTo(w)
+				return
+			}
+			if lastETag == "" {
+				lastETag = etag
+			}
+
+			h.requestLog(r).Debug("waiting for change", "path", r.URL.Path, "etag", lastETag)
+			select {
+			case <-changed:
+			case <-timeout:
+				resp.writeTo(w)
+				return
+			case <-shutdown:
+				httpError(w, "metadata server is shutting down", http.StatusServiceUnavailable, "text/html; charset=UTF-8")
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,360 @@
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+func projectClaims(projectID string) *Claims {
+	return &Claims{
+		ComputeMetadata: ComputeMetadata{
+			V1: V1{
+				Project: Project{
+					ProjectID: projectID,
+				},
+				Instance: Instance{
+					ServiceAccounts: map[string]serviceAccountDetails{
+						"default": {Email: "metadata-sa@" + projectID + ".iam.gserviceaccount.com"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func getMetadata(url string) (*http.Response, string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp, string(body), nil
+}
+
+func TestWaitForChangeHandler(t *testing.T) {
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	sc := &ServerConfig{
+		Port:         fmt.Sprintf(":%d", p),
+		SkipPrefetch: true,
+	}
+
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("before"))
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err != nil {
+		t.Errorf("error starting emulator %v", err)
+	}
+	defer h.Shutdown()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/computeMetadata/v1/project/project-id", p)
+	resp, _, err := getMetadata(url)
+	if err != nil {
+		t.Fatalf("error getting project-id %v", err)
+	}
+	etag := resp.Header["Etag"][0]
+
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, body, err := getMetadata(fmt.Sprintf("%s?wait_for_change=true&last_etag=%s", url, etag))
+		done <- result{body, err}
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("wait_for_change returned before claims were updated")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err = h.UpdateClaims(projectClaims("after-project"))
+	if err != nil {
+		t.Errorf("error updating claims %v", err)
+	}
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Errorf("error waiting for change %v", res.err)
+		}
+		if res.body != "after-project" {
+			t.Errorf("handler returned unexpected body: got %v want %v", res.body, "after-project")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("wait_for_change did not return after claims were updated")
+	}
+}
+
+func TestWaitForChangeTimeoutHandler(t *testing.T) {
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	sc := &ServerConfig{
+		Port:         fmt.Sprintf(":%d", p),
+		SkipPrefetch: true,
+	}
+
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("unchanged"))
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err != nil {
+		t.Errorf("error starting emulator %v", err)
+	}
+	defer h.Shutdown()
+
+	start := time.Now()
+	resp, body, err := getMetadata(fmt.Sprintf("http://127.0.0.1:%d/computeMetadata/v1/project/project-id?wait_for_change=true&timeout_sec=1", p))
+	if err != nil {
+		t.Fatalf("error waiting for change %v", err)
+	}
+	if time.Since(start) < time.Second {
+		t.Errorf("wait_for_change returned before timeout_sec elapsed")
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+	if body != "unchanged" {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, "unchanged")
+	}
+
+	resp, _, err = getMetadata(fmt.Sprintf("http://127.0.0.1:%d/computeMetadata/v1/project/project-id?wait_for_change=true&timeout_sec=foo", p))
+	if err != nil {
+		t.Fatalf("error waiting for change %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestShutdownReleasesWaitForChange(t *testing.T) {
+	p, err := getFreePort()
+	if err != nil {
+		t.Errorf("error getting emulator port %v", err)
+	}
+	sc := &ServerConfig{
+		Port:         fmt.Sprintf(":%d", p),
+		SkipPrefetch: true,
+	}
+
+	h, err := NewMetadataServer(context.Background(), sc, &google.Credentials{}, projectClaims("unchanged"))
+	if err != nil {
+		t.Errorf("error creating emulator %v", err)
+	}
+	err = h.Start()
+	if err != nil {
+		t.Errorf("error starting emulator %v", err)
+	}
+
+	type result struct {
+		code int
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, _, err := getMetadata(fmt.Sprintf("http://127.0.0.1:%d/computeMetadata/v1/project/project-id?wait_for_change=true", p))
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		done <- result{code: resp.StatusCode}
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("wait_for_change returned before the server was shut down")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := h.ShutdownContext(ctx); err != nil {
+		t.Errorf("error shutting down %v", err)
+	}
+	if d := time.Since(start); d >= 2*time.Second {
+		t.Errorf("shutdown waited for the drain timeout: %v", d)
+	}
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatalf("error waiting for change %v", res.err)
+		}
+		if res.code != http.StatusServiceUnavailable {
+			t.Errorf("handler returned wrong status code: got %v want %v", res.code, http.StatusServiceUnavailable)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("wait_for_change did not return after shutdown")
+	}
+}
+
+func TestSetPreempted(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	url := s.URL() + "/computeMetadata/v1/instance/preempted"
+
+	resp, body, err := getMetadata(url)
+	if err != nil {
+		t.Fatalf("error getting preempted %v", err)
+	}
+	if body != "FALSE" {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, "FALSE")
+	}
+
+	done := make(chan string, 1)
+	go func() {
+		_, body, err := getMetadata(fmt.Sprintf("%s?wait_for_change=true&last_etag=%s", url, resp.Header["Etag"][0]))
+		if err != nil {
+			t.Errorf("error waiting for change %v", err)
+		}
+		done <- body
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("wait_for_change returned before the instance was preempted")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := s.SetPreempted(true); err != nil {
+		t.Fatalf("error setting preempted %v", err)
+	}
+	select {
+	case body := <-done:
+		if body != "TRUE" {
+			t.Errorf("handler returned unexpected body: got %v want %v", body, "TRUE")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait_for_change did not return after the instance was preempted")
+	}
+
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.Scheduling.Preemptible = "FALSE"
+	if err := s.UpdateClaims(claims); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	if err := s.SetPreempted(true); err == nil {
+		t.Errorf("expected error preempting an instance which is not preemptible")
+	}
+}
+
+func TestPreemptedEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  GCEBool
+	}{
+		{`"FALSE"`, false},
+		{`"TRUE"`, true},
+		{`false`, false},
+		{`true`, true},
+	} {
+		var instance Instance
+		if err := json.Unmarshal([]byte(`{"preempted":`+tc.value+`}`), &instance); err != nil {
+			t.Errorf("error decoding preempted %s: %v", tc.value, err)
+			continue
+		}
+		if instance.Preempted != tc.want {
+			t.Errorf("unexpected preempted for %s: got %v want %v", tc.value, instance.Preempted, tc.want)
+		}
+	}
+	var instance Instance
+	if err := json.Unmarshal([]byte(`{"preempted":"yes"}`), &instance); err == nil {
+		t.Errorf("expected error decoding an invalid preempted value")
+	}
+
+	// recursive responses use the string form of the GCE metadata server
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	_, body, err := getMetadata(s.URL() + "/computeMetadata/v1/instance/?recursive=true")
+	if err != nil {
+		t.Fatalf("error getting instance %v", err)
+	}
+	if !strings.Contains(body, `"preempted":"FALSE"`) {
+		t.Errorf("unexpected preempted in recursive response: got %s", body)
+	}
+}
+
+func TestSetSpotVM(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	url := s.URL() + "/computeMetadata/v1/instance/spot-vm"
+
+	resp, body, err := getMetadata(url)
+	if err != nil {
+		t.Fatalf("error getting spot-vm %v", err)
+	}
+	if body != "FALSE" {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, "FALSE")
+	}
+
+	done := make(chan string, 1)
+	go func() {
+		_, body, err := getMetadata(fmt.Sprintf("%s?wait_for_change=true&last_etag=%s", url, resp.Header["Etag"][0]))
+		if err != nil {
+			t.Errorf("error waiting for change %v", err)
+		}
+		done <- body
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("wait_for_change returned before spot-vm was set")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := s.SetSpotVM(true); err != nil {
+		t.Fatalf("error setting spot-vm %v", err)
+	}
+	select {
+	case body := <-done:
+		if body != "TRUE" {
+			t.Errorf("handler returned unexpected body: got %v want %v", body, "TRUE")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait_for_change did not return after spot-vm was set")
+	}
+
+	// once set, the value no longer follows the preempted state
+	if err := s.SetSpotVM(false); err != nil {
+		t.Fatalf("error setting spot-vm %v", err)
+	}
+	if err := s.SetPreempted(true); err != nil {
+		t.Fatalf("error setting preempted %v", err)
+	}
+	if _, body, err := getMetadata(url); err != nil || body != "FALSE" {
+		t.Errorf("unexpected spot-vm after preemption: got %v %q", err, body)
+	}
+
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.Scheduling.Preemptible = "FALSE"
+	if err := s.UpdateClaims(claims); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	if err := s.SetSpotVM(true); err == nil {
+		t.Errorf("expected error marking an instance which is not preemptible as a Spot VM")
+	}
+}
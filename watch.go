@@ -0,0 +1,120 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// watchBufferSize is the number of events a watcher buffers before later changes are coalesced
+const watchBufferSize = 16
+
+// MetadataEvent is a change of the value served at a metadata path, see Watch()
+type MetadataEvent struct {
+	Path      string    // path passed to Watch()
+	OldValue  string    // response body before the change; empty if the path was not served
+	NewValue  string    // response body after the change; empty if the path is no longer served
+	Timestamp time.Time // when the change was noticed
+}
+
+// Watch returns a channel which receives an event every time the value served at path changes, eg after
+// UpdateClaims(), SetPreempted() or SetMaintenanceEvent().  path is a metadata path as requested over HTTP and may
+// include a query, eg `/computeMetadata/v1/instance/preempted` or `/computeMetadata/v1/instance/?recursive=true`.
+// Values are compared like `?wait_for_change=true` does, so a change which does not alter the response of path
+// sends no event.
+//
+// Up to 16 events are buffered.  If the receiver falls further behind, the changes after those are coalesced into
+// one event from the last value buffered to the latest value.  The channel is closed once ctx is done or the server
+// shuts down.
+func (h *MetadataServer) Watch(ctx context.Context, path string) (<-chan MetadataEvent, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q: %w", path, err)
+	}
+	if !strings.HasPrefix(u.Path, "/computeMetadata/") {
+		return nil, fmt.Errorf("path %q must start with /computeMetadata/", path)
+	}
+
+	handler := h.drainRequests(h.metadataRouter())
+	serve := func() string {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.RequestURI(), nil)
+		if err != nil {
+			return ""
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp := newBufferedResponse()
+		handler.ServeHTTP(resp, req)
+		if resp.code != http.StatusOK {
+			return ""
+		}
+		return resp.body.String()
+	}
+
+	shutdown := h.shutdownChannel()
+	// acquire the channel before evaluating so a change in between is not missed
+	changed := h.changeChannel()
+	last := serve()
+
+	events := make(chan MetadataEvent, watchBufferSize)
+	go func() {
+		defer close(events)
+		// the change waiting for room in events; changes noticed in the meantime replace its new value
+		var pending *MetadataEvent
+		for {
+			var out chan<- MetadataEvent
+			var next MetadataEvent
+			if pending != nil {
+				// send before looking at the next change so events are only coalesced while events is full
+				select {
+				case events <- *pending:
+					pending = nil
+					continue
+				default:
+				}
+				out, next = events, *pending
+			}
+			select {
+			case out <- next:
+				pending = nil
+				continue
+			case <-changed:
+			case <-ctx.Done():
+				return
+			case <-shutdown:
+				return
+			}
+			changed = h.changeChannel()
+			v := serve()
+			if v == last {
+				continue
+			}
+			if pending == nil {
+				pending = &MetadataEvent{Path: path, OldValue: last}
+			}
+			pending.NewValue, pending.Timestamp = v, time.Now()
+			last = v
+			if pending.NewValue == pending.OldValue {
+				// changed back before the event was received
+				pending = nil
+			}
+		}
+	}()
+	return events, nil
+}
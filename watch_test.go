@@ -0,0 +1,184 @@
+package mds
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event on events or fails the test if none arrives
+func nextEvent(t *testing.T, events <-chan MetadataEvent) MetadataEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatalf("watch channel was closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event received")
+	}
+	return MetadataEvent{}
+}
+
+// noEvent fails the test if events receives a value or is closed in the next 100ms
+func noEvent(t *testing.T, events <-chan MetadataEvent) {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		t.Errorf("unexpected event: got %+v %v", e, ok)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	ctx := context.Background()
+
+	preempted, err := s.Watch(ctx, "/computeMetadata/v1/instance/preempted")
+	if err != nil {
+		t.Fatalf("error watching preempted %v", err)
+	}
+	maintenance, err := s.Watch(ctx, "/computeMetadata/v1/instance/maintenance-event")
+	if err != nil {
+		t.Fatalf("error watching maintenance-event %v", err)
+	}
+	project, err := s.Watch(ctx, "/computeMetadata/v1/project/?recursive=true")
+	if err != nil {
+		t.Fatalf("error watching project %v", err)
+	}
+
+	before := time.Now()
+	if err := s.SetPreempted(true); err != nil {
+		t.Fatalf("error setting preempted %v", err)
+	}
+	if e := nextEvent(t, preempted); e.Path != "/computeMetadata/v1/instance/preempted" || e.OldValue != "FALSE" || e.NewValue != "TRUE" || e.Timestamp.Before(before) {
+		t.Errorf("unexpected preempted event: got %+v", e)
+	}
+	// watchers of values which did not change are not notified
+	noEvent(t, maintenance)
+	noEvent(t, project)
+
+	if err := s.SetMaintenanceEvent("MIGRATE_ON_HOST_MAINTENANCE"); err != nil {
+		t.Fatalf("error setting maintenance event %v", err)
+	}
+	if e := nextEvent(t, maintenance); e.OldValue != "NONE" || e.NewValue != "MIGRATE_ON_HOST_MAINTENANCE" {
+		t.Errorf("unexpected maintenance event: got %+v", e)
+	}
+	noEvent(t, preempted)
+
+	if err := s.UpdateClaims(projectClaims("other-project")); err != nil {
+		t.Fatalf("error updating claims %v", err)
+	}
+	e := nextEvent(t, project)
+	if e.OldValue != `{"attributes":{},"numericProjectId":0,"projectId":"some-project"}` || e.NewValue != `{"attributes":{},"numericProjectId":0,"projectId":"other-project"}` {
+		t.Errorf("unexpected project event: got %+v", e)
+	}
+	// UpdateClaims resets the runtime preempted state
+	if e := nextEvent(t, preempted); e.OldValue != "TRUE" || e.NewValue != "FALSE" {
+		t.Errorf("unexpected preempted event after UpdateClaims: got %+v", e)
+	}
+}
+
+func TestWatchSlowReceiver(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("project-0"), WithLogger(&recordingLogger{}))
+	events, err := s.Watch(context.Background(), "/computeMetadata/v1/project/project-id")
+	if err != nil {
+		t.Fatalf("error watching project-id %v", err)
+	}
+
+	// nothing is received while the project id changes more often than events are buffered
+	changes := 2*watchBufferSize + 4
+	for i := 1; i <= changes; i++ {
+		if err := s.UpdateClaims(projectClaims(fmt.Sprintf("project-%d", i))); err != nil {
+			t.Fatalf("error updating claims %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	latest := fmt.Sprintf("project-%d", changes)
+	previous := "project-0"
+	for n := 1; ; n++ {
+		e := nextEvent(t, events)
+		if e.OldValue != previous {
+			t.Errorf("event %d does not follow the previous one: got %+v want old value %s", n, e, previous)
+		}
+		previous = e.NewValue
+		if e.NewValue == latest {
+			if n > watchBufferSize+1 {
+				t.Errorf("changes were not coalesced: got %d events for %d changes", n, changes)
+			}
+			break
+		}
+	}
+	noEvent(t, events)
+}
+
+func TestWatchClosed(t *testing.T) {
+	s := NewTestMetadataServer(t, projectClaims("some-project"), WithLogger(&recordingLogger{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled, err := s.Watch(ctx, "/computeMetadata/v1/instance/preempted")
+	if err != nil {
+		t.Fatalf("error watching preempted %v", err)
+	}
+	shutdown, err := s.Watch(context.Background(), "/computeMetadata/v1/instance/preempted")
+	if err != nil {
+		t.Fatalf("error watching preempted %v", err)
+	}
+
+	closed := func(events <-chan MetadataEvent) bool {
+		select {
+		case _, ok := <-events:
+			return !ok
+		case <-time.After(5 * time.Second):
+			return false
+		}
+	}
+	cancel()
+	if !closed(cancelled) {
+		t.Errorf("watch channel was not closed when its context was cancelled")
+	}
+	if err := s.Shutdown(); err != nil {
+		t.Fatalf("error shutting down %v", err)
+	}
+	if !closed(shutdown) {
+		t.Errorf("watch channel was not closed on shutdown")
+	}
+
+	for _, path := range []string{"", "instance/preempted", "/healthz", "/computeMetadata/v1/%zz"} {
+		if _, err := s.Watch(context.Background(), path); err == nil {
+			t.Errorf("%q: expected error for an invalid path", path)
+		}
+	}
+}
+
+func TestWatchBeforeStart(t *testing.T) {
+	h, err := NewMetadataServer(context.Background(), &ServerConfig{
+		Listeners:    []ListenerSpec{{Network: "tcp", Address: "127.0.0.1:0"}},
+		SkipPrefetch: true,
+	}, staticCredentials("some-token"), projectClaims("some-project"), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatalf("error creating emulator %v", err)
+	}
+	events, err := h.Watch(context.Background(), "/computeMetadata/v1/instance/preempted")
+	if err != nil {
+		t.Fatalf("error watching preempted %v", err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatalf("error starting emulator %v", err)
+	}
+	if err := h.Shutdown(); err != nil {
+		t.Fatalf("error shutting down %v", err)
+	}
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Errorf("unexpected event")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("watch channel opened before Start was not closed on shutdown")
+	}
+}
@@ -0,0 +1,95 @@
+package mds
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+func writeTestCertificate(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "metadata-sa@some-project.iam.gserviceaccount.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServiceAccountX509(t *testing.T) {
+	cert, err := LoadX509FromFile(writeTestCertificate(t))
+	if err != nil {
+		t.Fatalf("error loading certificate %v", err)
+	}
+	claims := projectClaims("some-project")
+	sa := claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"]
+	sa.X509Cert = cert
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = sa
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["app"] = serviceAccountDetails{Email: "app@some-project.iam.gserviceaccount.com"}
+	s := NewTestMetadataServer(t, claims, WithLogger(&recordingLogger{}))
+
+	resp, body, err := getMetadata(s.URL() + "/computeMetadata/v1/instance/service-accounts/default/x509")
+	if err != nil {
+		t.Fatalf("error getting certificate %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-x509-user-cert" {
+		t.Fatalf("unexpected response: got %v %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	parsed, err := x509.ParseCertificate([]byte(body))
+	if err != nil {
+		t.Fatalf("error parsing the served certificate %v", err)
+	}
+	if parsed.Subject.CommonName != "metadata-sa@some-project.iam.gserviceaccount.com" {
+		t.Errorf("unexpected certificate subject: got %s", parsed.Subject.CommonName)
+	}
+	if _, body, _ := getMetadata(s.URL() + "/computeMetadata/v1/instance/service-accounts/default/"); body != "aliases/\nemail\nidentity\nscopes/\ntoken\nx509\n" {
+		t.Errorf("unexpected listing with a certificate: got %q", body)
+	}
+
+	if resp, _, _ := getMetadata(s.URL() + "/computeMetadata/v1/instance/service-accounts/app/x509"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status code without a certificate: got %v want %v", resp.StatusCode, http.StatusNotFound)
+	}
+	if _, body, _ := getMetadata(s.URL() + "/computeMetadata/v1/instance/service-accounts/app/"); body != "aliases/\nemail\nidentity\nscopes/\ntoken\n" {
+		t.Errorf("unexpected listing without a certificate: got %q", body)
+	}
+}
+
+func TestServiceAccountX509Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(path, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadX509FromFile(path); err == nil {
+		t.Errorf("expected error loading an invalid certificate")
+	}
+
+	claims := projectClaims("some-project")
+	claims.ComputeMetadata.V1.Instance.ServiceAccounts["default"] = serviceAccountDetails{Email: "metadata-sa@some-project.iam.gserviceaccount.com", X509Cert: "not a certificate"}
+	if _, err := NewMetadataServer(context.Background(), &ServerConfig{}, &google.Credentials{}, claims); err == nil {
+		t.Errorf("expected error for claims with an invalid certificate")
+	}
+}